@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/driusan/dicomfmt/organize"
+)
+
+// addReadingFlags adds the options for how files are read, which most
+// subcommands take, to fs. They're applied by applyReadingFlags once fs
+// has been parsed.
+func addReadingFlags(fs *flag.FlagSet, verbose *bool, parser *string) {
+	fs.BoolVar(verbose, "verbose", false, "Print extra information to standard error.")
+	fs.StringVar(parser, "parser", organize.DefaultOptions().Parser, "The DICOM parser to read files with ("+organize.ParserNames()+").")
+}
+
+func applyReadingFlags(verbose bool, parser string) {
+	organize.SetVerbose(verbose)
+	organize.SetParser(parser)
+}
+
+// purgeMain implements the purge subcommand, which securely deletes every
+// file belonging to a patient from an organized directory, and removes
+// them from the records kept about it.
+func purgeMain(args []string) {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	patientID := fs.String("patient-id", "", "The PatientID to delete all files for.")
+	auditPath := fs.String("audit-log", "", "File to append the audit record to. (Default: purge-audit.log in the target directory.)")
+	auditSyslog := fs.Bool("audit-syslog", false, "Also send the audit record to the system logger.")
+	var stores organize.PurgeStores
+	fs.StringVar(&stores.Manifest, "manifest", "", "Also remove the patient's files from this -manifest.")
+	fs.StringVar(&stores.Journal, "journal", "", "Also remove the patient's files from this -journal.")
+	fs.StringVar(&stores.Cache, "cache", "", "Also remove the patient's files from this -cache.")
+	fs.StringVar(&stores.Mirror, "mirror", "", "Also delete the patient's files from this -mirror.")
+	fs.StringVar(&stores.EncryptDir, "encrypt-dir", "", "Also delete the patient's archives from this -encrypt-dir.")
+	var verbose bool
+	var parser string
+	addReadingFlags(fs, &verbose, &parser)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s purge -patient-id id [options] target_directory\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *patientID == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	applyReadingFlags(verbose, parser)
+	remaining, err := organize.Purge(fs.Arg(0), *patientID, stores, *auditPath, *auditSyslog)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(remaining) > 0 {
+		log.Printf("Data for PatientID %s is still in:\n", *patientID)
+		for _, r := range remaining {
+			log.Println("\t" + r)
+		}
+		os.Exit(1)
+	}
+}
+
+// restoreMain implements the restore subcommand, which copies the files
+// recorded in a manifest from the organized tree back into the directory
+// structure that they were originally organized from.
+func restoreMain(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	mv := fs.Bool("move", false, "Move files out of the organized tree instead of copying them.")
+	verbose := fs.Bool("verbose", false, "Print extra information to standard error.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s restore [options] manifest output_directory\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "The manifest can also be a journal. Files are restored relative to the deepest directory containing all of their original paths.")
+		fmt.Fprintln(os.Stderr)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	organize.SetVerbose(*verbose)
+	exit(organize.Restore(os.Stdout, fs.Arg(0), fs.Arg(1), *mv))
+}
+
+// catMain implements the cat subcommand, which writes the contents of
+// files in an organized tree to standard output, decompressing them if
+// they're compressed.
+func catMain(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s cat file [...]\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := organize.Cat(os.Stdout, fs.Args()...); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// verifyMain implements the verify subcommand, which reads back every
+// file in an organized tree, or every file recorded in a manifest.
+func verifyMain(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	manifestPath := fs.String("manifest", "", "Verify the files recorded in this manifest.")
+	compare := fs.Bool("compare-sources", false, "With -manifest, also compare each file to its source file, if it still exists. Files which were changed while being organized, such as with -strip-overlays, won't match.")
+	var verbose bool
+	var parser string
+	addReadingFlags(fs, &verbose, &parser)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify target_directory_or_file [...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s verify -manifest manifest\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*manifestPath == "") == (fs.NArg() == 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	applyReadingFlags(verbose, parser)
+	exit(organize.Verify(os.Stdout, *manifestPath, *compare, fs.Args()...))
+}
+
+// decryptMain implements the decrypt subcommand, which extracts encrypted
+// archives.
+func decryptMain(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyPath := fs.String("key", "", "The file containing the key, as 64 hexadecimal digits.")
+	keyCommand := fs.String("key-command", "", "A command which prints the key, such as one that fetches it from a key management service.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s decrypt -key keyfile archive.tar.enc [...] output_directory\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	key, err := organize.LoadKey(*keyPath, *keyCommand)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Exit(organize.Decrypt(fs.Arg(fs.NArg()-1), key, fs.Args()[:fs.NArg()-1]...))
+}
+
+// lsMain implements the ls subcommand, which lists the patients, studies
+// and series in an organized tree.
+func lsMain(args []string) {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	format := fs.String("format", "tree", "How to print the inventory: tree, table (one line per series) or json.")
+	stats := fs.Bool("stats", false, "Instead of listing the series, print how many files and bytes there are of each modality, SOP class and transfer syntax.")
+	frames := fs.Bool("frames", false, "Instead of listing every series, print the series of each study which share a FrameOfReferenceUID, such as a localizer and the series planned on it, or a series and those registered or derived from it.")
+	var verbose bool
+	var parser string
+	addReadingFlags(fs, &verbose, &parser)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ls [options] target_directory\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	applyReadingFlags(verbose, parser)
+	if err := organize.List(os.Stdout, fs.Arg(0), *format, *stats, *frames); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// queueMain implements the queue subcommand, which reports on the uploads
+// waiting to be organized by receive mode.
+func queueMain(args []string) {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	spool := fs.String("spool-dir", "", "The directory that uploads are queued in. (Default: .incoming in the target directory.)")
+	staging := fs.String("staging-dir", "", "The directory that -study-settle holds studies in. (Default: .staging in the target directory.)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s queue status [options] target_directory\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "status" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := organize.QueueStatus(os.Stdout, fs.Arg(0), *spool, *staging); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// tailMain implements the tail subcommand, which prints the activity feed
+// of a daemon started with -activity-socket as it happens.
+func tailMain(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	jsonLines := fs.Bool("json", false, "Print each event as a line of JSON, instead of as text.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s tail [options] socket\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	log.Fatalln(organize.Tail(os.Stdout, fs.Arg(0), *jsonLines))
+}
+
+// duplicatesMain implements the duplicates subcommand, which reports the
+// byte-identical files stored in an organized tree.
+func duplicatesMain(args []string) {
+	fs := flag.NewFlagSet("duplicates", flag.ExitOnError)
+	link := fs.Bool("link", false, "Replace each duplicate with a hard link to the first file with the same contents, to reclaim the space. The files then share their permissions and modification time.")
+	var verbose bool
+	var parser string
+	addReadingFlags(fs, &verbose, &parser)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s duplicates [-link] target_directory [...]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	applyReadingFlags(verbose, parser)
+	exit(organize.Duplicates(os.Stdout, *link, fs.Args()...))
+}
+
+// serveFilesMain implements the serve-files subcommand, which serves the
+// instances in an organized tree over HTTP.
+func serveFilesMain(args []string) {
+	fs := flag.NewFlagSet("serve-files", flag.ExitOnError)
+	addr := fs.String("addr", ":8042", "The address to serve the files on.")
+	manifestPath := fs.String("manifest", "", "Find instances with this manifest instead of reading every file in the target directory.")
+	allowOrigin := fs.String("allow-origin", "", "Allow web viewers served from this origin (e.g. https://viewer.example.org, or * for any) to fetch instances.")
+	var verbose bool
+	var parser string
+	addReadingFlags(fs, &verbose, &parser)
+	var auth organize.ServerAuth
+	auth.AddFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve-files [options] target_directory\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	applyReadingFlags(verbose, parser)
+	log.Fatalln(organize.ServeFiles(*addr, fs.Arg(0), *manifestPath, *allowOrigin, &auth))
+}
+
+// serveDICOMMain implements the serve-dicom subcommand, which serves the
+// instances in an organized tree to viewers with C-FIND, C-GET and
+// C-MOVE.
+func serveDICOMMain(args []string) {
+	fs := flag.NewFlagSet("serve-dicom", flag.ExitOnError)
+	opts := organize.DICOMServerOptions{MoveDestinations: make(organize.MoveDestinations)}
+	addr := fs.String("addr", ":11112", "The address to accept associations on.")
+	fs.StringVar(&opts.AE, "ae", "DICOMFMT", "The AE title that viewers have to call.")
+	fs.StringVar(&opts.Manifest, "manifest", "", "Find instances with this manifest instead of reading every file in the target directory.")
+	allowAE := fs.String("allow-ae", "", "Only accept associations from these calling AE titles (comma separated).")
+	fs.BoolVar(&opts.AllowAnyAE, "allow-any-ae", false, "Accept associations from any calling AE title, so that anything which can connect can retrieve every instance.")
+	opts.Auth.AddTLSFlags(fs)
+	fs.Var(opts.MoveDestinations, "move-dest", "An AE that instances can be moved to, as AE=host:port. Can be repeated.")
+	var verbose bool
+	var parser string
+	addReadingFlags(fs, &verbose, &parser)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve-dicom [options] target_directory\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	applyReadingFlags(verbose, parser)
+	opts.Dir = fs.Arg(0)
+	if *allowAE != "" {
+		opts.AllowAE = strings.Split(*allowAE, ",")
+	}
+	log.Fatalln(organize.ServeDICOM(*addr, opts))
+}
+
+// remoteTargetMain implements the remote-target subcommand, which is
+// started over ssh by -remote to write the target on this host.
+func remoteTargetMain(args []string) {
+	if err := organize.ServeRemoteTarget(os.Stdin, os.Stdout); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// dashboardMain implements the dashboard subcommand, which serves the
+// dashboard for a target directory without organizing anything.
+func dashboardMain(args []string) {
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	addr := fs.String("http", ":8080", "The address to serve the dashboard on.")
+	history := fs.String("run-history", "", "The run history to show. (Default: "+organize.DefaultRunHistory+" in the target directory.)")
+	var verbose bool
+	var parser string
+	addReadingFlags(fs, &verbose, &parser)
+	var auth organize.ServerAuth
+	auth.AddFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s dashboard [options] target_directory\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	applyReadingFlags(verbose, parser)
+	log.Fatalln(organize.ServeDashboard(*addr, fs.Arg(0), *history, &auth))
+}
+
+// exit exits with status, or if err is set, logs it and exits with status
+// 1.
+func exit(status int, err error) {
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Exit(status)
+}
@@ -9,317 +9,260 @@
 // one parameter is supplied (used as both the source and target directory.)
 //
 // Each series will be organized into the format:
-//     targetDir/PatientName/SeriesName/[*].dcm
+//
+//	targetDir/PatientName/SeriesName/[*].dcm
 //
 // The name of any series directories that were created will be printed to
 // STDOUT.
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"path"
-	"path/filepath"
-	"time"
-	"unicode"
 
-	"github.com/driusan/go-dicom"
+	"github.com/driusan/dicomfmt/organize"
 )
 
-var verbose bool
-
-type SeriesInstanceUID string
-type FileName string
-
-type SeriesFiles struct {
-	PatientName, SeriesDescription string
-	InstanceCreationTime           time.Time
-	Files                          []FileName
+// subcommands are the functions implementing each subcommand, keyed by
+// its name. Running dicomfmt without one organizes.
+var subcommands = map[string]func(args []string){
+	"plan":          organizeCommand(organize.CommandPlan),
+	"apply":         organizeCommand(organize.CommandApply),
+	"retry":         organizeCommand(organize.CommandRetry),
+	"info":          organizeCommand(organize.CommandInfo),
+	"orphans":       organizeCommand(organize.CommandOrphans),
+	"pull":          organizeCommand(organize.CommandPull),
+	"purge":         purgeMain,
+	"restore":       restoreMain,
+	"cat":           catMain,
+	"verify":        verifyMain,
+	"decrypt":       decryptMain,
+	"ls":            lsMain,
+	"queue":         queueMain,
+	"tail":          tailMain,
+	"duplicates":    duplicatesMain,
+	"serve-files":   serveFilesMain,
+	"serve-dicom":   serveDICOMMain,
+	"remote-target": remoteTargetMain,
+	"dashboard":     dashboardMain,
 }
 
-func (f FileName) String() string {
-	return string(f)
-}
-
-func isTextFile(file FileName) bool {
-	f, err := os.Open(file.String())
-	if err != nil {
-		log.Println(err)
-		return false
-	}
-	defer f.Close()
-
-	// Check the first 128 runes of the file to see if they're printable
-	// characters while interpreted as UTF-8.
-	// (Assuming they're all 4 byte long runes, that's still 128*4=512 bytes,
-	// which should mean we only need to read 1 disk sector.)
-	buffer := bufio.NewReader(f)
-	for i := 0; i < 128; i++ {
-		r, _, err := buffer.ReadRune()
-		if err != nil {
-			if verbose {
-				log.Println(err)
-			}
-			return true
-		}
-
-		// \n, \t, and \r are control characters, but for our purposes they're printable.
-		if !unicode.IsPrint(r) && r != '\n' && r != '\t' && r != '\r' {
-			return false
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
 		}
 	}
-	return true
+	organizeMain(organize.CommandOrganize, os.Args[1:])
 }
 
-// Removes a directory if the directory is empty.
-func removeEmpty(dir string) bool {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return false
-	}
-	if len(files) == 0 {
-		err := os.Remove(dir)
-		return err == nil
+// organizeCommand returns the function implementing c, which takes the
+// same options as organizing does.
+func organizeCommand(c organize.Command) func(args []string) {
+	return func(args []string) {
+		organizeMain(c, args)
 	}
-	return false
 }
 
-// Split series takes a path name as a parameter, and map of the files contained
-// in each SeriesInstanceUID in the directory. It will recursively parse
-// files subdirectories of the directory that it's parsing.
-func SplitSeries(dir FileName) (map[SeriesInstanceUID]SeriesFiles, error) {
-	if dir == "" {
-		return nil, fmt.Errorf("Must provide a directory to split.")
-	}
-
-	files, err := ioutil.ReadDir(dir.String())
-	if err != nil {
-		return nil, err
+// organizeMain organizes, or does what c says, with the command line
+// options in args.
+func organizeMain(c organize.Command, args []string) {
+	opts := organize.DefaultOptions()
+	opts.Command = c
+
+	var configPath string
+	var conformance bool
+	flag.BoolVar(&opts.Verbose, "verbose", opts.Verbose, "Print extra information to standard error.")
+	flag.StringVar(&configPath, "config", "", "Read default options from this config file. (Default: dicomfmt/config.toml in the user config directory, if it exists.)")
+	flag.StringVar(&opts.Profile, "profile", opts.Profile, "Use the options from the named profile in the config file.")
+	flag.StringVar(&opts.Layout, "layout", opts.Layout, "The directory structure to organize series into, relative to the target directory. {TagName} is replaced by the value of the tag. The presets patient and accession can also be given by name.")
+	flag.StringVar(&opts.AuditLog, "audit-log", opts.AuditLog, "Append a record of every file operation to this file.")
+	flag.BoolVar(&opts.AuditSyslog, "audit-syslog", opts.AuditSyslog, "Send a record of every file operation to the system logger.")
+	flag.StringVar(&opts.OnSeriesComplete, "on-series-complete", opts.OnSeriesComplete, "Command to run after each series is organized. {dir} is replaced with the series directory, which is also in the DICOMFMT_DIR environment variable, along with DICOMFMT_PATIENT_NAME, DICOMFMT_SERIES_DESCRIPTION and DICOMFMT_FILES (the number of files placed in it).")
+	flag.StringVar(&opts.OnSeriesCompleteURL, "on-series-complete-url", opts.OnSeriesCompleteURL, "URL to POST a JSON description of each series to after it's organized.")
+	flag.BoolVar(&opts.SyncSeries, "sync-series", opts.SyncSeries, "Flush every file to disk as it's written, and only print each series or run -on-series-complete hooks once its files and directories have been flushed, so that nothing watching the target sees a partly written series.")
+	flag.StringVar(&opts.NotifyURL, "notify-url", opts.NotifyURL, "URL to POST a JSON summary to when the run (or in watch mode, a scan which found new files) completes or fails.")
+	flag.StringVar(&opts.NotifyEmail, "notify-email", opts.NotifyEmail, "Comma separated addresses to email a summary to when the run (or in watch mode, a scan which found new files) completes or fails.")
+	flag.StringVar(&opts.SMTPAddr, "smtp-addr", opts.SMTPAddr, "The host:port of the SMTP server to send -notify-email through. The DICOMFMT_SMTP_USER and DICOMFMT_SMTP_PASSWORD environment variables are used to authenticate.")
+	flag.StringVar(&opts.SMTPFrom, "smtp-from", opts.SMTPFrom, "The address to send -notify-email from. (Default: dicomfmt@hostname.)")
+	flag.BoolVar(&opts.NotifyFailuresOnly, "notify-failures-only", opts.NotifyFailuresOnly, "Only send notifications when a run fails.")
+	flag.DurationVar(&opts.Watch, "watch", opts.Watch, "Keep running, and rescan the source directories for new files at this interval.")
+	flag.StringVar(&opts.MetricsAddr, "metrics-addr", opts.MetricsAddr, "Serve Prometheus metrics at /metrics on this address (e.g. :9100).")
+	flag.BoolVar(&opts.FullParse, "full-parse", opts.FullParse, "Parse every element of each file, instead of stopping once the elements that are needed have been read.")
+	flag.StringVar(&opts.Cache, "cache", opts.Cache, "Remember the tags of each file in this file, and don't read files again if their size and modification time haven't changed.")
+	flag.IntVar(&opts.CacheSize, "cache-size", opts.CacheSize, "The maximum number of files to remember in the -cache. The least recently used are forgotten first.")
+	flag.BoolVar(&opts.Deterministic, "deterministic", opts.Deterministic, "Make runs with the same input give the same output, for golden file tests: the times recorded in manifests, journals, logs and notifications are SOURCE_DATE_EPOCH (or 2000-01-01) and generated names come from a counter.")
+	flag.StringVar(&opts.Order, "order", opts.Order, "The order to organize series in: newest or oldest, by StudyDate and StudyTime, so that recent studies are available first in a time-critical migration, or largest or smallest, by the size of their files. (Default: by SeriesInstanceUID.)")
+	flag.IntVar(&opts.ScanJobs, "scan-jobs", opts.ScanJobs, "The number of source directories to scan at the same time.")
+	flag.StringVar(&opts.BatchSize, "batch-size", opts.BatchSize, "Split the target into numbered batch directories (batch0001, batch0002, ...) of at most this size (e.g. 4.3G for DVDs or 23G for BD-R), for copying onto removable media. Series aren't split between batches, and each batch lists its series in batch.jsonl.")
+	flag.IntVar(&opts.BatchFiles, "batch-files", opts.BatchFiles, "Split the target into numbered batch directories of at most this many files, like -batch-size.")
+	flag.IntVar(&opts.ShardSize, "shard-size", opts.ShardSize, "Split series directories with more than this many files into numbered subfolders (0001, 0002, ...) of at most this many files each. (Default: don't split them.)")
+	flag.DurationVar(&opts.MinAge, "min-age", opts.MinAge, "In watch mode, wait until a file's size and modification time haven't changed for this long (e.g. 30s) before organizing it, in case it's still being written.")
+	flag.DurationVar(&opts.StudySettle, "study-settle", opts.StudySettle, "In watch and receive mode, hold each study in a staging area until no new files have arrived for it for this long (e.g. 10m), or it has NumberOfStudyRelatedInstances files, and then release the whole study into the target at once.")
+	flag.StringVar(&opts.StagingDir, "staging-dir", opts.StagingDir, "Where -study-settle holds studies. It should be on the same filesystem as the target. (Default: .staging in the target directory.)")
+	flag.StringVar(&opts.Reconcile, "reconcile", opts.Reconcile, "In watch mode, also do a full scan which rechecks every file on this cron schedule (e.g. \"0 3 * * *\" or @daily), to pick up any files that were missed.")
+	flag.StringVar(&opts.ControlAddr, "control-addr", opts.ControlAddr, "In watch mode, serve an HTTP API for checking the status of and controlling dicomfmt on this address.")
+	flag.StringVar(&opts.HTTPAddr, "http", opts.HTTPAddr, "In watch and receive mode, serve a web dashboard of the target directory and the history of runs on this address (e.g. :8080).")
+	flag.StringVar(&opts.RunHistory, "run-history", opts.RunHistory, "Append a summary of the run (or in watch mode, each scan which found new files), with the files which couldn't be organized, to this file for the dashboard. (Default with -http: "+organize.DefaultRunHistory+" in the target directory.)")
+	opts.Auth.AddFlags(flag.CommandLine)
+	flag.StringVar(&opts.ActivitySocket, "activity-socket", opts.ActivitySocket, "In watch and receive mode, stream the files received and organized, series completed and errors to clients of the tail subcommand connected to the unix socket at this path.")
+	flag.StringVar(&opts.Receive, "receive", opts.Receive, "Instead of organizing source directories, accept DICOM files POSTed to this address and organize them into the target directory.")
+	flag.StringVar(&opts.MaxUploadSize, "max-upload-size", opts.MaxUploadSize, "With -receive, reject requests larger than this. 0 accepts requests of any size.")
+	flag.StringVar(&opts.OrthancURL, "orthanc-url", opts.OrthancURL, "Import every study from the Orthanc server at this URL into the target directory.")
+	flag.StringVar(&opts.Pull.Host, "host", opts.Pull.Host, "With the pull subcommand, the host name or address of the PACS to pull studies from.")
+	flag.IntVar(&opts.Pull.Port, "port", opts.Pull.Port, "With the pull subcommand, the port of the PACS.")
+	flag.StringVar(&opts.Pull.AEC, "aec", opts.Pull.AEC, "With the pull subcommand, the AE title of the PACS.")
+	flag.StringVar(&opts.Pull.AET, "aet", opts.Pull.AET, "With the pull subcommand, the AE title to call the PACS with. With -retrieve move, the PACS has to know it as a destination at -store-addr.")
+	flag.StringVar(&opts.Pull.Accession, "accession", opts.Pull.Accession, "With the pull subcommand, pull the studies with this accession number.")
+	flag.StringVar(&opts.Pull.PatientID, "patient-id", opts.Pull.PatientID, "With the pull subcommand, pull the studies of the patient with this ID.")
+	flag.StringVar(&opts.Pull.StudyUID, "study-uid", opts.Pull.StudyUID, "With the pull subcommand, pull the study with this StudyInstanceUID.")
+	flag.StringVar(&opts.Pull.StudyDate, "study-date", opts.Pull.StudyDate, "With the pull subcommand, pull the studies from this date (YYYYMMDD), or range of dates (YYYYMMDD-YYYYMMDD).")
+	flag.StringVar(&opts.Pull.Retrieve, "retrieve", opts.Pull.Retrieve, "With the pull subcommand, how studies are retrieved: move (C-MOVE, where the PACS sends them to -store-addr) or get (C-GET, over the same connection as the query).")
+	flag.StringVar(&opts.Pull.StoreAddr, "store-addr", opts.Pull.StoreAddr, "With the pull subcommand and -retrieve move, the address to receive studies on.")
+	flag.StringVar(&opts.EncryptDir, "encrypt-dir", opts.EncryptDir, "Also write the files organized by each run (or in watch mode, each scan) into an AES-256 encrypted archive per patient in this directory, for sending over untrusted channels. They can be extracted with the decrypt subcommand.")
+	flag.StringVar(&opts.EncryptKey, "encrypt-key", opts.EncryptKey, "The file containing the key for -encrypt-dir, as 64 hexadecimal digits.")
+	flag.StringVar(&opts.EncryptKeyCommand, "encrypt-key-command", opts.EncryptKeyCommand, "A command which prints the key for -encrypt-dir, such as one that fetches it from a key management service.")
+	flag.StringVar(&opts.EncryptPer, "encrypt-per", opts.EncryptPer, "Whether -encrypt-dir has an archive per patient or per study.")
+	flag.StringVar(&opts.FHIRNDJSON, "fhir-ndjson", opts.FHIRNDJSON, "Append FHIR R4 ImagingStudy and Patient resources for the organized studies to this NDJSON file.")
+	flag.StringVar(&opts.FHIRURL, "fhir-url", opts.FHIRURL, "Send FHIR R4 ImagingStudy and Patient resources for the organized studies to the FHIR server at this base URL.")
+	flag.StringVar(&opts.FilesFrom, "files-from", opts.FilesFrom, "Organize the files listed in this file (or standard input, if -), one per line or NUL separated, instead of scanning source directories.")
+	flag.StringVar(&opts.DeadLetter, "dead-letter", opts.DeadLetter, "At the end of the run, write every file that couldn't be organized, and why, to this JSON file, so that they can be tried again with the retry subcommand.")
+	flag.BoolVar(&opts.Print0, "print0", opts.Print0, "Terminate the series directories printed to standard output with a NUL byte instead of a newline.")
+	flag.BoolVar(&opts.JSONLines, "json-lines", opts.JSONLines, "Print a JSON object describing each series to standard output instead of the directory name.")
+	flag.IntVar(&opts.MaxDepth, "max-depth", opts.MaxDepth, "Only organize files up to this many levels deep in each source directory, where 1 is the files directly in it. (Default: no limit.)")
+	flag.BoolVar(&opts.FollowSymlinks, "follow-symlinks", opts.FollowSymlinks, "Follow symlinks to directories in the source directories.")
+	flag.BoolVar(&opts.SkipHidden, "skip-hidden", opts.SkipHidden, "Ignore files and directories whose names start with a dot.")
+	flag.BoolVar(&opts.Force, "force", opts.Force, "Continue even if there doesn't appear to be enough disk space to copy all of the files.")
+	flag.StringVar(&opts.Expect, "expect", opts.Expect, "A CSV file of the studies that are expected, with a StudyInstanceUID, AccessionNumber or PatientID column. After the run, report which weren't found and which studies were organized without being expected.")
+	flag.BoolVar(&opts.Stats, "stats", opts.Stats, "At the end of the run, report how many files and bytes of each modality, SOP class and transfer syntax were organized.")
+	flag.StringVar(&opts.WarnPatientSize, "warn-patient-size", opts.WarnPatientSize, "Warn when more than this much (e.g. 50G) has been organized for a single patient.")
+	flag.IntVar(&opts.WarnPatientStudies, "warn-patient-studies", opts.WarnPatientStudies, "Warn when more than this many studies have been organized for a single patient.")
+	flag.IntVar(&opts.WarnPatientFiles, "warn-patient-files", opts.WarnPatientFiles, "Warn when more than this many files have been organized for a single patient.")
+	flag.StringVar(&opts.WarnStudySize, "warn-study-size", opts.WarnStudySize, "Warn when more than this much (e.g. 5G) has been organized for a single study, such as when a modality keeps resending it.")
+	flag.IntVar(&opts.WarnStudyFiles, "warn-study-files", opts.WarnStudyFiles, "Warn when more than this many files have been organized for a single study.")
+	flag.StringVar(&opts.WarnURL, "warn-url", opts.WarnURL, "URL to POST a JSON alert to as soon as any -warn-* limit is exceeded.")
+	flag.IntVar(&opts.WarnDirFiles, "warn-dir-files", opts.WarnDirFiles, "Warn when a directory that files are organized into has more than this many files.")
+	flag.StringVar(&opts.BandwidthLimit, "bwlimit", opts.BandwidthLimit, "Limit the rate that files are written to this many bytes per second (e.g. 500K, 20M).")
+	flag.StringVar(&opts.ResumableSize, "resumable-size", opts.ResumableSize, "Copy files at least this large in chunks, logging their progress, so that an interrupted copy is resumed instead of started over. 0 copies every file in one piece.")
+	flag.BoolVar(&opts.Nice, "nice", opts.Nice, "Run with low CPU and I/O priority.")
+	flag.IntVar(&opts.Retries, "retries", opts.Retries, "Retry reading or copying a file this many times if it fails, before giving up on it.")
+	flag.DurationVar(&opts.RetryDelay, "retry-delay", opts.RetryDelay, "How long to wait before the first retry. The delay doubles after each retry.")
+	flag.DurationVar(&opts.FileTimeout, "file-timeout", opts.FileTimeout, "Give up on reading a file if it takes longer than this (e.g. 2m), such as when a network filesystem hangs, and continue with the next one. Files that time out are reported as failed at the end of the run.")
+	flag.StringVar(&opts.Journal, "journal", opts.Journal, "Append a record of every file that was organized to this file.")
+	flag.StringVar(&opts.Resume, "resume", opts.Resume, "Skip any files recorded as organized in this journal from a previous run, and continue recording to it.")
+	flag.StringVar(&opts.ReviewList, "review-list", opts.ReviewList, "Append every file whose placement relied on heuristics or fallbacks (such as empty layout tags, burned in annotation detection or -description-map) to this file, with the reasons and a confidence score, for spot checking. Written as JSON lines if it ends in .json or .jsonl.")
+	flag.BoolVar(&opts.TrustManifest, "trust-manifest", opts.TrustManifest, "Don't read files that the -manifest says are already organized, as long as they still have the size and modification time that it recorded: files in the target where it says they were placed, and source files which haven't changed since they were copied. Files placed under a different layout aren't moved.")
+	flag.StringVar(&opts.Manifest, "manifest", opts.Manifest, "Append the original path of every file that was organized to this file, to keep a permanent record of where files came from.")
+	flag.StringVar(&opts.DescriptionMap, "description-map", opts.DescriptionMap, "A file mapping regular expressions to the canonical SeriesDescription that matching series are organized and reported by.")
+	flag.StringVar(&opts.TagRules, "tag-rules", opts.TagRules, "A file of rules that set elements (such as ClinicalTrialSubjectID or InstitutionName) in the organized copies. The changes are recorded in the -manifest.")
+	flag.BoolVar(&opts.ProvenanceTag, "provenance-tag", opts.ProvenanceTag, "Record the original path of each file in a private element ("+organize.ProvenanceCreator+") of the organized copy.")
+	flag.StringVar(&opts.Trash, "trash", opts.Trash, "Move emptied source directories and replaced files into this directory instead of deleting them.")
+	flag.BoolVar(&opts.DeleteVerified, "delete-source-after-verify", opts.DeleteVerified, "In copy mode, delete each source file once its copy has been read back and its SHA-256 hash matches, and remove any directories that were left empty.")
+	flag.BoolVar(&opts.KeepEmpty, "keep-empty", opts.KeepEmpty, "Don't remove empty directories from the sources after moving.")
+	flag.BoolVar(&opts.NoWriteSource, "no-write-source", opts.NoWriteSource, "Never modify, move or delete anything in the source directories, for reading from read-only mounts. Organizing a directory in place, moving and -delete-source-after-verify are refused, and the target and other outputs can't be inside a source directory.")
+	flag.StringVar(&opts.DirMode, "dir-mode", opts.DirMode, "The octal mode of directories created in the target directory (e.g. 2770).")
+	flag.StringVar(&opts.FileMode, "file-mode", opts.FileMode, "The octal mode of organized files. (Default: the mode they're created with.)")
+	flag.StringVar(&opts.Group, "group", opts.Group, "Make this group the owner of directories and files created in the target directory.")
+	flag.IntVar(&opts.MaxPath, "max-path", opts.MaxPath, "Shorten directory and file names so that the paths of organized files are at most this many bytes, adding a hash to keep them unique.")
+	flag.StringVar(&opts.Parser, "parser", opts.Parser, "The DICOM parser to read files with ("+organize.ParserNames()+").")
+	flag.StringVar(&opts.Quarantine, "quarantine", opts.Quarantine, "Move (or in copy mode, copy) files which crash the DICOM parser into this directory.")
+	flag.BoolVar(&opts.CheckOnly, "check-only", opts.CheckOnly, "When organizing a directory in place, print the files which aren't where their tags put them under the current layout, without moving anything, and exit with status 1 if there are any.")
+	flag.BoolVar(&opts.DryRun, "dry-run", opts.DryRun, "Print the operations that organizing would do to standard output, without changing anything.")
+	flag.BoolVar(&opts.Interactive, "interactive", opts.Interactive, "Ask what to do when a file conflicts with one already in the target directory, or with the rest of its series.")
+	flag.BoolVar(&opts.SeriesNumber, "series-number", opts.SeriesNumber, "Start the name of each series directory with its zero padded SeriesNumber, so that they sort in acquisition order.")
+	flag.Var(&opts.PatientRoots, "patient-root", "Spread patients across this directory and the others given with -patient-root, such as the mount points of several volumes, instead of the target directory. Each patient is placed in one of them by a hash of their PatientID, which only stays the same if the directories are given in the same order. Can be repeated.")
+	flag.Var(opts.SiteLabels, "site-label", "Add a top level directory for the site that the files came from: LABEL for every source directory, or LABEL=DIR for one of them. Can be repeated.")
+	flag.StringVar(&opts.SiteTag, "site-tag", opts.SiteTag, "Add a top level directory with the value of this tag (e.g. InstitutionName) for files without a -site-label.")
+	flag.StringVar(&opts.Transliterate, "transliterate", opts.Transliterate, "Transliterate tag values which aren't ASCII, such as Cyrillic, Greek, Korean or kana patient names, in the names of directories, using the conventions of a locale: "+organize.TransliterationLocaleNames()+". Replacements can be added in the [transliterate] table of the config file.")
+	flag.StringVar(&opts.DerivedSubdir, "derived-subdir", opts.DerivedSubdir, "Place derived images (whose ImageType is DERIVED or SECONDARY), such as reformats and dose screens, in a directory with this name next to the series directories of their study, instead of with the original acquisitions.")
+	flag.StringVar(&opts.Flatten, "flatten", opts.Flatten, "Put every file of a study or patient into a single directory, named by SOPInstanceUID, instead of using -layout (study or patient).")
+	flag.StringVar(&opts.Extension, "extension", opts.Extension, "Give every organized file this extension (e.g. .dcm), replacing extensions such as .ima and .IMG.")
+	flag.BoolVar(&opts.StripExtension, "strip-extension", opts.StripExtension, "Remove extensions commonly used for DICOM files, such as .dcm and .ima, from organized files.")
+	flag.BoolVar(&opts.Lowercase, "lowercase", opts.Lowercase, "Lowercase the names of organized files.")
+	flag.BoolVar(&opts.Compress, "compress", opts.Compress, "Store organized files gzip compressed, with .gz added to their names, to save space in cold archives. The cat and verify subcommands, and dicomfmt itself, read them back transparently.")
+	flag.BoolVar(&opts.AddFileMeta, "add-file-meta", opts.AddFileMeta, "Write files which are raw datasets, without a preamble and file meta information, as proper Part 10 files by adding them.")
+	flag.BoolVar(&opts.LittleEndian, "little-endian", opts.LittleEndian, "Convert files encoded as explicit VR big endian, a retired transfer syntax, to explicit VR little endian, which more software can read.")
+	flag.BoolVar(&opts.ConvertRetired, "convert-retired", opts.ConvertRetired, "Store images of retired SOP classes, such as the retired ultrasound and nuclear medicine images, as Secondary Capture Images, which current viewers can display.")
+	flag.BoolVar(&opts.StripOverlays, "strip-overlays", opts.StripOverlays, "Remove overlay (60xx) and curve (50xx) groups, which can contain annotations and identifiers, from organized files.")
+	flag.StringVar(&opts.PhantomDir, "phantom-dir", opts.PhantomDir, "Organize series of QA phantoms and test patients into this directory instead of the target directory.")
+	flag.StringVar(&opts.Patients, "patients", opts.Patients, "Only organize the files of the patients listed in this file, one PatientID or PatientName per line. Other patients' files are skipped before they're parsed, where possible.")
+	flag.BoolVar(&opts.SkipPhantoms, "skip-phantoms", opts.SkipPhantoms, "Don't organize series of QA phantoms and test patients.")
+	flag.Var(&opts.PhantomPatterns, "phantom-pattern", "Also treat series matching this predicate (e.g. PatientID=QA*) as phantoms. Can be repeated.")
+	flag.BoolVar(&opts.NoPhantomHeuristics, "no-phantom-heuristics", opts.NoPhantomHeuristics, "Only use -phantom-pattern to detect phantoms, not patient names and IDs containing words such as PHANTOM, TEST or QA.")
+	flag.StringVar(&opts.FixOrphans, "fix-orphans", opts.FixOrphans, "With the orphans subcommand, relocate (move misplaced instances to where they belong and other files to -orphan-dir) or remove (also delete files that aren't DICOM) the orphans that are found, instead of only listing them.")
+	flag.StringVar(&opts.OrphanDir, "orphan-dir", opts.OrphanDir, "The directory that -fix-orphans relocate moves files that aren't DICOM into. (Default: .orphans in the target directory.)")
+	flag.BoolVar(&conformance, "conformance", false, "Instead of organizing, check every file given (or in the directories given) against the IOD of its SOP class, and print whether each passed, had warnings (missing type 2 attributes) or failed (missing or empty type 1 attributes).")
+	flag.StringVar(&opts.Mirror, "mirror", opts.Mirror, "Also write every file placed in the target directory to the same path in this directory, such as a NAS, in the same pass. A file only fails if it couldn't be written to either.")
+	flag.StringVar(&opts.Remote, "remote", opts.Remote, "Write the target directory on this host ([user@]host) over ssh instead of on this machine. dicomfmt has to be installed there too. Files which already exist there are replaced by sending only the parts which changed, like rsync.")
+	flag.StringVar(&opts.RemoteCommand, "remote-command", opts.RemoteCommand, "With -remote, the path of dicomfmt on the remote host.")
+	flag.StringVar(&opts.BurnedInDir, "burned-in-dir", opts.BurnedInDir, "Organize series likely to contain burned in annotations into this directory instead of the target directory.")
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
 	}
 
-	series := make(map[SeriesInstanceUID]SeriesFiles)
-	for _, file := range files {
-		filename := FileName(filepath.Clean(dir.String() + "/" + file.Name()))
-
-		if file.IsDir() {
-			// Recursively add any subdirectories as documented.
-			subdirFiles, err := SplitSeries(filename)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			for newSeries, seriesData := range subdirFiles {
-				oldseries, ok := series[newSeries]
-				if ok {
-					// The series already existed, so just
-					// add the new files to it.
-					oldseries.Files = append(oldseries.Files, seriesData.Files...)
-					series[newSeries] = oldseries
-				} else {
-					// It's a new series, so set the key
-					series[newSeries] = seriesData
-				}
-			}
-		} else {
-			if isTextFile(filename) {
-				if verbose {
-					log.Printf("Skipping %s: not a DICOM file.\n", file.Name())
-				}
-				continue
-			}
-
-			bytes, err := ioutil.ReadFile(filename.String())
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-
-			parser, err := dicom.NewParser()
-			if err != nil {
-				log.Fatalln(err)
-			}
-			data, err := parser.Parse(bytes)
-			if err != nil {
-				log.Println(filename, " parser error: ", err)
-				continue
-			}
-
-			newSeriesEl, err := data.LookupElement("SeriesInstanceUID")
-			if err != nil {
-				log.Println(filename, " lookup error", err)
-				continue
-			}
-			newSeries := SeriesInstanceUID(newSeriesEl.GetValue())
-			if newSeries == "" {
-				log.Println("Could not find SeriesInstanceUID")
-				continue
-			}
-			oldseries, ok := series[newSeries]
-			if ok {
-				oldseries.Files = append(oldseries.Files, filename)
-				series[newSeries] = oldseries
-			} else {
-				patient, err := data.LookupElement("PatientName")
-				if err != nil {
-					log.Println(filename, " lookup error for PatientName", err)
-					continue
-				}
-				sd, err := data.LookupElement("SeriesDescription")
-				if err != nil {
-					log.Println(filename, " lookup error for SeriesDescription", err)
-					continue
-				}
-				instanceDate, err := data.LookupElement("InstanceCreationDate")
-				if err != nil {
-					log.Println(filename, " lookup error for SeriesDescription", err)
-					continue
-				}
-				instanceTime, err := data.LookupElement("InstanceCreationTime")
-				if err != nil {
-					log.Println(filename, " lookup error for SeriesDescription", err)
-					continue
-				}
+	flag.CommandLine.Parse(args)
+	opts.Args = flag.Args()
 
-				timeVal := instanceTime.GetValue()
-				if len(timeVal) < 4 {
-					log.Println(filename, " invalid InstanceCreationTime: ", instanceTime.GetValue())
-					continue
-				}
-
-				instanceDateTime := instanceDate.GetValue() + timeVal[0:4]
-				instanceTimeParsed, err := time.Parse("200601021504", instanceDateTime)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				series[newSeries] = SeriesFiles{
-					PatientName:          patient.GetValue(),
-					SeriesDescription:    sd.GetValue(),
-					InstanceCreationTime: instanceTimeParsed,
-					Files:                []FileName{filename},
-				}
-			}
+	if configPath != "" {
+		c, err := organize.LoadConfig(configPath)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		opts.Config = c
+	} else if path := organize.DefaultConfigPath(); path != "" {
+		c, err := organize.LoadConfig(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalln(err)
+		}
+		opts.Config = c
 	}
-	return series, nil
-}
-
-type fileAction func(src, dst FileName) error
-
-func moveFile(src, dst FileName) error {
-	return os.Rename(src.String(), dst.String())
-}
-
-func copyFile(src, dst FileName) error {
-	f, err := os.Open(src.String())
-	if err != nil {
-		return err
+	if err := opts.Config.Apply(flag.CommandLine, opts.Profile); err != nil {
+		log.Fatalln(err)
 	}
-	defer f.Close()
-	fdst, err := os.Create(dst.String())
-	if err != nil {
-		return err
+	if conformance {
+		if len(opts.Args) == 0 {
+			log.Fatalln("-conformance requires a file or directory to check")
+		}
+		organize.SetVerbose(opts.Verbose)
+		os.Exit(organize.Conformance(opts.Args))
 	}
-	defer fdst.Close()
-	_, err = io.Copy(fdst, f)
-	return err
-}
 
-func main() {
-	var mv bool
-
-	flag.BoolVar(&verbose, "verbose", false, "Print extra information to standard error.")
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] source_dir [...] target_directory\n\n", os.Args[0])
-		flag.PrintDefaults()
+	code, err := organize.Run(handleSignals(), opts)
+	if errors.Is(err, organize.ErrNoArgs) {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] source_dir [...] target_directory\n", os.Args[0])
 		os.Exit(1)
+	} else if err != nil {
+		log.Fatalln(err)
 	}
+	os.Exit(code)
+}
 
-	flag.Parse()
-	args := flag.Args()
-
-	var srcDirs []string
-	var dst string
-	switch len(args) {
-	case 1:
-		srcDirs = args
-		dst = args[0]
-		mv = true
-	default:
-		srcDirs = args[:len(args)-1]
-		dst = args[len(args)-1]
-	}
-
-	// Ensure that the dst directory exists, and create it if not.
-	if _, err := os.Stat(dst); os.IsNotExist(err) {
-		if err := os.MkdirAll(dst, 0750); err != nil {
-			log.Fatalln(err)
-		}
-	}
-
-	// Ensure each sourceDir exists before doing anything.
-	for _, src := range srcDirs {
-		_, err := os.Stat(src)
-		if os.IsNotExist(err) {
-			log.Printf("%s does not exist.", src)
-			continue
-		}
-		series, err := SplitSeries(FileName(src))
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		for _, files := range series {
-			var movedSome bool
-			dstDir := fmt.Sprintf("%s/%s/%s_%s", dst, files.PatientName, files.InstanceCreationTime.Format("2006-01-02_15:04"), files.SeriesDescription)
-			for _, file := range files.Files {
-				dstFile := FileName(filepath.Clean(dstDir + "/" + path.Base(file.String())))
-
-				if dstFile == file {
-					continue
-				}
-				movedSome = true
-				// If there's an error it's likely because we ran
-				// out of diskspace or don't have permission,
-				// so treat it as fatal instead of trying to continue.
-				// on to the next series.
-				if err := os.MkdirAll(dstDir, 0750); err != nil {
-					log.Fatalln(err)
-				}
-
-				var action fileAction
-				if mv {
-					action = moveFile
-				} else {
-					action = copyFile
-				}
-				if err := action(file, dstFile); err != nil {
-					log.Fatalln(err)
-				}
-
-				// This isn't very efficient, but we need
-				// to remove empty directories after moving
-				// all the files out of it.
-				if mv {
-					srcDir := filepath.Dir(file.String())
-					if removed := removeEmpty(srcDir); removed {
-						// The scan dir was removed,
-						// remove the patientname dir
-						// if it was the last scan.
-						parentDir := filepath.Dir(srcDir)
-						removeEmpty(parentDir)
-					}
-				}
-			}
-
-			if movedSome {
-				fmt.Println(filepath.Clean(dstDir))
-			}
-		}
-	}
+// usage prints how to use every subcommand, and the options.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] source_dir [...] target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s plan [options] source_dir [...] target_directory > plan.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s apply [options] plan.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s retry [options] deadletter.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s restore [options] manifest output_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s ls [-format tree|table|json] [-stats|-frames] target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s cat file [...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s verify [-manifest manifest] [target_directory ...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s decrypt -key keyfile archive.tar.enc [...] output_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s queue status target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s tail [-json] socket\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s info [options] file_or_dir [...] [target_directory]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s pull -host host -aec AE [-accession A123] [options] target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -conformance file_or_dir [...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s orphans [-fix-orphans relocate|remove] [options] target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s duplicates [-link] target_directory [...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s serve-files [-addr :8042] [-manifest manifest] target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s serve-dicom -allow-ae AE[,...] [-ae AE] [-addr :11112] [-move-dest AE=host:port] target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s dashboard [-http :8080] target_directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s purge -patient-id id target_directory\n\n", os.Args[0])
+	flag.PrintDefaults()
 }
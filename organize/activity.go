@@ -0,0 +1,218 @@
+package organize
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of activityEvent.
+const (
+	activityReceived  = "received"
+	activityOrganized = "organized"
+	activitySeries    = "series"
+	activityError     = "error"
+)
+
+// An activityEvent is something that a running daemon did, as streamed to
+// "dicomfmt tail".
+type activityEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+
+	// For received files, the file in the upload queue, and for
+	// organized files, where the file was placed.
+	File string `json:"file,omitempty"`
+	// For received files, the client that sent it, and for organized
+	// files, where it came from.
+	From string `json:"from,omitempty"`
+
+	// For completed series.
+	Modality          string   `json:"modality,omitempty"`
+	SeriesDescription string   `json:"series_description,omitempty"`
+	Files             int      `json:"files,omitempty"`
+	Dirs              []string `json:"dirs,omitempty"`
+
+	// For errors, one of the dead* reasons and the error.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (e activityEvent) String() string {
+	t := e.Time.Local().Format("15:04:05")
+	switch e.Event {
+	case activityReceived:
+		return fmt.Sprintf("%s received  %s from %s", t, e.File, e.From)
+	case activityOrganized:
+		return fmt.Sprintf("%s organized %s from %s", t, e.File, e.From)
+	case activitySeries:
+		return fmt.Sprintf("%s series    %s %q: %s in %s", t, e.Modality, e.SeriesDescription, plural(e.Files, "file", "files"), strings.Join(e.Dirs, ", "))
+	case activityError:
+		return fmt.Sprintf("%s error     %s (%s): %s", t, e.File, e.Reason, e.Error)
+	}
+	return fmt.Sprintf("%s %s %s", t, e.Event, e.File)
+}
+
+// An activityFeed sends a daemon's activityEvents to every client
+// connected to its socket. Clients which don't keep up miss events, rather
+// than slowing down organizing.
+type activityFeed struct {
+	mu   sync.Mutex
+	subs map[chan activityEvent]bool
+}
+
+// The activity feed for this run, or nil if -activity-socket wasn't given.
+var activity *activityFeed
+
+// The number of events buffered for each client.
+const activityBuffer = 256
+
+// Publish sends e to every connected client. It's safe to call on a nil
+// activityFeed.
+func (a *activityFeed) Publish(e activityEvent) {
+	if a == nil {
+		return
+	}
+	e.Time = clock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for sub := range a.subs {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+func (a *activityFeed) subscribe() chan activityEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.subs == nil {
+		a.subs = make(map[chan activityEvent]bool)
+	}
+	sub := make(chan activityEvent, activityBuffer)
+	a.subs[sub] = true
+	return sub
+}
+
+func (a *activityFeed) unsubscribe(sub chan activityEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.subs, sub)
+}
+
+// Serve streams the feed to each client that connects to l, as JSON lines,
+// until l is closed.
+func (a *activityFeed) Serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		go a.stream(conn)
+	}
+}
+
+func (a *activityFeed) stream(conn net.Conn) {
+	defer conn.Close()
+	sub := a.subscribe()
+	defer a.unsubscribe(sub)
+
+	// Clients never send anything, so a read only returns once the
+	// client has gone away.
+	gone := make(chan struct{})
+	go func() {
+		var b [1]byte
+		conn.Read(b[:])
+		close(gone)
+	}()
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case e := <-sub:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// listenActivity listens on the unix socket at path. A socket left behind
+// by a daemon which is no longer running is replaced.
+func listenActivity(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another dicomfmt", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The feed includes file names, which can contain patient names.
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// fileFailed records that file couldn't be organized for reason, in the
+// dead letter list, the errors reported by the control API and the
+// activity feed.
+func fileFailed(file FileName, reason string, err error) {
+	deadLetters.Add(file, reason, err)
+	recentFailures.Add(file, reason, err)
+	if activity == nil {
+		return
+	}
+	e := activityEvent{Event: activityError, File: file.String(), Reason: reason}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	activity.Publish(e)
+}
+
+// Tail writes the activity feed of a daemon started with -activity-socket
+// to w as it happens, as text, or if jsonLines is set, as the JSON lines
+// that it's sent as. It returns once the daemon closes the connection.
+func Tail(w io.Writer, socket string, jsonLines bool) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return errors.New("The daemon closed the connection.")
+			}
+			return err
+		}
+		if jsonLines {
+			fmt.Fprintln(w, string(raw))
+			continue
+		}
+		var e activityEvent
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, e)
+	}
+}
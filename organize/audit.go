@@ -0,0 +1,102 @@
+package organize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"time"
+)
+
+// An auditEvent is a single record in the audit log.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// An auditLog is an append-only log of the operations that dicomfmt
+// performed on files, written as one JSON object per line to a file and/or
+// the system log.
+type auditLog struct {
+	f      *os.File
+	syslog io.WriteCloser
+	user   string
+}
+
+// openAuditLog opens the audit log at path (if not empty), and connects to
+// the system logger if useSyslog is set. If neither is requested, it returns
+// a nil log, which discards everything recorded.
+func openAuditLog(path string, useSyslog bool) (*auditLog, error) {
+	if path == "" && !useSyslog {
+		return nil, nil
+	}
+	a := &auditLog{user: "unknown"}
+	if u, err := user.Current(); err == nil {
+		a.user = u.Username
+	}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		a.f = f
+	}
+	if useSyslog {
+		w, err := openSyslog()
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.syslog = w
+	}
+	return a, nil
+}
+
+// Record appends an event to the log. It's safe to call on a nil log, in
+// which case nothing is recorded.
+func (a *auditLog) Record(action, path, detail string) error {
+	if a == nil {
+		return nil
+	}
+	line, err := json.Marshal(auditEvent{
+		Time:   clock(),
+		User:   a.user,
+		Action: action,
+		Path:   path,
+		Detail: detail,
+	})
+	if err != nil {
+		return err
+	}
+	if a.f != nil {
+		if _, err := fmt.Fprintf(a.f, "%s\n", line); err != nil {
+			return err
+		}
+	}
+	if a.syslog != nil {
+		if _, err := a.syslog.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	var err error
+	if a.f != nil {
+		err = a.f.Close()
+	}
+	if a.syslog != nil {
+		if serr := a.syslog.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
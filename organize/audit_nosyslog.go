@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package organize
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+func openSyslog() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}
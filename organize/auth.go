@@ -0,0 +1,192 @@
+package organize
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A tokenScope is what an API token allows its holder to do.
+type tokenScope string
+
+const (
+	// Reading the archive, metrics and status.
+	scopeRead tokenScope = "read"
+	// Sending files to be organized.
+	scopeIngest tokenScope = "ingest"
+	// Anything, including controlling a running daemon.
+	scopeAdmin tokenScope = "admin"
+)
+
+// allows reports whether a token with scope s can be used for something
+// which needs scope need. Read and ingest tokens are kept separate, so
+// that a modality which sends files can't read anything back.
+func (s tokenScope) allows(need tokenScope) bool {
+	return s == need || s == scopeAdmin
+}
+
+// An apiToken is an entry in the -api-tokens file.
+type apiToken struct {
+	Name  string
+	Scope tokenScope
+}
+
+// ServerAuth is the access control and TLS configuration shared by the
+// HTTP server modes.
+type ServerAuth struct {
+	TokensPath      string
+	TLSCert, TLSKey string
+
+	// The tokens, keyed by their SHA-256 hash so that looking them up
+	// doesn't take longer for tokens which are closer to a real one.
+	tokens map[[sha256.Size]byte]apiToken
+}
+
+// AddFlags adds the options for a serverAuth to fs.
+func (a *ServerAuth) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&a.TokensPath, "api-tokens", "", "Require an API token from this file for every request to the HTTP servers. Each line is a scope (read, ingest or admin), a token and an optional name. Tokens are sent as a bearer token, or as the password of basic authentication.")
+	a.AddTLSFlags(fs)
+}
+
+// AddTLSFlags only adds the TLS options to fs, for servers which aren't
+// HTTP and so don't take API tokens.
+func (a *ServerAuth) AddTLSFlags(fs *flag.FlagSet) {
+	fs.StringVar(&a.TLSCert, "tls-cert", "", "Serve TLS (HTTPS, or DICOM TLS for serve-dicom) with the PEM encoded certificate chain in this file.")
+	fs.StringVar(&a.TLSKey, "tls-key", "", "The PEM encoded private key for -tls-cert.")
+}
+
+// Load checks the options and reads the tokens file, if there is one.
+func (a *ServerAuth) Load() error {
+	if (a.TLSCert == "") != (a.TLSKey == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if a.TokensPath == "" {
+		return nil
+	}
+	f, err := os.Open(a.TokensPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: %s can be read by other users.\n", a.TokensPath)
+	}
+	a.tokens = make(map[[sha256.Size]byte]apiToken)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected a scope and a token", a.TokensPath, n)
+		}
+		scope := tokenScope(fields[0])
+		switch scope {
+		case scopeRead, scopeIngest, scopeAdmin:
+		default:
+			return fmt.Errorf("%s:%d: unknown scope %q", a.TokensPath, n, fields[0])
+		}
+		name := strings.Join(fields[2:], " ")
+		if name == "" {
+			name = fmt.Sprintf("%s:%d", a.TokensPath, n)
+		}
+		a.tokens[sha256.Sum256([]byte(fields[1]))] = apiToken{name, scope}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(a.tokens) == 0 {
+		return fmt.Errorf("%s: no tokens", a.TokensPath)
+	}
+	return nil
+}
+
+// requestToken returns the token sent with a request, if any.
+func requestToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	const bearer = "Bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(bearer) && strings.EqualFold(h[:len(bearer)], bearer) {
+		return strings.TrimSpace(h[len(bearer):])
+	}
+	return ""
+}
+
+// Require only passes requests on to h if they have a token which allows
+// scope. Without -api-tokens, every request is passed on. It's safe to
+// call on a nil serverAuth.
+func (a *ServerAuth) Require(scope tokenScope, h http.Handler) http.Handler {
+	if a == nil || a.tokens == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			// Basic authentication lets people use the dashboard
+			// from a browser.
+			w.Header().Set("WWW-Authenticate", `Basic realm="dicomfmt"`)
+			http.Error(w, "an API token is required", http.StatusUnauthorized)
+			return
+		}
+		t, ok := a.tokens[sha256.Sum256([]byte(token))]
+		if !ok {
+			log.Printf("Rejected invalid API token for %s from %s.\n", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="dicomfmt"`)
+			http.Error(w, "invalid API token", http.StatusUnauthorized)
+			return
+		}
+		if !t.Scope.allows(scope) {
+			log.Printf("Rejected %s token %s for %s from %s, which needs %s.\n", t.Scope, t.Name, r.URL.Path, r.RemoteAddr, scope)
+			http.Error(w, fmt.Sprintf("a %s token is required", scope), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves HTTPS if a certificate was given, or HTTP
+// otherwise, like server.ListenAndServe.
+func (a *ServerAuth) ListenAndServe(server *http.Server) error {
+	if a.tokens == nil {
+		log.Printf("Warning: serving %s without -api-tokens, so anyone who can connect to it has full access.\n", server.Addr)
+	}
+	if a.TLSCert == "" {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	return server.ListenAndServeTLS(a.TLSCert, a.TLSKey)
+}
+
+// Listen listens for TCP connections on addr, which are wrapped in TLS if
+// a certificate was given, for servers which aren't HTTP.
+func (a *ServerAuth) Listen(addr string) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if a.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(a.TLSCert, a.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil || tlsConfig == nil {
+		return l, err
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// Serve serves h on addr, exiting if it can't.
+func (a *ServerAuth) Serve(addr string, h http.Handler) {
+	log.Fatalln(a.ListenAndServe(&http.Server{Addr: addr, Handler: h}))
+}
@@ -0,0 +1,101 @@
+package organize
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	tokens := `# scope token name
+read r3ad dashboard users
+ingest 1ngest modality
+admin adm1n
+`
+	if err := os.WriteFile(path, []byte(tokens), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := &ServerAuth{TokensPath: path}
+	if err := auth.Load(); err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		scope  tokenScope
+		bearer string
+		basic  string
+		want   int
+	}{
+		{"no token", scopeRead, "", "", http.StatusUnauthorized},
+		{"invalid token", scopeRead, "wrong", "", http.StatusUnauthorized},
+		{"read token", scopeRead, "r3ad", "", http.StatusOK},
+		{"read token for ingest", scopeIngest, "r3ad", "", http.StatusForbidden},
+		{"ingest token", scopeIngest, "1ngest", "", http.StatusOK},
+		{"ingest token for read", scopeRead, "1ngest", "", http.StatusForbidden},
+		{"admin token for read", scopeRead, "adm1n", "", http.StatusOK},
+		{"admin token for admin", scopeAdmin, "adm1n", "", http.StatusOK},
+		{"read token for admin", scopeAdmin, "r3ad", "", http.StatusForbidden},
+		{"basic auth", scopeRead, "", "r3ad", http.StatusOK},
+		{"invalid basic auth", scopeRead, "", "wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.basic != "" {
+				r.SetBasicAuth("anyone", tt.basic)
+			}
+			w := httptest.NewRecorder()
+			auth.Require(tt.scope, ok).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestServerAuthWithoutTokens(t *testing.T) {
+	var auth *ServerAuth
+	w := httptest.NewRecorder()
+	auth.Require(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d without -api-tokens, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServerAuthLoadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens string
+		cert   string
+		err    string
+	}{
+		{"unknown scope", "write abc\n", "", "unknown scope"},
+		{"missing token", "read\n", "", "expected a scope and a token"},
+		{"empty", "# nothing\n", "", "no tokens"},
+		{"certificate without key", "read abc\n", "cert.pem", "must be given together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens")
+			if err := os.WriteFile(path, []byte(tt.tokens), 0600); err != nil {
+				t.Fatal(err)
+			}
+			auth := &ServerAuth{TokensPath: path, TLSCert: tt.cert}
+			if err := auth.Load(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The name of the manifest written in each batch directory.
+const batchManifestName = "batch.jsonl"
+
+// batchName returns the name of the nth (counting from 0) batch directory.
+func batchName(n int) string {
+	return fmt.Sprintf("batch%04d", n+1)
+}
+
+// batchNumber returns which batch a directory named name is, or -1 if it
+// isn't one.
+func batchNumber(name string) int {
+	if len(name) != len("batch0001") || !strings.HasPrefix(name, "batch") {
+		return -1
+	}
+	n, err := strconv.Atoi(name[len("batch"):])
+	if err != nil || n < 1 {
+		return -1
+	}
+	return n - 1
+}
+
+// A batchEntry is a line of a batch manifest, describing a series that was
+// placed in the batch.
+type batchEntry struct {
+	SeriesInstanceUID string   `json:"series_instance_uid"`
+	StudyInstanceUID  string   `json:"study_instance_uid,omitempty"`
+	PatientID         string   `json:"patient_id,omitempty"`
+	PatientName       string   `json:"patient_name"`
+	SeriesDescription string   `json:"series_description"`
+	Files             []string `json:"files"`
+	Bytes             int64    `json:"bytes"`
+}
+
+// batches split the target directory into numbered batch directories
+// (batch0001, batch0002, ...) of at most Bytes bytes or Files files each,
+// for copying onto removable media. Series are never split between
+// batches. Each batch has a manifest listing the series in it, which is
+// also used to continue filling the last batch on the next run.
+type batches struct {
+	Dir   string
+	Bytes int64
+	Files int
+
+	mu sync.Mutex
+	// The size of each batch, including what has been planned this
+	// run.
+	bytes []int64
+	files []int
+	// The batch that each series was placed in.
+	series map[string]int
+}
+
+// openBatches reads the manifests of the batches which already exist in
+// dir. When a series was recorded more than once, because it was organized
+// again, its last entry is the one that counts.
+func openBatches(dir string, maxBytes int64, maxFiles int) (*batches, error) {
+	b := &batches{Dir: dir, Bytes: maxBytes, Files: maxFiles, series: make(map[string]int)}
+	last := make(map[string]batchEntry)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range infos {
+		n := batchNumber(info.Name())
+		if !info.IsDir() || n < 0 {
+			continue
+		}
+		b.grow(n)
+		f, err := os.Open(filepath.Join(dir, info.Name(), batchManifestName))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 64*1024*1024)
+		for scanner.Scan() {
+			var e batchEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			}
+			if prev, ok := last[e.SeriesInstanceUID]; ok {
+				m := b.series[e.SeriesInstanceUID]
+				b.bytes[m] -= prev.Bytes
+				b.files[m] -= len(prev.Files)
+			}
+			b.bytes[n] += e.Bytes
+			b.files[n] += len(e.Files)
+			b.series[e.SeriesInstanceUID] = n
+			last[e.SeriesInstanceUID] = e
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// grow makes sure that batch n is being tracked.
+func (b *batches) grow(n int) {
+	for len(b.bytes) <= n {
+		b.bytes = append(b.bytes, 0)
+		b.files = append(b.files, 0)
+	}
+}
+
+// full returns whether adding size bytes and count files would put batch n
+// over its limits.
+func (b *batches) full(n int, size int64, count int) bool {
+	if b.files[n] == 0 {
+		// An empty batch takes anything, even a series that's
+		// bigger than the limit.
+		return false
+	}
+	return (b.Bytes > 0 && b.bytes[n]+size > b.Bytes) || (b.Files > 0 && b.files[n]+count > b.Files)
+}
+
+// For returns the batch directory that series s should be organized into.
+// It's safe to call on nil batches, which returns root unchanged.
+func (b *batches) For(s SeriesFiles, root string) string {
+	if b == nil || root != b.Dir {
+		return root
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n, ok := b.series[s.tagValue("SeriesInstanceUID")]; ok {
+		return filepath.Join(root, batchName(n))
+	}
+	var size int64
+	for _, file := range s.Files {
+		if fi, err := os.Stat(file.String()); err == nil {
+			size += fi.Size()
+		}
+	}
+	n := len(b.bytes) - 1
+	if n < 0 || b.full(n, size, len(s.Files)) {
+		n++
+		b.grow(n)
+	}
+	if (b.Bytes > 0 && size > b.Bytes) || (b.Files > 0 && len(s.Files) > b.Files) {
+		log.Printf("Series %s of %s doesn't fit in a batch, placing it in %s by itself.\n", s.SeriesDescription, s.PatientName, batchName(n))
+	}
+	b.bytes[n] += size
+	b.files[n] += len(s.Files)
+	b.series[s.tagValue("SeriesInstanceUID")] = n
+	return filepath.Join(root, batchName(n))
+}
+
+// Record adds the files of a series that were placed to the manifest of
+// the batch that they're in. It's safe to call on nil batches.
+func (b *batches) Record(s SeriesFiles, placed []FileName) error {
+	if b == nil || len(placed) == 0 {
+		return nil
+	}
+	rel, err := filepath.Rel(b.Dir, placed[0].String())
+	if err != nil {
+		return err
+	}
+	batch := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+	if batchNumber(batch) < 0 {
+		// The series was routed somewhere else.
+		return nil
+	}
+	e := batchEntry{
+		SeriesInstanceUID: s.tagValue("SeriesInstanceUID"),
+		StudyInstanceUID:  s.tagValue("StudyInstanceUID"),
+		PatientID:         s.tagValue("PatientID"),
+		PatientName:       s.PatientName,
+		SeriesDescription: s.SeriesDescription,
+	}
+	for _, file := range placed {
+		if rel, err := filepath.Rel(filepath.Join(b.Dir, batch), file.String()); err == nil {
+			e.Files = append(e.Files, filepath.ToSlash(rel))
+		}
+		if fi, err := os.Stat(file.String()); err == nil {
+			e.Bytes += fi.Size()
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(b.Dir, batch, batchManifestName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,282 @@
+package organize
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// retiredTransferSyntaxes are transfer syntaxes which have been retired
+// from the standard, but are still found on old MOD and CD archives.
+// Except for explicit VR big endian, they only change how the pixel data
+// is compressed, and the rest of the dataset is explicit VR little endian.
+var retiredTransferSyntaxes = map[string]bool{
+	explicitVRBigEndian:      true,
+	"1.2.840.10008.1.2.4.52": true,
+	"1.2.840.10008.1.2.4.53": true,
+	"1.2.840.10008.1.2.4.54": true,
+	"1.2.840.10008.1.2.4.55": true,
+	"1.2.840.10008.1.2.4.56": true,
+	"1.2.840.10008.1.2.4.58": true,
+	"1.2.840.10008.1.2.4.59": true,
+	"1.2.840.10008.1.2.4.60": true,
+	"1.2.840.10008.1.2.4.61": true,
+	"1.2.840.10008.1.2.4.62": true,
+	"1.2.840.10008.1.2.4.63": true,
+	"1.2.840.10008.1.2.4.64": true,
+	"1.2.840.10008.1.2.4.65": true,
+	"1.2.840.10008.1.2.4.66": true,
+}
+
+const jpegBaseline = "1.2.840.10008.1.2.4.50"
+
+// fileTransferSyntax returns the transfer syntax in the file meta
+// information of data, without reading any further.
+func fileTransferSyntax(data []byte) string {
+	off := 0
+	if len(data) >= 132 && string(data[128:132]) == "DICM" {
+		off = 132
+	}
+	r := &elementReader{data: data, off: off, enc: metaEncoding}
+	for r.more() {
+		t, err := r.peekTag()
+		if err != nil || t.Group != 0x0002 {
+			return ""
+		}
+		el, err := r.next()
+		if err != nil {
+			return ""
+		}
+		if el.Tag == transferSyntaxTag {
+			return string(bytes.TrimRight(el.Value, " \x00"))
+		}
+	}
+	return ""
+}
+
+// The size of each of the values of VRs which hold binary numbers, which
+// have to be byte swapped between big and little endian.
+var binaryVRSizes = map[string]int{
+	"AT": 2, "OW": 2, "SS": 2, "US": 2,
+	"FL": 4, "OF": 4, "OL": 4, "SL": 4, "UL": 4,
+	"FD": 8, "OD": 8, "OV": 8, "SV": 8, "UV": 8,
+}
+
+// swapValue returns a copy of value with each of its size byte numbers
+// byte swapped.
+func swapValue(value []byte, size int) ([]byte, error) {
+	if len(value)%size != 0 {
+		return nil, fmt.Errorf("length %d isn't a multiple of %d", len(value), size)
+	}
+	swapped := make([]byte, len(value))
+	for i := 0; i < len(value); i += size {
+		for j := 0; j < size; j++ {
+			swapped[i+j] = value[i+size-1-j]
+		}
+	}
+	return swapped, nil
+}
+
+// convertElements returns elements, which were encoded with from, with
+// their values converted to be encoded with to. Elements with implicit VRs
+// can't be converted to explicit ones, since their VRs aren't known.
+func convertElements(elements []element, from, to encoding, depth int) ([]element, error) {
+	if from == to {
+		return elements, nil
+	}
+	if depth >= maxSequenceDepth {
+		return nil, fmt.Errorf("sequences nested more than %d deep", maxSequenceDepth)
+	}
+	converted := make([]element, 0, len(elements))
+	for _, el := range elements {
+		switch size, ok := binaryVRSizes[el.VR]; {
+		case el.VR == "SQ":
+			value, err := convertItems(el.Value, from, to, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", el.Tag, err)
+			}
+			el.Value = value
+		case ok && !el.Undefined && from.order != to.order:
+			value, err := swapValue(el.Value, size)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", el.Tag, err)
+			}
+			el.Value = value
+		}
+		converted = append(converted, el)
+	}
+	return converted, nil
+}
+
+// convertItems converts the items of a sequence, along with its sequence
+// delimitation item if it has one, from one encoding to another.
+func convertItems(value []byte, from, to encoding, depth int) ([]byte, error) {
+	r := &elementReader{data: value, enc: from, depth: depth}
+	var out []byte
+	for r.more() {
+		t, _, length, err := r.header()
+		if err != nil {
+			return nil, err
+		}
+		if t == seqDelimTag {
+			out = appendElement(out, element{Tag: seqDelimTag}, to)
+			continue
+		}
+		if t != itemTag {
+			return nil, fmt.Errorf("unexpected %v in sequence", t)
+		}
+		var items []element
+		if length == undefinedLength {
+			for {
+				next, err := r.peekTag()
+				if err != nil {
+					return nil, err
+				}
+				if next == itemDelimTag {
+					if _, _, _, err := r.header(); err != nil {
+						return nil, err
+					}
+					break
+				}
+				el, err := r.next()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, el)
+			}
+		} else {
+			if uint64(r.off)+uint64(length) > uint64(len(value)) {
+				return nil, fmt.Errorf("item length %d runs past end of data", length)
+			}
+			sub := &elementReader{data: value[r.off : r.off+int(length)], enc: from, depth: depth}
+			for sub.more() {
+				el, err := sub.next()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, el)
+			}
+			r.off += int(length)
+		}
+		items, err = convertElements(items, from, to, depth)
+		if err != nil {
+			return nil, err
+		}
+		var body []byte
+		for _, el := range items {
+			body = appendElement(body, el, to)
+		}
+		out = appendElement(out, element{Tag: itemTag, Undefined: length == undefinedLength, Value: body}, to)
+		if length == undefinedLength {
+			out = appendElement(out, element{Tag: itemDelimTag}, to)
+		}
+	}
+	return out, nil
+}
+
+// setTransferSyntax changes the transfer syntax that ds is written with,
+// without converting its elements.
+func (ds *dataset) setTransferSyntax(ts string) {
+	ds.TransferSyntax = ts
+	value, _ := ds.encodeValue("UI", ts)
+	for i, el := range ds.Meta {
+		if el.Tag == transferSyntaxTag {
+			ds.Meta[i].Value = value
+			return
+		}
+	}
+}
+
+// canConvert reports whether a dataset in the transfer syntax from can be
+// converted to to. Only uncompressed datasets can be, to little endian,
+// and only ones with explicit VRs to explicit VR little endian.
+func canConvert(from, to string) bool {
+	switch from {
+	case implicitVRLittleEndian, explicitVRLittleEndian, explicitVRBigEndian, deflatedExplicitVRLittleEndian:
+	default:
+		return false
+	}
+	return to == implicitVRLittleEndian || (to == explicitVRLittleEndian && from != implicitVRLittleEndian)
+}
+
+// convertTo converts ds to the transfer syntax ts, which canConvert has
+// to allow.
+func (ds *dataset) convertTo(ts string) error {
+	elements, err := convertElements(ds.Elements, encodingFor(ds.TransferSyntax), encodingFor(ts), 0)
+	if err != nil {
+		return err
+	}
+	ds.Elements = elements
+	ds.setTransferSyntax(ts)
+	return nil
+}
+
+// toLittleEndian converts a dataset encoded as explicit VR big endian to
+// explicit VR little endian. Datasets in any other transfer syntax are
+// left alone.
+func (ds *dataset) toLittleEndian() error {
+	if ds.TransferSyntax != explicitVRBigEndian {
+		return nil
+	}
+	elements, err := convertElements(ds.Elements, encodingFor(explicitVRBigEndian), encodingFor(explicitVRLittleEndian), 0)
+	if err != nil {
+		return err
+	}
+	ds.Elements = elements
+	ds.setTransferSyntax(explicitVRLittleEndian)
+	return nil
+}
+
+// convertToLittleEndian is the rewrite for -little-endian.
+func convertToLittleEndian(src FileName, ds *dataset) error {
+	return ds.toLittleEndian()
+}
+
+// A retiredHeader is the header of a file in a retired transfer syntax,
+// which was converted to explicit VR little endian to be parsed. It still
+// reports the file's own transfer syntax.
+type retiredHeader struct {
+	Header
+	transferSyntax string
+}
+
+func (h retiredHeader) Lookup(name string) (string, error) {
+	if name == "TransferSyntaxUID" {
+		return h.transferSyntax, nil
+	}
+	return h.Header.Lookup(name)
+}
+
+// parseRetired parses data, which is encoded in the retired transfer
+// syntax ts, since the parsers don't all understand them. Big endian files
+// are converted to explicit VR little endian first, and the others are
+// parsed as JPEG Baseline, which encapsulates the pixel data in the same
+// way.
+func parseRetired(parser HeaderParser, data []byte, ts string) (Header, error) {
+	ds, err := readDataset(data)
+	if err != nil {
+		return nil, err
+	}
+	if ts == explicitVRBigEndian {
+		if err := ds.toLittleEndian(); err != nil {
+			return nil, err
+		}
+	} else {
+		ds.setTransferSyntax(jpegBaseline)
+	}
+	var buf bytes.Buffer
+	if _, err := ds.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	h, err := parser.Parse(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return retiredHeader{h, ts}, nil
+}
+
+// isBigEndian reports whether tags, the FileTags of a file, say it's
+// encoded as explicit VR big endian.
+func isBigEndian(tags map[string]string) bool {
+	return strings.TrimSpace(tags["TransferSyntaxUID"]) == explicitVRBigEndian
+}
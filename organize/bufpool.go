@@ -0,0 +1,60 @@
+package organize
+
+import (
+	"bytes"
+	"os"
+	"sync"
+)
+
+// Buffers that files are read into for parsing. Reusing them instead of
+// allocating a new slice for every file keeps the garbage collector from
+// dominating runs over hundreds of thousands of files.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Buffers larger than this aren't kept, so that one enormous file doesn't
+// pin its memory for the rest of the run.
+const maxPooledBuffer = 64 << 20
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buf to the pool. Nothing parsed from its contents may
+// be used afterwards, since the parser may refer to the buffer instead of
+// copying values out of it.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// readInto replaces the contents of buf with the contents of a file,
+// decompressing it if it's compressed.
+func readInto(buf *bytes.Buffer, filename string) error {
+	buf.Reset()
+	if isCompressed(filename) {
+		r, err := openStored(filename)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = buf.ReadFrom(r)
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		// One extra byte lets ReadFrom see EOF without growing the
+		// buffer again.
+		buf.Grow(int(info.Size()) + 1)
+	}
+	_, err = buf.ReadFrom(f)
+	return err
+}
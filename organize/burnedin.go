@@ -0,0 +1,77 @@
+package organize
+
+import (
+	"strings"
+)
+
+// SOP Class UIDs for the Secondary Capture family. These are frequently
+// screenshots or scanned documents, so any PHI is part of the pixel data.
+var secondaryCaptureClasses = map[string]bool{
+	"1.2.840.10008.5.1.4.1.1.7":   true, // Secondary Capture Image Storage
+	"1.2.840.10008.5.1.4.1.1.7.1": true, // Multi-frame Single Bit SC
+	"1.2.840.10008.5.1.4.1.1.7.2": true, // Multi-frame Grayscale Byte SC
+	"1.2.840.10008.5.1.4.1.1.7.3": true, // Multi-frame Grayscale Word SC
+	"1.2.840.10008.5.1.4.1.1.7.4": true, // Multi-frame True Color SC
+}
+
+// Modalities whose devices commonly render patient details directly into
+// the image.
+var burnedInModalities = map[string]bool{
+	"US": true,
+	"OT": true,
+}
+
+// burnedInKind is the heuristic that flagged a file as likely containing
+// burned in annotations.
+type burnedInKind int
+
+const (
+	burnedInNone burnedInKind = iota
+	// The file itself says that it has burned in annotations.
+	burnedInDeclared
+	burnedInSecondaryCapture
+	burnedInModality
+)
+
+// burnedIn records whether, and why, a file or series is likely to contain
+// burned in annotations.
+type burnedIn struct {
+	Kind burnedInKind `json:"kind,omitempty"`
+	// The SOP class or modality that it was flagged for.
+	Value string `json:"value,omitempty"`
+}
+
+// Flagged reports whether it's likely to contain burned in annotations.
+func (b burnedIn) Flagged() bool {
+	return b.Kind != burnedInNone
+}
+
+// String returns a short description of why it was flagged, or the empty
+// string if it wasn't.
+func (b burnedIn) String() string {
+	switch b.Kind {
+	case burnedInDeclared:
+		return "BurnedInAnnotation is YES"
+	case burnedInSecondaryCapture:
+		return "secondary capture SOP class " + b.Value
+	case burnedInModality:
+		return "modality " + b.Value
+	}
+	return ""
+}
+
+// burnedInReason applies a set of heuristics to determine if the pixel data
+// of a file is likely to contain burned in annotations, and returns why it
+// was flagged.
+func burnedInReason(data Header) burnedIn {
+	if strings.ToUpper(strings.TrimSpace(lookupValue(data, "BurnedInAnnotation"))) == "YES" {
+		return burnedIn{Kind: burnedInDeclared}
+	}
+	if sopClass := strings.TrimSpace(lookupValue(data, "SOPClassUID")); secondaryCaptureClasses[sopClass] {
+		return burnedIn{burnedInSecondaryCapture, sopClass}
+	}
+	if modality := strings.ToUpper(strings.TrimSpace(lookupValue(data, "Modality"))); burnedInModalities[modality] {
+		return burnedIn{burnedInModality, modality}
+	}
+	return burnedIn{}
+}
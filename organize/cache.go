@@ -0,0 +1,192 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A cacheEntry is the parsed form of a file, which is reused as long as
+// the file's size and modification time haven't changed.
+type cacheEntry struct {
+	Path    string            `json:"path"`
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"mod_time"`
+	Used    time.Time         `json:"used"`
+	UID     SeriesInstanceUID `json:"series_instance_uid"`
+	Series  SeriesFiles       `json:"series"`
+}
+
+// cacheHeader is the first line of a cache file. If the tags that are read
+// or the parser change, the cached entries are incomplete and the cache is
+// discarded.
+type cacheHeader struct {
+	Version int    `json:"version"`
+	Parser  string `json:"parser"`
+	Tags    string `json:"tags"`
+}
+
+// A parseCache remembers the result of parsing files between runs, so that
+// files which haven't changed don't have to be read again.
+type parseCache struct {
+	Path string
+
+	// The maximum number of entries to keep. The least recently used
+	// entries are dropped when the cache is saved.
+	Max int
+
+	header cacheHeader
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	changed bool
+}
+
+// cached is the cache used by parseInto, if -cache was given.
+var cached *parseCache
+
+// openParseCache loads the cache at path, or starts a new one if it
+// doesn't exist or was written with different options.
+func openParseCache(path string, max int) (*parseCache, error) {
+	c := &parseCache{
+		Path:    path,
+		Max:     max,
+		header:  cacheHeader{2, parserBackend, strings.Join(RequiredTags(), ",")},
+		entries: make(map[string]*cacheEntry),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	if !scanner.Scan() {
+		return c, scanner.Err()
+	}
+	var header cacheHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header != c.header {
+		if verbose {
+			log.Printf("Not using %s, since it was written with different options.\n", path)
+		}
+		c.changed = true
+		return c, nil
+	}
+	for scanner.Scan() {
+		var entry cacheEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		c.entries[entry.Path] = &entry
+	}
+	return c, scanner.Err()
+}
+
+// Get returns the cached result of parsing file, if it hasn't changed
+// since it was cached. It's safe to call on a nil cache.
+func (c *parseCache) Get(file FileName) (SeriesInstanceUID, SeriesFiles, bool) {
+	if c == nil {
+		return "", SeriesFiles{}, false
+	}
+	info, err := os.Stat(file.String())
+	if err != nil {
+		return "", SeriesFiles{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[file.String()]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return "", SeriesFiles{}, false
+	}
+	entry.Used = time.Now()
+	c.changed = true
+	return entry.UID, entry.Series, true
+}
+
+// Put caches the result of parsing file. It's safe to call on a nil
+// cache.
+func (c *parseCache) Put(file FileName, uid SeriesInstanceUID, s SeriesFiles) {
+	if c == nil {
+		return
+	}
+	info, err := os.Stat(file.String())
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[file.String()] = &cacheEntry{
+		Path:    file.String(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Used:    time.Now(),
+		UID:     uid,
+		Series:  s,
+	}
+	c.changed = true
+}
+
+// Save writes the cache back to disk, keeping only the most recently used
+// entries. It's safe to call on a nil cache.
+func (c *parseCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.changed {
+		return nil
+	}
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Used.After(entries[j].Used)
+	})
+	if c.Max > 0 && len(entries) > c.Max {
+		for _, entry := range entries[c.Max:] {
+			delete(c.entries, entry.Path)
+		}
+		entries = entries[:c.Max]
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.Path), ".cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(c.header); err != nil {
+		f.Close()
+		return err
+	}
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), c.Path); err != nil {
+		return err
+	}
+	c.changed = false
+	return nil
+}
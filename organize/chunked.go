@@ -0,0 +1,143 @@
+package organize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files at least this large, such as whole slide images, are copied in
+// chunks by copyFile, so that a copy which is interrupted can be resumed
+// where it left off instead of starting over, and its progress is logged.
+// Zero copies every file in one piece.
+var chunkedCopySize int64 = 1 << 30
+
+// The size of each chunk of a chunked copy, which is flushed to disk before
+// the next is written.
+const copyChunkSize = 64 << 20
+
+// How often the progress of a chunked copy is logged.
+const copyProgressInterval = 10 * time.Second
+
+// A copyProgress is how much of a source file a chunked copy has written,
+// kept next to the partial copy. It's only trusted if the source hasn't
+// changed since.
+type copyProgress struct {
+	Source  string    `json:"source"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Copied  int64     `json:"copied"`
+}
+
+// partialPaths returns where a chunked copy to dst is written until it's
+// complete, and where its progress is kept. They're hidden, so that
+// nothing reading the target mistakes them for organized files.
+func partialPaths(dst FileName) (partial, progress string) {
+	dir, base := filepath.Split(dst.String())
+	partial = filepath.Join(dir, "."+base+".partial")
+	return partial, partial + ".json"
+}
+
+func readCopyProgress(path string) (copyProgress, error) {
+	var p copyProgress
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(data, &p)
+	return p, err
+}
+
+// writeCopyProgress replaces the progress at path, so that it's never left
+// half written.
+func writeCopyProgress(fs FileSystem, path string, p copyProgress) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	f, err := fs.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(path+".tmp", path)
+}
+
+// copyChunked copies src, which is open as f, to dst through a partial
+// copy, resuming a previous copy of the same source if there is one. The
+// partial copy is left behind if the copy fails, and renamed to dst once
+// it's complete.
+func copyChunked(fs FileSystem, src FileName, f *os.File, info os.FileInfo, dst FileName) error {
+	partial, progress := partialPaths(dst)
+	p := copyProgress{Source: src.String(), Size: info.Size(), ModTime: info.ModTime()}
+	if prev, err := readCopyProgress(progress); err == nil && prev.Source == p.Source && prev.Size == p.Size && prev.ModTime.Equal(p.ModTime) {
+		if fi, err := fs.Stat(partial); err == nil && fi.Size() >= prev.Copied && prev.Copied <= p.Size {
+			p.Copied = prev.Copied
+		}
+	}
+	if p.Copied > 0 {
+		log.Printf("Resuming the copy of %s after %s of %s.\n", src, humanBytes(uint64(p.Copied)), humanBytes(uint64(p.Size)))
+	}
+	if _, err := f.Seek(p.Copied, io.SeekStart); err != nil {
+		return err
+	}
+	w, err := fs.CreateAt(partial, p.Copied)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	last := time.Now()
+	for p.Copied < p.Size {
+		chunk := p.Size - p.Copied
+		if chunk > copyChunkSize {
+			chunk = copyChunkSize
+		}
+		n, err := io.CopyN(bandwidth.Writer(w), f, chunk)
+		p.Copied += n
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%s was truncated while it was being copied", src)
+			}
+			return err
+		}
+		// Each chunk is flushed before it's recorded, even without
+		// -sync-series, so that a resumed copy never skips data that
+		// was lost in a crash.
+		if s, ok := w.(interface{ Sync() error }); ok {
+			if err := s.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := writeCopyProgress(fs, progress, p); err != nil {
+			return err
+		}
+		if time.Since(last) >= copyProgressInterval && p.Copied < p.Size {
+			log.Printf("Copying %s: %s of %s (%d%%).\n", src, humanBytes(uint64(p.Copied)), humanBytes(uint64(p.Size)), p.Copied*100/p.Size)
+			last = time.Now()
+		}
+	}
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if fi.Size() != p.Size || !fi.ModTime().Equal(p.ModTime) {
+		return fmt.Errorf("%s changed while it was being copied", src)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(partial, dst.String()); err != nil {
+		return err
+	}
+	fs.Remove(progress)
+	return nil
+}
@@ -0,0 +1,166 @@
+package organize
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The extension given to files which are stored compressed with
+// -compress.
+const compressedExtension = ".gz"
+
+// isCompressed returns whether a file is stored gzip compressed, going by
+// its name.
+func isCompressed(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), compressedExtension)
+}
+
+// storedReader closes both the decompressor and the file under it.
+type storedReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r storedReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+// openStored opens a file for reading its contents, decompressing it if
+// it's compressed. Reading it to the end checks that it wasn't damaged.
+func openStored(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressed(path) {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return storedReader{zr, f}, nil
+}
+
+// readStored returns the contents of a file, decompressing it if it's
+// compressed.
+func readStored(path string) ([]byte, error) {
+	r, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// writeCompressed writes data to w compressed.
+func writeCompressed(w io.Writer, data io.WriterTo) error {
+	zw := gzip.NewWriter(w)
+	if _, err := data.WriteTo(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Cat writes the contents of files in an organized tree to w,
+// decompressing them if they're compressed.
+func Cat(w io.Writer, files ...string) error {
+	for _, file := range files {
+		r, err := openStored(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// verifyStored checks that a file in an organized tree can be read back,
+// decompressing it if it's compressed, and that it's a DICOM file.
+func verifyStored(file string) error {
+	r, err := openStored(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	_, err = readTags(FileName(file), "SOPInstanceUID")
+	return err
+}
+
+// Verify reads back every file in paths, which can be files or organized
+// trees, and every file recorded in manifest, if it's set, logging any
+// which can't be read. If compareSources is set, files in the manifest
+// are also compared to their source files, if they still exist. It writes
+// a summary to w and returns the exit status, which is 1 if any failed.
+func Verify(w io.Writer, manifest string, compareSources bool, paths ...string) (int, error) {
+	checked, failed := 0, 0
+	check := func(err error) {
+		checked++
+		if err != nil {
+			log.Println(err)
+			failed++
+		}
+	}
+	if manifest != "" {
+		entries, err := readManifest(manifest)
+		if err != nil {
+			return 1, err
+		}
+		// Only the last entry for each file is current.
+		latest := make(map[string]manifestEntry)
+		var order []string
+		for _, e := range entries {
+			if _, ok := latest[e.Dst]; !ok {
+				order = append(order, e.Dst)
+			}
+			latest[e.Dst] = e
+		}
+		for _, dst := range order {
+			e := latest[dst]
+			if _, err := os.Stat(e.Src); err == nil && compareSources {
+				check(verifyCopy(FileName(e.Src), FileName(e.Dst)))
+				continue
+			}
+			check(verifyStored(e.Dst))
+		}
+	}
+	for _, path := range paths {
+		filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				check(err)
+				return nil
+			}
+			if info.IsDir() {
+				if file != path && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() || (!isCompressed(file) && isTextFile(FileName(file))) {
+				return nil
+			}
+			check(verifyStored(file))
+			return nil
+		})
+	}
+	fmt.Fprintf(w, "%d files checked, %d failed.\n", checked, failed)
+	if failed > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,281 @@
+package organize
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Config is a parsed configuration file.
+//
+// Configuration files use a subset of TOML. Keys in the top level table
+// are the names of command line options and are used as defaults for any
+// option that isn't given on the command line. Tables named
+// [profile.NAME] contain options which override the defaults when the
+// profile is selected with -profile NAME. For example:
+//
+//	verbose = true
+//	layout = "{PatientName}/{StudyDate}/{SeriesDescription}"
+//
+//	[profile.research]
+//	strip-overlays = true
+//	burned-in-dir = "/data/review"
+//
+// Other tables are used for settings which don't map directly to an
+// option.
+type Config struct {
+	path   string
+	tables map[string]map[string][]string
+
+	// The keys of each table, in the order they appear in the file.
+	order map[string][]string
+}
+
+// DefaultConfigPath returns the location of the configuration file used if
+// -config isn't given.
+func DefaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dicomfmt", "config.toml")
+}
+
+// parseValue parses a TOML value, returning each element if it's an array.
+func parseValue(v string) ([]string, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "[") {
+		if !strings.HasSuffix(v, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		var values []string
+		inner := strings.TrimSpace(v[1 : len(v)-1])
+		for inner != "" {
+			elem, rest, err := splitValue(inner)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, elem)
+			inner = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), ","))
+		}
+		return values, nil
+	}
+	value, rest, err := splitValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("unexpected %q after value", rest)
+	}
+	return []string{value}, nil
+}
+
+// splitValue parses the scalar value at the start of s, returning it along
+// with the remainder of s.
+func splitValue(s string) (string, string, error) {
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				return value, s[i+1:], err
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	end := strings.IndexAny(s, ", \t]")
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end], s[end:], nil
+}
+
+// stripComment removes a trailing comment from a line, ignoring any # that
+// is inside of a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteKey(key string) string {
+	key = strings.TrimSpace(key)
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		if key[0] == '\'' {
+			return key[1 : len(key)-1]
+		}
+		if k, err := strconv.Unquote(key); err == nil {
+			return k
+		}
+	}
+	return key
+}
+
+// LoadConfig reads the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Config{
+		path:   path,
+		tables: map[string]map[string][]string{"": {}},
+		order:  make(map[string][]string),
+	}
+	table := ""
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := c.tables[table]; !ok {
+				c.tables[table] = make(map[string][]string)
+			}
+			if parts := strings.SplitN(table, ".", 3); len(parts) == 3 && parts[0] == "profile" {
+				// A profile which only has tables of its own,
+				// such as [profile.NAME.layout.modality], still
+				// exists.
+				if _, ok := c.tables["profile."+parts[1]]; !ok {
+					c.tables["profile."+parts[1]] = make(map[string][]string)
+				}
+			}
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineno)
+		}
+		values, err := parseValue(line[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		key := unquoteKey(line[:eq])
+		if _, ok := c.tables[table][key]; !ok {
+			c.order[table] = append(c.order[table], key)
+		}
+		c.tables[table][key] = values
+	}
+	return c, scanner.Err()
+}
+
+// Table returns the values in a table of the config, with any values from
+// the same table under the selected profile taking precedence.
+func (c *Config) Table(name, profile string) map[string][]string {
+	merged := make(map[string][]string)
+	if c == nil {
+		return merged
+	}
+	for k, v := range c.tables[name] {
+		merged[k] = v
+	}
+	if profile != "" {
+		pname := "profile." + profile
+		if name != "" {
+			pname += "." + name
+		}
+		for k, v := range c.tables[pname] {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// Keys returns the keys of a table in the order they appear in the config,
+// for tables where the order matters. Keys from the selected profile come
+// first, followed by any other keys from the table itself.
+func (c *Config) Keys(name, profile string) []string {
+	if c == nil {
+		return nil
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	var tables []string
+	if profile != "" {
+		pname := "profile." + profile
+		if name != "" {
+			pname += "." + name
+		}
+		tables = append(tables, pname)
+	}
+	for _, table := range append(tables, name) {
+		for _, k := range c.order[table] {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// Apply sets any option in fs which wasn't given on the command line to
+// its value from the config, using the named profile if not empty.
+func (c *Config) Apply(fs *flag.FlagSet, profile string) error {
+	if c == nil {
+		if profile != "" {
+			return fmt.Errorf("profile %s requested, but there is no config file", profile)
+		}
+		return nil
+	}
+	if _, ok := c.tables["profile."+profile]; profile != "" && !ok {
+		return fmt.Errorf("%s: no profile named %s", c.path, profile)
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	// The options are set in order, so that the same error is always
+	// the one reported.
+	options := c.Table("", profile)
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := options[name]
+		if given[name] || name == "config" || name == "profile" {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %s", c.path, name)
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %s: %v", c.path, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package organize
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{`true`, []string{"true"}, false},
+		{` 42 `, []string{"42"}, false},
+		{`"a \"quoted\" string"`, []string{`a "quoted" string`}, false},
+		{`'C:\literal'`, []string{`C:\literal`}, false},
+		{`["a", 'b', c]`, []string{"a", "b", "c"}, false},
+		{`[]`, nil, false},
+		{`["a, b", "c"]`, []string{"a, b", "c"}, false},
+		{`"unterminated`, nil, true},
+		{`["a"`, nil, true},
+		{`"a" b`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseValue(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseValue(%s) error %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("parseValue(%s) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`a = 1 # comment`, `a = 1 `},
+		{`a = "# not a comment" # comment`, `a = "# not a comment" `},
+		{`a = '#' # comment`, `a = '#' `},
+		{`a = "\"#" # comment`, `a = "\"#" `},
+		{`# comment`, ``},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.in); got != tt.want {
+			t.Errorf("stripComment(%s) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// writeConfig writes a config file and loads it.
+func writeConfig(t *testing.T, contents string) *Config {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestConfigApply(t *testing.T) {
+	cfg := writeConfig(t, `
+verbose = true
+layout = "{PatientName}/{StudyDate}" # comment
+patient-root = ["a", "b"]
+
+[profile.research]
+layout = "research/{PatientID}"
+strip-overlays = true
+
+[layout.modality]
+MG = "{PatientName}/mammo"
+
+[profile.mammo.layout.modality]
+MG = "{PatientID}/mammo"
+`)
+	tests := []struct {
+		name    string
+		args    []string
+		profile string
+		want    map[string]string
+		err     string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"verbose": "true", "layout": "{PatientName}/{StudyDate}", "patient-root": "a,b", "strip-overlays": "false"},
+		},
+		{
+			name:    "profile",
+			profile: "research",
+			want:    map[string]string{"verbose": "true", "layout": "research/{PatientID}", "strip-overlays": "true"},
+		},
+		{
+			name:    "command line wins",
+			args:    []string{"-layout", "given", "-verbose=false"},
+			profile: "research",
+			want:    map[string]string{"verbose": "false", "layout": "given", "strip-overlays": "true"},
+		},
+		{
+			name:    "profile with only tables",
+			profile: "mammo",
+			want:    map[string]string{"verbose": "true", "layout": "{PatientName}/{StudyDate}"},
+		},
+		{
+			name:    "missing profile",
+			profile: "clinical",
+			err:     "no profile named clinical",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Bool("verbose", false, "")
+			fs.String("layout", "", "")
+			fs.Bool("strip-overlays", false, "")
+			var roots PatientRoots
+			fs.Var(&roots, "patient-root", "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.Apply(fs, tt.profile)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Apply error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	if got := cfg.Table("layout.modality", "")["MG"]; len(got) != 1 || got[0] != "{PatientName}/mammo" {
+		t.Errorf("layout.modality MG = %q", got)
+	}
+	if got := cfg.Table("layout.modality", "mammo")["MG"]; len(got) != 1 || got[0] != "{PatientID}/mammo" {
+		t.Errorf("layout.modality MG with the mammo profile = %q", got)
+	}
+}
+
+func TestConfigUnknownOption(t *testing.T) {
+	cfg := writeConfig(t, "no-such-option = 1\nb-unknown = 2\na-unknown = 3\n")
+	// The first unknown option in order is always the one reported.
+	for i := 0; i < 10; i++ {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		if err := cfg.Apply(fs, ""); err == nil || !strings.Contains(err.Error(), "unknown option a-unknown") {
+			t.Fatalf("Apply error %v, want unknown option a-unknown", err)
+		}
+	}
+}
+
+func TestConfigKeysOrder(t *testing.T) {
+	cfg := writeConfig(t, `
+[routes]
+b = "1"
+a = "2"
+
+[profile.x.routes]
+c = "3"
+a = "4"
+`)
+	if got := strings.Join(cfg.Keys("routes", "x"), ","); got != "c,a,b" {
+		t.Errorf("Keys = %s, want c,a,b", got)
+	}
+	if got := strings.Join(cfg.Keys("routes", ""), ","); got != "b,a" {
+		t.Errorf("Keys without a profile = %s, want b,a", got)
+	}
+}
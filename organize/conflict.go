@@ -0,0 +1,156 @@
+package organize
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ways that a conflict can be resolved.
+const (
+	resolveSkip      = 's'
+	resolveOverwrite = 'o'
+	resolveRename    = 'r'
+)
+
+// The tags that -interactive compares between files to find conflicts.
+var conflictTags = []string{"SOPInstanceUID", "PatientID", "StudyInstanceUID"}
+
+// A resolver asks the user how to resolve conflicts while organizing. A
+// nil resolver overwrites, which is what dicomfmt does when it isn't
+// interactive.
+type resolver struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// Resolutions chosen for every remaining conflict of a kind.
+	all map[string]byte
+}
+
+func newResolver(in io.Reader, out io.Writer) *resolver {
+	return &resolver{in: bufio.NewReader(in), out: out, all: make(map[string]byte)}
+}
+
+// Resolve describes a conflict of the given kind and returns how the user
+// chose to resolve it.
+func (r *resolver) Resolve(kind, description string) byte {
+	if r == nil {
+		return resolveOverwrite
+	}
+	if choice, ok := r.all[kind]; ok {
+		return choice
+	}
+	for {
+		fmt.Fprintf(r.out, "%s\n[s]kip, [o]verwrite, [r]ename (capitalize to apply to every %s conflict)? ", description, kind)
+		line, err := r.in.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" && err != nil {
+			// There's nobody left to ask, so be cautious.
+			fmt.Fprintln(r.out)
+			return resolveSkip
+		}
+		if len(line) != 1 {
+			continue
+		}
+		choice := line[0]
+		switch choice {
+		case 'S', 'O', 'R':
+			choice += 'a' - 'A'
+			r.all[kind] = choice
+		}
+		switch choice {
+		case resolveSkip, resolveOverwrite, resolveRename:
+			return choice
+		}
+	}
+}
+
+// sameContent reports whether two files have identical contents, after
+// decompressing them if they're compressed.
+func sameContent(a, b string) (bool, error) {
+	if isCompressed(a) == isCompressed(b) {
+		ia, err := os.Stat(a)
+		if err != nil {
+			return false, err
+		}
+		ib, err := os.Stat(b)
+		if err != nil {
+			return false, err
+		}
+		if ia.Size() != ib.Size() {
+			return false, nil
+		}
+	}
+	fa, err := openStored(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := openStored(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	bufA, bufB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// freeName returns a name like file_1.dcm in the same directory as file
+// which doesn't exist yet.
+func freeName(file FileName) FileName {
+	ext := filepath.Ext(file.String())
+	base := strings.TrimSuffix(file.String(), ext)
+	for i := 1; ; i++ {
+		name := FileName(fmt.Sprintf("%s_%d%s", base, i, ext))
+		if _, err := os.Stat(name.String()); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// conflict returns the kind and a description of any conflict with
+// placing file from series s at dst, or "" if there isn't one.
+func (o *Organizer) conflict(s SeriesFiles, file, dst FileName) (string, string) {
+	if _, err := os.Stat(dst.String()); err == nil {
+		if same, err := sameContent(file.String(), dst.String()); err == nil && !same {
+			return "name", fmt.Sprintf("%s already exists with different contents than %s.", dst, file)
+		}
+	}
+	tags := s.FileTags[file]
+	if uid := tags["SOPInstanceUID"]; uid != "" {
+		key := filepath.Dir(dst.String()) + "\x00" + uid
+		if other, ok := o.placedSOPs[key]; ok && other != dst {
+			if same, err := sameContent(file.String(), other.String()); err == nil && !same {
+				return "duplicate", fmt.Sprintf("%s has the same SOPInstanceUID as %s, but different contents.", file, other)
+			}
+		}
+	}
+	if len(s.Files) > 0 {
+		first := s.FileTags[s.Files[0]]
+		for _, name := range []string{"PatientID", "StudyInstanceUID"} {
+			if tags[name] != first[name] {
+				return "metadata", fmt.Sprintf("%s has %s %q, but the rest of its series has %q.", file, name, tags[name], first[name])
+			}
+		}
+	}
+	return "", ""
+}
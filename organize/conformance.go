@@ -0,0 +1,234 @@
+package organize
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// An iodAttribute is an attribute that a module of an IOD requires. Type 1
+// attributes must be present with a value, and type 2 attributes must be
+// present but can be empty.
+type iodAttribute struct {
+	Name string
+	Tag  tag
+	Type int
+}
+
+// The mandatory modules of the IODs that conformance checks, reduced to
+// their type 1 and 2 attributes which aren't conditional.
+var (
+	patientModule = []iodAttribute{
+		{"PatientName", tag{0x0010, 0x0010}, 2},
+		{"PatientID", tag{0x0010, 0x0020}, 2},
+		{"PatientBirthDate", tag{0x0010, 0x0030}, 2},
+		{"PatientSex", tag{0x0010, 0x0040}, 2},
+	}
+	generalStudyModule = []iodAttribute{
+		{"StudyDate", tag{0x0008, 0x0020}, 2},
+		{"StudyTime", tag{0x0008, 0x0030}, 2},
+		{"AccessionNumber", tag{0x0008, 0x0050}, 2},
+		{"ReferringPhysicianName", tag{0x0008, 0x0090}, 2},
+		{"StudyInstanceUID", tag{0x0020, 0x000D}, 1},
+		{"StudyID", tag{0x0020, 0x0010}, 2},
+	}
+	generalSeriesModule = []iodAttribute{
+		{"Modality", tag{0x0008, 0x0060}, 1},
+		{"SeriesInstanceUID", tag{0x0020, 0x000E}, 1},
+		{"SeriesNumber", tag{0x0020, 0x0011}, 2},
+	}
+	generalEquipmentModule = []iodAttribute{
+		{"Manufacturer", tag{0x0008, 0x0070}, 2},
+	}
+	sopCommonModule = []iodAttribute{
+		{"SOPClassUID", tag{0x0008, 0x0016}, 1},
+		{"SOPInstanceUID", tag{0x0008, 0x0018}, 1},
+	}
+	generalImageModule = []iodAttribute{
+		{"InstanceNumber", tag{0x0020, 0x0013}, 2},
+	}
+	imagePixelModule = []iodAttribute{
+		{"SamplesPerPixel", tag{0x0028, 0x0002}, 1},
+		{"PhotometricInterpretation", tag{0x0028, 0x0004}, 1},
+		{"Rows", tag{0x0028, 0x0010}, 1},
+		{"Columns", tag{0x0028, 0x0011}, 1},
+		{"BitsAllocated", tag{0x0028, 0x0100}, 1},
+		{"BitsStored", tag{0x0028, 0x0101}, 1},
+		{"HighBit", tag{0x0028, 0x0102}, 1},
+		{"PixelRepresentation", tag{0x0028, 0x0103}, 1},
+		{"PixelData", tag{0x7FE0, 0x0010}, 1},
+	}
+	frameOfReferenceModule = []iodAttribute{
+		{"FrameOfReferenceUID", tag{0x0020, 0x0052}, 1},
+		{"PositionReferenceIndicator", tag{0x0020, 0x1040}, 2},
+	}
+	imagePlaneModule = []iodAttribute{
+		{"SliceThickness", tag{0x0018, 0x0050}, 2},
+		{"ImagePositionPatient", tag{0x0020, 0x0032}, 1},
+		{"ImageOrientationPatient", tag{0x0020, 0x0037}, 1},
+		{"PixelSpacing", tag{0x0028, 0x0030}, 1},
+	}
+	ctImageModule = []iodAttribute{
+		{"ImageType", tag{0x0008, 0x0008}, 1},
+		{"KVP", tag{0x0018, 0x0060}, 2},
+		{"AcquisitionNumber", tag{0x0020, 0x0012}, 2},
+		{"RescaleIntercept", tag{0x0028, 0x1052}, 1},
+		{"RescaleSlope", tag{0x0028, 0x1053}, 1},
+	}
+	mrImageModule = []iodAttribute{
+		{"ImageType", tag{0x0008, 0x0008}, 1},
+		{"ScanningSequence", tag{0x0018, 0x0020}, 1},
+		{"SequenceVariant", tag{0x0018, 0x0021}, 1},
+		{"ScanOptions", tag{0x0018, 0x0022}, 2},
+		{"MRAcquisitionType", tag{0x0018, 0x0023}, 2},
+		{"RepetitionTime", tag{0x0018, 0x0080}, 2},
+		{"EchoTime", tag{0x0018, 0x0081}, 2},
+		{"EchoTrainLength", tag{0x0018, 0x0091}, 2},
+	}
+	crModule = []iodAttribute{
+		{"BodyPartExamined", tag{0x0018, 0x0015}, 2},
+		{"ViewPosition", tag{0x0018, 0x5101}, 2},
+	}
+	scEquipmentModule = []iodAttribute{
+		{"ConversionType", tag{0x0008, 0x0064}, 1},
+	}
+)
+
+// An iod is the name and modules of an information object definition.
+type iod struct {
+	Name    string
+	Modules [][]iodAttribute
+}
+
+// commonModules are the modules that every composite IOD has.
+var commonModules = [][]iodAttribute{
+	patientModule, generalStudyModule, generalSeriesModule,
+	generalEquipmentModule, sopCommonModule,
+}
+
+// iods are the IODs that files are checked against, keyed by SOP class.
+// Files of any other SOP class are only checked against commonModules.
+var iods = map[string]iod{
+	"1.2.840.10008.5.1.4.1.1.1": {"CR Image", append([][]iodAttribute{
+		crModule, generalImageModule, imagePixelModule,
+	}, commonModules...)},
+	"1.2.840.10008.5.1.4.1.1.2": {"CT Image", append([][]iodAttribute{
+		frameOfReferenceModule, generalImageModule, imagePlaneModule,
+		imagePixelModule, ctImageModule,
+	}, commonModules...)},
+	"1.2.840.10008.5.1.4.1.1.4": {"MR Image", append([][]iodAttribute{
+		frameOfReferenceModule, generalImageModule, imagePlaneModule,
+		imagePixelModule, mrImageModule,
+	}, commonModules...)},
+	"1.2.840.10008.5.1.4.1.1.7": {"Secondary Capture Image", append([][]iodAttribute{
+		scEquipmentModule, generalImageModule, imagePixelModule,
+	}, commonModules...)},
+}
+
+// Results of checking a file's conformance, in order of severity.
+const (
+	conformancePass = "PASS"
+	conformanceWarn = "WARN"
+	conformanceFail = "FAIL"
+)
+
+// checkConformance checks a dataset against the IOD of its SOP class. It
+// returns the result, and the problems which caused it.
+func checkConformance(ds *dataset) (string, []string) {
+	var failures, warnings []string
+	sopClass := ds.stringValue(sopClassUIDTag)
+	def, ok := iods[sopClass]
+	if !ok {
+		def = iod{"", commonModules}
+		if sopClass != "" {
+			warnings = append(warnings, fmt.Sprintf("no IOD known for SOP class %s, only common modules were checked", sopClass))
+		}
+	}
+	seen := make(map[tag]bool)
+	for _, module := range def.Modules {
+		for _, a := range module {
+			if seen[a.Tag] {
+				continue
+			}
+			seen[a.Tag] = true
+			el, exists := ds.element(a.Tag)
+			switch {
+			case !exists && a.Type == 1:
+				failures = append(failures, fmt.Sprintf("missing type 1 %s %v", a.Name, a.Tag))
+			case !exists:
+				warnings = append(warnings, fmt.Sprintf("missing type 2 %s %v", a.Name, a.Tag))
+			case a.Type == 1 && len(bytes.TrimRight(el.Value, " \x00")) == 0:
+				failures = append(failures, fmt.Sprintf("empty type 1 %s %v", a.Name, a.Tag))
+			}
+		}
+	}
+	for _, el := range ds.Meta {
+		if el.Tag == mediaStorageSOPTag {
+			if v := string(bytes.TrimRight(el.Value, " \x00")); v != ds.stringValue(sopInstanceUIDTag) {
+				failures = append(failures, fmt.Sprintf("MediaStorageSOPInstanceUID %s doesn't match SOPInstanceUID", v))
+			}
+		}
+	}
+	if ds.Preamble == nil {
+		warnings = append(warnings, "no preamble and DICM prefix")
+	}
+	switch {
+	case len(failures) > 0:
+		return conformanceFail, append(failures, warnings...)
+	case len(warnings) > 0:
+		return conformanceWarn, warnings
+	}
+	return conformancePass, nil
+}
+
+// Conformance implements -conformance. It checks every DICOM file in
+// paths, which can be files or directories, against the IOD of its SOP
+// class, and prints a line for each with the result and any problems. It
+// returns the exit status, which is 1 if any file failed.
+func Conformance(paths []string) int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	counts := make(map[string]int)
+	check := func(file string) {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		result, problems := conformanceFail, []string(nil)
+		if err := readInto(buf, file); err != nil {
+			problems = []string{err.Error()}
+		} else if ds, err := readDataset(buf.Bytes()); err != nil {
+			problems = []string{"unreadable: " + err.Error()}
+		} else {
+			result, problems = checkConformance(ds)
+		}
+		counts[result]++
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result, file, strings.Join(problems, "; "))
+	}
+	for _, path := range paths {
+		filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				counts[conformanceFail]++
+				return nil
+			}
+			if info.IsDir() {
+				if file != path && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() || (!isCompressed(file) && isTextFile(FileName(file))) {
+				return nil
+			}
+			check(file)
+			return nil
+		})
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%d files passed, %d had warnings, %d failed.\n", counts[conformancePass], counts[conformanceWarn], counts[conformanceFail])
+	if counts[conformanceFail] > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+package organize
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A pauser blocks anything that calls Wait while it's paused.
+type pauser struct {
+	mu sync.Mutex
+	// resumed is closed when the pauser isn't paused, and replaced
+	// when it's paused again.
+	resumed chan struct{}
+}
+
+func newPauser() *pauser {
+	p := &pauser{resumed: make(chan struct{})}
+	close(p.resumed)
+	return p
+}
+
+// Wait blocks until the pauser is resumed or ctx is cancelled, and returns
+// ctx's error in the latter case. It returns immediately on a nil pauser.
+func (p *pauser) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pauser) SetPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+		if paused {
+			p.resumed = make(chan struct{})
+		}
+	default:
+		if !paused {
+			close(p.resumed)
+		}
+	}
+}
+
+func (p *pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// recentErrors keeps the last few files that couldn't be organized, so
+// that they can be reported by the control API.
+type recentErrors struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+// recentFailures is where fileFailed records failures, when the control API
+// is being served.
+var recentFailures *recentErrors
+
+func (r *recentErrors) Add(file FileName, reason string, err error) {
+	if r == nil {
+		return
+	}
+	line := file.String() + ": " + reason
+	if err != nil {
+		line += ": " + err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, line)
+	if len(r.lines) > r.max {
+		r.lines = r.lines[len(r.lines)-r.max:]
+	}
+}
+
+func (r *recentErrors) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// status is the response to a /status request.
+type status struct {
+	State           string    `json:"state"`
+	Scans           int       `json:"scans"`
+	LastScanStarted time.Time `json:"last_scan_started"`
+	LastScanEnded   time.Time `json:"last_scan_ended"`
+	LastReconcile   time.Time `json:"last_reconcile"`
+	NextReconcile   time.Time `json:"next_reconcile"`
+	FilesIngested   int64     `json:"files_ingested"`
+	BytesWritten    int64     `json:"bytes_written"`
+	ParseFailures   int64     `json:"parse_failures"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// requirePost rejects anything but POST requests to endpoints which change
+// state.
+func requirePost(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// controlHandler returns the handler for the control API of a watcher.
+// Health checks don't need a token, checking the status needs a read
+// token, and anything which changes the state needs an admin token.
+func controlHandler(w *watcher, recent *recentErrors, auth *ServerAuth) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok\n"))
+	})
+	mux.Handle("/status", auth.Require(scopeRead, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		s := w.Status()
+		m := metrics.Snapshot()
+		s.FilesIngested = m.Files
+		s.BytesWritten = m.Bytes
+		s.ParseFailures = m.ParseFailures
+		writeJSON(rw, s)
+	})))
+	mux.Handle("/errors", auth.Require(scopeRead, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, recent.Lines())
+	})))
+	mux.Handle("/pause", auth.Require(scopeAdmin, requirePost(func(rw http.ResponseWriter, r *http.Request) {
+		w.o.Pause.SetPaused(true)
+		writeJSON(rw, w.Status())
+	})))
+	mux.Handle("/resume", auth.Require(scopeAdmin, requirePost(func(rw http.ResponseWriter, r *http.Request) {
+		w.o.Pause.SetPaused(false)
+		writeJSON(rw, w.Status())
+	})))
+	mux.Handle("/rescan", auth.Require(scopeAdmin, requirePost(func(rw http.ResponseWriter, r *http.Request) {
+		w.Rescan()
+		writeJSON(rw, w.Status())
+	})))
+	return mux
+}
+
+func serveControl(addr string, w *watcher, recent *recentErrors, auth *ServerAuth) {
+	auth.Serve(addr, controlHandler(w, recent, auth))
+}
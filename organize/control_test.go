@@ -0,0 +1,43 @@
+package organize
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPauserWait(t *testing.T) {
+	var none *pauser
+	if err := none.Wait(context.Background()); err != nil {
+		t.Errorf("Wait on a nil pauser returned %v", err)
+	}
+
+	p := newPauser()
+	if err := p.Wait(context.Background()); err != nil {
+		t.Errorf("Wait before pausing returned %v", err)
+	}
+
+	p.SetPaused(true)
+	p.SetPaused(true)
+	if !p.Paused() {
+		t.Fatal("not paused after pausing")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait while paused returned %v, want the context's error", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- p.Wait(context.Background()) }()
+	p.SetPaused(false)
+	p.SetPaused(false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait returned %v after resuming", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Wait didn't return after resuming")
+	}
+}
@@ -0,0 +1,132 @@
+package organize
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cronSchedule is a schedule in the format used by crontab: minute,
+// hour, day of month, month and day of week fields, each of which can be
+// *, a number, a range (1-5), a list (1,15) or have a step (*/15).
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// Whether the day of month and day of week fields were both
+	// restricted, in which case matching either is enough.
+	domAndDow bool
+}
+
+// cronField parses a single field of a schedule, whose values range from
+// min to max.
+func cronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				// 5/15 means every 15 starting at 5.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is outside of %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// parseCron parses a schedule such as "0 3 * * *" (every day at 3:00) or
+// one of the shorthands @hourly, @daily, @weekly and @monthly. Times are
+// in the local time zone.
+func parseCron(spec string) (*cronSchedule, error) {
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: must have 5 fields", spec)
+	}
+	var s cronSchedule
+	var err error
+	bounds := []struct {
+		dst      *map[int]bool
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.dst, err = cronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+	}
+	if s.dow[7] {
+		// Both 0 and 7 are Sunday.
+		s.dow[0] = true
+	}
+	s.domAndDow = fields[2] != "*" && fields[4] != "*"
+	return &s, nil
+}
+
+// Next returns the first time after t that the schedule matches, or the
+// zero time if it never does (such as on February 30th.)
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	// Every schedule that can match does so within a few years.
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case !s.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if s.domAndDow {
+		return s.dom[t.Day()] || s.dow[int(t.Weekday())]
+	}
+	return s.dom[t.Day()] && s.dow[int(t.Weekday())]
+}
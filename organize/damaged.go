@@ -0,0 +1,77 @@
+package organize
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// A damagedError is the error for a file that's empty or truncated, rather
+// than one the parser doesn't understand.
+type damagedError struct {
+	file   FileName
+	reason string
+}
+
+func (e damagedError) Error() string {
+	return fmt.Sprintf("%s is damaged: %s", e.file, e.reason)
+}
+
+// damagedFiles collects the damaged files found during a run, so that
+// they're reported together at the end instead of being mixed in with
+// other errors.
+type damagedFiles struct {
+	mu    sync.Mutex
+	files []damagedError
+}
+
+var damaged damagedFiles
+
+func (d *damagedFiles) Add(e damagedError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files = append(d.files, e)
+}
+
+// Len returns the number of damaged files found so far.
+func (d *damagedFiles) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.files)
+}
+
+// Report logs every damaged file.
+func (d *damagedFiles) Report() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.files) == 0 {
+		return
+	}
+	log.Printf("%d damaged files were not organized:\n", len(d.files))
+	for _, e := range d.files {
+		log.Printf("\t%s: %s\n", e.file, e.reason)
+	}
+}
+
+// checkSize returns why data is too short to be a DICOM file, or "" if
+// it's not.
+func checkSize(data []byte) string {
+	switch {
+	case len(data) == 0:
+		return "empty file"
+	case len(data) < 132 && rawTransferSyntax(data) == "":
+		return fmt.Sprintf("only %d bytes, shorter than the 128 byte preamble and DICM prefix", len(data))
+	}
+	return ""
+}
+
+// checkElements returns why the elements of data can't be read, such as an
+// element whose length runs past the end of the file, or "" if they can.
+// It's only used to explain parser errors, since it doesn't check anything
+// beyond the element boundaries.
+func checkElements(data []byte) string {
+	if _, err := readDataset(data); err != nil {
+		return "truncated or corrupt: " + err.Error()
+	}
+	return ""
+}
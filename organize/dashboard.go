@@ -0,0 +1,251 @@
+package organize
+
+import (
+	"bytes"
+	"html/template"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How long the dashboard shows the same inventory before reading the
+// target directory again.
+const dashboardInventoryTTL = time.Minute
+
+var dashboardTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"bytes": func(n int64) string { return humanBytes(uint64(n)) },
+	"time":  func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dicomfmt: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+nav a { margin-right: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; vertical-align: middle; }
+td.n { text-align: right; }
+img { max-width: 64px; max-height: 64px; background: #000; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<nav><a href="/">Archive</a><a href="/runs">Runs</a></nav>
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "archive"}}{{template "header" .}}
+{{if .Error}}<p class="failed">{{.Error}}</p>{{end}}
+{{range .Inventory.Patients}}
+<h2>{{.PatientName}} ({{.PatientID}}) &mdash; {{bytes .Bytes}}</h2>
+{{range .Studies}}
+<h3>{{.StudyDate}} {{.StudyDescription}} &mdash; {{.Instances}} instances, {{bytes .Bytes}}</h3>
+<table>
+<tr><th></th><th>Series</th><th>Modality</th><th>Instances</th><th>Size</th></tr>
+{{range .Series}}<tr>
+<td><img src="/thumbnail?series={{.SeriesInstanceUID}}" alt=""></td>
+<td>{{.SeriesDescription}}</td>
+<td>{{.Modality}}</td>
+<td class="n">{{.Instances}}</td>
+<td class="n">{{bytes .Bytes}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+{{else}}<p>The archive is empty.</p>{{end}}
+</body>
+</html>
+{{end}}
+
+{{define "runs"}}{{template "header" .}}
+{{if .Error}}<p class="failed">{{.Error}}</p>{{end}}
+<table>
+<tr><th>Finished</th><th>Event</th><th>Status</th><th>Host</th><th>Series</th><th>Files</th><th>Size</th><th>Not organized</th><th>Parse failures</th><th>Damaged</th></tr>
+{{range .Runs}}<tr{{if ne .Status "completed"}} class="failed"{{end}}>
+<td>{{time .Finished}}</td>
+<td>{{.Event}}</td>
+<td>{{.Status}}</td>
+<td>{{.Host}}</td>
+<td class="n">{{.Series}}</td>
+<td class="n">{{.Files}}</td>
+<td class="n">{{bytes .Bytes}}</td>
+<td class="n">{{.Failed}}</td>
+<td class="n">{{.ParseFailures}}</td>
+<td class="n">{{.Damaged}}</td>
+</tr>
+{{if or .Errors .Warnings}}<tr><td></td><td colspan="9">
+{{if .Warnings}}<details><summary>{{len .Warnings}} limits exceeded</summary><ul>{{range .Warnings}}<li>{{.}}</li>{{end}}</ul></details>{{end}}
+{{if .Errors}}<details><summary>{{len .Errors}} files not organized</summary><ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul></details>{{end}}
+</td></tr>{{end}}
+{{else}}<tr><td colspan="10">No runs have been recorded.</td></tr>{{end}}
+</table>
+</body>
+</html>
+{{end}}
+`))
+
+// A dashboard is a web UI showing the patients, studies and series in an
+// organized tree, and the history of the runs which organized it, for
+// people who don't use the command line.
+type dashboard struct {
+	dir     string
+	history string
+
+	mu         sync.Mutex
+	inv        *inventory
+	loaded     time.Time
+	thumbnails map[string][]byte
+}
+
+// Inventory returns the inventory of the target directory, reading it
+// again if it's older than dashboardInventoryTTL.
+func (d *dashboard) Inventory() (*inventory, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inv != nil && time.Since(d.loaded) < dashboardInventoryTTL {
+		return d.inv, nil
+	}
+	inv, err := takeInventory(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	d.inv, d.loaded = inv, time.Now()
+	d.thumbnails = make(map[string][]byte)
+	return inv, nil
+}
+
+// Thumbnail returns a PNG thumbnail of a series.
+func (d *dashboard) Thumbnail(series string) ([]byte, error) {
+	inv, err := d.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	b, ok := d.thumbnails[series]
+	d.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+	var file string
+	for _, p := range inv.Patients {
+		for _, st := range p.Studies {
+			for _, se := range st.Series {
+				if se.SeriesInstanceUID == series {
+					file = se.file
+				}
+			}
+		}
+	}
+	if file == "" {
+		return nil, os.ErrNotExist
+	}
+	img, err := thumbnail(file)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.thumbnails[series] = buf.Bytes()
+	d.mu.Unlock()
+	return buf.Bytes(), nil
+}
+
+func (d *dashboard) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Println(err)
+	}
+}
+
+// Handler returns the handler for the dashboard's pages. The same
+// information is available as JSON at /api/archive and /api/runs.
+func (d *dashboard) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page := struct {
+			Title     string
+			Inventory *inventory
+			Error     error
+		}{Title: "Archive: " + d.dir}
+		if page.Inventory, page.Error = d.Inventory(); page.Error != nil {
+			log.Println(page.Error)
+			page.Inventory = &inventory{}
+		}
+		d.render(w, "archive", page)
+	})
+	mux.HandleFunc("/runs", func(w http.ResponseWriter, r *http.Request) {
+		page := struct {
+			Title string
+			Runs  []runRecord
+			Error error
+		}{Title: "Runs"}
+		if page.Runs, page.Error = readRunHistory(d.history); page.Error != nil {
+			log.Println(page.Error)
+		}
+		d.render(w, "runs", page)
+	})
+	mux.HandleFunc("/thumbnail", func(w http.ResponseWriter, r *http.Request) {
+		b, err := d.Thumbnail(r.URL.Query().Get("series"))
+		if err != nil {
+			if verbose && !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(b)
+	})
+	mux.HandleFunc("/api/archive", func(w http.ResponseWriter, r *http.Request) {
+		inv, err := d.Inventory()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, inv)
+	})
+	mux.HandleFunc("/api/runs", func(w http.ResponseWriter, r *http.Request) {
+		runs, err := readRunHistory(d.history)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if runs == nil {
+			runs = []runRecord{}
+		}
+		writeJSON(w, runs)
+	})
+	return mux
+}
+
+func serveDashboard(addr, dir, history string, auth *ServerAuth) {
+	d := &dashboard{dir: dir, history: history}
+	auth.Serve(addr, auth.Require(scopeRead, d.Handler()))
+}
+
+// ServeDashboard serves the dashboard for the target directory dir on
+// addr, without organizing anything, showing the runs recorded in the run
+// history at history, or DefaultRunHistory in dir if it's empty. It only
+// returns if the server fails.
+func ServeDashboard(addr, dir, history string, auth *ServerAuth) error {
+	if err := auth.Load(); err != nil {
+		return err
+	}
+	if history == "" {
+		history = filepath.Join(dir, DefaultRunHistory)
+	}
+	d := &dashboard{dir: dir, history: history}
+	return auth.ListenAndServe(&http.Server{Addr: addr, Handler: auth.Require(scopeRead, d.Handler())})
+}
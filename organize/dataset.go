@@ -0,0 +1,418 @@
+package organize
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Transfer syntaxes which change the way that elements are encoded. Any
+// other transfer syntax only affects the pixel data, and the dataset itself
+// is encoded as explicit VR little endian.
+const (
+	implicitVRLittleEndian         = "1.2.840.10008.1.2"
+	explicitVRLittleEndian         = "1.2.840.10008.1.2.1"
+	deflatedExplicitVRLittleEndian = "1.2.840.10008.1.2.1.99"
+	explicitVRBigEndian            = "1.2.840.10008.1.2.2"
+)
+
+const undefinedLength = 0xFFFFFFFF
+
+// A tag identifies an element in a dataset.
+type tag struct {
+	Group, Element uint16
+}
+
+func (t tag) String() string {
+	return fmt.Sprintf("(%04X,%04X)", t.Group, t.Element)
+}
+
+var (
+	itemTag           = tag{0xFFFE, 0xE000}
+	itemDelimTag      = tag{0xFFFE, 0xE00D}
+	seqDelimTag       = tag{0xFFFE, 0xE0DD}
+	transferSyntaxTag = tag{0x0002, 0x0010}
+)
+
+// An encoding describes how the elements of (part of) a dataset are
+// written.
+type encoding struct {
+	explicit bool
+	order    binary.ByteOrder
+}
+
+var metaEncoding = encoding{true, binary.LittleEndian}
+
+func encodingFor(transferSyntax string) encoding {
+	switch transferSyntax {
+	case implicitVRLittleEndian, "":
+		return encoding{false, binary.LittleEndian}
+	case explicitVRBigEndian:
+		return encoding{true, binary.BigEndian}
+	default:
+		return encoding{true, binary.LittleEndian}
+	}
+}
+
+// longVR reports whether the VR uses a 4 byte length in explicit VR
+// encodings.
+func longVR(vr string) bool {
+	switch vr {
+	case "OB", "OD", "OF", "OL", "OV", "OW", "SQ", "SV", "UC", "UN", "UR", "UT", "UV":
+		return true
+	}
+	return false
+}
+
+// An element is a single top level element of a dataset. Value holds the
+// value bytes exactly as they were encoded, so that elements that aren't
+// modified are written back out unchanged. For undefined length elements,
+// Value includes the items and the trailing sequence delimitation item.
+type element struct {
+	Tag       tag
+	VR        string
+	Undefined bool
+	Value     []byte
+}
+
+// A dataset is a low level view of a DICOM file, which only decodes enough
+// to find the boundaries of top level elements. It's used where files need
+// to be rewritten, which the go-dicom parser can't do.
+type dataset struct {
+	// The 128 byte preamble and DICM prefix, or nil if the file
+	// didn't have one.
+	Preamble []byte
+
+	Meta           []element
+	TransferSyntax string
+	Elements       []element
+}
+
+// An elementReader reads consecutive elements from a buffer.
+type elementReader struct {
+	data []byte
+	off  int
+	enc  encoding
+	// How many sequences the elements being read are nested in.
+	depth int
+}
+
+// The deepest that sequences can be nested in files that are read. Real
+// files rarely nest more than a few levels, while a corrupt file nesting
+// millions of them would otherwise exhaust the stack.
+const maxSequenceDepth = 64
+
+// The largest that the dataset of a deflated file can be once it's
+// inflated, so that a corrupt or malicious file can't exhaust memory.
+const maxInflatedSize = 1 << 30
+
+func (r *elementReader) more() bool {
+	return r.off < len(r.data)
+}
+
+func (r *elementReader) need(n int) error {
+	if r.off+n > len(r.data) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (r *elementReader) peekTag() (tag, error) {
+	if err := r.need(4); err != nil {
+		return tag{}, err
+	}
+	return tag{
+		r.enc.order.Uint16(r.data[r.off:]),
+		r.enc.order.Uint16(r.data[r.off+2:]),
+	}, nil
+}
+
+// header reads the tag, VR and length of the next element.
+func (r *elementReader) header() (tag, string, uint32, error) {
+	t, err := r.peekTag()
+	if err != nil {
+		return t, "", 0, err
+	}
+	r.off += 4
+	if !r.enc.explicit || t.Group == 0xFFFE {
+		if err := r.need(4); err != nil {
+			return t, "", 0, err
+		}
+		length := r.enc.order.Uint32(r.data[r.off:])
+		r.off += 4
+		return t, "", length, nil
+	}
+	if err := r.need(4); err != nil {
+		return t, "", 0, err
+	}
+	vr := string(r.data[r.off : r.off+2])
+	r.off += 2
+	if longVR(vr) {
+		if err := r.need(6); err != nil {
+			return t, vr, 0, err
+		}
+		length := r.enc.order.Uint32(r.data[r.off+2:])
+		r.off += 6
+		return t, vr, length, nil
+	}
+	length := uint32(r.enc.order.Uint16(r.data[r.off:]))
+	r.off += 2
+	return t, vr, length, nil
+}
+
+// next reads the next element, including the contents of any nested
+// sequence.
+func (r *elementReader) next() (element, error) {
+	t, vr, length, err := r.header()
+	if err != nil {
+		return element{Tag: t}, err
+	}
+	el := element{Tag: t, VR: vr}
+	start := r.off
+	if length == undefinedLength {
+		el.Undefined = true
+		if err := r.skipUndefined(vr); err != nil {
+			return el, fmt.Errorf("%v: %v", t, err)
+		}
+	} else {
+		if uint64(r.off)+uint64(length) > uint64(len(r.data)) {
+			return el, fmt.Errorf("%v: length %d runs past end of data", t, length)
+		}
+		r.off += int(length)
+	}
+	el.Value = r.data[start:r.off]
+	return el, nil
+}
+
+// skipUndefined advances past the items of an undefined length element,
+// up to and including its sequence delimitation item.
+func (r *elementReader) skipUndefined(vr string) error {
+	if r.depth >= maxSequenceDepth {
+		return fmt.Errorf("sequences nested more than %d deep", maxSequenceDepth)
+	}
+	sub := &elementReader{data: r.data, off: r.off, enc: r.enc, depth: r.depth + 1}
+	if vr == "UN" {
+		// The contents of an undefined length UN are always
+		// implicit VR little endian.
+		sub.enc = encoding{false, binary.LittleEndian}
+	}
+	for {
+		t, _, length, err := sub.header()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case seqDelimTag:
+			r.off = sub.off
+			return nil
+		case itemTag:
+			if length != undefinedLength {
+				if uint64(sub.off)+uint64(length) > uint64(len(sub.data)) {
+					return fmt.Errorf("item length %d runs past end of data", length)
+				}
+				sub.off += int(length)
+				continue
+			}
+			for {
+				next, err := sub.peekTag()
+				if err != nil {
+					return err
+				}
+				if next == itemDelimTag {
+					if _, _, _, err := sub.header(); err != nil {
+						return err
+					}
+					break
+				}
+				if _, err := sub.next(); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected %v in sequence", t)
+		}
+	}
+}
+
+// readDataset splits the encoded file data into its top level elements.
+func readDataset(data []byte) (*dataset, error) {
+	ds, _, err := readDatasetUntil(data, 0)
+	return ds, err
+}
+
+// readDatasetUntil splits the encoded file data into its top level
+// elements, stopping before the first element in group stop or a later
+// group if stop isn't zero. It returns the offset in data that it stopped
+// at, so that the rest of a large file can be copied without reading it.
+// Deflated datasets can't be split.
+func readDatasetUntil(data []byte, stop uint16) (*dataset, int, error) {
+	ds := &dataset{}
+	start := 0
+	if len(data) >= 132 && string(data[128:132]) == "DICM" {
+		ds.Preamble = data[:132]
+		start = 132
+	}
+
+	r := &elementReader{data: data[start:], enc: metaEncoding}
+	for r.more() {
+		t, err := r.peekTag()
+		if err != nil {
+			return nil, 0, err
+		}
+		if t.Group != 0x0002 {
+			break
+		}
+		el, err := r.next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if el.Tag == transferSyntaxTag {
+			ds.TransferSyntax = string(bytes.TrimRight(el.Value, " \x00"))
+		}
+		ds.Meta = append(ds.Meta, el)
+	}
+	if len(ds.Meta) == 0 {
+		ds.TransferSyntax = rawTransferSyntax(data[start:])
+	}
+	start += r.off
+
+	body := data[start:]
+	if ds.TransferSyntax == deflatedExplicitVRLittleEndian {
+		if stop != 0 {
+			return nil, 0, errors.New("deflated datasets can't be split")
+		}
+		inflated, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(body)), maxInflatedSize+1))
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(inflated) > maxInflatedSize {
+			return nil, 0, fmt.Errorf("deflated dataset is larger than %d bytes", maxInflatedSize)
+		}
+		body = inflated
+	}
+
+	r = &elementReader{data: body, enc: encodingFor(ds.TransferSyntax)}
+	for r.more() {
+		if stop != 0 {
+			if t, err := r.peekTag(); err == nil && t.Group >= stop {
+				break
+			}
+		}
+		el, err := r.next()
+		if err != nil {
+			return nil, 0, err
+		}
+		ds.Elements = append(ds.Elements, el)
+	}
+	return ds, start + r.off, nil
+}
+
+// encodedLen returns the number of bytes that el takes up when encoded.
+func encodedLen(el element, enc encoding) int {
+	if enc.explicit && el.Tag.Group != 0xFFFE && longVR(el.VR) {
+		return 12 + len(el.Value)
+	}
+	return 8 + len(el.Value)
+}
+
+func appendElement(b []byte, el element, enc encoding) []byte {
+	var scratch [4]byte
+	enc.order.PutUint16(scratch[:], el.Tag.Group)
+	enc.order.PutUint16(scratch[2:], el.Tag.Element)
+	b = append(b, scratch[:]...)
+
+	length := uint32(len(el.Value))
+	if el.Undefined {
+		length = undefinedLength
+	}
+	switch {
+	case !enc.explicit || el.Tag.Group == 0xFFFE:
+		enc.order.PutUint32(scratch[:], length)
+		b = append(b, scratch[:]...)
+	case longVR(el.VR):
+		b = append(b, el.VR...)
+		b = append(b, 0, 0)
+		enc.order.PutUint32(scratch[:], length)
+		b = append(b, scratch[:]...)
+	default:
+		b = append(b, el.VR...)
+		enc.order.PutUint16(scratch[:], uint16(length))
+		b = append(b, scratch[:2]...)
+	}
+	return append(b, el.Value...)
+}
+
+// fixGroupLengths updates any group length elements to match the size of
+// the remaining elements in their group.
+func fixGroupLengths(elements []element, enc encoding) {
+	for i, el := range elements {
+		if el.Tag.Element != 0x0000 || el.Tag.Group == 0xFFFE {
+			continue
+		}
+		var length int
+		for _, other := range elements[i+1:] {
+			if other.Tag.Group != el.Tag.Group {
+				break
+			}
+			length += encodedLen(other, enc)
+		}
+		value := make([]byte, 4)
+		enc.order.PutUint32(value, uint32(length))
+		elements[i].Value = value
+	}
+}
+
+// removeGroups removes every top level element whose group matches the
+// predicate, returning the number of elements removed.
+func (ds *dataset) removeGroups(match func(group uint16) bool) int {
+	kept := ds.Elements[:0]
+	for _, el := range ds.Elements {
+		if !match(el.Tag.Group) {
+			kept = append(kept, el)
+		}
+	}
+	removed := len(ds.Elements) - len(kept)
+	ds.Elements = kept
+	return removed
+}
+
+// WriteTo encodes the dataset to w, recalculating any group lengths.
+func (ds *dataset) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	buf = append(buf, ds.Preamble...)
+
+	fixGroupLengths(ds.Meta, metaEncoding)
+	for _, el := range ds.Meta {
+		buf = append(buf, appendElement(nil, el, metaEncoding)...)
+	}
+
+	enc := encodingFor(ds.TransferSyntax)
+	fixGroupLengths(ds.Elements, enc)
+	var body []byte
+	for _, el := range ds.Elements {
+		body = appendElement(body, el, enc)
+	}
+
+	if ds.TransferSyntax == deflatedExplicitVRLittleEndian {
+		var deflated bytes.Buffer
+		fw, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := fw.Write(body); err != nil {
+			return 0, err
+		}
+		if err := fw.Close(); err != nil {
+			return 0, err
+		}
+		body = deflated.Bytes()
+	}
+	buf = append(buf, body...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
@@ -0,0 +1,110 @@
+package organize
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDatasetRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		transferSyntax string
+	}{
+		{"implicit VR little endian", implicitVRLittleEndian},
+		{"explicit VR little endian", explicitVRLittleEndian},
+		{"deflated explicit VR little endian", deflatedExplicitVRLittleEndian},
+		{"explicit VR big endian", explicitVRBigEndian},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &dataset{TransferSyntax: tt.transferSyntax}
+			set := func(name, vr, v string) {
+				value, err := ds.encodeValue(vr, v)
+				if err != nil {
+					t.Fatalf("encoding %s: %v", name, err)
+				}
+				ds.setElement(element{Tag: tagDictionary[name], VR: vr, Value: value})
+			}
+			set("SOPClassUID", "UI", "1.2.840.10008.5.1.4.1.1.7")
+			set("SOPInstanceUID", "UI", "1.2.3.4")
+			set("PatientName", "PN", "DOE^JANE")
+			set("Rows", "US", "512")
+			set("SeriesNumber", "IS", "3")
+			// Group lengths are recalculated whatever they're set to.
+			ds.setElement(element{Tag: tag{0x0008, 0x0000}, VR: "UL", Value: make([]byte, 4)})
+			ds.setFileMeta()
+
+			var buf bytes.Buffer
+			if _, err := ds.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readDataset(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.TransferSyntax != tt.transferSyntax {
+				t.Errorf("transfer syntax %s, want %s", got.TransferSyntax, tt.transferSyntax)
+			}
+			if len(got.Elements) != len(ds.Elements) {
+				t.Fatalf("read %d elements, want %d", len(got.Elements), len(ds.Elements))
+			}
+			for i, el := range ds.Elements {
+				g := got.Elements[i]
+				if g.Tag != el.Tag || !bytes.Equal(g.Value, el.Value) {
+					t.Errorf("element %d is %s %x, want %s %x", i, g.Tag, g.Value, el.Tag, el.Value)
+				}
+			}
+
+			// Each group length is the encoded length of the rest of
+			// its group.
+			for _, c := range []struct {
+				elements []element
+				enc      encoding
+			}{
+				{got.Meta, metaEncoding},
+				{got.Elements, encodingFor(got.TransferSyntax)},
+			} {
+				for i, el := range c.elements {
+					if el.Tag.Element != 0 {
+						continue
+					}
+					want := 0
+					for _, other := range c.elements[i+1:] {
+						if other.Tag.Group != el.Tag.Group {
+							break
+						}
+						want += encodedLen(other, c.enc)
+					}
+					if n := int(c.enc.order.Uint32(el.Value)); n != want {
+						t.Errorf("group %04X length %d, want %d", el.Tag.Group, n, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadDatasetTruncated(t *testing.T) {
+	data := synthBytes(t, "PatientName=DOE^JANE")
+	// Cut the file off in the middle of the last element.
+	if _, err := readDataset(data[:len(data)-3]); err == nil {
+		t.Error("reading a truncated file succeeded")
+	}
+}
+
+func FuzzReadDataset(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ds, err := readDataset(data)
+		if err != nil {
+			return
+		}
+		// Anything that can be read can be written back out.
+		var buf bytes.Buffer
+		if _, err := ds.WriteTo(&buf); err != nil {
+			t.Errorf("writing a dataset that was read: %v", err)
+		}
+	})
+}
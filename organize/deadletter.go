@@ -0,0 +1,159 @@
+package organize
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons that a file is put in the dead letter list.
+const (
+	deadParseError   = "parse-error"
+	deadDamaged      = "damaged"
+	deadParserCrash  = "parser-crash"
+	deadTimeout      = "timeout"
+	deadCopyFailed   = "copy-failed"
+	deadTrashFailed  = "trash-failed"
+	deadDeleteFailed = "delete-source-failed"
+	deadNoTagRules   = "tag-rules-missing"
+)
+
+// A deadLetterEntry is a file which couldn't be organized.
+type deadLetterEntry struct {
+	File string `json:"file"`
+	// One of the dead* reasons, saying what step failed.
+	Reason string `json:"reason"`
+	// The kind of error, if it's one that can be fixed without
+	// changing the file: permission, no-space or not-found.
+	Cause string    `json:"cause,omitempty"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// A deadLetter is every file that failed during a run, along with why,
+// so that they can be re-attempted with "dicomfmt retry" once whatever
+// caused them to fail (such as permissions or a full disk) is fixed. It's
+// written to a JSON file at the end of the run.
+type deadLetter struct {
+	Target string            `json:"target"`
+	Move   bool              `json:"move,omitempty"`
+	Files  []deadLetterEntry `json:"files"`
+
+	// The file that the list is written to.
+	path string
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// The dead letter list for this run, or nil if -dead-letter wasn't given.
+var deadLetters *deadLetter
+
+// failureCause returns the cause of err for a deadLetterEntry.
+func failureCause(err error) string {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return "permission"
+	case isNoSpace(err):
+		return "no-space"
+	case errors.Is(err, os.ErrNotExist):
+		return "not-found"
+	}
+	return ""
+}
+
+// Add records that file failed for reason. A file is only recorded once,
+// for the first failure. It's safe to call on a nil deadLetter.
+func (d *deadLetter) Add(file FileName, reason string, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string]bool)
+	}
+	if d.seen[file.String()] {
+		return
+	}
+	d.seen[file.String()] = true
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	d.Files = append(d.Files, deadLetterEntry{
+		File:   file.String(),
+		Reason: reason,
+		Cause:  failureCause(err),
+		Error:  msg,
+		Time:   clock(),
+	})
+}
+
+// Write writes the list to its file, replacing it. An empty list is still
+// written, so that one left by an earlier run isn't retried again.
+func (d *deadLetter) Write() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Files == nil {
+		d.Files = []deadLetterEntry{}
+	}
+	sort.SliceStable(d.Files, func(i, j int) bool { return d.Files[i].File < d.Files[j].File })
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(d.path), ".deadletter")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), d.path); err != nil {
+		return err
+	}
+	if len(d.Files) > 0 {
+		log.Printf("The %d files that failed were listed in %s. Run %s retry %s to try them again.\n", len(d.Files), d.path, os.Args[0], d.path)
+	}
+	return nil
+}
+
+// readDeadLetter reads a dead letter list written by an earlier run.
+func readDeadLetter(path string) (*deadLetter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var d deadLetter
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if d.Target == "" {
+		return nil, fmt.Errorf("%s: dead letter list has no target", path)
+	}
+	return &d, nil
+}
+
+// FileNames returns the files in the list.
+func (d *deadLetter) FileNames() []FileName {
+	files := make([]FileName, 0, len(d.Files))
+	for _, e := range d.Files {
+		files = append(files, FileName(e.File))
+	}
+	return files
+}
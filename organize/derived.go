@@ -0,0 +1,30 @@
+package organize
+
+import (
+	"strings"
+)
+
+// isDerived reports whether an ImageType value marks an image as derived
+// from other images, such as a reformat, MIP or dose screen capture,
+// rather than being an original acquisition: its first value is DERIVED
+// or its second value is SECONDARY.
+func isDerived(imageType string) bool {
+	values := strings.Split(imageType, `\`)
+	if strings.ToUpper(strings.TrimSpace(values[0])) == "DERIVED" {
+		return true
+	}
+	return len(values) > 1 && strings.ToUpper(strings.TrimSpace(values[1])) == "SECONDARY"
+}
+
+// derivedLayout returns the layout that derived images are placed in with
+// -derived-subdir, which puts them in the directory dir next to the series
+// directories of their study: dir is inserted before the series directory
+// of layout, or after the last directory of a flattened layout, which has
+// no series directories.
+func derivedLayout(layout, dir string, flattened bool) string {
+	if flattened {
+		return layout + "/" + dir
+	}
+	i := strings.LastIndexByte(layout, '/')
+	return layout[:i+1] + dir + "/" + layout[i+1:]
+}
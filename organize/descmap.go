@@ -0,0 +1,59 @@
+package organize
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A descriptionRule renames series whose SeriesDescription matches Pattern.
+type descriptionRule struct {
+	Pattern *regexp.Regexp
+	Name    string
+}
+
+// A descriptionMap normalizes the many ways that the same kind of series
+// is described, so that AX T1 SE, t1_ax and T1 AXIAL can all be organized
+// into a single T1_AX directory. It's read from a file in the same format
+// as the config file, where each key is a regular expression and each
+// value is the name that matching descriptions are replaced with:
+//
+//	"^(ax|axial)[ _]t1|^t1[ _](ax|axial)" = "T1_AX"
+//	"^t2[ _]flair" = "T2_FLAIR"
+//
+// Patterns are case insensitive, and are tried in the order they're
+// listed. Names can refer to groups in the pattern, such as $1.
+type descriptionMap []descriptionRule
+
+func loadDescriptionMap(path string) (descriptionMap, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	table := cfg.Table("", "")
+	var m descriptionMap
+	for _, pattern := range cfg.Keys("", "") {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		values := table[pattern]
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%s: %s must map to a single name", path, pattern)
+		}
+		m = append(m, descriptionRule{re, values[0]})
+	}
+	return m, nil
+}
+
+// Normalize returns the canonical name for a SeriesDescription, or the
+// description unchanged if it doesn't match any rule.
+func (m descriptionMap) Normalize(description string) string {
+	d := strings.TrimSpace(description)
+	for _, rule := range m {
+		if match := rule.Pattern.FindStringSubmatchIndex(d); match != nil {
+			return string(rule.Pattern.ExpandString(nil, rule.Name, d, match))
+		}
+	}
+	return description
+}
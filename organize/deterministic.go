@@ -0,0 +1,63 @@
+package organize
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// clock returns the time that's recorded in manifests, journals, audit
+// logs and summaries. Timers, such as -study-settle and -watch, always use
+// the real time.
+var clock = time.Now
+
+// idSource is where generated names, such as those of uploads received
+// without one, come from.
+var idSource io.Reader = rand.Reader
+
+// sequence is an io.Reader of a counter, for generating names which are
+// the same on every run.
+type sequence struct {
+	n uint64
+}
+
+// Read fills b with the next value of the counter, repeated.
+func (s *sequence) Read(b []byte) (int, error) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], atomic.AddUint64(&s.n, 1))
+	for i := range b {
+		b[i] = buf[i%8]
+	}
+	return len(b), nil
+}
+
+// setDeterministic makes everything that would otherwise differ between
+// runs with the same input the same, for golden file tests. The clock is
+// stopped at SOURCE_DATE_EPOCH, if it's set, or else the start of 2000, and
+// names are generated from a counter. Encryption still uses random salts,
+// since reusing them would be insecure.
+func setDeterministic() {
+	t := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		t = time.Unix(epoch, 0).UTC()
+	}
+	clock = func() time.Time { return t }
+	idSource = &sequence{}
+}
+
+// sortedUIDs returns the SeriesInstanceUIDs of the series in a map in
+// order, so that series are always organized and reported in the same
+// order.
+func sortedUIDs(series map[SeriesInstanceUID]SeriesFiles) []SeriesInstanceUID {
+	uids := make([]SeriesInstanceUID, 0, len(series))
+	for uid := range series {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
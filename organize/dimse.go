@@ -0,0 +1,773 @@
+package organize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file implements enough of the DICOM upper layer protocol (PS3.8)
+// and of DIMSE (PS3.7) to query and retrieve studies from a PACS, to
+// receive the instances that it sends, and to answer the same requests
+// from viewers.
+
+// The types of PDU.
+const (
+	pduAssociateRQ = 0x01
+	pduAssociateAC = 0x02
+	pduAssociateRJ = 0x03
+	pduData        = 0x04
+	pduReleaseRQ   = 0x05
+	pduReleaseRP   = 0x06
+	pduAbort       = 0x07
+)
+
+const (
+	applicationContextUID = "1.2.840.10008.3.1.1.1"
+	verificationUID       = "1.2.840.10008.1.1"
+	studyRootFindUID      = "1.2.840.10008.5.1.4.1.2.2.1"
+	studyRootMoveUID      = "1.2.840.10008.5.1.4.1.2.2.2"
+	studyRootGetUID       = "1.2.840.10008.5.1.4.1.2.2.3"
+	patientRootFindUID    = "1.2.840.10008.5.1.4.1.2.1.1"
+	patientRootMoveUID    = "1.2.840.10008.5.1.4.1.2.1.2"
+	patientRootGetUID     = "1.2.840.10008.5.1.4.1.2.1.3"
+)
+
+// The largest PDU that's accepted from a peer, which is also the largest
+// P-DATA-TF PDU that peers are asked to send.
+const maxPDULength = 256 << 10
+
+// The largest command or identifier that's accepted from a peer.
+const maxIdentifierLength = 1 << 20
+
+// How long to wait for a peer to send or accept each PDU. A C-MOVE can
+// go a long time between responses while the instances are sent, so this
+// is generous.
+var dimseTimeout = 10 * time.Minute
+
+// The results of proposing a presentation context.
+const (
+	contextAccepted                     = 0
+	contextAbstractSyntaxNotSupported   = 3
+	contextTransferSyntaxesNotSupported = 4
+)
+
+// DIMSE command fields.
+const (
+	cStoreRQ  = 0x0001
+	cStoreRSP = 0x8001
+	cGetRQ    = 0x0010
+	cGetRSP   = 0x8010
+	cFindRQ   = 0x0020
+	cFindRSP  = 0x8020
+	cMoveRQ   = 0x0021
+	cMoveRSP  = 0x8021
+	cEchoRQ   = 0x0030
+	cEchoRSP  = 0x8030
+	cCancelRQ = 0x0FFF
+)
+
+// DIMSE statuses.
+const (
+	statusSuccess         = 0x0000
+	statusPending         = 0xFF00
+	statusPendingWarning  = 0xFF01
+	statusCancel          = 0xFE00
+	statusSubopsFailed    = 0xB000
+	statusNotAuthorized   = 0x0124
+	statusOutOfResources  = 0xA700
+	statusCantStartSubops = 0xA702
+	statusUnknownMoveDest = 0xA801
+	statusIdentifierError = 0xA900
+	statusUnableToProcess = 0xC000
+)
+
+// The command data set type of commands which aren't followed by a data
+// set.
+const noDataSet = 0x0101
+
+// The elements of a command set.
+var (
+	cmdAffectedSOPClass    = tag{0x0000, 0x0002}
+	cmdField               = tag{0x0000, 0x0100}
+	cmdMessageID           = tag{0x0000, 0x0110}
+	cmdRespondedTo         = tag{0x0000, 0x0120}
+	cmdMoveDestination     = tag{0x0000, 0x0600}
+	cmdPriority            = tag{0x0000, 0x0700}
+	cmdDataSetType         = tag{0x0000, 0x0800}
+	cmdStatus              = tag{0x0000, 0x0900}
+	cmdErrorComment        = tag{0x0000, 0x0902}
+	cmdAffectedSOPInstance = tag{0x0000, 0x1000}
+	cmdRemaining           = tag{0x0000, 0x1020}
+	cmdCompleted           = tag{0x0000, 0x1021}
+	cmdFailed              = tag{0x0000, 0x1022}
+	cmdWarning             = tag{0x0000, 0x1023}
+	cmdMoveOriginatorAE    = tag{0x0000, 0x1030}
+	cmdMoveOriginatorID    = tag{0x0000, 0x1031}
+)
+
+var queryRetrieveLevelTag = tag{0x0008, 0x0052}
+
+// errReleased is returned when the peer releases the association instead
+// of sending the next message.
+var errReleased = errors.New("the association was released")
+
+// A presentationContext is an abstract syntax, such as a SOP class, and
+// the transfer syntaxes proposed for it, or the one that was accepted.
+type presentationContext struct {
+	ID               byte
+	AbstractSyntax   string
+	TransferSyntaxes []string
+	Result           byte
+}
+
+// TransferSyntax returns the accepted transfer syntax of the context.
+func (pc presentationContext) TransferSyntax() string {
+	if len(pc.TransferSyntaxes) == 0 {
+		return ""
+	}
+	return pc.TransferSyntaxes[0]
+}
+
+// An associatePDU is an A-ASSOCIATE-RQ or A-ASSOCIATE-AC PDU.
+type associatePDU struct {
+	Called, Calling string
+	Contexts        []presentationContext
+	MaxPDU          uint32
+	// The abstract syntaxes that the requestor proposes to be the SCP
+	// of, which is how it receives the instances of a C-GET. In an
+	// A-ASSOCIATE-AC, the ones that were accepted.
+	SCPRoles []string
+}
+
+func appendItem(b []byte, typ byte, contents []byte) []byte {
+	b = append(b, typ, 0, byte(len(contents)>>8), byte(len(contents)))
+	return append(b, contents...)
+}
+
+// aeTitle pads an AE title to the 16 bytes it takes up in a PDU.
+func aeTitle(ae string) []byte {
+	b := bytes.Repeat([]byte{' '}, 16)
+	copy(b, ae)
+	return b
+}
+
+func (p *associatePDU) encode(ac bool) []byte {
+	b := []byte{0, 1, 0, 0}
+	b = append(b, aeTitle(p.Called)...)
+	b = append(b, aeTitle(p.Calling)...)
+	b = append(b, make([]byte, 32)...)
+	b = appendItem(b, 0x10, []byte(applicationContextUID))
+	for _, pc := range p.Contexts {
+		if ac {
+			sub := []byte{pc.ID, 0, pc.Result, 0}
+			sub = appendItem(sub, 0x40, []byte(pc.TransferSyntax()))
+			b = appendItem(b, 0x21, sub)
+			continue
+		}
+		sub := []byte{pc.ID, 0, 0, 0}
+		sub = appendItem(sub, 0x30, []byte(pc.AbstractSyntax))
+		for _, ts := range pc.TransferSyntaxes {
+			sub = appendItem(sub, 0x40, []byte(ts))
+		}
+		b = appendItem(b, 0x20, sub)
+	}
+	var max [4]byte
+	binary.BigEndian.PutUint32(max[:], p.MaxPDU)
+	user := appendItem(nil, 0x51, max[:])
+	user = appendItem(user, 0x52, []byte(implementationUID))
+	for _, uid := range p.SCPRoles {
+		role := []byte{byte(len(uid) >> 8), byte(len(uid))}
+		role = append(append(role, uid...), 0, 1)
+		user = appendItem(user, 0x54, role)
+	}
+	user = appendItem(user, 0x55, []byte("DICOMFMT"))
+	return appendItem(b, 0x50, user)
+}
+
+// nextItem splits the first item off of b.
+func nextItem(b []byte) (typ byte, contents, rest []byte, err error) {
+	if len(b) < 4 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) < 4+n {
+		return 0, nil, nil, fmt.Errorf("item of type %#x runs past the end of the PDU", b[0])
+	}
+	return b[0], b[4 : 4+n], b[4+n:], nil
+}
+
+func trimUID(b []byte) string {
+	return strings.TrimRight(string(b), " \x00")
+}
+
+func decodeAssociate(b []byte) (*associatePDU, error) {
+	if len(b) < 68 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	p := &associatePDU{
+		Called:  strings.TrimSpace(string(b[4:20])),
+		Calling: strings.TrimSpace(string(b[20:36])),
+	}
+	for items := b[68:]; len(items) > 0; {
+		typ, contents, rest, err := nextItem(items)
+		if err != nil {
+			return nil, err
+		}
+		items = rest
+		switch typ {
+		case 0x20, 0x21:
+			if len(contents) < 4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			pc := presentationContext{ID: contents[0], Result: contents[2]}
+			for sub := contents[4:]; len(sub) > 0; {
+				typ, value, rest, err := nextItem(sub)
+				if err != nil {
+					return nil, err
+				}
+				sub = rest
+				switch typ {
+				case 0x30:
+					pc.AbstractSyntax = trimUID(value)
+				case 0x40:
+					pc.TransferSyntaxes = append(pc.TransferSyntaxes, trimUID(value))
+				}
+			}
+			p.Contexts = append(p.Contexts, pc)
+		case 0x50:
+			for sub := contents; len(sub) > 0; {
+				typ, value, rest, err := nextItem(sub)
+				if err != nil {
+					return nil, err
+				}
+				sub = rest
+				switch {
+				case typ == 0x51 && len(value) == 4:
+					p.MaxPDU = binary.BigEndian.Uint32(value)
+				case typ == 0x54 && len(value) >= 2:
+					n := int(binary.BigEndian.Uint16(value))
+					if len(value) == n+4 && value[n+3] == 1 {
+						p.SCPRoles = append(p.SCPRoles, trimUID(value[2:2+n]))
+					}
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// A pdv is a fragment of a command or data set.
+type pdv struct {
+	Context       byte
+	Command, Last bool
+	Data          []byte
+}
+
+// An association is an established DIMSE association with a peer.
+type association struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	Calling, Called string
+
+	// The largest P-DATA-TF PDU that the peer accepts, or 0 if it
+	// doesn't have a limit.
+	peerMax uint32
+	// The presentation contexts that were accepted, by ID.
+	contexts map[byte]presentationContext
+
+	// The PDVs left over from the last P-DATA-TF PDU.
+	pending   []pdv
+	messageID uint16
+}
+
+func newAssociation(conn net.Conn) *association {
+	return &association{conn: conn, r: bufio.NewReader(conn), contexts: make(map[byte]presentationContext)}
+}
+
+func (a *association) readPDU() (byte, []byte, error) {
+	a.conn.SetReadDeadline(time.Now().Add(dimseTimeout))
+	var hdr [6]byte
+	if _, err := io.ReadFull(a.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[2:])
+	if n > maxPDULength {
+		return 0, nil, fmt.Errorf("%s sent a PDU of %d bytes, more than the %d allowed", a.conn.RemoteAddr(), n, maxPDULength)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(a.r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
+
+func (a *association) writePDU(typ byte, body []byte) error {
+	a.conn.SetWriteDeadline(time.Now().Add(dimseTimeout))
+	b := make([]byte, 6, 6+len(body))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[2:], uint32(len(body)))
+	_, err := a.conn.Write(append(b, body...))
+	return err
+}
+
+// nextPDV returns the next PDV sent by the peer. If the peer releases the
+// association instead, the release is confirmed and errReleased is
+// returned.
+func (a *association) nextPDV() (pdv, error) {
+	for len(a.pending) == 0 {
+		typ, body, err := a.readPDU()
+		if err != nil {
+			return pdv{}, err
+		}
+		switch typ {
+		case pduData:
+		case pduReleaseRQ:
+			a.writePDU(pduReleaseRP, make([]byte, 4))
+			a.conn.Close()
+			return pdv{}, errReleased
+		case pduAbort:
+			a.conn.Close()
+			return pdv{}, fmt.Errorf("%s aborted the association", a.conn.RemoteAddr())
+		default:
+			a.Abort()
+			return pdv{}, fmt.Errorf("%s sent an unexpected PDU of type %#x", a.conn.RemoteAddr(), typ)
+		}
+		for len(body) > 0 {
+			if len(body) < 6 {
+				return pdv{}, io.ErrUnexpectedEOF
+			}
+			n := binary.BigEndian.Uint32(body)
+			if n < 2 || uint64(n) > uint64(len(body)-4) {
+				return pdv{}, fmt.Errorf("PDV of %d bytes runs past the end of the PDU", n)
+			}
+			a.pending = append(a.pending, pdv{
+				Context: body[4],
+				Command: body[5]&1 != 0,
+				Last:    body[5]&2 != 0,
+				Data:    body[6 : 4+n],
+			})
+			body = body[4+n:]
+		}
+	}
+	p := a.pending[0]
+	a.pending = a.pending[1:]
+	return p, nil
+}
+
+// A command is the command set of a DIMSE message, along with the
+// presentation context it was sent on.
+type command struct {
+	*dataset
+	Context byte
+}
+
+func newCommand(field uint16, context byte) *command {
+	c := &command{&dataset{TransferSyntax: implicitVRLittleEndian}, context}
+	c.setElement(element{Tag: tag{0x0000, 0x0000}, VR: "UL"})
+	c.setUS(cmdField, field)
+	return c
+}
+
+func (c *command) setUS(t tag, v uint16) {
+	value := make([]byte, 2)
+	binary.LittleEndian.PutUint16(value, v)
+	c.setElement(element{Tag: t, VR: "US", Value: value})
+}
+
+func (c *command) setString(t tag, vr, v string) {
+	value, _ := c.encodeValue(vr, v)
+	c.setElement(element{Tag: t, VR: vr, Value: value})
+}
+
+func (c *command) us(t tag) uint16 {
+	el, ok := c.element(t)
+	if !ok || len(el.Value) != 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(el.Value)
+}
+
+func (c *command) Field() uint16     { return c.us(cmdField) }
+func (c *command) MessageID() uint16 { return c.us(cmdMessageID) }
+func (c *command) Status() uint16    { return c.us(cmdStatus) }
+
+// HasData reports whether the command is followed by a data set.
+func (c *command) HasData() bool {
+	return c.us(cmdDataSetType) != noDataSet
+}
+
+// response returns the response to a request, with the given status.
+func (c *command) response(status uint16) *command {
+	rsp := newCommand(c.Field()|0x8000, c.Context)
+	rsp.setUS(cmdRespondedTo, c.MessageID())
+	if uid := c.stringValue(cmdAffectedSOPClass); uid != "" {
+		rsp.setString(cmdAffectedSOPClass, "UI", uid)
+	}
+	if uid := c.stringValue(cmdAffectedSOPInstance); uid != "" {
+		rsp.setString(cmdAffectedSOPInstance, "UI", uid)
+	}
+	rsp.setUS(cmdStatus, status)
+	return rsp
+}
+
+// NewRequest returns a request on the presentation context pc with the
+// next message ID.
+func (a *association) NewRequest(field uint16, pc presentationContext) *command {
+	a.messageID++
+	c := newCommand(field, pc.ID)
+	c.setString(cmdAffectedSOPClass, "UI", pc.AbstractSyntax)
+	c.setUS(cmdMessageID, a.messageID)
+	return c
+}
+
+// ReadCommand reads the next command from the peer.
+func (a *association) ReadCommand() (*command, error) {
+	var buf []byte
+	var context byte
+	for {
+		p, err := a.nextPDV()
+		if err != nil {
+			return nil, err
+		}
+		if !p.Command {
+			return nil, errors.New("received a data set where a command was expected")
+		}
+		if buf != nil && p.Context != context {
+			return nil, errors.New("a command was split across presentation contexts")
+		}
+		context = p.Context
+		if buf = append(buf, p.Data...); len(buf) > maxIdentifierLength {
+			return nil, fmt.Errorf("command is larger than %d bytes", maxIdentifierLength)
+		}
+		if p.Last {
+			break
+		}
+	}
+	if _, ok := a.contexts[context]; !ok {
+		return nil, fmt.Errorf("command sent on presentation context %d, which wasn't accepted", context)
+	}
+	ds, err := decodeIdentifier(buf, implicitVRLittleEndian)
+	if err != nil {
+		return nil, fmt.Errorf("reading command: %v", err)
+	}
+	return &command{ds, context}, nil
+}
+
+// ReadData copies the data set following command c to w.
+func (a *association) ReadData(c *command, w io.Writer) error {
+	for {
+		p, err := a.nextPDV()
+		if err != nil {
+			return err
+		}
+		if p.Command || p.Context != c.Context {
+			return errors.New("received a command where a data set was expected")
+		}
+		if _, err := w.Write(p.Data); err != nil {
+			return err
+		}
+		if p.Last {
+			return nil
+		}
+	}
+}
+
+// A cappedBuffer is a buffer which refuses to grow past max bytes.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, fmt.Errorf("data set is larger than %d bytes", b.max)
+	}
+	return b.Buffer.Write(p)
+}
+
+// ReadIdentifier reads the identifier following command c, such as the
+// keys of a query or one of its matches.
+func (a *association) ReadIdentifier(c *command) (*dataset, error) {
+	buf := &cappedBuffer{max: maxIdentifierLength}
+	if err := a.ReadData(c, buf); err != nil {
+		return nil, err
+	}
+	return decodeIdentifier(buf.Bytes(), a.contexts[c.Context].TransferSyntax())
+}
+
+// decodeIdentifier reads a data set without file meta information, which
+// is encoded with the transfer syntax ts.
+func decodeIdentifier(data []byte, ts string) (*dataset, error) {
+	ds := &dataset{TransferSyntax: ts}
+	r := &elementReader{data: data, enc: encodingFor(ts)}
+	for r.more() {
+		el, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		ds.Elements = append(ds.Elements, el)
+	}
+	return ds, nil
+}
+
+// send sends the contents of r as PDVs on a presentation context, split
+// to fit into the PDUs that the peer accepts.
+func (a *association) send(context byte, isCommand bool, r io.Reader) error {
+	size := int(a.peerMax)
+	if size == 0 || size > maxPDULength {
+		size = maxPDULength
+	}
+	size -= 6
+	br := bufio.NewReaderSize(r, size)
+	chunk := make([]byte, size)
+	for {
+		n, err := io.ReadFull(br, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			_, err := br.Peek(1)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			last = err == io.EOF
+		}
+		body := make([]byte, 6, 6+n)
+		binary.BigEndian.PutUint32(body, uint32(n+2))
+		body[4] = context
+		if isCommand {
+			body[5] |= 1
+		}
+		if last {
+			body[5] |= 2
+		}
+		if err := a.writePDU(pduData, append(body, chunk[:n]...)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Send sends a command, followed by a data set if data isn't nil.
+func (a *association) Send(c *command, data io.WriterTo) error {
+	if data == nil {
+		c.setUS(cmdDataSetType, noDataSet)
+	} else {
+		c.setUS(cmdDataSetType, 0x0001)
+	}
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		return err
+	}
+	if err := a.send(c.Context, true, &buf); err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := data.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	err := a.send(c.Context, false, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// Identifier returns the data set ds, encoded for the presentation
+// context of c, to be sent after it.
+func (a *association) Identifier(c *command, ds *dataset) io.WriterTo {
+	ds.Preamble, ds.Meta = nil, nil
+	ds.TransferSyntax = a.contexts[c.Context].TransferSyntax()
+	return ds
+}
+
+// ContextFor returns the accepted presentation context with the lowest ID
+// for an abstract syntax.
+func (a *association) ContextFor(abstractSyntax string) (presentationContext, bool) {
+	var ids []int
+	for id, pc := range a.contexts {
+		if pc.AbstractSyntax == abstractSyntax {
+			ids = append(ids, int(id))
+		}
+	}
+	if len(ids) == 0 {
+		return presentationContext{}, false
+	}
+	sort.Ints(ids)
+	return a.contexts[byte(ids[0])], true
+}
+
+// Release releases the association and closes the connection.
+func (a *association) Release() error {
+	defer a.conn.Close()
+	if err := a.writePDU(pduReleaseRQ, make([]byte, 4)); err != nil {
+		return err
+	}
+	for {
+		typ, _, err := a.readPDU()
+		if err != nil {
+			return err
+		}
+		if typ == pduReleaseRP || typ == pduAbort {
+			return nil
+		}
+	}
+}
+
+// Abort aborts the association and closes the connection.
+func (a *association) Abort() {
+	a.writePDU(pduAbort, make([]byte, 4))
+	a.conn.Close()
+}
+
+// The reasons that the service user gives for rejecting an association.
+var rejectReasons = map[byte]string{
+	1: "no reason given",
+	2: "application context not supported",
+	3: "calling AE title not recognized",
+	7: "called AE title not recognized",
+}
+
+// dialAssociation requests an association with the AE called at addr,
+// proposing contexts. The contexts that weren't accepted are left out of
+// the association.
+func dialAssociation(ctx context.Context, addr, calling, called string, contexts []presentationContext, scpRoles []string) (*association, error) {
+	d := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return requestAssociation(conn, addr, calling, called, contexts, scpRoles)
+}
+
+// requestAssociation is like dialAssociation, but over conn, which is
+// already connected to addr, such as with TLS.
+func requestAssociation(conn net.Conn, addr, calling, called string, contexts []presentationContext, scpRoles []string) (*association, error) {
+	a := newAssociation(conn)
+	a.Calling, a.Called = calling, called
+	rq := &associatePDU{Called: called, Calling: calling, Contexts: contexts, MaxPDU: maxPDULength, SCPRoles: scpRoles}
+	if err := a.writePDU(pduAssociateRQ, rq.encode(false)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, body, err := a.readPDU()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch typ {
+	case pduAssociateAC:
+	case pduAssociateRJ:
+		conn.Close()
+		reason := "no reason given"
+		if len(body) >= 4 && body[2] == 1 && rejectReasons[body[3]] != "" {
+			reason = rejectReasons[body[3]]
+		}
+		return nil, fmt.Errorf("%s (%s) rejected the association: %s", called, addr, reason)
+	default:
+		a.Abort()
+		return nil, fmt.Errorf("%s (%s) answered the association request with a PDU of type %#x", called, addr, typ)
+	}
+	ac, err := decodeAssociate(body)
+	if err != nil {
+		a.Abort()
+		return nil, err
+	}
+	a.peerMax = ac.MaxPDU
+	proposed := make(map[byte]presentationContext)
+	for _, pc := range contexts {
+		proposed[pc.ID] = pc
+	}
+	for _, pc := range ac.Contexts {
+		p, ok := proposed[pc.ID]
+		if pc.Result != contextAccepted || !ok || pc.TransferSyntax() == "" {
+			continue
+		}
+		a.contexts[pc.ID] = presentationContext{ID: pc.ID, AbstractSyntax: p.AbstractSyntax, TransferSyntaxes: []string{pc.TransferSyntax()}}
+	}
+	return a, nil
+}
+
+// An acceptor answers association requests.
+type acceptor struct {
+	// The AE title that peers have to call.
+	AE string
+	// If not empty, only these calling AE titles are accepted.
+	Allowed map[string]bool
+	// Negotiate returns the transfer syntax to accept a proposed
+	// context with, or "" and the result to reject it with. scpRole is
+	// whether the requestor proposed to be the SCP of the abstract
+	// syntax.
+	Negotiate func(pc presentationContext, scpRole bool) (string, byte)
+}
+
+// Accept reads an association request from conn and answers it.
+func (ac *acceptor) Accept(conn net.Conn) (*association, error) {
+	a := newAssociation(conn)
+	typ, body, err := a.readPDU()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != pduAssociateRQ {
+		a.Abort()
+		return nil, fmt.Errorf("%s sent a PDU of type %#x instead of an association request", conn.RemoteAddr(), typ)
+	}
+	rq, err := decodeAssociate(body)
+	if err != nil {
+		a.Abort()
+		return nil, err
+	}
+	reject := func(reason byte) (*association, error) {
+		a.writePDU(pduAssociateRJ, []byte{0, 1, 1, reason})
+		conn.Close()
+		return nil, fmt.Errorf("rejected association from %s (%s) to %s: %s", rq.Calling, conn.RemoteAddr(), rq.Called, rejectReasons[reason])
+	}
+	if rq.Called != ac.AE {
+		return reject(7)
+	}
+	if len(ac.Allowed) > 0 && !ac.Allowed[rq.Calling] {
+		return reject(3)
+	}
+	a.Calling, a.Called = rq.Calling, rq.Called
+	a.peerMax = rq.MaxPDU
+
+	roles := make(map[string]bool)
+	for _, uid := range rq.SCPRoles {
+		roles[uid] = true
+	}
+	rsp := &associatePDU{Called: rq.Called, Calling: rq.Calling, MaxPDU: maxPDULength}
+	accepted := make(map[string]bool)
+	for _, pc := range rq.Contexts {
+		ts, result := ac.Negotiate(pc, roles[pc.AbstractSyntax])
+		if ts != "" {
+			result = contextAccepted
+			a.contexts[pc.ID] = presentationContext{ID: pc.ID, AbstractSyntax: pc.AbstractSyntax, TransferSyntaxes: []string{ts}}
+			if roles[pc.AbstractSyntax] && !accepted[pc.AbstractSyntax] {
+				rsp.SCPRoles = append(rsp.SCPRoles, pc.AbstractSyntax)
+			}
+			accepted[pc.AbstractSyntax] = true
+		}
+		rsp.Contexts = append(rsp.Contexts, presentationContext{ID: pc.ID, Result: result, TransferSyntaxes: []string{ts}})
+	}
+	if err := a.writePDU(pduAssociateAC, rsp.encode(true)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return a, nil
+}
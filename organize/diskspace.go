@@ -0,0 +1,103 @@
+package organize
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errSpaceUnsupported is returned when free space can't be checked on this
+// platform.
+var errSpaceUnsupported = errors.New("checking disk space is not supported on this platform")
+
+// existingParent returns dir, or the closest parent of dir which exists.
+func existingParent(dir string) string {
+	dir = filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// seriesRoot returns the directory that a series will be organized under.
+func (o *Organizer) seriesRoot(files SeriesFiles) string {
+	if files.BurnedIn.Flagged() && o.ReviewDir != "" {
+		return o.ReviewDir
+	}
+	if root := o.PatientRoots.For(files); root != "" {
+		return root
+	}
+	return o.Dst
+}
+
+// checkSpace returns an error if there isn't enough free space on each
+// filesystem that files will be copied to for all of the files in series.
+// If free space can't be checked on this platform, it always succeeds.
+func (o *Organizer) checkSpace(series map[SeriesInstanceUID]SeriesFiles) error {
+	err := o.checkSpaceNeeded(series)
+	if err == errSpaceUnsupported {
+		if verbose {
+			log.Println(err)
+		}
+		return nil
+	}
+	return err
+}
+
+func (o *Organizer) checkSpaceNeeded(series map[SeriesInstanceUID]SeriesFiles) error {
+	needed := make(map[string]uint64)
+	dirs := make(map[string]string)
+	for _, files := range series {
+		dir := existingParent(o.seriesRoot(files))
+		fsID, err := filesystemID(dir)
+		if err != nil {
+			return err
+		}
+		dirs[fsID] = dir
+		for _, f := range files.Files {
+			if fi, err := os.Stat(f.String()); err == nil {
+				needed[fsID] += uint64(fi.Size())
+			}
+		}
+	}
+
+	var problems []string
+	for fsID, bytes := range needed {
+		free, err := freeSpace(dirs[fsID])
+		if err != nil {
+			return err
+		}
+		if bytes > free {
+			problems = append(problems, fmt.Sprintf("%s needs %s but only has %s available", dirs[fsID], humanBytes(bytes), humanBytes(free)))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("not enough disk space: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// humanBytes formats a number of bytes for error messages.
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
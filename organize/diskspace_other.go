@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package organize
+
+func filesystemID(path string) (string, error) {
+	return "", errSpaceUnsupported
+}
+
+func freeSpace(path string) (uint64, error) {
+	return 0, errSpaceUnsupported
+}
+
+func isNoSpace(err error) bool {
+	return false
+}
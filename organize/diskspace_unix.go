@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package organize
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// filesystemID returns an identifier for the filesystem that path is on.
+func filesystemID(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(uint64(st.Dev)), nil
+}
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem that path is on.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// isNoSpace reports whether err is because the filesystem is full.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,8 @@
+// Package organize organizes DICOM folders into a consistent format. It
+// implements the dicomfmt command, which is a thin wrapper around Run.
+//
+// Options configure organizing the same way as dicomfmt's command line
+// options do, and Run does what dicomfmt does with them until it's done
+// or its context is cancelled. New returns an Organizer instead, whose
+// ScanAll, PlanAll, All and Apply methods can be used separately.
+package organize
@@ -0,0 +1,197 @@
+package organize
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A duplicateGroup is a set of files in the target with identical
+// contents, which aren't already hard links to each other.
+type duplicateGroup struct {
+	Size  int64
+	Sum   []byte
+	Files []string
+
+	// The other paths of each file which are already hard links to it,
+	// which have to be linked as well to reclaim its space.
+	Links map[string][]string
+}
+
+// findDuplicates returns the groups of byte-identical files below each of
+// dirs, with the files of each group, and the groups, sorted by path.
+// Hidden directories, such as the staging area and the trash, are
+// skipped. Only files with the same size as another file are hashed.
+func findDuplicates(dirs []string) ([]duplicateGroup, error) {
+	bySize := make(map[int64][]string)
+	infos := make(map[string]os.FileInfo)
+	links := make(map[string][]string)
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			if info.IsDir() {
+				if path != dir && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+			for _, other := range bySize[info.Size()] {
+				if os.SameFile(info, infos[other]) {
+					// Already a hard link, or the same file
+					// found through two of dirs.
+					if path != other {
+						links[other] = append(links[other], path)
+					}
+					return nil
+				}
+			}
+			bySize[info.Size()] = append(bySize[info.Size()], path)
+			infos[path] = info
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var groups []duplicateGroup
+	for size, files := range bySize {
+		if len(files) < 2 {
+			continue
+		}
+		bySum := make(map[string][]string)
+		for _, file := range files {
+			sum, err := hashStored(file)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			bySum[string(sum)] = append(bySum[string(sum)], file)
+		}
+		for sum, same := range bySum {
+			if len(same) < 2 {
+				continue
+			}
+			sort.Strings(same)
+			g := duplicateGroup{Size: size, Sum: []byte(sum), Files: same, Links: make(map[string][]string)}
+			for _, file := range same {
+				if l, ok := links[file]; ok {
+					g.Links[file] = l
+				}
+			}
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Files[0] < groups[j].Files[0] })
+	return groups, nil
+}
+
+// hashStored returns the SHA-256 hash of the bytes of a file as they're
+// stored, without decompressing it, since only files which are stored the
+// same way can be linked together.
+func hashStored(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// linkDuplicate replaces dup with a hard link to file. The link is created
+// next to dup and renamed over it, so that dup is never missing.
+func linkDuplicate(file, dup string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dup), ".link")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	tmp.Close()
+	os.Remove(name)
+	if err := os.Link(file, name); err != nil {
+		return err
+	}
+	if err := os.Rename(name, dup); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// Duplicates writes the groups of byte-identical files stored in the
+// organized trees dirs to w, such as the same instances exported and
+// organized twice under different names. If link is set, each duplicate
+// is replaced with a hard link to the first file with the same contents.
+// It returns the exit status, which is 1 if any couldn't be linked.
+func Duplicates(w io.Writer, link bool, dirs ...string) (int, error) {
+	groups, err := findDuplicates(dirs)
+	if err != nil {
+		return 1, err
+	}
+	var dups, linked int
+	var wasted, reclaimed uint64
+	for i, g := range groups {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		uid := ""
+		if tags, err := readTags(FileName(g.Files[0]), "SOPInstanceUID"); err == nil {
+			uid = strings.TrimSpace(tags["SOPInstanceUID"])
+		}
+		if uid != "" {
+			fmt.Fprintf(w, "# %d copies of %s, SOPInstanceUID %s, sha256 %x\n", len(g.Files), humanBytes(uint64(g.Size)), uid, g.Sum)
+		} else {
+			fmt.Fprintf(w, "# %d copies of %s, sha256 %x\n", len(g.Files), humanBytes(uint64(g.Size)), g.Sum)
+		}
+		for _, file := range g.Files {
+			fmt.Fprintln(w, file)
+		}
+		for _, dup := range g.Files[1:] {
+			dups++
+			wasted += uint64(g.Size)
+			if !link {
+				continue
+			}
+			failed := false
+			for _, path := range append([]string{dup}, g.Links[dup]...) {
+				if err := linkDuplicate(g.Files[0], path); err != nil {
+					log.Printf("Could not link %s to %s: %v\n", path, g.Files[0], err)
+					failed = true
+				}
+			}
+			if failed {
+				continue
+			}
+			linked++
+			reclaimed += uint64(g.Size)
+		}
+	}
+	if len(groups) == 0 {
+		log.Println("No duplicate files found.")
+		return 0, nil
+	}
+	log.Printf("%s stored more than once, using %s.\n", plural(dups, "file is", "files are"), humanBytes(wasted))
+	if link {
+		log.Printf("Linked %s, reclaiming %s.\n", plural(linked, "file", "files"), humanBytes(reclaimed))
+		if linked < dups {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
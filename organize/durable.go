@@ -0,0 +1,50 @@
+package organize
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// If set, every file written to the target is flushed to disk before it's
+// closed, and the directories that a series was placed in are flushed
+// before the series is printed or its hooks are run. Series are already
+// placed one at a time, so anything watching the output never sees a
+// series directory that's incomplete, or that could lose files in a crash.
+var syncSeries bool
+
+// syncFile flushes f, a file being written to the target, to disk if
+// syncSeries is set and f can be flushed.
+func syncFile(f io.WriteCloser) error {
+	if !syncSeries {
+		return nil
+	}
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// syncDirs flushes each of dirs on fs to disk if syncSeries is set, along with
+// their parents up to and including root, since any of them could have
+// been created for the series. Directories outside of root, such as
+// -phantom-dir, only have themselves flushed.
+func syncDirs(fs FileSystem, root string, dirs []string) error {
+	if !syncSeries {
+		return nil
+	}
+	root = filepath.Clean(root)
+	done := make(map[string]bool)
+	for _, dir := range dirs {
+		for d := filepath.Clean(dir); !done[d]; d = filepath.Dir(d) {
+			done[d] = true
+			if err := fs.SyncDir(d); err != nil {
+				return err
+			}
+			if d == root || !strings.HasPrefix(d, root+string(filepath.Separator)) {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package organize
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Encrypted archives are a tar file encrypted with AES-256-GCM in chunks,
+// so that they can be written and read without holding the whole archive
+// in memory. The file starts with encryptMagic and a random salt, which
+// the archive's key is derived from, followed by the chunks. Each chunk's
+// nonce is its number and whether it's the last one, so chunks can't be
+// reordered, dropped or truncated without decryption failing.
+const (
+	encryptMagic     = "DCMFENC1"
+	encryptSaltSize  = 32
+	encryptChunkSize = 64 * 1024
+	encryptExtension = ".tar.enc"
+)
+
+// Tags read from each organized file to decide which archive it goes in.
+var encryptTags = []string{"PatientID", "PatientName", "StudyInstanceUID"}
+
+// LoadKey reads a 256 bit key, written as 64 hexadecimal digits, from
+// path, or from the output of command, which can fetch it from a key
+// management service.
+func LoadKey(path, command string) ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case path != "" && command != "":
+		return nil, errors.New("only one of a key file and a key command can be given")
+	case path != "":
+		data, err = ioutil.ReadFile(path)
+	case command != "":
+		cmd := shellCommand(command)
+		cmd.Stderr = os.Stderr
+		data, err = cmd.Output()
+	default:
+		return nil, errors.New("no key file or key command was given")
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the key must be 64 hexadecimal digits")
+	}
+	return key, nil
+}
+
+// archiveCipher returns the cipher for an archive with the given salt.
+func archiveCipher(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encryptMagic))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, n uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// An encryptWriter encrypts everything written to it. Close must be
+// called to write the last chunk.
+type encryptWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	salt := make([]byte, encryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := archiveCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encryptMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead, e.n, last), e.buf, nil)
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == encryptChunkSize {
+			// Only written once there's more, so that the last
+			// chunk is always marked as being last.
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// A decryptReader reads the plaintext of an encrypted archive.
+type decryptReader struct {
+	r    *bufio.Reader
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+	done bool
+}
+
+func newDecryptReader(r io.Reader, key []byte) (*decryptReader, error) {
+	header := make([]byte, len(encryptMagic)+encryptSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("not an encrypted archive: %v", err)
+	}
+	if string(header[:len(encryptMagic)]) != encryptMagic {
+		return nil, errors.New("not an encrypted archive")
+	}
+	aead, err := archiveCipher(key, header[len(encryptMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: bufio.NewReaderSize(r, encryptChunkSize+aead.Overhead()+1), aead: aead}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		sealed := make([]byte, encryptChunkSize+d.aead.Overhead())
+		n, err := io.ReadFull(d.r, sealed)
+		last := false
+		switch {
+		case err == io.ErrUnexpectedEOF:
+			last = true
+		case err != nil:
+			return 0, errors.New("the archive is truncated")
+		default:
+			if _, err := d.r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		plain, err := d.aead.Open(nil, chunkNonce(d.aead, d.n, last), sealed[:n], nil)
+		if err != nil {
+			return 0, errors.New("the archive is damaged, truncated or was encrypted with a different key")
+		}
+		d.n++
+		d.buf = plain
+		d.done = last
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// An archiver writes the files organized into the target into an
+// encrypted archive for each patient or study, so that they can be sent
+// over untrusted channels. The files in each archive are named by their
+// path relative to the target.
+type archiver struct {
+	Dst string
+	Dir string
+	Key []byte
+
+	// If set, there's an archive for each study instead of each
+	// patient.
+	PerStudy bool
+
+	mu    sync.Mutex
+	files map[string][]FileName
+}
+
+func newArchiver(dst, dir string, key []byte, perStudy bool) *archiver {
+	return &archiver{Dst: dst, Dir: dir, Key: key, PerStudy: perStudy, files: make(map[string][]FileName)}
+}
+
+// archiveName returns the name of the archive that a file with the given
+// tags goes in.
+func (a *archiver) archiveName(tags map[string]string) string {
+	name := strings.TrimSpace(tags["PatientName"]) + "_" + strings.TrimSpace(tags["PatientID"])
+	if a.PerStudy {
+		name = strings.TrimSpace(tags["StudyInstanceUID"])
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	return safeComponent(name)
+}
+
+// Add records that files were placed in the target directory. It's safe to
+// call on a nil archiver.
+func (a *archiver) Add(files []FileName) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, file := range files {
+		tags, err := readTags(file, encryptTags...)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		name := a.archiveName(tags)
+		a.files[name] = append(a.files[name], file)
+	}
+}
+
+// Flush writes an archive of everything added since the last flush for
+// each patient or study. If there's already an archive with the same name
+// from an earlier run, the new one is numbered. It's safe to call on a nil
+// archiver.
+func (a *archiver) Flush() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.files) == 0 {
+		return nil
+	}
+	if err := perms.MkdirAll(LocalFS{}, a.Dir); err != nil {
+		return err
+	}
+	var names []string
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failed error
+	for _, name := range names {
+		path := filepath.Join(a.Dir, name+encryptExtension)
+		for i := 1; ; i++ {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				break
+			}
+			path = filepath.Join(a.Dir, fmt.Sprintf("%s_%d%s", name, i, encryptExtension))
+		}
+		if err := a.write(path, a.files[name]); err != nil {
+			os.Remove(path)
+			log.Printf("Could not write %s: %v\n", path, err)
+			failed = err
+			continue
+		}
+		if verbose {
+			log.Printf("Encrypted %d files into %s.\n", len(a.files[name]), path)
+		}
+		delete(a.files, name)
+	}
+	return failed
+}
+
+// write writes an encrypted archive of files to path.
+func (a *archiver) write(path string, files []FileName) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc, err := newEncryptWriter(w, a.Key)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(enc)
+	for _, file := range files {
+		if err := addToArchive(tw, a.Dst, file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addToArchive(tw *tar.Writer, root string, file FileName) error {
+	src, err := os.Open(file.String())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, file.String())
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	hdr.Format = tar.FormatPAX
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+// extractArchive decrypts an encrypted archive into dir.
+func extractArchive(path, dir string, key []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec, err := newDecryptReader(f, key)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	tr := tar.NewReader(dec)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return fmt.Errorf("%s: unexpected entry %q", path, hdr.Name)
+		}
+		out := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(out), 0750); err != nil {
+			return err
+		}
+		dst, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, tr); err != nil {
+			dst.Close()
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := dst.Close(); err != nil {
+			return err
+		}
+		fmt.Println(out)
+	}
+}
+
+// Decrypt extracts the encrypted archives written by -encrypt-dir into
+// out, with the key read by LoadKey, logging any which can't be. It
+// returns the exit status, which is 1 if any couldn't be extracted.
+func Decrypt(out string, key []byte, archives ...string) int {
+	status := 0
+	for _, archive := range archives {
+		if err := extractArchive(archive, out, key); err != nil {
+			log.Println(err)
+			status = 1
+		}
+	}
+	return status
+}
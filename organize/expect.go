@@ -0,0 +1,163 @@
+package organize
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The columns of an expected studies list that can be matched against,
+// in the order they're preferred when a list has more than one.
+var expectColumns = []string{"StudyInstanceUID", "AccessionNumber", "PatientID"}
+
+// expectedStudies is a list of the studies that a run is expected to find,
+// such as an export from the RIS or a trial's enrollment list, which is
+// used to reconcile what was ingested afterwards.
+type expectedStudies struct {
+	// The tag that studies are matched by.
+	Tag string
+
+	// The rows of the list, keyed by their value for Tag.
+	rows  map[string][]string
+	order []string
+
+	mu         sync.Mutex
+	found      map[string]bool
+	unexpected map[string]string
+}
+
+// normalizeColumn returns the name of the tag that a CSV column heading
+// such as "Accession Number" or "patient_id" refers to.
+func normalizeColumn(heading string) string {
+	h := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '_' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(heading)))
+	if h == "ACCESSION" {
+		return "AccessionNumber"
+	}
+	for _, c := range expectColumns {
+		if strings.ToUpper(c) == h {
+			return c
+		}
+	}
+	return ""
+}
+
+// loadExpected reads a CSV file of expected studies. The first line must
+// be a heading with a StudyInstanceUID, AccessionNumber or PatientID
+// column, which is what studies are matched by. Other columns are only
+// used when reporting missing studies.
+func loadExpected(path string) (*expectedStudies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	heading, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	col := -1
+	e := &expectedStudies{rows: make(map[string][]string), found: make(map[string]bool), unexpected: make(map[string]string)}
+	for _, want := range expectColumns {
+		for i, h := range heading {
+			if normalizeColumn(h) == want {
+				col, e.Tag = i, want
+				break
+			}
+		}
+		if col >= 0 {
+			break
+		}
+	}
+	if col < 0 {
+		return nil, fmt.Errorf("%s: no %s column", path, strings.Join(expectColumns, ", "))
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if col >= len(row) {
+			continue
+		}
+		key := strings.TrimSpace(row[col])
+		if key == "" {
+			continue
+		}
+		if _, ok := e.rows[key]; !ok {
+			e.order = append(e.order, key)
+		}
+		e.rows[key] = row
+	}
+	return e, nil
+}
+
+// Add records that a series was organized. It's safe to call on a nil
+// list.
+func (e *expectedStudies) Add(s SeriesFiles) {
+	if e == nil {
+		return
+	}
+	key := strings.TrimSpace(s.tagValue(e.Tag))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.rows[key]; ok {
+		e.found[key] = true
+		return
+	}
+	if key == "" {
+		key = "(no " + e.Tag + ")"
+	}
+	if _, ok := e.unexpected[key]; !ok {
+		e.unexpected[key] = fmt.Sprintf("%s %s (%s)", e.Tag, key, s.PatientName)
+	}
+}
+
+// Report logs the expected studies which weren't organized and the
+// organized studies which weren't expected.
+func (e *expectedStudies) Report() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var missing []string
+	for _, key := range e.order {
+		if !e.found[key] {
+			missing = append(missing, strings.Join(e.rows[key], ","))
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("%d of %d expected studies were not found:\n", len(missing), len(e.order))
+		for _, row := range missing {
+			log.Println("\t" + row)
+		}
+	}
+	var unexpected []string
+	for _, desc := range e.unexpected {
+		unexpected = append(unexpected, desc)
+	}
+	sort.Strings(unexpected)
+	if len(unexpected) > 0 {
+		log.Printf("%d studies were organized which weren't expected:\n", len(unexpected))
+		for _, desc := range unexpected {
+			log.Println("\t" + desc)
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		log.Printf("All %d expected studies were found.\n", len(e.order))
+	}
+}
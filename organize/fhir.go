@@ -0,0 +1,325 @@
+package organize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tags read from each organized file to build the FHIR resources.
+var fhirTags = []string{
+	"PatientID", "PatientName", "PatientBirthDate", "PatientSex",
+	"StudyInstanceUID", "StudyDate", "StudyDescription",
+	"SeriesInstanceUID", "SeriesNumber", "SeriesDescription", "Modality",
+	"SOPInstanceUID", "SOPClassUID", "InstanceNumber",
+}
+
+// A fhirExporter builds FHIR R4 ImagingStudy and Patient resources for the
+// files that were organized, and writes them as NDJSON and/or sends them to
+// a FHIR server.
+type fhirExporter struct {
+	// NDJSON file to append resources to.
+	NDJSON string
+
+	// Base URL of a FHIR server to PUT resources to.
+	ServerURL string
+
+	mu      sync.Mutex
+	studies map[string]*fhirStudy
+	dirty   map[string]bool
+}
+
+type fhirStudy struct {
+	uid, description, date string
+	patient                map[string]string
+	series                 map[string]*fhirSeries
+}
+
+type fhirSeries struct {
+	uid, number, modality, description string
+	instances                          []fhirInstance
+}
+
+type fhirInstance struct {
+	uid, sopClass, number string
+	path                  string
+}
+
+func newFHIRExporter(ndjson, serverURL string) *fhirExporter {
+	if ndjson == "" && serverURL == "" {
+		return nil
+	}
+	return &fhirExporter{
+		NDJSON:    ndjson,
+		ServerURL: strings.TrimRight(serverURL, "/"),
+		studies:   make(map[string]*fhirStudy),
+		dirty:     make(map[string]bool),
+	}
+}
+
+// Add records that files were placed in the target directory. It's safe to
+// call on a nil exporter.
+func (e *fhirExporter) Add(files []FileName) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, file := range files {
+		tags, err := readTags(file, fhirTags...)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		uid := tags["StudyInstanceUID"]
+		if uid == "" {
+			log.Printf("%s: no StudyInstanceUID, not exporting to FHIR\n", file)
+			continue
+		}
+		study, ok := e.studies[uid]
+		if !ok {
+			study = &fhirStudy{
+				uid:         uid,
+				description: tags["StudyDescription"],
+				date:        tags["StudyDate"],
+				patient:     tags,
+				series:      make(map[string]*fhirSeries),
+			}
+			e.studies[uid] = study
+		}
+		series, ok := study.series[tags["SeriesInstanceUID"]]
+		if !ok {
+			series = &fhirSeries{
+				uid:         tags["SeriesInstanceUID"],
+				number:      tags["SeriesNumber"],
+				modality:    tags["Modality"],
+				description: tags["SeriesDescription"],
+			}
+			study.series[series.uid] = series
+		}
+		path, err := filepath.Abs(file.String())
+		if err != nil {
+			path = file.String()
+		}
+		series.instances = append(series.instances, fhirInstance{
+			uid:      tags["SOPInstanceUID"],
+			sopClass: tags["SOPClassUID"],
+			number:   tags["InstanceNumber"],
+			path:     path,
+		})
+		e.dirty[uid] = true
+	}
+}
+
+// fhirID converts a value to something valid as a FHIR resource id.
+func fhirID(s string) string {
+	id := []rune{}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			id = append(id, r)
+		default:
+			id = append(id, '-')
+		}
+	}
+	if len(id) > 64 {
+		id = id[:64]
+	}
+	if len(id) == 0 {
+		return "unknown"
+	}
+	return string(id)
+}
+
+// fhirDate converts a DICOM DA value to a FHIR date.
+func fhirDate(da string) string {
+	t, err := time.Parse("20060102", strings.TrimSpace(da))
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// atoi returns the integer value of a DICOM IS value, or nil if it isn't
+// one, so that it's omitted from the JSON.
+func atoi(is string) *int {
+	n, err := strconv.Atoi(strings.TrimSpace(is))
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+func patientResource(tags map[string]string) map[string]interface{} {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"id":           fhirID(tags["PatientID"]),
+		"identifier":   []map[string]string{{"value": tags["PatientID"]}},
+	}
+	if pn := strings.TrimSpace(tags["PatientName"]); pn != "" {
+		parts := strings.Split(pn, "^")
+		name := map[string]interface{}{"family": parts[0]}
+		// Given and middle names.
+		var given []string
+		for i := 1; i < len(parts) && i < 3; i++ {
+			if parts[i] != "" {
+				given = append(given, parts[i])
+			}
+		}
+		if len(given) > 0 {
+			name["given"] = given
+		}
+		patient["name"] = []interface{}{name}
+	}
+	if d := fhirDate(tags["PatientBirthDate"]); d != "" {
+		patient["birthDate"] = d
+	}
+	switch strings.TrimSpace(tags["PatientSex"]) {
+	case "M":
+		patient["gender"] = "male"
+	case "F":
+		patient["gender"] = "female"
+	case "O":
+		patient["gender"] = "other"
+	default:
+		patient["gender"] = "unknown"
+	}
+	return patient
+}
+
+func (s *fhirStudy) resource() map[string]interface{} {
+	var uids []string
+	for uid := range s.series {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	var series []interface{}
+	var total int
+	for _, uid := range uids {
+		se := s.series[uid]
+		var instances []interface{}
+		for _, in := range se.instances {
+			instances = append(instances, map[string]interface{}{
+				"uid":      in.uid,
+				"sopClass": map[string]string{"system": "urn:ietf:rfc:3986", "code": "urn:oid:" + in.sopClass},
+				"number":   atoi(in.number),
+				"extension": []map[string]string{{
+					"url":      "https://github.com/driusan/dicomfmt/fhir/StructureDefinition/file-path",
+					"valueUri": "file://" + filepath.ToSlash(in.path),
+				}},
+			})
+		}
+		total += len(instances)
+		series = append(series, map[string]interface{}{
+			"uid":               se.uid,
+			"number":            atoi(se.number),
+			"modality":          map[string]string{"system": "http://dicom.nema.org/resources/ontology/DCM", "code": se.modality},
+			"description":       se.description,
+			"numberOfInstances": len(instances),
+			"instance":          instances,
+		})
+	}
+	study := map[string]interface{}{
+		"resourceType":      "ImagingStudy",
+		"id":                fhirID(s.uid),
+		"identifier":        []map[string]string{{"system": "urn:dicom:uid", "value": "urn:oid:" + s.uid}},
+		"status":            "available",
+		"subject":           map[string]string{"reference": "Patient/" + fhirID(s.patient["PatientID"])},
+		"numberOfSeries":    len(series),
+		"numberOfInstances": total,
+		"series":            series,
+	}
+	if s.description != "" {
+		study["description"] = s.description
+	}
+	if d := fhirDate(s.date); d != "" {
+		study["started"] = d
+	}
+	return study
+}
+
+func (e *fhirExporter) put(resource map[string]interface{}) error {
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/%s/%s", e.ServerURL, resource["resourceType"], resource["id"])
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: unexpected response %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Flush writes the resources for every study which has had files added
+// since the last flush. Studies include every file that was added to them
+// by this process, so that resources sent to the server are complete.
+func (e *fhirExporter) Flush() error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var uids []string
+	for uid := range e.dirty {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	var resources []map[string]interface{}
+	patients := make(map[string]bool)
+	for _, uid := range uids {
+		study := e.studies[uid]
+		if id := study.patient["PatientID"]; !patients[id] {
+			patients[id] = true
+			resources = append(resources, patientResource(study.patient))
+		}
+		resources = append(resources, study.resource())
+	}
+	e.dirty = make(map[string]bool)
+
+	if e.NDJSON != "" {
+		f, err := os.OpenFile(e.NDJSON, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		for _, r := range resources {
+			if err := enc.Encode(r); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if e.ServerURL != "" {
+		for _, r := range resources {
+			if err := e.put(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
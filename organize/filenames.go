@@ -0,0 +1,73 @@
+package organize
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions that DICOM files are commonly given, which are replaced by
+// -extension and removed by -strip-extension. Other extensions are kept,
+// since DICOM files are often named by UIDs which contain dots.
+var dicomExtensions = map[string]bool{
+	".dcm":   true,
+	".dicom": true,
+	".dic":   true,
+	".dc3":   true,
+	".ima":   true,
+	".img":   true,
+}
+
+// fileNaming renames organized files.
+type fileNaming struct {
+	// If set, the extension that every file is given.
+	Extension string
+
+	// If set, extensions commonly used for DICOM files are removed.
+	StripExtension bool
+
+	// If set, file names are lowercased.
+	Lowercase bool
+}
+
+// Renames reports whether n changes any names.
+func (n fileNaming) Renames() bool {
+	return n.Extension != "" || n.StripExtension || n.Lowercase
+}
+
+// Apply returns the new name for a file.
+func (n fileNaming) Apply(name string) string {
+	if n.Extension != "" || n.StripExtension {
+		if ext := filepath.Ext(name); dicomExtensions[strings.ToLower(ext)] {
+			name = strings.TrimSuffix(name, ext)
+		}
+	}
+	if n.Lowercase {
+		name = strings.ToLower(name)
+	}
+	return name + n.Extension
+}
+
+// uniqueName returns dst, or a name like dst_1.dcm if another file has
+// already been planned to be placed at dst this run, since files which had
+// different names before they were renamed can end up with the same one.
+func (o *Organizer) uniqueName(src, dst FileName) FileName {
+	if o.planned == nil {
+		o.planned = make(map[FileName]FileName)
+	}
+	name := dst
+	ext := filepath.Ext(dst.String())
+	base := strings.TrimSuffix(dst.String(), ext)
+	for i := 1; ; i++ {
+		if other, ok := o.planned[name]; !ok || other == src {
+			break
+		}
+		name = FileName(fmt.Sprintf("%s_%d%s", base, i, ext))
+	}
+	if name != dst {
+		log.Printf("%s would have the same name as %s after renaming, using %s.\n", src, o.planned[dst], name)
+	}
+	o.planned[name] = src
+	return name
+}
@@ -0,0 +1,47 @@
+package organize
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// readFileList reads a list of file names from r. Names are separated by
+// NUL bytes if there are any in the input (as produced by find -print0),
+// and by newlines otherwise.
+func readFileList(r io.Reader) ([]FileName, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sep := []byte{'\n'}
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = []byte{0}
+	}
+	var files []FileName
+	for _, name := range bytes.Split(data, sep) {
+		if sep[0] == '\n' {
+			name = bytes.TrimSuffix(name, []byte{'\r'})
+		}
+		if len(name) == 0 {
+			continue
+		}
+		files = append(files, FileName(name))
+	}
+	return files, nil
+}
+
+// openFileList reads the file list from path, or from stdin if path is
+// "-".
+func openFileList(path string) ([]FileName, error) {
+	if path == "-" {
+		return readFileList(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readFileList(f)
+}
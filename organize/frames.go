@@ -0,0 +1,89 @@
+package organize
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// A frameGroup is the series of a study which share a FrameOfReferenceUID,
+// so that their coordinates can be compared directly: typically a
+// localizer and the series planned on it, or a series and the series
+// registered to or derived from it.
+type frameGroup struct {
+	PatientName         string             `json:"patient_name"`
+	PatientID           string             `json:"patient_id"`
+	StudyInstanceUID    string             `json:"study_instance_uid"`
+	StudyDate           string             `json:"study_date"`
+	StudyDescription    string             `json:"study_description"`
+	FrameOfReferenceUID string             `json:"frame_of_reference_uid"`
+	Series              []*inventorySeries `json:"series"`
+}
+
+// FrameGroups returns the groups of more than one series in each study of
+// the inventory which share a FrameOfReferenceUID, in the order of the
+// inventory. Series without a frame of reference aren't in any group.
+func (inv *inventory) FrameGroups() []frameGroup {
+	groups := []frameGroup{}
+	for _, p := range inv.Patients {
+		for _, st := range p.Studies {
+			byFrame := make(map[string][]*inventorySeries)
+			var frames []string
+			for _, se := range st.Series {
+				if se.FrameOfReferenceUID == "" {
+					continue
+				}
+				if _, ok := byFrame[se.FrameOfReferenceUID]; !ok {
+					frames = append(frames, se.FrameOfReferenceUID)
+				}
+				byFrame[se.FrameOfReferenceUID] = append(byFrame[se.FrameOfReferenceUID], se)
+			}
+			sort.Strings(frames)
+			for _, uid := range frames {
+				if len(byFrame[uid]) < 2 {
+					continue
+				}
+				groups = append(groups, frameGroup{
+					PatientName:         p.PatientName,
+					PatientID:           p.PatientID,
+					StudyInstanceUID:    st.StudyInstanceUID,
+					StudyDate:           st.StudyDate,
+					StudyDescription:    st.StudyDescription,
+					FrameOfReferenceUID: uid,
+					Series:              byFrame[uid],
+				})
+			}
+		}
+	}
+	return groups
+}
+
+// PrintFrames writes the frame of reference groups of the inventory to w,
+// under the study that each is in.
+func (inv *inventory) PrintFrames(w io.Writer) {
+	lastStudy := ""
+	for _, g := range inv.FrameGroups() {
+		if key := g.PatientID + "\x00" + g.PatientName + "\x00" + g.StudyInstanceUID; key != lastStudy {
+			lastStudy = key
+			fmt.Fprintf(w, "%s (%s) %s %s:\n", g.PatientName, g.PatientID, g.StudyDate, g.StudyDescription)
+		}
+		fmt.Fprintf(w, "    %s: %s\n", g.FrameOfReferenceUID, plural(len(g.Series), "series", "series"))
+		for _, se := range g.Series {
+			fmt.Fprintf(w, "        %s (%s): %s\n", se.SeriesDescription, se.Modality, plural(se.Instances, "instance", "instances"))
+		}
+	}
+}
+
+// PrintFramesTable writes a line for each series in a frame of reference
+// group to out.
+func (inv *inventory) PrintFramesTable(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATIENT\tID\tSTUDY DATE\tSTUDY\tFRAME OF REFERENCE\tSERIES\tMODALITY\tINSTANCES")
+	for _, g := range inv.FrameGroups() {
+		for _, se := range g.Series {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", g.PatientName, g.PatientID, g.StudyDate, g.StudyDescription, g.FrameOfReferenceUID, se.SeriesDescription, se.Modality, se.Instances)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,119 @@
+package organize
+
+import (
+	"io"
+	"os"
+)
+
+// A FileSystem is where organized files are written. Every change that
+// placing files makes to the target goes through it, rather than calling
+// the os package directly, so that the target can be somewhere other than
+// a local disk. Source files are still read from the local disk.
+type FileSystem interface {
+	Stat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	// Create creates or truncates a file for writing. Close may be
+	// called more than once.
+	Create(name string) (io.WriteCloser, error)
+	// CreateAt opens a file for writing after its first off bytes,
+	// creating it or truncating it to off bytes, to resume writing it.
+	CreateAt(name string, off int64) (io.WriteCloser, error)
+	// Rename moves a file, which may be a source file, to name.
+	Rename(oldname, name string) error
+	Remove(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	// SyncDir flushes the entries of a directory to disk, so that files
+	// created in or renamed into it survive a crash.
+	SyncDir(name string) error
+}
+
+// LocalFS is a FileSystem on the local disk.
+type LocalFS struct{}
+
+func (LocalFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (LocalFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (LocalFS) CreateAt(name string, off int64) (io.WriteCloser, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(off); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (LocalFS) Rename(oldname, name string) error {
+	return os.Rename(oldname, name)
+}
+
+func (LocalFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (LocalFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (LocalFS) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (LocalFS) SyncDir(name string) error {
+	return syncDir(name)
+}
+
+// A fileAction places src at dst on fs.
+type fileAction func(fs FileSystem, src, dst FileName) error
+
+func moveFile(fs FileSystem, src, dst FileName) error {
+	if err := readOnly.Check(src.String()); err != nil {
+		return err
+	}
+	if err := readOnly.Check(dst.String()); err != nil {
+		return err
+	}
+	return fs.Rename(src.String(), dst.String())
+}
+
+func copyFile(fs FileSystem, src, dst FileName) error {
+	if err := readOnly.Check(dst.String()); err != nil {
+		return err
+	}
+	f, err := os.Open(src.String())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && chunkedCopySize > 0 && info.Size() >= chunkedCopySize {
+		return copyChunked(fs, src, f, info, dst)
+	}
+	fdst, err := fs.Create(dst.String())
+	if err != nil {
+		return err
+	}
+	defer fdst.Close()
+	if _, err := io.Copy(bandwidth.Writer(fdst), f); err != nil {
+		return err
+	}
+	if err := syncFile(fdst); err != nil {
+		return err
+	}
+	return fdst.Close()
+}
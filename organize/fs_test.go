@@ -0,0 +1,87 @@
+package organize_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/driusan/dicomfmt/organize"
+	"github.com/driusan/dicomfmt/testutil"
+)
+
+func TestExecuteMemFS(t *testing.T) {
+	tests := []struct {
+		name string
+		move bool
+	}{
+		{"copy", false},
+		{"move", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testutil.NewMemFS()
+			dst := string(filepath.Separator) + "target"
+			if err := m.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+			o := &organize.Organizer{Dst: dst, Move: tt.move, FS: m, Layout: "{PatientName}/{SeriesDescription}"}
+			src := testutil.SourceDir(t, 1, 1, 2, 3)
+			found := o.Scan(context.Background(), src, nil)
+			if len(found) != 2 {
+				t.Fatalf("found %d series, want 2", len(found))
+			}
+
+			p := o.PlanAll(context.Background(), found)
+			var copies int
+			for _, sp := range p.Series {
+				for _, op := range sp.Operations {
+					switch op.Op {
+					case "copy", "move":
+						copies++
+						if !strings.HasPrefix(op.Dst.String(), dst+string(filepath.Separator)) {
+							t.Errorf("%s is planned outside of the target", op.Dst)
+						}
+					}
+				}
+			}
+			if copies != 6 {
+				t.Fatalf("planned %d copies, want 6", copies)
+			}
+			if got := m.Files(); len(got) != 0 {
+				t.Fatalf("planning wrote %v", got)
+			}
+
+			o.Apply(context.Background(), p)
+			if len(o.Failed) != 0 {
+				t.Fatalf("failed to organize %v", o.Failed)
+			}
+			got := m.Files()
+			var want []string
+			for _, se := range []string{"Series 1", "Series 2"} {
+				for _, im := range []string{"IM0001.dcm", "IM0002.dcm", "IM0003.dcm"} {
+					want = append(want, filepath.Join(dst, "SYNTH^PATIENT1", se, im))
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("target has\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			if _, err := os.Stat(dst); err == nil {
+				t.Errorf("%s was created on the local disk", dst)
+			}
+			left := 0
+			filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					left++
+				}
+				return nil
+			})
+			if tt.move && left != 0 {
+				t.Errorf("%d source files left after moving", left)
+			} else if !tt.move && left != 6 {
+				t.Errorf("%d source files left after copying, want 6", left)
+			}
+		})
+	}
+}
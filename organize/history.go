@@ -0,0 +1,83 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// The name of the run history kept in the target directory for the
+// dashboard, unless -run-history is given.
+const DefaultRunHistory = ".run-history"
+
+// A runRecord is a runSummary, along with the files which couldn't be
+// organized, as it's kept in the run history.
+type runRecord struct {
+	runSummary
+	Errors []string `json:"errors,omitempty"`
+}
+
+// A runHistory is a record of every run, or scan in watch mode, written as
+// one JSON object per line, so that past runs and their errors can be
+// shown by the dashboard.
+type runHistory struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Record appends a run to the history. It's safe to call on a nil
+// runHistory.
+func (h *runHistory) Record(s runSummary, failed []FileName) error {
+	if h == nil {
+		return nil
+	}
+	rec := runRecord{runSummary: s}
+	for _, f := range failed {
+		rec.Errors = append(rec.Errors, f.String())
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readRunHistory returns the runs recorded in the history at path, most
+// recent first. A history which doesn't exist yet is empty.
+func readRunHistory(path string) ([]runRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var runs []runRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var rec runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// The last line may have been partially written if
+			// the run was killed.
+			continue
+		}
+		runs = append(runs, rec)
+	}
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+	return runs, scanner.Err()
+}
@@ -0,0 +1,93 @@
+package organize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// seriesHooks are run after every file in a series has been placed in its
+// target directory.
+type seriesHooks struct {
+	// A command to run, with {dir} replaced by the series directory.
+	// The series is also described by the DICOMFMT_ environment
+	// variables it's run with.
+	Command string
+
+	// A URL to POST a JSON description of the series to.
+	URL string
+}
+
+// seriesEvent describes a series which was organized into Dir, and how
+// many of its files were placed there. It's used as the body of the
+// webhook request and for -json-lines output.
+type seriesEvent struct {
+	Dir               string    `json:"dir"`
+	PatientName       string    `json:"patient_name"`
+	SeriesDescription string    `json:"series_description"`
+	SeriesTime        time.Time `json:"series_time"`
+	Files             int       `json:"files"`
+}
+
+var hookClient = &http.Client{Timeout: 30 * time.Second}
+
+// Complete runs the hooks for a series, files of which were placed in dir.
+// Failures are logged, but don't stop the organization of other series.
+func (h seriesHooks) Complete(dir string, series SeriesFiles, files int) {
+	if h.Command != "" {
+		// The values are passed in the environment rather than
+		// quoted into the command, since no quoting is safe for
+		// every shell.
+		cmd := shellCommand(strings.Replace(h.Command, "{dir}", shellVar("DICOMFMT_DIR"), -1))
+		cmd.Env = append(os.Environ(),
+			"DICOMFMT_DIR="+dir,
+			"DICOMFMT_PATIENT_NAME="+series.PatientName,
+			"DICOMFMT_SERIES_DESCRIPTION="+series.SeriesDescription,
+			"DICOMFMT_FILES="+strconv.Itoa(files),
+		)
+		// Hooks aren't allowed to write to stdout, which is reserved
+		// for the list of series directories.
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("Series complete command for %s failed: %v\n", dir, err)
+		}
+	}
+	if h.URL != "" {
+		if err := h.post(dir, series, files); err != nil {
+			log.Printf("Series complete webhook for %s failed: %v\n", dir, err)
+		}
+	}
+}
+
+func newSeriesEvent(dir string, series SeriesFiles, files int) seriesEvent {
+	return seriesEvent{
+		Dir:               dir,
+		PatientName:       series.PatientName,
+		SeriesDescription: series.SeriesDescription,
+		SeriesTime:        series.InstanceCreationTime,
+		Files:             files,
+	}
+}
+
+func (h seriesHooks) post(dir string, series SeriesFiles, files int) error {
+	body, err := json.Marshal(newSeriesEvent(dir, series, files))
+	if err != nil {
+		return err
+	}
+	resp, err := hookClient.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
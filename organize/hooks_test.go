@@ -0,0 +1,35 @@
+package organize
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestHookCommandQuoting(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command is written for sh")
+	}
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "out")
+	for _, dir := range []string{
+		filepath.Join(tmp, "plain"),
+		filepath.Join(tmp, `it's "quoted"`),
+		filepath.Join(tmp, "$(touch injected); `touch injected`"),
+	} {
+		h := seriesHooks{Command: "printf '%s|%s|%s' {dir} \"$DICOMFMT_PATIENT_NAME\" \"$DICOMFMT_FILES\" > " + out}
+		h.Complete(dir, SeriesFiles{PatientName: "O'BRIEN^PAT"}, 3)
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := dir + "|O'BRIEN^PAT|3"; string(got) != want {
+			t.Errorf("hook got %q, want %q", got, want)
+		}
+	}
+	if _, err := os.Stat("injected"); err == nil {
+		os.Remove("injected")
+		t.Error("the directory name was run as a command")
+	}
+}
@@ -0,0 +1,116 @@
+package organize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// printInfo implements the info subcommand. It prints the tags that
+// organizing uses for each file in paths, which can be files or
+// directories, along with where the current options would place it when
+// withDst is set. Nothing is changed.
+func printInfo(o *Organizer, paths []string, withDst bool) int {
+	status := 0
+	series := make(map[SeriesInstanceUID]SeriesFiles)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		if info.IsDir() {
+			for uid, s := range o.Scan(context.Background(), path, nil) {
+				addParsed(series, uid, s)
+			}
+			continue
+		}
+		if err := addFile(series, FileName(filepath.Clean(path))); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+		}
+	}
+
+	var uids []string
+	for uid := range series {
+		uids = append(uids, string(uid))
+	}
+	sort.Strings(uids)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, uid := range uids {
+		s := series[SeriesInstanceUID(uid)]
+		dsts := make(map[FileName]Operation)
+		why := ""
+		if withDst {
+			sp := o.Plan(s)
+			for _, op := range sp.Operations {
+				switch op.Op {
+				case opKeep:
+					dsts[op.Dst] = op
+				case opCopy, opMove:
+					dsts[op.Src] = op
+				}
+			}
+			s = sp.Series
+			if len(sp.Operations) == 0 {
+				why = "not organized (" + o.Phantoms.Reason(s) + ")"
+			}
+		}
+
+		fmt.Fprintf(w, "Series %s\n", uid)
+		fmt.Fprintf(w, "  PatientName:\t%s\n", s.PatientName)
+		fmt.Fprintf(w, "  SeriesDescription:\t%s\n", s.SeriesDescription)
+		fmt.Fprintf(w, "  Modality:\t%s\n", s.Modality)
+		fmt.Fprintf(w, "  InstanceCreationTime:\t%s\n", s.InstanceCreationTime.Format("2006-01-02 15:04"))
+		if s.Site != "" {
+			fmt.Fprintf(w, "  Site:\t%s\n", s.Site)
+		}
+		if s.BurnedIn.Flagged() {
+			fmt.Fprintf(w, "  Burned in annotations:\t%s\n", s.BurnedIn)
+		}
+		printTags(w, "  ", s.Tags)
+
+		files := append([]FileName(nil), s.Files...)
+		sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+		for _, file := range files {
+			fmt.Fprintf(w, "  %s\n", file)
+			printTags(w, "    ", s.FileTags[file])
+			if !withDst {
+				continue
+			}
+			op, ok := dsts[file]
+			switch {
+			case why != "":
+				fmt.Fprintf(w, "    Destination:\t%s\n", why)
+			case !ok:
+				fmt.Fprintf(w, "    Destination:\tunknown\n")
+			case op.Op == opKeep:
+				fmt.Fprintf(w, "    Destination:\t%s (already there)\n", op.Dst)
+			default:
+				fmt.Fprintf(w, "    Destination:\t%s\n", op.Dst)
+			}
+			for _, r := range op.Review {
+				fmt.Fprintf(w, "    Heuristic:\t%s\n", r.Reason)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return status
+}
+
+// printTags prints the values of tags in alphabetical order.
+func printTags(w *tabwriter.Writer, indent string, tags map[string]string) {
+	var names []string
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s%s:\t%s\n", indent, name, tags[name])
+	}
+}
@@ -0,0 +1,119 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A journalEntry records that a file was successfully placed in the
+// target.
+type journalEntry struct {
+	Src  string    `json:"src"`
+	Dst  string    `json:"dst"`
+	Time time.Time `json:"time"`
+}
+
+// A journal is a log of every file that was placed, written as one JSON
+// object per line, so that an interrupted run can be resumed.
+type journal struct {
+	Path string
+
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{Path: path, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Placed records that src was placed at dst. It's safe to call on a nil
+// journal.
+func (j *journal) Placed(src, dst FileName) error {
+	if j == nil {
+		return nil
+	}
+	line, err := json.Marshal(journalEntry{Src: src.String(), Dst: dst.String(), Time: clock()})
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Flush writes any buffered entries and syncs them to disk.
+func (j *journal) Flush() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	if err := j.Flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// readJournal returns the destination of every file recorded in the
+// journal at path, keyed by the source file.
+func readJournal(path string) (map[FileName]FileName, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	placed := make(map[FileName]FileName)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line may have been partially written if
+			// the previous run was killed.
+			continue
+		}
+		placed[FileName(entry.Src)] = FileName(entry.Dst)
+	}
+	return placed, scanner.Err()
+}
+
+// resumeSkip returns a function which reports whether a file was already
+// placed according to a previous run's journal. Files whose destination no
+// longer exists on fs are organized again.
+func resumeSkip(fs FileSystem, placed map[FileName]FileName) func(FileName, os.FileInfo) bool {
+	return func(file FileName, info os.FileInfo) bool {
+		dst, ok := placed[file]
+		if !ok {
+			return false
+		}
+		if _, err := fs.Stat(dst.String()); err != nil {
+			if verbose {
+				log.Printf("%s was organized to %s, which no longer exists.\n", file, dst)
+			}
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,283 @@
+package organize
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The layout used to organize series if no other layout is given. This is
+// the format that dicomfmt has always used.
+const DefaultLayout = "{PatientName}/{InstanceCreationTime}_{SeriesDescription}"
+
+// layoutPresets are layouts that can be given to -layout by name.
+var layoutPresets = map[string]string{
+	"patient": DefaultLayout,
+	// For RIS driven workflows, where studies are looked up by
+	// accession number.
+	"accession": "{AccessionNumber}/{InstanceCreationTime}_{SeriesDescription}",
+}
+
+// flatLayouts are the layouts used by -flatten, which put every file of a
+// study or patient into a single directory.
+var flatLayouts = map[string]string{
+	"study":   "{PatientName}/{StudyDate}_{StudyDescription}",
+	"patient": "{PatientName}",
+}
+
+// expandPreset returns the layout for a preset name, or layout itself if
+// it isn't one.
+func expandPreset(layout string) string {
+	if preset, ok := layoutPresets[layout]; ok {
+		return preset
+	}
+	return layout
+}
+
+// seriesTags are the additional tags which are read from the first file of
+// each series, so that they can be used in layouts.
+var seriesTags []string
+
+// fileTags are the tags which are read from every file, and stored in
+// the series' FileTags.
+var fileTags []string
+
+// addTag adds a tag to a list of tags to read, if it's not already there.
+func addTag(tags []string, t string) []string {
+	for _, existing := range tags {
+		if existing == t {
+			return tags
+		}
+	}
+	return append(tags, t)
+}
+
+// layoutRules override the layout for specific kinds of files. They're
+// configured in the [layout.modality] and [layout.sop-class] tables of the
+// config file, keyed by the Modality or SOPClassUID that they apply to:
+//
+//	[layout.modality]
+//	MG = "{PatientName}/{StudyDate}/{ImageLaterality}_{ViewPosition}"
+//
+//	[layout.sop-class]
+//	"1.2.840.10008.5.1.4.1.1.88.22" = "reports/{PatientName}/{StudyDate}"
+//
+// A matching SOP class takes precedence over a matching modality.
+type layoutRules struct {
+	Modality map[string]string
+	SOPClass map[string]string
+}
+
+func newLayoutRules(cfg *Config, profile string) *layoutRules {
+	r := &layoutRules{
+		Modality: make(map[string]string),
+		SOPClass: make(map[string]string),
+	}
+	for k, v := range cfg.Table("layout.modality", profile) {
+		r.Modality[strings.ToUpper(k)] = expandPreset(v[len(v)-1])
+	}
+	for k, v := range cfg.Table("layout.sop-class", profile) {
+		r.SOPClass[k] = expandPreset(v[len(v)-1])
+	}
+	if len(r.Modality) == 0 && len(r.SOPClass) == 0 {
+		return nil
+	}
+	// Rules are chosen for each file, so the tags they use are read
+	// from each file too.
+	for _, l := range r.Modality {
+		addFileTags(l)
+	}
+	for _, l := range r.SOPClass {
+		addFileTags(l)
+	}
+	fileTags = addTag(fileTags, "Modality")
+	fileTags = addTag(fileTags, "SOPClassUID")
+	return r
+}
+
+// For returns the layout to use for file, which is part of series s, or
+// def if no rule matches it.
+func (r *layoutRules) For(s SeriesFiles, file FileName, def string) string {
+	if r == nil {
+		return def
+	}
+	tags := s.FileTags[file]
+	if l, ok := r.SOPClass[strings.TrimSpace(tags["SOPClassUID"])]; ok {
+		return l
+	}
+	modality := strings.TrimSpace(tags["Modality"])
+	if modality == "" {
+		modality = s.Modality
+	}
+	if l, ok := r.Modality[strings.ToUpper(strings.TrimSpace(modality))]; ok {
+		return l
+	}
+	return def
+}
+
+// splitTagRef splits a reference to a tag in a layout, such as
+// {SeriesNumber:3}, into the tag name and the width that numeric values
+// are zero padded to.
+func splitTagRef(ref string) (string, int) {
+	i := strings.IndexByte(ref, ':')
+	if i < 0 {
+		return ref, 0
+	}
+	width, err := strconv.Atoi(ref[i+1:])
+	if err != nil {
+		return ref, 0
+	}
+	return ref[:i], width
+}
+
+// padNumber zero pads v to width if it's a number.
+func padNumber(v string, width int) string {
+	if v == "" || len(v) >= width || strings.TrimLeft(v, "0123456789") != "" {
+		return v
+	}
+	return strings.Repeat("0", width-len(v)) + v
+}
+
+// prefixSeriesNumber returns layout with a zero padded SeriesNumber added
+// to the start of its last directory, so that series sort in acquisition
+// order.
+func prefixSeriesNumber(layout string) string {
+	i := strings.LastIndexByte(layout, '/') + 1
+	return layout[:i] + "{SeriesNumber:3}_" + layout[i:]
+}
+
+// Map replaces each layout in the rules with the result of f.
+func (r *layoutRules) Map(f func(string) string) {
+	if r == nil {
+		return
+	}
+	for k, v := range r.Modality {
+		r.Modality[k] = f(v)
+	}
+	for k, v := range r.SOPClass {
+		r.SOPClass[k] = f(v)
+	}
+}
+
+// layoutTags returns the names of the tags used in a layout template.
+func layoutTags(layout string) []string {
+	var tags []string
+	for {
+		start := strings.IndexByte(layout, '{')
+		if start < 0 {
+			return tags
+		}
+		end := strings.IndexByte(layout[start:], '}')
+		if end < 0 {
+			return tags
+		}
+		name, _ := splitTagRef(layout[start+1 : start+end])
+		tags = append(tags, name)
+		layout = layout[start+end+1:]
+	}
+}
+
+// addSeriesTags ensures that the tags used in layout are read for each
+// series.
+func addSeriesTags(layout string) {
+	for _, t := range layoutTags(layout) {
+		seriesTags = addTag(seriesTags, t)
+	}
+}
+
+// addFileTags ensures that the tags used in layout are read for each file.
+func addFileTags(layout string) {
+	for _, t := range layoutTags(layout) {
+		fileTags = addTag(fileTags, t)
+	}
+}
+
+// forFile returns s with the values of the tags which were read for file
+// in place of the values from the first file of the series, so that a
+// layout rule chosen for file is expanded with its own tags.
+func (s SeriesFiles) forFile(file FileName) SeriesFiles {
+	tags := s.FileTags[file]
+	if len(tags) == 0 {
+		return s
+	}
+	merged := make(map[string]string, len(s.Tags)+len(tags))
+	for k, v := range s.Tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	s.Tags = merged
+	return s
+}
+
+// tagValue returns the value of a tag for a series, as it's used in
+// directory names.
+func (s SeriesFiles) tagValue(name string) string {
+	switch name {
+	case "PatientName":
+		return s.PatientName
+	case "SeriesDescription":
+		return s.SeriesDescription
+	case "InstanceCreationTime":
+		return s.InstanceCreationTime.Format("2006-01-02_15:04")
+	case "Modality":
+		return s.Modality
+	case "Site":
+		if s.Site == "" && siteTag != "" {
+			return s.tagValue(siteTag)
+		}
+		return s.Site
+	}
+	return strings.TrimSpace(s.Tags[name])
+}
+
+// expandLayout returns the relative directory for a series, replacing
+// every {TagName} in layout with the NFC normalized value of the tag, so
+// that the same value always gives the same name, transliterated with
+// -transliterate. {TagName:N} zero pads numeric values to N digits.
+// Directories in the result are separated by /, regardless of the
+// platform.
+func expandLayout(layout string, s SeriesFiles) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(layout, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(layout[start:], '}')
+		if end < 0 {
+			break
+		}
+		out.WriteString(layout[:start])
+		name, width := splitTagRef(layout[start+1 : start+end])
+		out.WriteString(norm.NFC.String(safeValue(translit.Apply(name, padNumber(s.tagValue(name), width)))))
+		layout = layout[start+end+1:]
+	}
+	out.WriteString(layout)
+	return out.String()
+}
+
+// layoutDir returns the directory for a series below root, using the
+// platform's path separator. Directory names are shortened if it would be
+// too long, and resolved against existing directories using names.
+// Directories which expand to nothing are left out, and the rest are made
+// safe with safeComponent, so that whatever the tags of a file contain,
+// the result is always below root.
+func layoutDir(root, layout string, s SeriesFiles, names *dirNames) string {
+	var parts []string
+	for _, part := range strings.Split(expandLayout(layout, s), "/") {
+		if part != "" {
+			parts = append(parts, safeComponent(part))
+		}
+	}
+	limit := 0
+	if maxPathLen > 0 {
+		limit = maxPathLen - fileNameReserve
+	}
+	parts = fitPath(filepath.Clean(root), parts, limit)
+	parts = names.Resolve(root, parts)
+	return filepath.Join(append([]string{root}, parts...)...)
+}
@@ -0,0 +1,126 @@
+package organize
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSeries is the series that the layout tests expand layouts for.
+var testSeries = SeriesFiles{
+	PatientName:          "DOE^JANE",
+	SeriesDescription:    "AX T1",
+	InstanceCreationTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	Modality:             "MR",
+	Tags: map[string]string{
+		"SeriesNumber":    "7 ",
+		"StudyDate":       "20200102",
+		"AccessionNumber": "A123",
+	},
+}
+
+func TestExpandLayout(t *testing.T) {
+	tests := []struct {
+		layout string
+		want   string
+	}{
+		{DefaultLayout, "DOE^JANE/" + safeValue("2020-01-02_03:04") + "_AX T1"},
+		{layoutPresets["accession"], "A123/" + safeValue("2020-01-02_03:04") + "_AX T1"},
+		{"{Modality}/{StudyDate}", "MR/20200102"},
+		{"{SeriesNumber:3}_{SeriesDescription}", "007_AX T1"},
+		// Widths are only applied to numbers, and never truncate.
+		{"{SeriesDescription:3}", "AX T1"},
+		{"{SeriesNumber:1}", "7"},
+		// Tags which the series doesn't have expand to nothing.
+		{"{PatientName}/{BodyPartExamined}x", "DOE^JANE/x"},
+		{"static/{Modality}", "static/MR"},
+		// Unterminated references are kept as they are.
+		{"{Modality}/{Study", "MR/{Study"},
+	}
+	for _, tt := range tests {
+		if got := expandLayout(tt.layout, testSeries); got != tt.want {
+			t.Errorf("expandLayout(%q) = %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestLayoutDir(t *testing.T) {
+	root := filepath.Join("archive", "mr")
+	tests := []struct {
+		layout string
+		want   string
+	}{
+		{"{PatientName}/{SeriesDescription}", filepath.Join(root, "DOE^JANE", "AX T1")},
+		{"{Modality}", filepath.Join(root, "MR")},
+		{"{StudyDate}/{SeriesNumber:4}", filepath.Join(root, "20200102", "0007")},
+	}
+	for _, tt := range tests {
+		if got := layoutDir(root, tt.layout, testSeries, nil); got != tt.want {
+			t.Errorf("layoutDir(%q) = %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestLayoutDirStaysBelowRoot(t *testing.T) {
+	root := filepath.Join("archive", "mr")
+	for _, v := range []string{"..", ".", "../../x", "/etc", "a/../../..", `..\..\x`, ""} {
+		s := testSeries
+		s.PatientName, s.SeriesDescription = v, v
+		for _, layout := range []string{"{PatientName}/{SeriesDescription}", "{PatientName}", "x/{SeriesDescription}/.."} {
+			dir := layoutDir(root, layout, s, nil)
+			rel, err := filepath.Rel(root, dir)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				t.Errorf("layoutDir(%q) with %q = %q, which is outside of %s", layout, v, dir, root)
+			}
+		}
+	}
+}
+
+func TestLayoutRulesPerFile(t *testing.T) {
+	defer func(old []string) { fileTags = old }(fileTags)
+	cfg := &Config{tables: map[string]map[string][]string{
+		"layout.modality": {"MG": {"{PatientName}/{ImageLaterality}_{ViewPosition}"}},
+	}}
+	rules := newLayoutRules(cfg, "")
+	for _, name := range []string{"ImageLaterality", "ViewPosition"} {
+		found := false
+		for _, t := range fileTags {
+			found = found || t == name
+		}
+		if !found {
+			t.Errorf("%s isn't read from every file", name)
+		}
+	}
+
+	src := t.TempDir()
+	series := "SeriesInstanceUID=" + newUID(t)
+	views := map[string][]string{
+		"a.dcm": {"(0020,0062) CS=L", "(0018,5101) CS=CC"},
+		"b.dcm": {"(0020,0062) CS=R", "(0018,5101) CS=CC"},
+		"c.dcm": {"(0020,0062) CS=L", "(0018,5101) CS=MLO"},
+	}
+	for name, tags := range views {
+		synthFile(t, filepath.Join(src, name), append(tags, series, "Modality=MG", "PatientName=DOE")...)
+	}
+	dst := t.TempDir()
+	o := &Organizer{Dst: dst, Layout: DefaultLayout, LayoutRules: rules}
+	found := o.Scan(context.Background(), src, nil)
+	want := map[string]string{
+		"a.dcm": filepath.Join(dst, "DOE", "L_CC"),
+		"b.dcm": filepath.Join(dst, "DOE", "R_CC"),
+		"c.dcm": filepath.Join(dst, "DOE", "L_MLO"),
+	}
+	for _, sp := range o.PlanAll(context.Background(), found).Series {
+		for _, op := range sp.Operations {
+			if op.Op != opCopy {
+				continue
+			}
+			name := filepath.Base(op.Src.String())
+			if dir := filepath.Dir(op.Dst.String()); dir != want[name] {
+				t.Errorf("%s planned into %s, want %s", name, dir, want[name])
+			}
+		}
+	}
+}
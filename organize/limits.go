@@ -0,0 +1,227 @@
+package organize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// usageLimits keeps track of how much has been organized for each patient
+// and study, and warns when a patient, study or directory grows past the
+// configured limits. It's meant to catch test patients and QA phantoms
+// that are filling the archive, and modalities that keep resending the
+// same study, so nothing is refused; the warnings are logged as they
+// happen, sent to AlertURL if it's set, and included in the summary at
+// the end of the run.
+type usageLimits struct {
+	// The limits, which are ignored if they're 0.
+	PatientBytes   int64
+	PatientStudies int
+	PatientFiles   int
+	StudyBytes     int64
+	StudyFiles     int
+	DirFiles       int
+
+	// If set, each warning is POSTed to this URL as it happens.
+	AlertURL string
+
+	mu       sync.Mutex
+	patients map[string]*patientUsage
+	studies  map[string]*studyUsage
+	warned   map[string]bool
+	warnings []string
+}
+
+// patientUsage is what has been organized for a patient since dicomfmt
+// started.
+type patientUsage struct {
+	Bytes   int64
+	Files   int
+	Studies map[string]bool
+}
+
+// studyUsage is what has been organized for a study since dicomfmt
+// started.
+type studyUsage struct {
+	Bytes int64
+	Files int
+}
+
+// A limitAlert is the body of the request sent to AlertURL when a limit is
+// exceeded.
+type limitAlert struct {
+	Event   string    `json:"event"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+	Warning string    `json:"warning"`
+}
+
+var usage usageLimits
+
+func (u *usageLimits) warn(key, format string, args ...interface{}) {
+	if u.warned[key] {
+		return
+	}
+	u.warned[key] = true
+	w := fmt.Sprintf(format, args...)
+	log.Println(w)
+	u.warnings = append(u.warnings, w)
+}
+
+// enabled returns whether any limit is set.
+func (u *usageLimits) enabled() bool {
+	return u.PatientBytes > 0 || u.PatientStudies > 0 || u.PatientFiles > 0 ||
+		u.StudyBytes > 0 || u.StudyFiles > 0 || u.DirFiles > 0
+}
+
+// Add records that the files of a series were placed, into dirs, and warns
+// about any limit that it exceeded.
+func (u *usageLimits) Add(s SeriesFiles, dirs []string, placed []FileName) {
+	if !u.enabled() {
+		return
+	}
+	u.mu.Lock()
+	n := len(u.warnings)
+	u.add(s, dirs, placed)
+	alerts := append([]string(nil), u.warnings[n:]...)
+	u.mu.Unlock()
+	for _, w := range alerts {
+		u.alert(w)
+	}
+}
+
+// add does the work of Add, with u.mu held.
+func (u *usageLimits) add(s SeriesFiles, dirs []string, placed []FileName) {
+	if u.patients == nil {
+		u.patients = make(map[string]*patientUsage)
+		u.studies = make(map[string]*studyUsage)
+		u.warned = make(map[string]bool)
+	}
+
+	id := s.tagValue("PatientID")
+	patient := fmt.Sprintf("%s (ID %s)", s.PatientName, id)
+	p, ok := u.patients[id+"\x00"+s.PatientName]
+	if !ok {
+		p = &patientUsage{Studies: make(map[string]bool)}
+		u.patients[id+"\x00"+s.PatientName] = p
+	}
+	var size int64
+	for _, file := range placed {
+		if fi, err := os.Stat(file.String()); err == nil {
+			size += fi.Size()
+		}
+	}
+	p.Bytes += size
+	p.Files += len(placed)
+	study := s.tagValue("StudyInstanceUID")
+	if study != "" {
+		p.Studies[study] = true
+	}
+	if u.PatientBytes > 0 && p.Bytes > u.PatientBytes {
+		u.warn("bytes\x00"+patient, "Patient %s has had %s organized, over the limit of %s.", patient, humanBytes(uint64(p.Bytes)), humanBytes(uint64(u.PatientBytes)))
+	}
+	if u.PatientStudies > 0 && len(p.Studies) > u.PatientStudies {
+		u.warn("studies\x00"+patient, "Patient %s has had %d studies organized, over the limit of %d.", patient, len(p.Studies), u.PatientStudies)
+	}
+	if u.PatientFiles > 0 && p.Files > u.PatientFiles {
+		u.warn("files\x00"+patient, "Patient %s has had %d files organized, over the limit of %d.", patient, p.Files, u.PatientFiles)
+	}
+
+	if study != "" && (u.StudyBytes > 0 || u.StudyFiles > 0) {
+		st, ok := u.studies[study]
+		if !ok {
+			st = &studyUsage{}
+			u.studies[study] = st
+		}
+		st.Bytes += size
+		st.Files += len(placed)
+		desc := fmt.Sprintf("%s of patient %s", study, patient)
+		if u.StudyBytes > 0 && st.Bytes > u.StudyBytes {
+			u.warn("study-bytes\x00"+study, "Study %s has had %s organized, over the limit of %s.", desc, humanBytes(uint64(st.Bytes)), humanBytes(uint64(u.StudyBytes)))
+		}
+		if u.StudyFiles > 0 && st.Files > u.StudyFiles {
+			u.warn("study-files\x00"+study, "Study %s has had %d files organized, over the limit of %d.", desc, st.Files, u.StudyFiles)
+		}
+	}
+
+	if u.DirFiles <= 0 {
+		return
+	}
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		var n int
+		for _, info := range infos {
+			if !info.IsDir() {
+				n++
+			}
+		}
+		if n > u.DirFiles {
+			u.warn("dir\x00"+dir, "%s has %d files, over the limit of %d.", dir, n, u.DirFiles)
+		}
+	}
+}
+
+// alert sends a warning to AlertURL, if it's set.
+func (u *usageLimits) alert(warning string) {
+	if u.AlertURL == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	body, err := json.Marshal(limitAlert{Event: "limit_exceeded", Host: host, Time: clock(), Warning: warning})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = retries.Do("Sending alert to "+u.AlertURL, func() error {
+		resp, err := hookClient.Post(u.AlertURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected response %s", resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Alert webhook failed:", err)
+	}
+}
+
+// Len returns the number of warnings so far.
+func (u *usageLimits) Len() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.warnings)
+}
+
+// Since returns the warnings after the first n.
+func (u *usageLimits) Since(n int) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if n >= len(u.warnings) {
+		return nil
+	}
+	return append([]string(nil), u.warnings[n:]...)
+}
+
+// Report logs every warning again, so that they aren't lost among the
+// rest of the output of a long run.
+func (u *usageLimits) Report() {
+	warnings := u.Since(0)
+	if len(warnings) == 0 {
+		return
+	}
+	log.Printf("%d limits were exceeded:\n", len(warnings))
+	for _, w := range warnings {
+		log.Println("\t" + w)
+	}
+}
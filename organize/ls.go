@@ -0,0 +1,246 @@
+package organize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// The tags that the ls subcommand reads from each file.
+var inventoryTags = []string{
+	"PatientName", "PatientID", "StudyInstanceUID", "StudyDate",
+	"StudyDescription", "SeriesInstanceUID", "SeriesDescription",
+	"Modality", "SOPClassUID", "TransferSyntaxUID", "FrameOfReferenceUID",
+}
+
+// inventorySeries, inventoryStudy and inventoryPatient are the contents of
+// an organized tree, as reported by dicomfmt ls.
+type inventorySeries struct {
+	SeriesInstanceUID   string `json:"series_instance_uid"`
+	SeriesDescription   string `json:"series_description"`
+	Modality            string `json:"modality"`
+	FrameOfReferenceUID string `json:"frame_of_reference_uid,omitempty"`
+	Instances           int    `json:"instances"`
+	Bytes               int64  `json:"bytes"`
+
+	// One of the series' files, for the dashboard's thumbnails.
+	file string
+}
+
+type inventoryStudy struct {
+	StudyInstanceUID string             `json:"study_instance_uid"`
+	StudyDate        string             `json:"study_date"`
+	StudyDescription string             `json:"study_description"`
+	Instances        int                `json:"instances"`
+	Bytes            int64              `json:"bytes"`
+	Series           []*inventorySeries `json:"series"`
+
+	series map[string]*inventorySeries
+}
+
+type inventoryPatient struct {
+	PatientName string            `json:"patient_name"`
+	PatientID   string            `json:"patient_id"`
+	Instances   int               `json:"instances"`
+	Bytes       int64             `json:"bytes"`
+	Studies     []*inventoryStudy `json:"studies"`
+
+	studies map[string]*inventoryStudy
+}
+
+// An inventory is every patient found in an organized tree.
+type inventory struct {
+	Patients []*inventoryPatient `json:"patients"`
+
+	patients map[string]*inventoryPatient
+	stats    *objectStats
+}
+
+// Add adds a file with the given tags to the inventory.
+func (inv *inventory) Add(file string, tags map[string]string, size int64) {
+	key := tags["PatientID"] + "\x00" + tags["PatientName"]
+	p, ok := inv.patients[key]
+	if !ok {
+		p = &inventoryPatient{PatientName: tags["PatientName"], PatientID: tags["PatientID"], studies: make(map[string]*inventoryStudy)}
+		inv.patients[key] = p
+		inv.Patients = append(inv.Patients, p)
+	}
+	st, ok := p.studies[tags["StudyInstanceUID"]]
+	if !ok {
+		st = &inventoryStudy{
+			StudyInstanceUID: tags["StudyInstanceUID"],
+			StudyDate:        tags["StudyDate"],
+			StudyDescription: tags["StudyDescription"],
+			series:           make(map[string]*inventorySeries),
+		}
+		p.studies[tags["StudyInstanceUID"]] = st
+		p.Studies = append(p.Studies, st)
+	}
+	se, ok := st.series[tags["SeriesInstanceUID"]]
+	if !ok {
+		se = &inventorySeries{
+			SeriesInstanceUID: tags["SeriesInstanceUID"],
+			SeriesDescription: tags["SeriesDescription"],
+			Modality:          tags["Modality"],
+		}
+		st.series[tags["SeriesInstanceUID"]] = se
+		st.Series = append(st.Series, se)
+	}
+	if se.file == "" {
+		se.file = file
+	}
+	if se.FrameOfReferenceUID == "" {
+		se.FrameOfReferenceUID = tags["FrameOfReferenceUID"]
+	}
+	inv.stats.Add(tags, size)
+	p.Instances++
+	st.Instances++
+	se.Instances++
+	p.Bytes += size
+	st.Bytes += size
+	se.Bytes += size
+}
+
+// Sort orders patients by name, studies by date and series by description.
+func (inv *inventory) Sort() {
+	sort.Slice(inv.Patients, func(i, j int) bool {
+		a, b := inv.Patients[i], inv.Patients[j]
+		if a.PatientName != b.PatientName {
+			return a.PatientName < b.PatientName
+		}
+		return a.PatientID < b.PatientID
+	})
+	for _, p := range inv.Patients {
+		sort.Slice(p.Studies, func(i, j int) bool {
+			a, b := p.Studies[i], p.Studies[j]
+			if a.StudyDate != b.StudyDate {
+				return a.StudyDate < b.StudyDate
+			}
+			return a.StudyInstanceUID < b.StudyInstanceUID
+		})
+		for _, st := range p.Studies {
+			sort.Slice(st.Series, func(i, j int) bool {
+				a, b := st.Series[i], st.Series[j]
+				if a.SeriesDescription != b.SeriesDescription {
+					return a.SeriesDescription < b.SeriesDescription
+				}
+				return a.SeriesInstanceUID < b.SeriesInstanceUID
+			})
+		}
+	}
+}
+
+// takeInventory reads the tags of every DICOM file below dir. Hidden
+// directories, such as the staging area and incoming queue, are skipped.
+func takeInventory(dir string) (*inventory, error) {
+	inv := &inventory{Patients: []*inventoryPatient{}, patients: make(map[string]*inventoryPatient), stats: newObjectStats()}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || isTextFile(FileName(path)) {
+			return nil
+		}
+		tags, err := readTags(FileName(path), inventoryTags...)
+		if err != nil {
+			if verbose {
+				log.Println(err)
+			}
+			return nil
+		}
+		for k, v := range tags {
+			tags[k] = strings.TrimSpace(v)
+		}
+		inv.Add(path, tags, info.Size())
+		return nil
+	})
+	inv.Sort()
+	return inv, err
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, one)
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// PrintTree writes the inventory to w as a tree of patients, studies and
+// series.
+func (inv *inventory) PrintTree(w io.Writer) {
+	for _, p := range inv.Patients {
+		fmt.Fprintf(w, "%s (%s): %s, %s, %s\n", p.PatientName, p.PatientID, plural(len(p.Studies), "study", "studies"), plural(p.Instances, "instance", "instances"), humanBytes(uint64(p.Bytes)))
+		for _, st := range p.Studies {
+			fmt.Fprintf(w, "    %s %s: %s, %s, %s\n", st.StudyDate, st.StudyDescription, plural(len(st.Series), "series", "series"), plural(st.Instances, "instance", "instances"), humanBytes(uint64(st.Bytes)))
+			for _, se := range st.Series {
+				fmt.Fprintf(w, "        %s (%s): %s, %s\n", se.SeriesDescription, se.Modality, plural(se.Instances, "instance", "instances"), humanBytes(uint64(se.Bytes)))
+			}
+		}
+	}
+}
+
+// PrintTable writes a line for each series in the inventory to out.
+func (inv *inventory) PrintTable(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATIENT\tID\tSTUDY DATE\tSTUDY\tSERIES\tMODALITY\tINSTANCES\tBYTES")
+	for _, p := range inv.Patients {
+		for _, st := range p.Studies {
+			for _, se := range st.Series {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", p.PatientName, p.PatientID, st.StudyDate, st.StudyDescription, se.SeriesDescription, se.Modality, se.Instances, se.Bytes)
+			}
+		}
+	}
+	w.Flush()
+}
+
+// List writes the patients, studies and series in the organized tree dir
+// to w, formatted as a tree, a table with a line per series, or json. If
+// stats is set, it writes how many files and bytes there are of each
+// modality, SOP class and transfer syntax instead, and if frames is set,
+// the series of each study which share a FrameOfReferenceUID.
+func List(w io.Writer, dir, format string, stats, frames bool) error {
+	switch format {
+	case "tree", "table", "json":
+	default:
+		return fmt.Errorf("Unknown -format %q", format)
+	}
+
+	inv, err := takeInventory(dir)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	switch {
+	case stats && format == "json":
+		return enc.Encode(inv.stats)
+	case stats:
+		inv.stats.Print(w)
+	case frames && format == "json":
+		return enc.Encode(inv.FrameGroups())
+	case frames && format == "table":
+		inv.PrintFramesTable(w)
+	case frames:
+		inv.PrintFrames(w)
+	case format == "table":
+		inv.PrintTable(w)
+	case format == "json":
+		return enc.Encode(inv)
+	default:
+		inv.PrintTree(w)
+	}
+	return nil
+}
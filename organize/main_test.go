@@ -0,0 +1,58 @@
+package organize
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fuzzSeeds returns the seed corpus for the fuzz tests: valid files in
+// each of the uncompressed transfer syntaxes, a raw dataset without file
+// meta information, and some broken files.
+func fuzzSeeds(f *testing.F) [][]byte {
+	var seeds [][]byte
+	for _, ts := range []string{implicitVRLittleEndian, explicitVRLittleEndian, deflatedExplicitVRLittleEndian, explicitVRBigEndian} {
+		ds := synthDataset(f, "PatientName=DOE^JANE", "SeriesDescription=AX T1", "Modality=MR", "SeriesNumber=3")
+		ds.TransferSyntax = ts
+		ds.setFileMeta()
+		var buf bytes.Buffer
+		if _, err := ds.WriteTo(&buf); err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, buf.Bytes())
+	}
+	raw := synthDataset(f, "PatientName=DOE^JANE")
+	raw.Preamble, raw.Meta = nil, nil
+	var buf bytes.Buffer
+	if _, err := raw.WriteTo(&buf); err != nil {
+		f.Fatal(err)
+	}
+	seeds = append(seeds, buf.Bytes())
+
+	valid := seeds[1]
+	seeds = append(seeds,
+		nil,
+		[]byte("DICM"),
+		append(make([]byte, 128), "DICM"...),
+		valid[:len(valid)/2],
+		// An element whose length runs past the end of the file.
+		append(append([]byte{}, valid...), 0x10, 0x00, 0x10, 0x00, 'P', 'N', 0xFF, 0x7F),
+		// An undefined length sequence which is never closed.
+		append(append([]byte{}, valid...), 0x08, 0x00, 0x15, 0x11, 'S', 'Q', 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE, 0xFF, 0x00, 0xE0, 0xFF, 0xFF, 0xFF, 0xFF),
+	)
+	return seeds
+}
+
+func FuzzParseData(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		uid, header, err := parseData("fuzz.dcm", data)
+		if err != nil {
+			return
+		}
+		if uid == "" || header == nil {
+			t.Errorf("parsed without an error, but got SeriesInstanceUID %q and header %v", uid, header)
+		}
+	})
+}
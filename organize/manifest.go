@@ -0,0 +1,264 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A manifestEntry records where an organized file originally came from.
+// Journal entries can also be read as manifest entries.
+type manifestEntry struct {
+	Src               string      `json:"src"`
+	Dst               string      `json:"dst"`
+	SOPInstanceUID    string      `json:"sop_instance_uid,omitempty"`
+	Site              string      `json:"site,omitempty"`
+	SeriesDescription string      `json:"series_description,omitempty"`
+	Shard             string      `json:"shard,omitempty"`
+	Changes           []tagChange `json:"changes,omitempty"`
+	Size              int64       `json:"size"`
+	ModTime           time.Time   `json:"mod_time"`
+	Time              time.Time   `json:"time"`
+
+	// The study, series and frame of reference of the file, so that the
+	// series sharing a frame of reference can be found from the manifest
+	// alone.
+	StudyInstanceUID    string `json:"study_instance_uid,omitempty"`
+	SeriesInstanceUID   string `json:"series_instance_uid,omitempty"`
+	FrameOfReferenceUID string `json:"frame_of_reference_uid,omitempty"`
+
+	// Without -burned-in-dir, why the file's series was flagged as
+	// likely containing burned in annotations, since it's placed in the
+	// target with everything else.
+	BurnedIn string `json:"burned_in,omitempty"`
+
+	// With -transliterate, the original values of the tags which were
+	// transliterated in the file's directory names.
+	Transliterated map[string]string `json:"transliterated,omitempty"`
+}
+
+// A manifest is a permanent record of the original path of every file
+// that was organized, written as one JSON object per line. Unlike the
+// journal, which only lasts until a run finishes, a manifest is meant to
+// be kept alongside the target and appended to by every run.
+type manifest struct {
+	Path string
+
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func openManifest(path string) (*manifest, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{Path: path, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Record records that src, from the series s, was placed at dst on fs.
+// The shard of its series directory, the elements that were changed and
+// why it was flagged as having burned in annotations, if any, are taken
+// from extra. It's safe to call on a nil manifest.
+func (m *manifest) Record(fs FileSystem, src, dst FileName, s SeriesFiles, extra manifestEntry) error {
+	if m == nil {
+		return nil
+	}
+	srcPath, err := filepath.Abs(src.String())
+	if err != nil {
+		return err
+	}
+	dstPath, err := filepath.Abs(dst.String())
+	if err != nil {
+		return err
+	}
+	entry := manifestEntry{
+		Src:               srcPath,
+		Dst:               dstPath,
+		SOPInstanceUID:    s.FileTags[src]["SOPInstanceUID"],
+		Site:              s.Site,
+		SeriesDescription: s.SeriesDescription,
+		Shard:             extra.Shard,
+		Changes:           extra.Changes,
+		BurnedIn:          extra.BurnedIn,
+		Time:              clock(),
+
+		StudyInstanceUID:    s.tagValue("StudyInstanceUID"),
+		SeriesInstanceUID:   s.tagValue("SeriesInstanceUID"),
+		FrameOfReferenceUID: strings.TrimSpace(s.FileTags[src]["FrameOfReferenceUID"]),
+		Transliterated:      translit.Originals(s),
+	}
+	if info, err := fs.Stat(dst.String()); err == nil {
+		entry.Size = info.Size()
+		entry.ModTime = info.ModTime()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.w.Write(append(line, '\n'))
+	return err
+}
+
+// Flush writes any buffered entries and syncs them to disk.
+func (m *manifest) Flush() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.w.Flush(); err != nil {
+		return err
+	}
+	return m.f.Sync()
+}
+
+func (m *manifest) Close() error {
+	if m == nil {
+		return nil
+	}
+	if err := m.Flush(); err != nil {
+		m.f.Close()
+		return err
+	}
+	return m.f.Close()
+}
+
+// readManifest returns every entry of the manifest at path, in the order
+// they were recorded.
+func readManifest(path string) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	err := scanManifest(path, func(entry manifestEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// scanManifest calls fn with every entry of the manifest at path, in the
+// order they were recorded, without keeping them all in memory.
+func scanManifest(path string, fn func(manifestEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line may have been partially written if
+			// the previous run was killed.
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// A manifestIndex is what an existing manifest says is already in the
+// target, for -trust-manifest, so that merging a few new files into a
+// large archive doesn't need every file in it to be read again. Entries
+// are only trusted while the file still has the size and modification
+// time that were recorded.
+type manifestIndex struct {
+	path string
+	// The filesystem that the target is on.
+	fs FileSystem
+
+	// The size and modification time of each file placed in the
+	// target, by its absolute path.
+	placed map[string]manifestFile
+	// Where each source file was placed.
+	copied map[string]string
+
+	mu      sync.Mutex
+	skipped int
+}
+
+type manifestFile struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// loadManifestIndex reads the manifest at path, for a target on fs. A
+// manifest which doesn't exist yet is empty.
+func loadManifestIndex(fs FileSystem, path string) (*manifestIndex, error) {
+	m := &manifestIndex{
+		fs:     fs,
+		path:   path,
+		placed: make(map[string]manifestFile),
+		copied: make(map[string]string),
+	}
+	err := scanManifest(path, func(entry manifestEntry) {
+		m.placed[entry.Dst] = manifestFile{entry.Size, entry.ModTime}
+		if entry.Src != entry.Dst {
+			m.copied[entry.Src] = entry.Dst
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return m, nil
+}
+
+// matches reports whether info is the file recorded at path.
+func (m *manifestIndex) matches(path string, info os.FileInfo) bool {
+	f, ok := m.placed[path]
+	return ok && info.Size() == f.Size && info.ModTime().Equal(f.ModTime)
+}
+
+// Skip reports whether file doesn't need to be read, either because it's
+// in the target where the manifest says it was placed, or because it's a
+// source file which hasn't changed since it was copied to a file that's
+// still in the target. info is file's FileInfo, if it's known.
+func (m *manifestIndex) Skip(file FileName, info os.FileInfo) bool {
+	abs, err := filepath.Abs(file.String())
+	if err != nil {
+		return false
+	}
+	if info == nil {
+		if info, err = os.Stat(file.String()); err != nil {
+			return false
+		}
+	}
+	skip := m.matches(abs, info)
+	// The copy is at least as new as the source, whether or not its
+	// modification time was preserved, unless the source has changed
+	// since it was copied.
+	if dst, ok := m.copied[abs]; !skip && ok && !info.ModTime().After(m.placed[dst].ModTime) {
+		if fi, err := m.fs.Stat(dst); err == nil {
+			skip = m.matches(dst, fi)
+		}
+	}
+	if skip {
+		m.mu.Lock()
+		m.skipped++
+		m.mu.Unlock()
+	}
+	return skip
+}
+
+// Report logs how many files weren't read because of the manifest. It's
+// safe to call on a nil manifestIndex.
+func (m *manifestIndex) Report() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.skipped > 0 {
+		log.Printf("Skipped %s already organized according to %s.\n", plural(m.skipped, "file", "files"), m.path)
+	}
+}
@@ -0,0 +1,94 @@
+package organize
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// metricSet holds the counters exposed to Prometheus.
+type metricSet struct {
+	mu            sync.Mutex
+	filesIngested int64
+	seriesDone    int64
+	bytesWritten  int64
+	parseFailures int64
+	modalityFiles map[string]int64
+	modalityBytes map[string]int64
+}
+
+var metrics = &metricSet{
+	modalityFiles: make(map[string]int64),
+	modalityBytes: make(map[string]int64),
+}
+
+// Ingested records that a file of size bytes was placed in the target.
+func (m *metricSet) Ingested(modality string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filesIngested++
+	m.bytesWritten += size
+	m.modalityFiles[modality]++
+	m.modalityBytes[modality] += size
+}
+
+// SeriesDone records that a series was organized.
+func (m *metricSet) SeriesDone() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesDone++
+}
+
+// ParseFailure records that a file couldn't be parsed.
+func (m *metricSet) ParseFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parseFailures++
+}
+
+// A metricSnapshot is the value of the overall counters at some point.
+type metricSnapshot struct {
+	Series, Files, Bytes, ParseFailures int64
+}
+
+func (m *metricSet) Snapshot() metricSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return metricSnapshot{m.seriesDone, m.filesIngested, m.bytesWritten, m.parseFailures}
+}
+
+func writeCounter(w http.ResponseWriter, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func writeLabeledCounter(w http.ResponseWriter, name, help, label string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *metricSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeCounter(w, "dicomfmt_files_ingested_total", "Number of files placed in the target directory.", m.filesIngested)
+	writeCounter(w, "dicomfmt_series_organized_total", "Number of series organized into the target directory.", m.seriesDone)
+	writeCounter(w, "dicomfmt_bytes_written_total", "Number of bytes placed in the target directory.", m.bytesWritten)
+	writeCounter(w, "dicomfmt_parse_failures_total", "Number of files which could not be parsed.", m.parseFailures)
+	writeLabeledCounter(w, "dicomfmt_modality_files_total", "Number of files placed in the target directory by modality.", "modality", m.modalityFiles)
+	writeLabeledCounter(w, "dicomfmt_modality_bytes_total", "Number of bytes placed in the target directory by modality.", "modality", m.modalityBytes)
+}
+
+func serveMetrics(addr string, auth *ServerAuth) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", auth.Require(scopeRead, metrics))
+	auth.Serve(addr, mux)
+}
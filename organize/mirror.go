@@ -0,0 +1,68 @@
+package organize
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// A mirror is a second target directory which every file placed in the
+// target is also written to, at the same path relative to it, so that
+// both are filled in a single pass over slow sources. A file only fails
+// if it can't be written to either of them. Files routed outside of the
+// target, such as to -phantom-dir, aren't mirrored.
+type mirror struct {
+	Dir string
+	// The target directory being mirrored.
+	Root string
+}
+
+// Path returns where the mirror of dst, which is a file in the target,
+// goes. It returns false if dst isn't in the target. It's safe to call on
+// a nil mirror, which never has a path.
+func (m *mirror) Path(dst FileName) (FileName, bool) {
+	if m == nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(m.Root, dst.String())
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return FileName(filepath.Join(m.Dir, rel)), true
+}
+
+// Write writes the mirror of src, which is being placed at dst in the
+// target, to fs with action. It returns the path of the mirrored file.
+func (m *mirror) Write(fs FileSystem, src, dst FileName, action fileAction) (FileName, error) {
+	path, ok := m.Path(dst)
+	if !ok {
+		return "", nil
+	}
+	if err := perms.MkdirAll(fs, filepath.Dir(path.String())); err != nil {
+		return "", err
+	}
+	err := retries.Do("Mirroring "+src.String(), func() error { return action(fs, src, path) })
+	if err != nil {
+		fs.Remove(path.String())
+		return "", err
+	}
+	if err := perms.File(fs, path.String()); err != nil {
+		log.Println(err)
+	}
+	return path, nil
+}
+
+// Fill mirrors dst, a file which is already in the target, if the mirror
+// doesn't have it yet. It's safe to call on a nil mirror.
+func (m *mirror) Fill(fs FileSystem, dst FileName) {
+	path, ok := m.Path(dst)
+	if !ok {
+		return
+	}
+	if _, err := fs.Stat(path.String()); err == nil {
+		return
+	}
+	if _, err := m.Write(fs, dst, dst, copyFile); err != nil {
+		log.Printf("Could not mirror %s: %v\n", dst, err)
+	}
+}
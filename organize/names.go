@@ -0,0 +1,89 @@
+package organize
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// dirNames resolves the names of series directories against the
+// directories that already exist, so that tag values which differ only in
+// case aren't merged into the same directory on case insensitive
+// filesystems (such as on macOS and SMB shares).
+//
+// Names are compared after NFC normalization, since macOS returns
+// decomposed names from directory listings.
+type dirNames struct {
+	mu sync.Mutex
+
+	// The name that each part resolved to, keyed by its parent and the
+	// part.
+	resolved map[string]string
+
+	// The names resolved in each parent, which might not have been
+	// created yet when a whole run is planned in advance.
+	children map[string][]string
+}
+
+func newDirNames() *dirNames {
+	return &dirNames{
+		resolved: make(map[string]string),
+		children: make(map[string][]string),
+	}
+}
+
+// Resolve replaces any part of a directory below root that would collide
+// with an existing directory that's spelled differently.
+func (d *dirNames) Resolve(root string, parts []string) []string {
+	if d == nil {
+		return parts
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dir := root
+	for i, part := range parts {
+		parts[i] = d.name(dir, part)
+		dir = filepath.Join(dir, parts[i])
+	}
+	return parts
+}
+
+func (d *dirNames) name(parent, part string) string {
+	key := parent + string(filepath.Separator) + part
+	if name, ok := d.resolved[key]; ok {
+		return name
+	}
+	existingNames := d.children[parent]
+	entries, _ := ioutil.ReadDir(parent)
+	for _, e := range entries {
+		existingNames = append(existingNames, e.Name())
+	}
+	collides := ""
+	for _, name := range existingNames {
+		existing := norm.NFC.String(name)
+		if existing == part {
+			collides = ""
+			break
+		}
+		if strings.EqualFold(existing, part) {
+			collides = name
+		}
+	}
+	name := part
+	if collides != "" {
+		// The hash of the exact spelling keeps the name the same
+		// on every run.
+		sum := sha1.Sum([]byte(part))
+		name = part + "~" + hex.EncodeToString(sum[:4])
+		log.Printf("%s only differs in case from %s, using %s instead.\n", filepath.Join(parent, part), collides, name)
+	}
+	d.resolved[key] = name
+	d.children[parent] = append(d.children[parent], name)
+	return name
+}
@@ -0,0 +1,213 @@
+package organize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// A runSummary describes the outcome of a run, or of a single scan in
+// watch mode. It's used as the body of notification webhooks.
+type runSummary struct {
+	Event         string    `json:"event"`
+	Status        string    `json:"status"`
+	Host          string    `json:"host"`
+	Target        string    `json:"target"`
+	Started       time.Time `json:"started"`
+	Finished      time.Time `json:"finished"`
+	Series        int64     `json:"series"`
+	Files         int64     `json:"files"`
+	Bytes         int64     `json:"bytes"`
+	Failed        int       `json:"failed"`
+	ParseFailures int64     `json:"parse_failures"`
+	Damaged       int       `json:"damaged"`
+	Warnings      []string  `json:"warnings,omitempty"`
+}
+
+func (s runSummary) String() string {
+	return fmt.Sprintf(`dicomfmt %s %s on %s.
+
+Target:          %s
+Started:         %s
+Finished:        %s
+Series:          %d
+Files:           %d (%d bytes)
+Not organized:   %d
+Parse failures:  %d
+Damaged files:   %d
+%s`, s.Event, s.Status, s.Host, s.Target,
+		s.Started.Format(time.RFC1123), s.Finished.Format(time.RFC1123),
+		s.Series, s.Files, s.Bytes, s.Failed, s.ParseFailures, s.Damaged,
+		warningList(s.Warnings))
+}
+
+// warningList formats the limits that were exceeded for a summary.
+func warningList(warnings []string) string {
+	if len(warnings) == 0 {
+		return ""
+	}
+	return "\nLimits exceeded:\n  " + strings.Join(warnings, "\n  ") + "\n"
+}
+
+// smtpConfig is where email notifications are sent. The username and
+// password for servers which require authentication are read from the
+// DICOMFMT_SMTP_USER and DICOMFMT_SMTP_PASSWORD environment variables,
+// rather than options, so that they don't show up in the process list.
+type smtpConfig struct {
+	Addr string
+	From string
+	To   string
+}
+
+// A notifier sends a summary when a run or watch mode scan finishes.
+type notifier struct {
+	URL  string
+	SMTP smtpConfig
+
+	// If set, only runs which fail are notified about.
+	FailuresOnly bool
+
+	// If set, every summary is also recorded here, whether or not
+	// it's sent anywhere.
+	History *runHistory
+
+	// The counters at the start of the current run or scan.
+	start    time.Time
+	baseline metricSnapshot
+	failed   int
+	damaged  int
+	warnings int
+}
+
+// newNotifier returns a notifier, or nil if neither notifications nor a
+// run history are configured.
+func newNotifier(url string, mail smtpConfig, failuresOnly bool, history *runHistory) (*notifier, error) {
+	if url == "" && mail.To == "" && history == nil {
+		return nil, nil
+	}
+	if mail.To != "" && mail.Addr == "" {
+		return nil, fmt.Errorf("-notify-email requires -smtp-addr")
+	}
+	if mail.To != "" && mail.From == "" {
+		host, _ := os.Hostname()
+		mail.From = "dicomfmt@" + host
+	}
+	n := &notifier{URL: url, SMTP: mail, FailuresOnly: failuresOnly, History: history}
+	n.Reset(0)
+	return n, nil
+}
+
+// Reset starts counting towards the next summary. failed is the number of
+// files which have already failed to be organized.
+func (n *notifier) Reset(failed int) {
+	if n == nil {
+		return
+	}
+	n.start = clock()
+	n.baseline = metrics.Snapshot()
+	n.failed = failed
+	n.damaged = damaged.Len()
+	n.warnings = usage.Len()
+}
+
+// Summary returns the summary of everything since the last Reset.
+func (n *notifier) Summary(event, status, target string, failed int) runSummary {
+	host, _ := os.Hostname()
+	now := metrics.Snapshot()
+	return runSummary{
+		Event:         event,
+		Status:        status,
+		Host:          host,
+		Target:        target,
+		Started:       n.start,
+		Finished:      clock(),
+		Series:        now.Series - n.baseline.Series,
+		Files:         now.Files - n.baseline.Files,
+		Bytes:         now.Bytes - n.baseline.Bytes,
+		ParseFailures: now.ParseFailures - n.baseline.ParseFailures,
+		Failed:        failed - n.failed,
+		Damaged:       damaged.Len() - n.damaged,
+		Warnings:      usage.Since(n.warnings),
+	}
+}
+
+// Send sends a summary to every configured destination. Failures are
+// logged, since there's nothing else that can be done about them. It's
+// safe to call on a nil notifier.
+func (n *notifier) Send(s runSummary) {
+	if n == nil || (n.FailuresOnly && s.Status == "completed") {
+		return
+	}
+	if n.URL != "" {
+		if err := retries.Do("Sending notification to "+n.URL, func() error { return n.post(s) }); err != nil {
+			log.Println("Notification webhook failed:", err)
+		}
+	}
+	if n.SMTP.To != "" {
+		if err := retries.Do("Sending notification email", func() error { return n.mail(s) }); err != nil {
+			log.Println("Notification email failed:", err)
+		}
+	}
+}
+
+// Record adds a summary to the run history, if there is one, along with
+// the files in failed which failed since the last Reset.
+func (n *notifier) Record(s runSummary, failed []FileName) {
+	if n == nil || n.History == nil {
+		return
+	}
+	if n.failed < len(failed) {
+		failed = failed[n.failed:]
+	} else {
+		failed = nil
+	}
+	if err := n.History.Record(s, failed); err != nil {
+		log.Println(err)
+	}
+}
+
+func (n *notifier) post(s runSummary) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	resp, err := hookClient.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *notifier) mail(s runSummary) error {
+	to := strings.Split(n.SMTP.To, ",")
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.SMTP.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: dicomfmt %s %s on %s\r\n", s.Event, s.Status, s.Host)
+	fmt.Fprintf(&msg, "Date: %s\r\n", s.Finished.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(s.String(), "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if user := os.Getenv("DICOMFMT_SMTP_USER"); user != "" {
+		host, _, err := net.SplitHostPort(n.SMTP.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv("DICOMFMT_SMTP_PASSWORD"), host)
+	}
+	return smtp.SendMail(n.SMTP.Addr, auth, n.SMTP.From, to, msg.Bytes())
+}
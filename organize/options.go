@@ -0,0 +1,253 @@
+package organize
+
+import (
+	"io"
+	"time"
+)
+
+// A Command is what Run does with its arguments. Every command takes the
+// same Options as organizing does.
+type Command string
+
+const (
+	// CommandOrganize organizes the source directories into the target.
+	CommandOrganize Command = ""
+
+	// CommandPlan prints the operations that organizing would do as a
+	// JSON plan, without changing anything.
+	CommandPlan Command = "plan"
+
+	// CommandApply executes a plan written by CommandPlan.
+	CommandApply Command = "apply"
+
+	// CommandRetry organizes the files listed in a -dead-letter file
+	// again.
+	CommandRetry Command = "retry"
+
+	// CommandInfo prints the tags that organizing uses for each file,
+	// and where it would be placed.
+	CommandInfo Command = "info"
+
+	// CommandOrphans finds the files in a target which don't belong
+	// there.
+	CommandOrphans Command = "orphans"
+
+	// CommandPull retrieves studies from a PACS and organizes them.
+	CommandPull Command = "pull"
+)
+
+// Options configure organizing. Each one corresponds to the command line
+// option named in its comment, and is validated the same way. Options
+// should start from DefaultOptions, which has the same defaults as the
+// command line.
+//
+// Settings for how files are read and written, such as Verbose, Parser,
+// Retries and BandwidthLimit, are shared by everything in the process, so
+// the last Organizer created decides them.
+type Options struct {
+	Command Command
+
+	// The source directories followed by the target directory, or only
+	// the target directory to organize it in place. CommandApply and
+	// CommandRetry take the plan or dead letter file instead, and
+	// CommandInfo takes files or directories followed by an optional
+	// target.
+	Args []string
+
+	// A parsed configuration file, and the profile of it to use, for the
+	// settings which don't map directly to an option (-config and
+	// -profile). Applying its options is up to the caller, with
+	// Config.Apply.
+	Config  *Config
+	Profile string
+
+	Verbose bool // -verbose
+
+	// How series are laid out in the target.
+	Layout              string        // -layout
+	SeriesNumber        bool          // -series-number
+	Flatten             string        // -flatten
+	DerivedSubdir       string        // -derived-subdir
+	SiteLabels          SiteLabels    // -site-label
+	SiteTag             string        // -site-tag
+	Transliterate       string        // -transliterate
+	PatientRoots        PatientRoots  // -patient-root
+	ShardSize           int           // -shard-size
+	BatchSize           string        // -batch-size
+	BatchFiles          int           // -batch-files
+	MaxPath             int           // -max-path
+	Extension           string        // -extension
+	StripExtension      bool          // -strip-extension
+	Lowercase           bool          // -lowercase
+	BurnedInDir         string        // -burned-in-dir
+	PhantomDir          string        // -phantom-dir
+	SkipPhantoms        bool          // -skip-phantoms
+	PhantomPatterns     PredicateList // -phantom-pattern
+	NoPhantomHeuristics bool          // -no-phantom-heuristics
+
+	// How files are changed as they're organized.
+	StripOverlays  bool   // -strip-overlays
+	Compress       bool   // -compress
+	AddFileMeta    bool   // -add-file-meta
+	LittleEndian   bool   // -little-endian
+	ConvertRetired bool   // -convert-retired
+	ProvenanceTag  bool   // -provenance-tag
+	TagRules       string // -tag-rules
+	DescriptionMap string // -description-map
+
+	// Which files are read, and how.
+	MaxDepth       int           // -max-depth
+	FollowSymlinks bool          // -follow-symlinks
+	SkipHidden     bool          // -skip-hidden
+	FilesFrom      string        // -files-from
+	Patients       string        // -patients
+	Parser         string        // -parser
+	FullParse      bool          // -full-parse
+	Cache          string        // -cache
+	CacheSize      int           // -cache-size
+	ScanJobs       int           // -scan-jobs
+	Order          string        // -order
+	FileTimeout    time.Duration // -file-timeout
+	Retries        int           // -retries
+	RetryDelay     time.Duration // -retry-delay
+	Deterministic  bool          // -deterministic
+
+	// Where the times recorded in manifests, journals, audit logs and
+	// summaries, and the random bytes that names are generated from,
+	// come from. If nil, they're the real time and crypto/rand, or with
+	// Deterministic, a fixed time and a counter.
+	Clock func() time.Time
+	IDs   io.Reader
+
+	// How files are written.
+	DryRun         bool   // -dry-run
+	CheckOnly      bool   // -check-only
+	Interactive    bool   // -interactive
+	Force          bool   // -force
+	NoWriteSource  bool   // -no-write-source
+	DeleteVerified bool   // -delete-source-after-verify
+	KeepEmpty      bool   // -keep-empty
+	Trash          string // -trash
+	Quarantine     string // -quarantine
+	Mirror         string // -mirror
+	Remote         string // -remote
+	RemoteCommand  string // -remote-command
+	DirMode        string // -dir-mode
+	FileMode       string // -file-mode
+	Group          string // -group
+	SyncSeries     bool   // -sync-series
+	BandwidthLimit string // -bwlimit
+	ResumableSize  string // -resumable-size
+	Nice           bool   // -nice
+
+	// What's recorded about each run.
+	AuditLog          string // -audit-log
+	AuditSyslog       bool   // -audit-syslog
+	Journal           string // -journal
+	Resume            string // -resume
+	Manifest          string // -manifest
+	TrustManifest     bool   // -trust-manifest
+	ReviewList        string // -review-list
+	DeadLetter        string // -dead-letter
+	Expect            string // -expect
+	Stats             bool   // -stats
+	FHIRNDJSON        string // -fhir-ndjson
+	FHIRURL           string // -fhir-url
+	EncryptDir        string // -encrypt-dir
+	EncryptKey        string // -encrypt-key
+	EncryptKeyCommand string // -encrypt-key-command
+	EncryptPer        string // -encrypt-per
+	Print0            bool   // -print0
+	JSONLines         bool   // -json-lines
+
+	// Who's told about each series and run.
+	OnSeriesComplete    string // -on-series-complete
+	OnSeriesCompleteURL string // -on-series-complete-url
+	NotifyURL           string // -notify-url
+	NotifyEmail         string // -notify-email
+	SMTPAddr            string // -smtp-addr
+	SMTPFrom            string // -smtp-from
+	NotifyFailuresOnly  bool   // -notify-failures-only
+	WarnPatientSize     string // -warn-patient-size
+	WarnPatientStudies  int    // -warn-patient-studies
+	WarnPatientFiles    int    // -warn-patient-files
+	WarnStudySize       string // -warn-study-size
+	WarnStudyFiles      int    // -warn-study-files
+	WarnDirFiles        int    // -warn-dir-files
+	WarnURL             string // -warn-url
+
+	// Running as a service.
+	Watch          time.Duration // -watch
+	MinAge         time.Duration // -min-age
+	Reconcile      string        // -reconcile
+	StudySettle    time.Duration // -study-settle
+	StagingDir     string        // -staging-dir
+	Receive        string        // -receive
+	MaxUploadSize  string        // -max-upload-size
+	OrthancURL     string        // -orthanc-url
+	MetricsAddr    string        // -metrics-addr
+	ControlAddr    string        // -control-addr
+	HTTPAddr       string        // -http
+	RunHistory     string        // -run-history
+	ActivitySocket string        // -activity-socket
+	Auth           ServerAuth    // -api-tokens, -tls-cert and -tls-key
+
+	// CommandOrphans.
+	FixOrphans string // -fix-orphans
+	OrphanDir  string // -orphan-dir
+
+	// CommandPull.
+	Pull PullOptions
+}
+
+// PullOptions are the PACS and the studies that CommandPull retrieves.
+type PullOptions struct {
+	Host      string // -host
+	Port      int    // -port
+	AEC       string // -aec
+	AET       string // -aet
+	Retrieve  string // -retrieve
+	StoreAddr string // -store-addr
+
+	Accession string // -accession
+	PatientID string // -patient-id
+	StudyUID  string // -study-uid
+	StudyDate string // -study-date
+}
+
+// DefaultOptions returns the options that organizing uses if none are
+// given on the command line.
+func DefaultOptions() Options {
+	return Options{
+		Layout:        DefaultLayout,
+		SiteLabels:    make(SiteLabels),
+		Parser:        parserBackend,
+		CacheSize:     1000000,
+		ScanJobs:      4,
+		Retries:       3,
+		RetryDelay:    time.Second,
+		RemoteCommand: "dicomfmt",
+		DirMode:       "0750",
+		ResumableSize: "1G",
+		EncryptPer:    "patient",
+		MaxUploadSize: "4G",
+		Pull: PullOptions{
+			Port:      104,
+			AET:       "DICOMFMT",
+			Retrieve:  "move",
+			StoreAddr: ":11112",
+		},
+	}
+}
+
+// SetVerbose sets whether extra information is printed to standard error,
+// as Options.Verbose does, for the functions which don't take Options.
+func SetVerbose(v bool) {
+	verbose = v
+}
+
+// SetParser selects the parser backend that files are read with, as
+// Options.Parser does, for the functions which don't take Options.
+func SetParser(name string) {
+	parserBackend = name
+}
@@ -0,0 +1,112 @@
+package organize
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A seriesOrder is the order that series are organized in, for -order,
+// so that in a time critical migration the series which are needed soonest
+// are available in the new layout first.
+type seriesOrder string
+
+const (
+	// Series are organized in order of their SeriesInstanceUID.
+	orderUID seriesOrder = ""
+	// The series of the most recent studies are organized first.
+	orderNewest seriesOrder = "newest"
+	orderOldest seriesOrder = "oldest"
+	// The series with the most bytes of files are organized first.
+	orderLargest  seriesOrder = "largest"
+	orderSmallest seriesOrder = "smallest"
+)
+
+func parseOrder(s string) (seriesOrder, error) {
+	switch order := seriesOrder(s); order {
+	case orderNewest, orderOldest, orderLargest, orderSmallest:
+		return order, nil
+	case "", "uid":
+		return orderUID, nil
+	}
+	return orderUID, fmt.Errorf("unknown -order %q", s)
+}
+
+// Tags returns the series tags which are needed to order series.
+func (order seriesOrder) Tags() []string {
+	if order == orderNewest || order == orderOldest {
+		return []string{"StudyDate", "StudyTime"}
+	}
+	return nil
+}
+
+// studyTime returns when the study that s is part of was done, according
+// to its StudyDate and StudyTime, or the InstanceCreationTime of its first
+// file if it doesn't have a StudyDate.
+func studyTime(s SeriesFiles) time.Time {
+	date := strings.TrimSpace(s.Tags["StudyDate"])
+	t, err := time.Parse("20060102", date)
+	if err != nil {
+		return s.InstanceCreationTime
+	}
+	// StudyTime can leave off the seconds and minutes, and have a
+	// fraction of a second after them.
+	if hms := strings.TrimSpace(s.Tags["StudyTime"]); len(hms) >= 2 {
+		if i := strings.IndexByte(hms, '.'); i >= 0 {
+			hms = hms[:i]
+		}
+		if len(hms) < 6 {
+			hms += strings.Repeat("0", 6-len(hms))
+		}
+		if tt, err := time.Parse("20060102150405", date+hms[:6]); err == nil {
+			t = tt
+		}
+	}
+	return t
+}
+
+// seriesSize returns the total size of the files in s. Files which can't
+// be stat'd are counted as empty.
+func seriesSize(s SeriesFiles) int64 {
+	var size int64
+	for _, file := range s.Files {
+		if fi, err := os.Stat(file.String()); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// UIDs returns the SeriesInstanceUIDs of the series in a map in the order
+// that they should be organized. Series which tie are in order of their
+// SeriesInstanceUID, so that the order is always the same.
+func (order seriesOrder) UIDs(series map[SeriesInstanceUID]SeriesFiles) []SeriesInstanceUID {
+	uids := sortedUIDs(series)
+	switch order {
+	case orderNewest, orderOldest:
+		times := make(map[SeriesInstanceUID]time.Time, len(uids))
+		for _, uid := range uids {
+			times[uid] = studyTime(series[uid])
+		}
+		sort.SliceStable(uids, func(i, j int) bool {
+			if order == orderNewest {
+				return times[uids[i]].After(times[uids[j]])
+			}
+			return times[uids[i]].Before(times[uids[j]])
+		})
+	case orderLargest, orderSmallest:
+		sizes := make(map[SeriesInstanceUID]int64, len(uids))
+		for _, uid := range uids {
+			sizes[uid] = seriesSize(series[uid])
+		}
+		sort.SliceStable(uids, func(i, j int) bool {
+			if order == orderLargest {
+				return sizes[uids[i]] > sizes[uids[j]]
+			}
+			return sizes[uids[i]] < sizes[uids[j]]
+		})
+	}
+	return uids
+}
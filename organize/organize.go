@@ -0,0 +1,446 @@
+package organize
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Organizer places the files of each series into their directory in the
+// target.
+type Organizer struct {
+	Dst  string
+	Move bool
+
+	// The filesystem that Dst is on, or nil for the local disk.
+	FS FileSystem
+
+	// The layout template for series directories, and any rules
+	// overriding it for specific files.
+	Layout      string
+	LayoutRules *layoutRules
+
+	// If set, derived images are placed in a directory with this name
+	// next to the series directories of their study.
+	DerivedDir string
+
+	// If set, files are named by their SOPInstanceUID instead of
+	// keeping their original names, since the layout puts multiple
+	// series in the same directory.
+	Flatten bool
+
+	// Maps series descriptions to the canonical names that series are
+	// organized by.
+	Descriptions descriptionMap
+
+	// How organized files are renamed.
+	Naming fileNaming
+
+	// Where each file has been planned to be placed this run, for
+	// detecting files that renaming gives the same name.
+	planned map[FileName]FileName
+
+	// If positive, series directories with more than this many files
+	// are split into numbered subfolders of at most this many files.
+	ShardSize int
+
+	// The number of files in each shard of the directories that have
+	// been planned this run.
+	shards map[string][]int
+	// The shard that each concatenation was placed in, keyed by the
+	// directory and ConcatenationUID.
+	concatShards map[string]string
+
+	// Where series are organized into instead of Dst.
+	Routes routes
+
+	// If set, series that aren't routed elsewhere are spread across
+	// these directories by patient instead of being placed in Dst.
+	PatientRoots PatientRoots
+
+	// If set, the target is split into numbered batches of a limited
+	// size.
+	Batches *batches
+
+	// If set, studies are held in a staging area until they're
+	// complete.
+	Gate *studyGate
+
+	// If set, series of QA phantoms and test patients are skipped or
+	// placed in their own directory.
+	Phantoms *phantomFilter
+
+	// If set, series flagged as likely containing burned in
+	// annotations are placed here instead of Dst.
+	ReviewDir string
+
+	StripOverlays bool
+
+	// If set, organized files are stored gzip compressed.
+	Compress bool
+
+	// If set, raw datasets are given file meta information when
+	// they're organized.
+	AddFileMeta bool
+
+	// If set, big endian files are converted to little endian when
+	// they're organized.
+	LittleEndian bool
+
+	// If set, images of retired SOP classes are converted to Secondary
+	// Capture Images when they're organized.
+	ConvertRetired bool
+
+	// If set, the original path of each file is written into a private
+	// element of the organized copy.
+	ProvenanceTag bool
+
+	// If set, elements are set by these rules in the organized copy.
+	TagRules *tagRules
+
+	// The sites that source directories came from.
+	Sites SiteLabels
+
+	// How source directories are traversed.
+	Walk WalkOptions
+
+	// The order that the series found by a scan are organized in.
+	Order seriesOrder
+
+	// If set, detects series directories whose names only differ in
+	// case from existing ones.
+	Names *dirNames
+
+	// How series directories are printed to stdout.
+	Output outputFormat
+
+	Audit    *auditLog
+	Journal  *journal
+	Manifest *manifest
+	Review   *reviewList
+	Hooks    seriesHooks
+	Notify   *notifier
+	Expected *expectedStudies
+	Validate *tagProfiles
+	Mirror   *mirror
+	Stats    *objectStats
+	Retired  *retiredSOPs
+	FHIR     *fhirExporter
+
+	// If set, organized files are also written into an encrypted
+	// archive for each patient or study.
+	Encrypt *archiver
+
+	// If set, organizing blocks before each series while it's
+	// paused.
+	Pause *pauser
+
+	// If set, removed directories and replaced files are moved here
+	// instead of being deleted.
+	Trash *trash
+
+	// If set, conflicts are resolved by asking instead of overwriting.
+	Conflicts *resolver
+
+	// The files placed by this run with -interactive, keyed by their
+	// directory and SOPInstanceUID.
+	placedSOPs map[string]FileName
+
+	// If non-nil, files which it returns true for aren't organized.
+	Skip func(FileName, os.FileInfo) bool
+
+	// If set, what's already in the target according to the manifest,
+	// which Skip also uses.
+	Trusted *manifestIndex
+
+	// If set, each source file is deleted once it's been copied and the
+	// copy's hash matches.
+	DeleteVerified bool
+
+	// If set, files which were already copied to their destination
+	// with the same content aren't copied again.
+	SkipIdentical bool
+
+	// If set, empty directories aren't removed from the sources when
+	// moving.
+	KeepEmpty bool
+
+	// The source directories that have been scanned.
+	roots []string
+
+	// Directories removed by Sweep.
+	Removed []string
+
+	// Files which couldn't be organized.
+	Failed []FileName
+
+	// If the run was interrupted, the file that it stopped before.
+	Stopped FileName
+	// Whether the run was interrupted.
+	interrupted bool
+}
+
+// Scan finds every series in src. If skip is non-nil, any file that it
+// returns true for is ignored. If ctx is cancelled, the series found so
+// far are returned.
+func (o *Organizer) Scan(ctx context.Context, src string, skip func(FileName, os.FileInfo) bool) map[SeriesInstanceUID]SeriesFiles {
+	o.addRoot(src)
+	return o.scan(ctx, src, skip, nil)
+}
+
+// ScanAll finds every series in the source directories, scanning up to
+// jobs of them at the same time, and reports how many files were found in
+// each.
+func (o *Organizer) ScanAll(ctx context.Context, srcs []string, jobs int) map[SeriesInstanceUID]SeriesFiles {
+	if jobs < 1 {
+		jobs = 1
+	}
+	series := make(map[SeriesInstanceUID]SeriesFiles)
+	stats := make([]*scanStats, len(srcs))
+	results := make([]map[SeriesInstanceUID]SeriesFiles, len(srcs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, src := range srcs {
+		o.addRoot(src)
+		stats[i] = &scanStats{Source: src}
+		wg.Add(1)
+		go func(i int, src string, stats *scanStats) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			start := time.Now()
+			found := o.scan(ctx, src, nil, stats)
+			stats.Elapsed = time.Since(start)
+
+			results[i] = found
+		}(i, src, stats[i])
+	}
+	wg.Wait()
+	// The results are merged in the order of the sources, so that the
+	// first file of each series doesn't depend on which source was
+	// scanned the fastest.
+	for _, found := range results {
+		for _, uid := range sortedUIDs(found) {
+			addSeries(series, uid, found[uid])
+		}
+	}
+	if len(srcs) > 1 || verbose {
+		reportScans(stats)
+	}
+	return series
+}
+
+// scan does the work of Scan, counting the files found in stats if it's
+// non-nil. It's safe to call concurrently for different sources.
+func (o *Organizer) scan(ctx context.Context, src string, skip func(FileName, os.FileInfo) bool, stats *scanStats) map[SeriesInstanceUID]SeriesFiles {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		log.Printf("%s does not exist.", src)
+		return nil
+	}
+	opts := o.Walk
+	opts.Skip = skip
+	opts.Stats = stats
+	if o.Skip != nil {
+		opts.Skip = func(f FileName, info os.FileInfo) bool {
+			return o.Skip(f, info) || (skip != nil && skip(f, info))
+		}
+	}
+	series, err := splitSeries(ctx, FileName(src), opts)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if site := o.Sites.For(src); site != "" {
+		for uid, files := range series {
+			files.Site = site
+			series[uid] = files
+		}
+	}
+	return series
+}
+
+func (o *Organizer) addRoot(src string) {
+	src = filepath.Clean(src)
+	for _, root := range o.roots {
+		if root == src {
+			return
+		}
+	}
+	o.roots = append(o.roots, src)
+}
+
+// Dir organizes every series found in src.
+func (o *Organizer) Dir(ctx context.Context, src string, skip func(FileName, os.FileInfo) bool) {
+	o.All(ctx, o.Scan(ctx, src, skip))
+}
+
+// All organizes every series in a map returned by SplitSeries, stopping
+// between files if ctx is cancelled.
+func (o *Organizer) All(ctx context.Context, series map[SeriesInstanceUID]SeriesFiles) {
+	for _, uid := range o.Order.UIDs(series) {
+		if o.stopping(ctx) {
+			return
+		}
+		o.Series(ctx, series[uid])
+	}
+}
+
+// fs returns the filesystem that the target is on.
+func (o *Organizer) fs() FileSystem {
+	if o.FS == nil {
+		return LocalFS{}
+	}
+	return o.FS
+}
+
+// stopping reports whether the run should stop because ctx was cancelled,
+// and remembers it so that Finish reports the run as interrupted. It must
+// only be called by the goroutine placing files.
+func (o *Organizer) stopping(ctx context.Context) bool {
+	if canceled(ctx) {
+		o.interrupted = true
+	}
+	return o.interrupted
+}
+
+// removeEmpty removes dir if it's empty, moving it to the trash if there is
+// one.
+func (o *Organizer) removeEmpty(dir string) bool {
+	if o.Trash != nil {
+		return o.Trash.EmptyDir(dir)
+	}
+	return removeEmpty(dir)
+}
+
+// Sweep removes every empty directory below the scanned source
+// directories when moving or deleting verified sources, deepest first so
+// that directories which only contained empty directories are removed
+// too. The source directories themselves are kept.
+func (o *Organizer) Sweep() {
+	if (!o.Move && !o.DeleteVerified) || o.KeepEmpty {
+		return
+	}
+	for _, root := range o.roots {
+		var dirs []string
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if path != root && (sameAsAny(info, o.Walk.Exclude) || (o.Walk.SkipHidden && strings.HasPrefix(info.Name(), "."))) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		})
+		for i := len(dirs) - 1; i > 0; i-- {
+			if o.removeEmpty(dirs[i]) {
+				o.Audit.Record("remove-dir", dirs[i], "")
+				o.Removed = append(o.Removed, dirs[i])
+			}
+		}
+	}
+}
+
+// Finish flushes anything that was buffered, and reports the outcome of
+// the run. It returns the status that dicomfmt should exit with.
+func (o *Organizer) Finish() int {
+	status := 0
+	o.Sweep()
+	if len(o.Removed) > 0 {
+		log.Printf("Removed %d empty directories:\n", len(o.Removed))
+		for _, dir := range o.Removed {
+			log.Println("\t" + dir)
+		}
+	}
+	if err := o.FHIR.Flush(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := o.Encrypt.Flush(); err != nil {
+		status = 1
+	}
+	if err := o.Journal.Close(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := o.Manifest.Close(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := o.Review.Close(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := o.Trash.Close(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := o.Audit.Close(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := cached.Save(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	if err := deadLetters.Write(); err != nil {
+		log.Println(err)
+		status = 1
+	}
+	damaged.Report()
+	onlyPatients.Report()
+	o.Trusted.Report()
+	timedOut.Report()
+	usage.Report()
+	o.Expected.Report()
+	o.Validate.Report()
+	o.Stats.Report()
+	o.Retired.Report()
+	if len(o.Failed) > 0 {
+		log.Printf("%d files could not be organized.\n", len(o.Failed))
+		status = 1
+	}
+	if o.interrupted {
+		if o.Stopped != "" {
+			log.Printf("Interrupted before organizing %s.\n", o.Stopped)
+		} else {
+			log.Println("Interrupted.")
+		}
+		if o.Journal != nil {
+			log.Printf("Run again with -resume %s to continue.\n", o.Journal.Path)
+		}
+		status = 130
+	}
+	o.notify("run", status)
+	return status
+}
+
+// notify sends a summary of everything organized since the last
+// notification, with a status based on the exit status.
+func (o *Organizer) notify(event string, status int) {
+	if o.Notify == nil {
+		return
+	}
+	result := "completed"
+	switch status {
+	case 0:
+	case 130:
+		result = "interrupted"
+	default:
+		result = "failed"
+	}
+	s := o.Notify.Summary(event, result, o.Dst, len(o.Failed))
+	o.Notify.Record(s, o.Failed)
+	o.Notify.Send(s)
+	o.Notify.Reset(len(o.Failed))
+}
+
+// Series places every file of a series into the series directory, and
+// returns the new path of each file.
+func (o *Organizer) Series(ctx context.Context, files SeriesFiles) []FileName {
+	return o.Execute(ctx, o.Plan(files))
+}
@@ -0,0 +1,162 @@
+package organize
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An orphanReport lists the files and directories in an organized tree
+// that don't belong there.
+type orphanReport struct {
+	// Files that aren't DICOM, such as copies of reports or files left
+	// behind by other tools.
+	Leftovers []string
+
+	// The series with instances whose tags place them somewhere else
+	// under the current options.
+	Misplaced []SeriesPlan
+
+	// Directories with no files in them, deepest first.
+	EmptyDirs []string
+}
+
+// Len returns the number of orphans found.
+func (r orphanReport) Len() int {
+	n := len(r.Leftovers) + len(r.EmptyDirs)
+	for _, sp := range r.Misplaced {
+		for _, op := range sp.Operations {
+			if op.Op == opMove {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Print prints every orphan to stdout, one per line.
+func (r orphanReport) Print() {
+	for _, file := range r.Leftovers {
+		fmt.Printf("not dicom\t%s\n", file)
+	}
+	for _, sp := range r.Misplaced {
+		for _, op := range sp.Operations {
+			if op.Op == opMove {
+				fmt.Printf("misplaced\t%s -> %s\n", op.Src, op.Dst)
+			}
+		}
+	}
+	for _, dir := range r.EmptyDirs {
+		fmt.Printf("empty\t%s\n", dir)
+	}
+}
+
+// findOrphans checks an organized tree against where the organizer would
+// place its contents. Files directly in dst are never orphans, since
+// that's where manifests and logs are kept, and neither is anything in
+// hidden or excluded directories, such as the staging area.
+func findOrphans(ctx context.Context, o *Organizer, dst string) orphanReport {
+	var r orphanReport
+	dicom := make(map[FileName]bool)
+	for _, s := range o.Scan(ctx, dst, nil) {
+		for _, file := range s.Files {
+			dicom[file] = true
+		}
+		sp := o.Plan(s)
+		for _, op := range sp.Operations {
+			if op.Op == opMove {
+				r.Misplaced = append(r.Misplaced, sp)
+				break
+			}
+		}
+	}
+
+	root := filepath.Clean(dst)
+	var dirs []string
+	hasFiles := make(map[string]bool)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".") || sameAsAny(info, o.Walk.Exclude) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		for dir := filepath.Dir(path); dir != root && !hasFiles[dir]; dir = filepath.Dir(dir) {
+			hasFiles[dir] = true
+		}
+		if filepath.Dir(path) == root || !info.Mode().IsRegular() || dicom[FileName(path)] {
+			return nil
+		}
+		r.Leftovers = append(r.Leftovers, path)
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if !hasFiles[dirs[i]] {
+			r.EmptyDirs = append(r.EmptyDirs, dirs[i])
+		}
+	}
+	return r
+}
+
+// fixOrphans moves misplaced instances to where they belong, and either
+// moves leftover files into orphanDir, keeping their paths relative to dst,
+// or removes them. Empty directories are removed when the organizer
+// finishes.
+func fixOrphans(ctx context.Context, o *Organizer, r orphanReport, remove bool, orphanDir string) {
+	for _, sp := range r.Misplaced {
+		if o.stopping(ctx) {
+			return
+		}
+		o.Execute(ctx, sp)
+	}
+	for _, file := range r.Leftovers {
+		if o.stopping(ctx) {
+			return
+		}
+		if remove {
+			var err error
+			if o.Trash != nil {
+				err = o.Trash.File(file)
+			} else {
+				err = os.Remove(file)
+			}
+			if err != nil {
+				log.Println(err)
+				o.Failed = append(o.Failed, FileName(file))
+				continue
+			}
+			o.Audit.Record("delete", file, "not a DICOM file")
+			continue
+		}
+		rel, err := filepath.Rel(o.Dst, file)
+		if err != nil {
+			log.Println(err)
+			o.Failed = append(o.Failed, FileName(file))
+			continue
+		}
+		dstFile := FileName(filepath.Join(orphanDir, rel))
+		if _, err := os.Stat(dstFile.String()); err == nil {
+			dstFile = freeName(dstFile)
+		}
+		if err := perms.MkdirAll(LocalFS{}, filepath.Dir(dstFile.String())); err != nil {
+			log.Fatalln(err)
+		}
+		if err := os.Rename(file, dstFile.String()); err != nil {
+			log.Println(err)
+			o.Failed = append(o.Failed, FileName(file))
+			continue
+		}
+		o.Audit.Record("move", file, "not a DICOM file, moved to "+dstFile.String())
+	}
+}
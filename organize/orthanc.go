@@ -0,0 +1,196 @@
+package organize
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An orthancSource imports studies from an Orthanc server using its REST
+// API.
+//
+// Imported instances are recorded in a state file in the target directory,
+// so an interrupted import can be continued by running it again.
+type orthancSource struct {
+	URL    string
+	client *http.Client
+
+	// Instances are downloaded here before they're organized.
+	staging string
+
+	statePath string
+	done      map[string]bool
+}
+
+func newOrthancSource(url, target string) (*orthancSource, error) {
+	s := &orthancSource{
+		URL:       strings.TrimRight(url, "/"),
+		client:    &http.Client{Timeout: 10 * time.Minute},
+		staging:   filepath.Join(target, ".orthanc-incoming"),
+		statePath: filepath.Join(target, ".orthanc-imported"),
+		done:      make(map[string]bool),
+	}
+	f, err := os.Open(s.statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s.done[scanner.Text()] = true
+	}
+	return s, scanner.Err()
+}
+
+// validOrthancID reports whether id looks like an Orthanc identifier,
+// which is groups of hex digits separated by dashes. IDs come from the
+// server and are used in paths, so anything else is refused.
+func validOrthancID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !strings.ContainsRune("0123456789abcdefABCDEF-", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *orthancSource) request(path string) (*http.Response, error) {
+	resp, err := s.client.Get(s.URL + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected response %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *orthancSource) getJSON(path string, v interface{}) error {
+	resp, err := s.request(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *orthancSource) download(id, dir string) error {
+	resp, err := s.request("/instances/" + id + "/file")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(filepath.Join(dir, id+".dcm"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// markDone records instances as imported in the state file.
+func (s *orthancSource) markDone(ids []string) error {
+	f, err := os.OpenFile(s.statePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, id := range ids {
+		if _, err := fmt.Fprintln(f, id); err != nil {
+			return err
+		}
+		s.done[id] = true
+	}
+	return f.Close()
+}
+
+// Import downloads every study which hasn't already been imported, and
+// organizes it with o. Studies are downloaded and organized one at a time.
+// If ctx is cancelled, it stops without marking the study it was
+// organizing as imported, so that it's imported again on the next run.
+func (s *orthancSource) Import(ctx context.Context, o *Organizer) error {
+	var studies []string
+	if err := s.getJSON("/studies", &studies); err != nil {
+		return err
+	}
+	for _, study := range studies {
+		if o.stopping(ctx) {
+			return nil
+		}
+		if !validOrthancID(study) {
+			log.Printf("Skipping study with invalid ID %q.\n", study)
+			continue
+		}
+		var instances []struct{ ID string }
+		if err := s.getJSON("/studies/"+study+"/instances", &instances); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		dir := filepath.Join(s.staging, study)
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+		var downloaded []string
+		for _, instance := range instances {
+			if s.done[instance.ID] {
+				continue
+			}
+			if !validOrthancID(instance.ID) {
+				log.Printf("Skipping instance with invalid ID %q in study %s.\n", instance.ID, study)
+				continue
+			}
+			if err := s.download(instance.ID, dir); err != nil {
+				log.Println(err)
+				continue
+			}
+			downloaded = append(downloaded, instance.ID)
+		}
+		if len(downloaded) == 0 {
+			removeEmpty(dir)
+			continue
+		}
+
+		series, err := SplitSeries(FileName(dir))
+		if err != nil {
+			return err
+		}
+		failedBefore := len(o.Failed)
+		for _, uid := range o.Order.UIDs(series) {
+			o.Series(ctx, series[uid])
+		}
+		if o.stopping(ctx) {
+			return nil
+		}
+		if n := len(o.Failed) - failedBefore; n > 0 {
+			// The study is imported again on the next run.
+			log.Printf("Could not place %s from study %s, not marking it as imported.\n", plural(n, "instance", "instances"), study)
+			continue
+		}
+		removeEmpty(dir)
+		if err := s.markDone(downloaded); err != nil {
+			return err
+		}
+		if verbose {
+			log.Printf("Imported %d instances from study %s\n", len(downloaded), study)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package organize
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// An outputFormat determines how the names of series directories are
+// printed to stdout.
+type outputFormat int
+
+const (
+	// One directory per line.
+	outputLines outputFormat = iota
+	// Each directory followed by a NUL byte, for xargs -0.
+	outputNUL
+	// One JSON object describing the series per line.
+	outputJSONLines
+)
+
+// Print writes a series directory, which files of the series were placed
+// in, to stdout in the format.
+func (f outputFormat) Print(dir string, series SeriesFiles, files int) {
+	switch f {
+	case outputNUL:
+		fmt.Printf("%s\x00", dir)
+	case outputJSONLines:
+		line, err := json.Marshal(newSeriesEvent(dir, series, files))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Stdout.Write(append(line, '\n'))
+	default:
+		fmt.Println(dir)
+	}
+}
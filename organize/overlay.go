@@ -0,0 +1,24 @@
+package organize
+
+import (
+	"log"
+)
+
+// isOverlayOrCurveGroup reports whether group is one of the repeating
+// overlay (6000-601E) or retired curve (5000-501E) groups, which may
+// contain annotations or identifiers.
+func isOverlayOrCurveGroup(group uint16) bool {
+	if group%2 != 0 {
+		// Odd groups are private.
+		return false
+	}
+	return (group >= 0x6000 && group <= 0x601E) || (group >= 0x5000 && group <= 0x501E)
+}
+
+// removeOverlays is a rewrite which removes any overlay and curve groups.
+func removeOverlays(src FileName, ds *dataset) error {
+	if n := ds.removeGroups(isOverlayOrCurveGroup); n > 0 && verbose {
+		log.Printf("Removed %d overlay and curve elements from %s\n", n, src)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package organize
+
+import "testing"
+
+func TestIsOverlayOrCurveGroup(t *testing.T) {
+	tests := []struct {
+		group uint16
+		want  bool
+	}{
+		{0x6000, true},
+		{0x6002, true},
+		{0x601E, true},
+		{0x5000, true},
+		{0x501E, true},
+		// Odd groups are private.
+		{0x6001, false},
+		{0x5011, false},
+		// Even groups past the repeating range aren't overlays or
+		// curves.
+		{0x6020, false},
+		{0x60FE, false},
+		{0x5020, false},
+		{0x0028, false},
+		{0x7FE0, false},
+	}
+	for _, tt := range tests {
+		if got := isOverlayOrCurveGroup(tt.group); got != tt.want {
+			t.Errorf("isOverlayOrCurveGroup(%#04x) = %v, want %v", tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveOverlays(t *testing.T) {
+	ds := &dataset{TransferSyntax: explicitVRLittleEndian}
+	for _, el := range []element{
+		{Tag: tag{0x0010, 0x0010}, VR: "PN", Value: []byte("DOE^JANE")},
+		{Tag: tag{0x5000, 0x3000}, VR: "OB", Value: make([]byte, 4)},
+		{Tag: tag{0x6000, 0x3000}, VR: "OB", Value: make([]byte, 4)},
+		{Tag: tag{0x601E, 0x0010}, VR: "US", Value: make([]byte, 2)},
+		{Tag: tag{0x6020, 0x0010}, VR: "US", Value: make([]byte, 2)},
+	} {
+		ds.setElement(el)
+	}
+	if err := removeOverlays("test.dcm", ds); err != nil {
+		t.Fatal(err)
+	}
+	var kept []tag
+	for _, el := range ds.Elements {
+		kept = append(kept, el.Tag)
+	}
+	if len(kept) != 2 || kept[0] != (tag{0x0010, 0x0010}) || kept[1] != (tag{0x6020, 0x0010}) {
+		t.Errorf("kept %v, want PatientName and (6020,0010)", kept)
+	}
+}
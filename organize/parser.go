@@ -0,0 +1,89 @@
+package organize
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Header is the parsed header of a DICOM file.
+type Header interface {
+	// Lookup returns the value of the element with the given
+	// keyword (such as PatientName), or an error if the file doesn't
+	// contain it.
+	Lookup(name string) (string, error)
+}
+
+// A HeaderParser parses the contents of a DICOM file.
+type HeaderParser interface {
+	Parse(data []byte) (Header, error)
+}
+
+// parserBackends are the parsers that dicomfmt was built with, and any
+// registered by RegisterParser, keyed by the name used to select them
+// with -parser.
+var parserBackends = make(map[string]func() (HeaderParser, error))
+
+// The name of the parser backend to use. The default can be changed at
+// build time with
+// -ldflags "-X github.com/driusan/dicomfmt/organize.parserBackend=NAME".
+var parserBackend = "go-dicom"
+
+// RegisterParser adds a parser backend, which can then be selected by name
+// with Options.Parser, replacing any backend already registered with that
+// name. It should be called from an init function, before anything is
+// organized. The constructor is called for each parser that's needed, and
+// each parser is only used by one goroutine at a time.
+func RegisterParser(name string, constructor func() (HeaderParser, error)) {
+	parserBackends[name] = constructor
+}
+
+// ParserNames returns the names of the parser backends, separated by
+// commas.
+func ParserNames() string {
+	var names []string
+	for name := range parserBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newHeaderParser creates a parser using the selected backend.
+func newHeaderParser() (HeaderParser, error) {
+	constructor, ok := parserBackends[parserBackend]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser %q (available: %s)", parserBackend, ParserNames())
+	}
+	return constructor()
+}
+
+// Parsers which aren't in use. Creating a parser is expensive, since
+// go-dicom loads its whole data dictionary for each one, so they're reused
+// for every file instead. Each parser is only used by one goroutine at a
+// time.
+var idleParsers sync.Pool
+
+// getParser returns a parser using the selected backend, which should be
+// returned with putParser when it's no longer needed.
+func getParser() (HeaderParser, error) {
+	if p, ok := idleParsers.Get().(HeaderParser); ok {
+		return p, nil
+	}
+	return newHeaderParser()
+}
+
+func putParser(p HeaderParser) {
+	idleParsers.Put(p)
+}
+
+// lookupValue returns the value of the named element, or the empty string if
+// it's not present in the file.
+func lookupValue(data Header, name string) string {
+	v, err := data.Lookup(name)
+	if err != nil {
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,41 @@
+package organize
+
+import (
+	"github.com/driusan/go-dicom"
+)
+
+// goDicomParser parses files with github.com/driusan/go-dicom, which
+// dicomfmt has always used.
+type goDicomParser struct {
+	p *dicom.Parser
+}
+
+type goDicomHeader struct {
+	*dicom.DicomFile
+}
+
+func init() {
+	RegisterParser("go-dicom", func() (HeaderParser, error) {
+		p, err := dicom.NewParser()
+		if err != nil {
+			return nil, err
+		}
+		return goDicomParser{p}, nil
+	})
+}
+
+func (p goDicomParser) Parse(data []byte) (Header, error) {
+	file, err := p.p.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return goDicomHeader{file}, nil
+}
+
+func (h goDicomHeader) Lookup(name string) (string, error) {
+	el, err := h.LookupElement(name)
+	if err != nil {
+		return "", err
+	}
+	return el.GetValue(), nil
+}
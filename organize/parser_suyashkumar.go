@@ -0,0 +1,67 @@
+//go:build suyashkumar
+// +build suyashkumar
+
+package organize
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	dicomtag "github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// suyashkumarParser parses files with github.com/suyashkumar/dicom, which
+// handles some Enhanced MR and vendor specific files that go-dicom can't.
+// It's only included when building with the suyashkumar tag.
+type suyashkumarParser struct{}
+
+type suyashkumarHeader struct {
+	ds dicom.Dataset
+}
+
+func init() {
+	RegisterParser("suyashkumar", func() (HeaderParser, error) {
+		return suyashkumarParser{}, nil
+	})
+}
+
+func (suyashkumarParser) Parse(data []byte) (Header, error) {
+	ds, err := dicom.Parse(bytes.NewReader(data), int64(len(data)), nil, dicom.SkipPixelData())
+	if err != nil {
+		return nil, err
+	}
+	return suyashkumarHeader{ds}, nil
+}
+
+func (h suyashkumarHeader) Lookup(name string) (string, error) {
+	info, err := dicomtag.FindByName(name)
+	if err != nil {
+		return "", err
+	}
+	el, err := h.ds.FindElementByTag(info.Tag)
+	if err != nil {
+		return "", err
+	}
+	// Multiple values are joined with a backslash, as they're encoded
+	// in the file.
+	switch v := el.Value.GetValue().(type) {
+	case []string:
+		return strings.Join(v, `\`), nil
+	case []int:
+		s := make([]string, len(v))
+		for i, n := range v {
+			s[i] = fmt.Sprint(n)
+		}
+		return strings.Join(s, `\`), nil
+	case []float64:
+		s := make([]string, len(v))
+		for i, n := range v {
+			s[i] = fmt.Sprint(n)
+		}
+		return strings.Join(s, `\`), nil
+	default:
+		return el.Value.String(), nil
+	}
+}
@@ -0,0 +1,59 @@
+package organize
+
+import (
+	"strings"
+	"testing"
+)
+
+// BenchmarkParserReuse compares creating a parser for every file, as
+// dicomfmt used to, with reusing idle parsers.
+func BenchmarkParserReuse(b *testing.B) {
+	data := synthBytes(b, "PatientName=DOE^JANE", "SeriesDescription=AX T1", "Modality=MR")
+	names := RequiredTags()
+	b.Run("New", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parser, err := newHeaderParser()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := parseHeader(parser, data, names); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Reused", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parser, err := getParser()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := parseHeader(parser, data, names); err != nil {
+				b.Fatal(err)
+			}
+			putParser(parser)
+		}
+	})
+}
+
+func TestParserBackends(t *testing.T) {
+	data := synthBytes(t, "PatientName=DOE^JANE", "SeriesDescription=AX T1")
+	defer func(old string) { parserBackend = old }(parserBackend)
+	for name := range parserBackends {
+		t.Run(name, func(t *testing.T) {
+			parserBackend = name
+			parser, err := newHeaderParser()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := parseHeader(parser, data, []string{"PatientName", "SeriesDescription"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(lookupValue(h, "SeriesDescription")); got != "AX T1" {
+				t.Errorf("SeriesDescription = %q, want AX T1", got)
+			}
+		})
+	}
+}
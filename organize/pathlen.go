@@ -0,0 +1,94 @@
+package organize
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// The longest name that most filesystems allow for a single path
+// component, in bytes.
+const maxNameLen = 255
+
+// Room left for file names when shortening series directories, so that
+// every file of a series is placed in the same directory regardless of its
+// name's length.
+const fileNameReserve = 64
+
+// If non-zero, the maximum length in bytes of the paths of organized
+// files. Directory and file names are shortened to fit.
+var maxPathLen int
+
+// shortenName truncates name to at most n bytes, replacing the end of it
+// with a hash of the whole name so that different long names stay
+// distinct. The same name is always shortened the same way.
+func shortenName(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+	keep := n - len(suffix)
+	if keep < 0 {
+		keep = 0
+	}
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	return name[:keep] + suffix
+}
+
+// The shortest that fitPath will shorten a directory name to.
+const minNameLen = 24
+
+// fitPath shortens the parts of a directory below root so that it's no
+// longer than limit bytes, by repeatedly truncating the longest part. If
+// limit is 0, parts are only shortened to maxNameLen. It may not be
+// possible to fit the path if root itself is too long.
+func fitPath(root string, parts []string, limit int) []string {
+	for i, part := range parts {
+		parts[i] = shortenName(part, maxNameLen)
+	}
+	if limit <= 0 {
+		return parts
+	}
+	for {
+		length := len(root)
+		longest := -1
+		for i, part := range parts {
+			length += 1 + len(part)
+			if longest < 0 || len(part) > len(parts[longest]) {
+				longest = i
+			}
+		}
+		if length <= limit || longest < 0 || len(parts[longest]) <= minNameLen {
+			return parts
+		}
+		n := len(parts[longest]) - (length - limit)
+		if n < minNameLen {
+			n = minNameLen
+		}
+		parts[longest] = safeComponent(shortenName(parts[longest], n))
+	}
+}
+
+// fitFile returns the path of a file named name in dir, shortening the name
+// if the path would be longer than maxPathLen. The extension is kept.
+func fitFile(dir, name string) string {
+	n := maxNameLen
+	if maxPathLen > 0 && maxPathLen-len(dir)-1 < n {
+		n = maxPathLen - len(dir) - 1
+		if n < minNameLen {
+			n = minNameLen
+		}
+	}
+	if len(name) > n {
+		ext := filepath.Ext(name)
+		if len(ext) > 8 {
+			ext = ""
+		}
+		name = shortenName(name[:len(name)-len(ext)], n-len(ext)) + ext
+	}
+	return filepath.Join(dir, name)
+}
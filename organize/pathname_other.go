@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+package organize
+
+import "strings"
+
+// safeValue returns a tag value which can be used in a file name. Other
+// than on Windows, any character other than the path separator and NUL is
+// allowed. The separator is replaced, so that a value can't add
+// directories to the layout, or climb out of the target with "..".
+func safeValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// safeComponent returns a path component which can be created on this
+// platform, and which names an entry in its parent directory rather than
+// the directory itself or its parent.
+func safeComponent(name string) string {
+	switch name {
+	case "", ".", "..":
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// nativePath returns a path given on the command line in the form used
+// internally.
+func nativePath(p string) string {
+	return p
+}
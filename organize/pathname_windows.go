@@ -0,0 +1,58 @@
+package organize
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Names which refer to devices on Windows, with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// safeValue replaces the characters that aren't allowed in file names on
+// Windows, including both path separators, in a tag value.
+func safeValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// safeComponent makes a single path component usable on Windows, which
+// silently drops trailing dots and spaces and doesn't allow device names.
+func safeComponent(name string) string {
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		return base + "_" + name[len(base):]
+	}
+	return name
+}
+
+// nativePath resolves a path given on the command line to an absolute
+// path, which resolves drive relative paths such as C:dicom, and adds the
+// \\?\ prefix so that paths longer than 260 characters can be created
+// below it.
+func nativePath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil || strings.HasPrefix(abs, `\\?\`) {
+		return p
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,40 @@
+package organize
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+)
+
+// PatientRoots are target directories, such as the mount points of
+// several volumes, that patients are spread across with -patient-root, so
+// that an archive larger than any one volume can be organized in a single
+// run. Every series of a patient goes to the same root, chosen by a hash
+// of their PatientID, so a patient is always placed in the same root as
+// long as the roots are given in the same order.
+type PatientRoots []string
+
+func (r PatientRoots) String() string {
+	return strings.Join(r, ",")
+}
+
+func (r *PatientRoots) Set(v string) error {
+	*r = append(*r, filepath.Clean(nativePath(v)))
+	return nil
+}
+
+// For returns the root that the patient of series s is placed in, or "" if
+// there are no roots. Series without a PatientID are placed by their
+// PatientName instead.
+func (r PatientRoots) For(s SeriesFiles) string {
+	if len(r) == 0 {
+		return ""
+	}
+	key := strings.TrimSpace(s.tagValue("PatientID"))
+	if key == "" {
+		key = normalizeName(s.PatientName)
+	}
+	sum := sha1.Sum([]byte(key))
+	return r[binary.BigEndian.Uint32(sum[:4])%uint32(len(r))]
+}
@@ -0,0 +1,206 @@
+package organize
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errPatientNotListed is returned by addFile for files which were skipped
+// because their patient isn't in the -patients list.
+var errPatientNotListed = errors.New("patient not in -patients list")
+
+// A patientList is the patients to organize with -patients, for pulling a
+// few subjects out of a large mixed archive. Each entry is a PatientID or
+// a PatientName, and a file is organized if either of its own match one.
+type patientList struct {
+	path string
+
+	// The entries, keyed by how they're compared to PatientIDs and to
+	// PatientNames.
+	ids, names map[string]string
+
+	mu      sync.Mutex
+	found   map[string]bool
+	skipped int
+}
+
+// The -patients list for this run, or nil if every patient is organized.
+var onlyPatients *patientList
+
+// normalizeName returns a PatientName in the form that's compared, ignoring
+// case and empty trailing components, so that DOE^JOHN matches Doe^John^^.
+func normalizeName(name string) string {
+	return strings.ToUpper(strings.TrimRight(strings.TrimSpace(name), "^ "))
+}
+
+// loadPatientList reads a list of patients, one per line. Blank lines and
+// lines starting with # are ignored.
+func loadPatientList(path string) (*patientList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l := &patientList{
+		path:  path,
+		ids:   make(map[string]string),
+		names: make(map[string]string),
+		found: make(map[string]bool),
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l.ids[line] = line
+		l.names[normalizeName(line)] = line
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.ids) == 0 {
+		return nil, fmt.Errorf("%s doesn't list any patients", path)
+	}
+	return l, nil
+}
+
+// match returns the entry that a patient matches, or "" if they aren't
+// listed.
+func (l *patientList) match(name, id string) string {
+	if e, ok := l.ids[strings.TrimSpace(id)]; ok && strings.TrimSpace(id) != "" {
+		return e
+	}
+	if e, ok := l.names[normalizeName(name)]; ok && normalizeName(name) != "" {
+		return e
+	}
+	return ""
+}
+
+// Includes reports whether the patient with name and id is listed, and
+// remembers that they were found. It's safe to call on a nil patientList,
+// which includes every patient.
+func (l *patientList) Includes(name, id string) bool {
+	if l == nil {
+		return true
+	}
+	e := l.match(name, id)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e == "" {
+		l.skipped++
+		return false
+	}
+	l.found[e] = true
+	return true
+}
+
+// Skips reports whether the contents of a file are certainly of a patient
+// who isn't listed, by reading the elements up to the PatientID directly
+// rather than with the parser, so that other patients' files cost as
+// little as possible. Files it can't tell about are left for Includes to
+// check once they've been parsed. It's safe to call on a nil patientList.
+func (l *patientList) Skips(data []byte) bool {
+	if l == nil {
+		return false
+	}
+	name, id, ok := peekPatient(data)
+	if !ok || l.match(name, id) != "" {
+		return false
+	}
+	// Names in character sets which aren't compatible with ASCII can't
+	// be compared without decoding them.
+	for _, c := range []byte(name) {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	l.mu.Lock()
+	l.skipped++
+	l.mu.Unlock()
+	return true
+}
+
+var patientIDTag = tag{0x0010, 0x0020}
+
+// peekPatient returns the PatientName and PatientID of data, or false if
+// they can't be read without the parser, such as from a deflated file.
+func peekPatient(data []byte) (name, id string, ok bool) {
+	data = withFileMeta(data)
+	off := 0
+	if len(data) >= 132 && string(data[128:132]) == "DICM" {
+		off = 132
+	}
+	ts := fileTransferSyntax(data)
+	if ts == deflatedExplicitVRLittleEndian {
+		return "", "", false
+	}
+	r := &elementReader{data: data, off: off, enc: metaEncoding}
+	for r.more() {
+		t, err := r.peekTag()
+		if err != nil {
+			return "", "", false
+		}
+		if t.Group != 0x0002 {
+			break
+		}
+		if _, err := r.next(); err != nil {
+			return "", "", false
+		}
+	}
+	r.enc = encodingFor(ts)
+	for r.more() {
+		t, err := r.peekTag()
+		if err != nil {
+			return "", "", false
+		}
+		if t.Group > patientIDTag.Group || (t.Group == patientIDTag.Group && t.Element > patientIDTag.Element) {
+			break
+		}
+		el, err := r.next()
+		if err != nil {
+			return "", "", false
+		}
+		switch el.Tag {
+		case tag{0x0010, 0x0010}:
+			name = string(bytes.TrimRight(el.Value, " \x00"))
+		case patientIDTag:
+			id = string(bytes.TrimRight(el.Value, " \x00"))
+		}
+	}
+	return name, id, true
+}
+
+// Report logs how many files were skipped, and which listed patients
+// weren't found at all.
+func (l *patientList) Report() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.skipped > 0 {
+		log.Printf("Skipped %s of patients not listed in %s.\n", plural(l.skipped, "file", "files"), l.path)
+	}
+	var missing []string
+	for _, e := range l.ids {
+		if !l.found[e] {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	sort.Strings(missing)
+	log.Printf("%d of the %d patients listed in %s weren't found:\n", len(missing), len(l.ids), l.path)
+	for _, e := range missing {
+		log.Println("\t" + e)
+	}
+}
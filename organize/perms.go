@@ -0,0 +1,114 @@
+package organize
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// permissions are applied to the directories and files created in the
+// target directory.
+type permissions struct {
+	// The mode of created directories.
+	DirMode os.FileMode
+
+	// The mode of organized files, or 0 to leave it as it was
+	// created.
+	FileMode os.FileMode
+
+	// The group that owns created directories and organized files, or
+	// -1 to leave it as the default.
+	Group int
+}
+
+var perms = permissions{DirMode: 0750, Group: -1}
+
+// parseMode parses an octal mode such as 2770, including the setuid,
+// setgid and sticky bits.
+func parseMode(s string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || bits&^07777 != 0 {
+		return 0, fmt.Errorf("invalid mode %q", s)
+	}
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// lookupGroup returns the ID of the named group, which may also be given
+// as a number.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return -1, fmt.Errorf("group %s: ownership can't be set on this platform", name)
+	}
+	return gid, nil
+}
+
+// set applies the group and mode to path on fs. The mode is set explicitly,
+// since the umask would otherwise clear some of its bits.
+func (p permissions) set(fs FileSystem, path string, mode os.FileMode) error {
+	if err := readOnly.Check(path); err != nil {
+		return err
+	}
+	if p.Group >= 0 {
+		if err := fs.Chown(path, -1, p.Group); err != nil {
+			return err
+		}
+	}
+	if mode != 0 {
+		return fs.Chmod(path, mode)
+	}
+	return nil
+}
+
+// MkdirAll creates dir and any parents that don't exist on fs, with the
+// configured mode and group.
+func (p permissions) MkdirAll(fs FileSystem, dir string) error {
+	if info, err := fs.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := p.MkdirAll(fs, parent); err != nil {
+			return err
+		}
+	}
+	if err := readOnly.Check(dir); err != nil {
+		return err
+	}
+	if err := fs.Mkdir(dir, p.DirMode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return p.set(fs, dir, p.DirMode)
+}
+
+// File applies the configured mode and group to an organized file.
+func (p permissions) File(fs FileSystem, path string) error {
+	if p.FileMode == 0 && p.Group < 0 {
+		return nil
+	}
+	return p.set(fs, path, p.FileMode)
+}
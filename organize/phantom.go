@@ -0,0 +1,98 @@
+package organize
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words in a patient's name or ID that mark them as a QA phantom or test
+// patient rather than a real patient, such as PHANTOM, TEST^TEST or QA1.
+var phantomWords = map[string]bool{
+	"PHANTOM":     true,
+	"QA":          true,
+	"QC":          true,
+	"TEST":        true,
+	"DUMMY":       true,
+	"CALIBRATION": true,
+}
+
+// A PredicateList is a list of predicates given by repeating an option.
+type PredicateList []predicate
+
+func (l PredicateList) String() string {
+	var s []string
+	for _, p := range l {
+		op := "="
+		if p.Negate {
+			op = "!="
+		}
+		s = append(s, p.Tag+op+p.Pattern)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *PredicateList) Set(v string) error {
+	p, err := parsePredicate(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, p)
+	seriesTags = addTag(seriesTags, p.Tag)
+	return nil
+}
+
+// A phantomFilter detects series of QA phantoms and test patients, so
+// that they can be kept out of the archive.
+type phantomFilter struct {
+	// Series matching any of these are also treated as phantoms.
+	Patterns PredicateList
+
+	// If set, only Patterns are used, not the built in heuristics.
+	NoHeuristics bool
+
+	// Where phantoms are organized instead of the target, or "" if
+	// they're skipped.
+	Dir string
+}
+
+// phantomWord returns the first word of v that marks a phantom or test
+// patient, or "" if there isn't one. Any digits at the end of a word are
+// ignored, so that QA2 and PHANTOM01 are matched too.
+func phantomWord(v string) string {
+	v = strings.ToUpper(v)
+	if strings.Contains(v, "PHANTOM") {
+		return "PHANTOM"
+	}
+	words := strings.FieldsFunc(v, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if w = strings.TrimRightFunc(w, unicode.IsDigit); phantomWords[w] {
+			return w
+		}
+	}
+	return ""
+}
+
+// Reason returns why series s looks like a phantom or test patient, or ""
+// if it doesn't. It's safe to call on a nil filter.
+func (f *phantomFilter) Reason(s SeriesFiles) string {
+	if f == nil {
+		return ""
+	}
+	for _, p := range f.Patterns {
+		if p.Match(s) {
+			return "matches " + PredicateList{p}.String()
+		}
+	}
+	if f.NoHeuristics {
+		return ""
+	}
+	if w := phantomWord(s.PatientName); w != "" {
+		return "PatientName contains " + w
+	}
+	if w := phantomWord(s.tagValue("PatientID")); w != "" {
+		return "PatientID contains " + w
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package organize
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// sameLocation reports whether a file at src is already at dst on fs, even if
+// the paths are spelled differently: one relative and the other absolute,
+// through a symlinked directory, in a different Unicode normalization (as
+// macOS returns names from directory listings) or in a different case on
+// a case insensitive filesystem. Organizing a directory in place must
+// never move a file that's already where it belongs, since moving it onto
+// itself could trash or delete it.
+func sameLocation(fs FileSystem, src, dst FileName) bool {
+	if src == dst {
+		return true
+	}
+	a, err := filepath.Abs(src.String())
+	if err != nil {
+		return false
+	}
+	b, err := filepath.Abs(dst.String())
+	if err != nil {
+		return false
+	}
+	a, b = norm.NFC.String(a), norm.NFC.String(b)
+	if a == b {
+		return true
+	}
+	if !strings.EqualFold(filepath.Base(a), filepath.Base(b)) {
+		return false
+	}
+	if da, err := filepath.EvalSymlinks(filepath.Dir(a)); err == nil {
+		if db, err := filepath.EvalSymlinks(filepath.Dir(b)); err == nil && da == db && filepath.Base(a) == filepath.Base(b) {
+			return true
+		}
+	}
+	if !strings.EqualFold(a, b) {
+		return false
+	}
+	// Only paths which differ in case are compared by identity, since
+	// hard links are the same file in two different places.
+	si, err := os.Stat(src.String())
+	if err != nil {
+		return false
+	}
+	di, err := fs.Stat(dst.String())
+	if err != nil {
+		return false
+	}
+	return os.SameFile(si, di)
+}
+
+// printMisplaced implements -check-only. It prints each file in a plan for
+// organizing a directory in place which isn't where its tags put it under
+// the current layout, without moving anything, and returns the exit
+// status: 1 if any file is misplaced.
+func printMisplaced(p Plan) int {
+	var files, misplaced int
+	for _, sp := range p.Series {
+		for _, op := range sp.Operations {
+			switch op.Op {
+			case opKeep:
+				files++
+			case opMove:
+				files++
+				misplaced++
+				fmt.Printf("misplaced\t%s -> %s\n", op.Src, op.Dst)
+			}
+		}
+	}
+	if misplaced == 0 {
+		if verbose {
+			log.Printf("All %s are where the layout puts them.\n", plural(files, "file", "files"))
+		}
+		return 0
+	}
+	log.Printf("%d of %s aren't where their tags put them under the current layout.\n", misplaced, plural(files, "file", "files"))
+	return 1
+}
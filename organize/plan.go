@@ -0,0 +1,623 @@
+package organize
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The kinds of operation in a plan.
+const (
+	// Create a directory, and any missing parents.
+	opMkdir = "mkdir"
+	// Copy or move Src to Dst.
+	opCopy = "copy"
+	opMove = "move"
+	// Move Dst into the trash, since it's about to be replaced by Src.
+	opTrash = "trash"
+	// Src is already where it belongs, so there's nothing to do.
+	opKeep = "keep"
+)
+
+// An Operation is a single step of a Plan.
+type Operation struct {
+	Op  string   `json:"op"`
+	Src FileName `json:"src,omitempty"`
+	Dst FileName `json:"dst"`
+
+	// For copies and moves, whether overlays are removed from the
+	// file, and whether its original path is written into it.
+	StripOverlays bool `json:"strip_overlays,omitempty"`
+	Provenance    bool `json:"provenance,omitempty"`
+
+	// For copies and moves, whether the -tag-rules are applied to the
+	// file.
+	SetTags bool `json:"set_tags,omitempty"`
+
+	// For copies and moves, whether Dst is stored compressed.
+	Compress bool `json:"compress,omitempty"`
+
+	// For copies and moves, whether file meta information is added to
+	// the file if it's a raw dataset.
+	AddFileMeta bool `json:"add_file_meta,omitempty"`
+
+	// For copies and moves, whether the file is converted from big
+	// endian to little endian.
+	LittleEndian bool `json:"little_endian,omitempty"`
+
+	// For copies and moves, whether the file, an image of a retired SOP
+	// class, is stored as a Secondary Capture Image instead.
+	ConvertRetired bool `json:"convert_retired,omitempty"`
+
+	// For copies, whether the source is deleted once the copy has
+	// been verified.
+	DeleteSource bool `json:"delete_source,omitempty"`
+
+	// For copies and moves, the numbered subfolder of the series
+	// directory that Dst is in, if the directory is split.
+	Shard string `json:"shard,omitempty"`
+
+	// The heuristics that deciding where Dst is relied on, if any.
+	Review []reviewReason `json:"review,omitempty"`
+}
+
+// String describes the operation, such as
+// "copy+strip-overlays+compress src -> dst" for a copy which also removes
+// overlays and compresses the file. Every change made to the file is
+// listed, in the order that they're made.
+func (op Operation) String() string {
+	switch op.Op {
+	case opCopy, opMove:
+		return fmt.Sprintf("%s %s -> %s", strings.Join(append([]string{op.Op}, op.modifiers()...), "+"), op.Src, op.Dst)
+	case opKeep:
+		return fmt.Sprintf("keep %s", op.Dst)
+	default:
+		return fmt.Sprintf("%s %s", op.Op, op.Dst)
+	}
+}
+
+// modifiers returns the names of the changes that a copy or move makes
+// to the file, in the order that action makes them.
+func (op Operation) modifiers() []string {
+	var mods []string
+	for _, m := range []struct {
+		set  bool
+		name string
+	}{
+		{op.SetTags, "set-tags"},
+		{op.StripOverlays, "strip-overlays"},
+		{op.Provenance, "provenance"},
+		{op.AddFileMeta, "add-file-meta"},
+		{op.LittleEndian, "little-endian"},
+		{op.ConvertRetired, "convert-retired"},
+		{op.Compress, "compress"},
+		{op.DeleteSource, "delete-source"},
+	} {
+		if m.set {
+			mods = append(mods, m.name)
+		}
+	}
+	return mods
+}
+
+// action returns the function that carries out a copy or move, using rules
+// if the operation sets tags.
+func (op Operation) action(rules *tagRules) fileAction {
+	var rewrites []rewrite
+	if op.SetTags && rules != nil {
+		rewrites = append(rewrites, rules.rewrite)
+	}
+	if op.StripOverlays {
+		rewrites = append(rewrites, removeOverlays)
+	}
+	if op.Provenance {
+		rewrites = append(rewrites, addProvenance)
+	}
+	if op.AddFileMeta {
+		rewrites = append(rewrites, addFileMeta)
+	}
+	if op.LittleEndian {
+		rewrites = append(rewrites, convertToLittleEndian)
+	}
+	if op.ConvertRetired {
+		rewrites = append(rewrites, convertRetired)
+	}
+	switch {
+	case len(rewrites) > 0 || op.Compress:
+		return rewriteAction(rewrites, op.Op == opMove, op.Compress)
+	case op.Op == opMove:
+		return moveFile
+	default:
+		return copyFile
+	}
+}
+
+// A SeriesPlan is the operations that organize a single series.
+type SeriesPlan struct {
+	Series     SeriesFiles `json:"series"`
+	Operations []Operation `json:"operations"`
+}
+
+// A Plan is every operation of a run. It's produced from the scan without
+// changing anything, so that it can be reviewed (and edited) before it's
+// executed, possibly by a later "dicomfmt apply".
+type Plan struct {
+	Target  string   `json:"target"`
+	Sources []string `json:"sources,omitempty"`
+	Move    bool     `json:"move,omitempty"`
+
+	// The trash directory that replaced files are moved to, if there
+	// are any trash operations.
+	Trash string `json:"trash,omitempty"`
+
+	Series []SeriesPlan `json:"series"`
+}
+
+// readPlan reads a plan written by "dicomfmt plan".
+func readPlan(path string) (Plan, error) {
+	var p Plan
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+	if p.Target == "" {
+		return p, fmt.Errorf("%s: plan has no target", path)
+	}
+	return p, nil
+}
+
+// printPlan writes a plan to standard output, either as JSON that can be
+// applied later or as a line for each operation.
+func printPlan(p Plan, asJSON bool) {
+	if !asJSON {
+		p.WriteTo(os.Stdout)
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// WriteTo writes a line describing each operation in the plan to w.
+func (p Plan) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, sp := range p.Series {
+		for _, op := range sp.Operations {
+			n, err := fmt.Fprintln(w, op)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Plan returns the operations that organizing a series would do.
+func (o *Organizer) Plan(files SeriesFiles) SeriesPlan {
+	if files.Site == "" {
+		// The series didn't come from a source directory, such as
+		// with -files-from.
+		files.Site = o.Sites.For("")
+	}
+	// The heuristics that placing the series relied on.
+	var review []reviewReason
+	if d := o.Descriptions.Normalize(files.SeriesDescription); d != files.SeriesDescription {
+		review = append(review, reviewReason{fmt.Sprintf("SeriesDescription %q normalized to %q", files.SeriesDescription, d), confidenceDescription})
+		files.SeriesDescription = d
+	}
+	sp := SeriesPlan{Series: files}
+	root := o.Dst
+	if reason := o.Phantoms.Reason(files); reason != "" {
+		if !strings.HasPrefix(reason, "matches ") {
+			review = append(review, reviewReason{"treated as a phantom: " + reason, confidencePhantom})
+		}
+		if o.Phantoms.Dir == "" {
+			if verbose {
+				log.Printf("Skipping series %s of %s: %s\n", files.SeriesDescription, files.PatientName, reason)
+			}
+			return sp
+		}
+		if verbose {
+			log.Printf("Routing series %s of %s to %s: %s\n", files.SeriesDescription, files.PatientName, o.Phantoms.Dir, reason)
+		}
+		root = o.Phantoms.Dir
+	} else if files.BurnedIn.Flagged() && o.ReviewDir != "" {
+		if verbose {
+			log.Printf("Routing series %s to %s: %s\n", files.SeriesDescription, o.ReviewDir, files.BurnedIn)
+		}
+		if files.BurnedIn.Kind != burnedInDeclared {
+			review = append(review, reviewReason{"suspected burned in annotations: " + files.BurnedIn.String(), confidenceBurnedIn})
+		}
+		root = o.ReviewDir
+	} else if target := o.Routes.For(files); target != "" {
+		if verbose {
+			log.Printf("Routing series %s to %s\n", files.SeriesDescription, target)
+		}
+		root = target
+	} else if target := o.PatientRoots.For(files); target != "" {
+		root = target
+	}
+	root = o.Batches.For(files, root)
+	if o.Gate != nil {
+		root = o.Gate.Stage(files, root)
+	}
+	op := opCopy
+	if o.Move {
+		op = opMove
+	}
+	layouts := make([]string, len(files.Files))
+	dstDirs := make([]string, len(files.Files))
+	planned := make(map[string]int)
+	for i, file := range files.Files {
+		layouts[i] = o.LayoutRules.For(files, file, o.Layout)
+		if o.DerivedDir != "" && isDerived(files.FileTags[file]["ImageType"]) {
+			layouts[i] = derivedLayout(layouts[i], o.DerivedDir, o.Flatten)
+		}
+		s := files
+		if o.LayoutRules != nil {
+			s = files.forFile(file)
+		}
+		dstDirs[i] = layoutDir(root, layouts[i], s, o.Names)
+		planned[dstDirs[i]]++
+	}
+	dirs := make(map[string]bool)
+	for i, file := range files.Files {
+		dstDir := dstDirs[i]
+		shard := o.shard(dstDir, file, strings.TrimSpace(files.FileTags[file]["ConcatenationUID"]), planned[dstDir])
+		if shard != "" {
+			dstDir = filepath.Join(dstDir, shard)
+		}
+		name := o.fileName(files, file)
+		if o.Compress && !isCompressed(name) {
+			name += compressedExtension
+		}
+		dstFile := FileName(fitFile(dstDir, name))
+		reasons := o.reviewReasons(review, files, file, layouts[i], name, filepath.Base(dstFile.String()))
+		if o.Naming.Renames() {
+			dstFile = o.uniqueName(file, dstFile)
+		}
+		if sameLocation(o.fs(), file, dstFile) {
+			sp.Operations = append(sp.Operations, Operation{Op: opKeep, Dst: file, Review: reasons})
+			continue
+		}
+		if !dirs[dstDir] {
+			dirs[dstDir] = true
+			sp.Operations = append(sp.Operations, Operation{Op: opMkdir, Dst: FileName(dstDir)})
+		}
+		if o.Trash != nil {
+			if _, err := o.fs().Stat(dstFile.String()); err == nil {
+				sp.Operations = append(sp.Operations, Operation{Op: opTrash, Src: file, Dst: dstFile})
+			}
+		}
+		addMeta := o.AddFileMeta && needsFileMeta(file)
+		littleEndian := o.LittleEndian && isBigEndian(files.FileTags[file])
+		convert := o.ConvertRetired && retiredSOPClasses[sopClassOf(files, file)].Image
+		sp.Operations = append(sp.Operations, Operation{
+			Op:             op,
+			Src:            file,
+			Dst:            dstFile,
+			StripOverlays:  o.StripOverlays,
+			Provenance:     o.ProvenanceTag,
+			SetTags:        o.TagRules != nil,
+			Compress:       o.compress(file, dstFile) || ((addMeta || littleEndian || convert) && isCompressed(dstFile.String())),
+			AddFileMeta:    addMeta,
+			LittleEndian:   littleEndian,
+			ConvertRetired: convert,
+			DeleteSource:   o.DeleteVerified && op == opCopy,
+			Shard:          shard,
+			Review:         reasons,
+		})
+	}
+	return sp
+}
+
+// compress returns whether placing file at dst needs to compress it. Files
+// which are already compressed are only decompressed and compressed again
+// when they're rewritten.
+func (o *Organizer) compress(file, dst FileName) bool {
+	if !isCompressed(dst.String()) {
+		return false
+	}
+	return !isCompressed(file.String()) || o.StripOverlays || o.ProvenanceTag || o.TagRules != nil
+}
+
+// fileName returns the name that file, which is part of series s, is
+// given in the target.
+func (o *Organizer) fileName(s SeriesFiles, file FileName) string {
+	if !o.Flatten {
+		return o.Naming.Apply(filepath.Base(file.String()))
+	}
+	// Files from different series commonly have the same names, so
+	// name them by their SOPInstanceUID, which is unique to each
+	// instance, instead.
+	if uid := strings.TrimSpace(s.FileTags[file]["SOPInstanceUID"]); uid != "" {
+		uid = safeComponent(safeValue(uid))
+		if o.Naming.Extension != "" {
+			return uid + o.Naming.Extension
+		}
+		return uid + ".dcm"
+	}
+	sum := sha1.Sum([]byte(file))
+	return hex.EncodeToString(sum[:4]) + "_" + o.Naming.Apply(filepath.Base(file.String()))
+}
+
+// PlanAll returns the plan for every series in a map returned by
+// SplitSeries. If ctx is cancelled, the plan only has the series planned
+// so far.
+func (o *Organizer) PlanAll(ctx context.Context, series map[SeriesInstanceUID]SeriesFiles) Plan {
+	p := Plan{Target: o.Dst, Sources: o.roots, Move: o.Move}
+	if o.Trash != nil {
+		p.Trash = o.Trash.Dir
+	}
+	for _, uid := range o.Order.UIDs(series) {
+		if o.stopping(ctx) {
+			break
+		}
+		p.Series = append(p.Series, o.Plan(series[uid]))
+	}
+	return p
+}
+
+// Apply executes every series of a plan, and arranges for the plan's
+// sources to be swept for empty directories when the run finishes.
+func (o *Organizer) Apply(ctx context.Context, p Plan) {
+	for _, src := range p.Sources {
+		o.addRoot(src)
+	}
+	for _, sp := range p.Series {
+		if o.stopping(ctx) {
+			return
+		}
+		o.Execute(ctx, sp)
+	}
+}
+
+// Execute carries out the operations of a series plan, and returns the new
+// path of each file. If ctx is cancelled, it stops before the next file,
+// and the files which were already placed are journaled and reported as
+// usual.
+func (o *Organizer) Execute(ctx context.Context, sp SeriesPlan) []FileName {
+	fs := o.fs()
+	if o.Pause.Wait(ctx) != nil {
+		return nil
+	}
+	files := sp.Series
+	// The directories that files were placed into, in the order that
+	// they were first used. Normally there's only one, but layout rules
+	// can split a series.
+	var movedDirs []string
+	moved := make(map[string]bool)
+	// The shard that each of them is, if their series directory is
+	// split.
+	shards := make(map[string]string)
+	// Files which should be moved to the trash before they're replaced.
+	replaced := make(map[FileName]bool)
+	placed := make([]FileName, 0, len(files.Files))
+	for _, op := range sp.Operations {
+		switch op.Op {
+		case opKeep:
+			placed = append(placed, op.Dst)
+			o.Mirror.Fill(fs, op.Dst)
+			if err := o.Review.Add(op.Dst, op.Dst, op.Review); err != nil {
+				log.Fatalln(err)
+			}
+			continue
+		case opMkdir:
+			// If creating the directory fails even after
+			// retrying, it's likely because we ran out of
+			// diskspace or don't have permission, so treat it
+			// as fatal instead of trying to continue on to the
+			// next series.
+			if err := retries.Do("Creating "+op.Dst.String(), func() error { return perms.MkdirAll(fs, op.Dst.String()) }); err != nil {
+				log.Fatalln(err)
+			}
+			continue
+		case opTrash:
+			// The file is only trashed when it's about to be
+			// replaced, in case the copy is skipped.
+			replaced[op.Dst] = true
+			continue
+		case opCopy, opMove:
+		default:
+			log.Printf("Unknown operation %q for %s.\n", op.Op, op.Dst)
+			continue
+		}
+
+		file, dstFile := op.Src, op.Dst
+		if o.stopping(ctx) {
+			o.Stopped = file
+			break
+		}
+		if o.Conflicts != nil {
+			if kind, description := o.conflict(files, file, dstFile); kind != "" {
+				switch o.Conflicts.Resolve(kind, description) {
+				case resolveSkip:
+					log.Printf("Skipping %s.\n", file)
+					continue
+				case resolveRename:
+					dstFile = freeName(dstFile)
+				}
+			}
+		}
+		_, statErr := fs.Stat(dstFile.String())
+		existed := statErr == nil
+		if existed && o.SkipIdentical && op.Op == opCopy && !replaced[dstFile] {
+			if same, err := sameContent(file.String(), dstFile.String()); err == nil && same {
+				placed = append(placed, dstFile)
+				o.Mirror.Fill(fs, dstFile)
+				continue
+			}
+		}
+		if existed && replaced[dstFile] {
+			if err := o.Trash.File(dstFile.String()); err != nil {
+				log.Printf("Could not move %s to the trash, not replacing it: %v\n", dstFile, err)
+				o.Failed = append(o.Failed, file)
+				fileFailed(file, deadTrashFailed, err)
+				continue
+			}
+			o.Audit.Record("trash", dstFile.String(), "replaced by "+file.String())
+			existed = false
+		}
+		if op.SetTags && o.TagRules == nil {
+			log.Printf("Not organizing %s: the plan applies tag rules, but no -tag-rules were given.\n", file)
+			o.Failed = append(o.Failed, file)
+			fileFailed(file, deadNoTagRules, errors.New("the plan applies tag rules, but no -tag-rules were given"))
+			continue
+		}
+		action := op.action(o.TagRules)
+		if err := retries.Do("Organizing "+file.String(), func() error { return action(fs, file, dstFile) }); err != nil {
+			if !existed && op.Op == opCopy {
+				// Don't leave a partial copy behind.
+				fs.Remove(dstFile.String())
+			}
+			// The mirror is written from the source instead, and
+			// the source is kept even when moving, since it's
+			// the only other copy.
+			mirrorOp := op
+			mirrorOp.Op = opCopy
+			mirrored, mirrorErr := o.Mirror.Write(fs, file, dstFile, mirrorOp.action(o.TagRules))
+			if mirrorErr != nil || mirrored == "" {
+				log.Printf("Could not organize %s: %v\n", file, err)
+				if mirrorErr != nil {
+					log.Printf("Could not mirror %s: %v\n", file, mirrorErr)
+				}
+				o.Failed = append(o.Failed, file)
+				fileFailed(file, deadCopyFailed, err)
+				continue
+			}
+			log.Printf("Could not organize %s into the target, only into the mirror: %v\n", file, err)
+			dstFile = mirrored
+			op.DeleteSource = false
+		} else if _, err := o.Mirror.Write(fs, dstFile, dstFile, copyFile); err != nil {
+			log.Printf("Could not mirror %s: %v\n", dstFile, err)
+		}
+		placed = append(placed, dstFile)
+		if err := perms.File(fs, dstFile.String()); err != nil {
+			log.Println(err)
+		}
+		if err := o.Journal.Placed(file, dstFile); err != nil {
+			log.Fatalln(err)
+		}
+		changes := o.TagRules.Changes(file)
+		extra := manifestEntry{Shard: op.Shard, Changes: changes}
+		if o.ReviewDir == "" {
+			extra.BurnedIn = files.BurnedIn.String()
+		}
+		if err := o.Manifest.Record(fs, file, dstFile, files, extra); err != nil {
+			log.Fatalln(err)
+		}
+		if err := o.Review.Add(file, dstFile, op.Review); err != nil {
+			log.Fatalln(err)
+		}
+		if uid := files.FileTags[file]["SOPInstanceUID"]; uid != "" && o.Conflicts != nil {
+			if o.placedSOPs == nil {
+				o.placedSOPs = make(map[string]FileName)
+			}
+			o.placedSOPs[filepath.Dir(dstFile.String())+"\x00"+uid] = dstFile
+		}
+		if dstDir := filepath.Dir(dstFile.String()); !moved[dstDir] {
+			moved[dstDir] = true
+			movedDirs = append(movedDirs, dstDir)
+			shards[dstDir] = op.Shard
+		}
+		if fi, err := fs.Stat(dstFile.String()); err == nil {
+			metrics.Ingested(files.Modality, fi.Size())
+			o.Stats.AddFile(files, file, fi.Size())
+			o.Retired.Add(files, file, dstFile)
+		}
+		activity.Publish(activityEvent{Event: activityOrganized, File: dstFile.String(), From: file.String()})
+		detail := "from " + file.String()
+		if op.StripOverlays {
+			detail += ", overlays removed"
+		}
+		if op.Provenance {
+			detail += ", original path recorded"
+		}
+		for _, c := range changes {
+			detail += fmt.Sprintf(", %s set to %q", c.Tag, c.New)
+		}
+		if err := o.Audit.Record(op.Op, dstFile.String(), detail); err != nil {
+			log.Fatalln(err)
+		}
+		if op.DeleteSource {
+			if err := o.deleteVerified(file, dstFile); err != nil {
+				log.Printf("Not deleting %s: %v\n", file, err)
+				o.Failed = append(o.Failed, file)
+				fileFailed(file, deadDeleteFailed, err)
+				continue
+			}
+			if err := o.Audit.Record("delete-source", file.String(), "verified copy at "+dstFile.String()); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	if err := o.Journal.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := o.Manifest.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := o.Review.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	if len(placed) > 0 {
+		metrics.SeriesDone()
+		activity.Publish(activityEvent{
+			Event:             activitySeries,
+			Modality:          files.Modality,
+			SeriesDescription: files.SeriesDescription,
+			Files:             len(placed),
+			Dirs:              movedDirs,
+		})
+		usage.Add(files, movedDirs, placed)
+		if err := o.Batches.Record(files, placed); err != nil {
+			log.Println(err)
+		}
+		o.Expected.Add(files)
+		o.Validate.Add(files, movedDirs)
+	}
+	syncRoot := o.Dst
+	if root := o.PatientRoots.For(files); root != "" {
+		syncRoot = root
+	}
+	if err := syncDirs(fs, syncRoot, movedDirs); err != nil {
+		// It's not reported, since it might not all be there
+		// after a crash.
+		log.Printf("Could not flush series %s to disk, not reporting it: %v\n", files.SeriesDescription, err)
+		return placed
+	}
+	if o.Gate != nil {
+		// The series is reported when its study is released.
+		o.Gate.Arrived(files, movedDirs, shards, len(placed))
+		return placed
+	}
+	for _, dir := range movedDirs {
+		n := 0
+		for _, file := range placed {
+			if filepath.Dir(file.String()) == dir {
+				n++
+			}
+		}
+		o.Output.Print(dir, files, n)
+		o.Hooks.Complete(dir, files, n)
+	}
+	o.FHIR.Add(placed)
+	o.Encrypt.Add(placed)
+	return placed
+}
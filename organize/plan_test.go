@@ -0,0 +1,218 @@
+package organize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPlanRenameCollisions(t *testing.T) {
+	src := t.TempDir()
+	series := "SeriesInstanceUID=" + newUID(t)
+	study := "StudyInstanceUID=" + newUID(t)
+	for _, name := range []string{"a/IM1.DCM", "b/im1.dcm", "c/Im1.dcm", "c/IM2.dcm"} {
+		synthFile(t, filepath.Join(src, name), series, study, "PatientName=DOE^JANE", "SeriesDescription=AX", "Modality=OT")
+	}
+
+	tests := []struct {
+		name   string
+		naming fileNaming
+		want   []string
+	}{
+		{"lowercase", fileNaming{Lowercase: true}, []string{"im1.dcm", "im1_1.dcm", "im1_2.dcm", "im2.dcm"}},
+		{"extension", fileNaming{Extension: ".dicom"}, []string{"IM1.dicom", "IM2.dicom", "Im1.dicom", "im1.dicom"}},
+		{"strip extension", fileNaming{StripExtension: true, Lowercase: true}, []string{"im1", "im1_1", "im1_2", "im2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Organizer{Dst: t.TempDir(), Layout: "{SeriesDescription}", Naming: tt.naming}
+			found := o.Scan(context.Background(), src, nil)
+			if len(found) != 1 {
+				t.Fatalf("found %d series, want 1", len(found))
+			}
+			var got []string
+			for _, sp := range o.PlanAll(context.Background(), found).Series {
+				for _, op := range sp.Operations {
+					if op.Op == opCopy {
+						got = append(got, filepath.Base(op.Dst.String()))
+					}
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("planned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanTrashesExisting(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	synthTree(t, src, 1, 1, 1, 2)
+	o := &Organizer{Dst: dst, Layout: "{SeriesDescription}", Trash: &trash{}}
+	found := o.Scan(context.Background(), src, nil)
+
+	existing := filepath.Join(dst, "Series 1", "IM0002.dcm")
+	if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []string
+	for _, sp := range o.PlanAll(context.Background(), found).Series {
+		for _, op := range sp.Operations {
+			ops = append(ops, op.Op+" "+filepath.Base(op.Dst.String()))
+		}
+	}
+	want := []string{"mkdir Series 1", "copy IM0001.dcm", "trash IM0002.dcm", "copy IM0002.dcm"}
+	if strings.Join(ops, ", ") != strings.Join(want, ", ") {
+		t.Errorf("planned %v, want %v", ops, want)
+	}
+}
+
+func TestExecuteConflicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer string
+		// The contents of the destination, and of the renamed copy if
+		// there is one.
+		want, renamed string
+	}{
+		{"skip", "s\n", "existing", ""},
+		{"overwrite", "o\n", "new", ""},
+		{"rename", "r\n", "existing", "new"},
+		{"skip every conflict", "S\n", "existing", ""},
+		{"invalid answer", "x\nyes\no\n", "new", ""},
+		// Nobody is left to ask, so nothing is overwritten.
+		{"no answer", "", "existing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			synthTree(t, src, 1, 1, 1, 1)
+			var prompts bytes.Buffer
+			o := &Organizer{Dst: dst, Layout: "{SeriesDescription}", Conflicts: newResolver(strings.NewReader(tt.answer), &prompts)}
+			found := o.Scan(context.Background(), src, nil)
+
+			existing := filepath.Join(dst, "Series 1", "IM0001.dcm")
+			if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(existing, []byte("existing"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			o.Apply(context.Background(), o.PlanAll(context.Background(), found))
+			if !strings.Contains(prompts.String(), "already exists with different contents") {
+				t.Errorf("wasn't asked about the conflict, got %q", prompts.String())
+			}
+
+			contents := func(path string) string {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return ""
+				}
+				if bytes.Equal(b, []byte("existing")) {
+					return "existing"
+				}
+				return "new"
+			}
+			if got := contents(existing); got != tt.want {
+				t.Errorf("destination is %s, want %s", got, tt.want)
+			}
+			if got := contents(filepath.Join(dst, "Series 1", "IM0001_1.dcm")); got != tt.renamed {
+				t.Errorf("renamed copy is %q, want %q", got, tt.renamed)
+			}
+		})
+	}
+}
+
+func TestResolverRemembersAll(t *testing.T) {
+	r := newResolver(strings.NewReader("R\n"), io.Discard)
+	for i := 0; i < 3; i++ {
+		if got := r.Resolve("name", "conflict"); got != resolveRename {
+			t.Errorf("conflict %d resolved with %c, want %c", i, got, resolveRename)
+		}
+	}
+	// Other kinds of conflict are still asked about.
+	if got := r.Resolve("duplicate", "conflict"); got != resolveSkip {
+		t.Errorf("other conflict resolved with %c, want %c", got, resolveSkip)
+	}
+}
+
+func TestManifestRecordsBurnedIn(t *testing.T) {
+	retries = retryPolicy{}
+	src, dst := t.TempDir(), t.TempDir()
+	const mr = "SOPClassUID=1.2.840.10008.5.1.4.1.1.4"
+	series := map[string][]string{
+		"none.dcm":     {mr, "Modality=MR"},
+		"declared.dcm": {mr, "Modality=MR", "BurnedInAnnotation=YES"},
+		"sc.dcm":       {"Modality=MR"},
+		"us.dcm":       {mr, "Modality=US"},
+	}
+	want := map[string]string{
+		"none.dcm":     "",
+		"declared.dcm": "BurnedInAnnotation is YES",
+		"sc.dcm":       "secondary capture SOP class " + synthSOPClassUID,
+		"us.dcm":       "modality US",
+	}
+	for name, tags := range series {
+		synthFile(t, filepath.Join(src, name), append(tags, "PatientName=DOE", "SeriesDescription="+name)...)
+	}
+	path := filepath.Join(t.TempDir(), "manifest.jsonl")
+	mnfst, err := openManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Organizer{Dst: dst, Layout: "{SeriesDescription}", Manifest: mnfst}
+	o.All(context.Background(), o.Scan(context.Background(), src, nil))
+	if err := mnfst.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry manifestEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		got[filepath.Base(entry.Src)] = entry.BurnedIn
+	}
+	for name, reason := range want {
+		if r, ok := got[name]; !ok {
+			t.Errorf("%s wasn't recorded", name)
+		} else if r != reason {
+			t.Errorf("%s recorded as burned in %q, want %q", name, r, reason)
+		}
+	}
+}
+
+func TestOperationString(t *testing.T) {
+	tests := []struct {
+		op   Operation
+		want string
+	}{
+		{Operation{Op: opCopy, Src: "a", Dst: "b"}, "copy a -> b"},
+		{Operation{Op: opMove, Src: "a", Dst: "b", Compress: true}, "move+compress a -> b"},
+		{Operation{Op: opCopy, Src: "a", Dst: "b", StripOverlays: true, Provenance: true, Compress: true}, "copy+strip-overlays+provenance+compress a -> b"},
+		{Operation{Op: opCopy, Src: "a", Dst: "b", SetTags: true, LittleEndian: true, DeleteSource: true}, "copy+set-tags+little-endian+delete-source a -> b"},
+		{Operation{Op: opKeep, Src: "b", Dst: "b"}, "keep b"},
+		{Operation{Op: opMkdir, Dst: "dir"}, "mkdir dir"},
+	}
+	for _, tt := range tests {
+		if got := tt.op.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.op, got, tt.want)
+		}
+	}
+}
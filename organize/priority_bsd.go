@@ -0,0 +1,15 @@
+//go:build darwin || freebsd || netbsd || openbsd
+// +build darwin freebsd netbsd openbsd
+
+package organize
+
+import (
+	"syscall"
+)
+
+// lowerPriority reduces the scheduling priority of the process. There's no
+// portable way to lower I/O priority on BSDs, but most of them take the
+// CPU priority into account.
+func lowerPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, 19)
+}
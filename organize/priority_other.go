@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!windows
+
+package organize
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func lowerPriority() error {
+	return fmt.Errorf("lowering priority is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,22 @@
+package organize
+
+import (
+	"syscall"
+)
+
+const processModeBackgroundBegin = 0x00100000
+
+var setPriorityClass = syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass")
+
+// lowerPriority puts the process into background mode, which lowers both
+// its CPU and I/O priority.
+func lowerPriority() error {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	if r, _, err := setPriorityClass.Call(uintptr(h), processModeBackgroundBegin); r == 0 {
+		return err
+	}
+	return nil
+}
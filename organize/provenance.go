@@ -0,0 +1,93 @@
+package organize
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The private creator of the block that -provenance-tag writes the
+// original path of a file into.
+const ProvenanceCreator = "DICOMFMT PROVENANCE"
+
+// The private group and element offset within the block of the original
+// path.
+const (
+	provenanceGroup   = 0x0009
+	provenanceElement = 0x10
+)
+
+// padValue pads a string value to an even length, as DICOM requires.
+func padValue(s string) []byte {
+	if len(s)%2 != 0 {
+		s += " "
+	}
+	return []byte(s)
+}
+
+// setElement replaces the top level element with el's tag, or inserts el
+// in tag order if there isn't one.
+func (ds *dataset) setElement(el element) {
+	i := 0
+	for ; i < len(ds.Elements); i++ {
+		t := ds.Elements[i].Tag
+		if t == el.Tag {
+			ds.Elements[i] = el
+			return
+		}
+		if t.Group > el.Tag.Group || (t.Group == el.Tag.Group && t.Element > el.Tag.Element) {
+			break
+		}
+	}
+	ds.Elements = append(ds.Elements, element{})
+	copy(ds.Elements[i+1:], ds.Elements[i:])
+	ds.Elements[i] = el
+}
+
+// privateBlock returns the block in group reserved by creator, reserving
+// the first free one if there isn't one yet.
+func (ds *dataset) privateBlock(group uint16, creator string) (uint16, error) {
+	used := make(map[uint16]bool)
+	for _, el := range ds.Elements {
+		if el.Tag.Group != group || el.Tag.Element < 0x10 || el.Tag.Element > 0xFF {
+			continue
+		}
+		if string(bytes.TrimRight(el.Value, " \x00")) == creator {
+			return el.Tag.Element, nil
+		}
+		used[el.Tag.Element] = true
+	}
+	for block := uint16(0x10); block <= 0xFF; block++ {
+		if !used[block] {
+			ds.setElement(element{Tag: tag{group, block}, VR: "LO", Value: padValue(creator)})
+			return block, nil
+		}
+	}
+	return 0, fmt.Errorf("no free private blocks in group %04X", group)
+}
+
+// addProvenance is a rewrite which records the absolute path and
+// modification time of the original file in a private element, so that
+// it's known where an instance came from long after it was organized.
+func addProvenance(src FileName, ds *dataset) error {
+	path, err := filepath.Abs(src.String())
+	if err != nil {
+		return err
+	}
+	value := path
+	if info, err := os.Stat(src.String()); err == nil {
+		value += "\n" + info.ModTime().UTC().Format(time.RFC3339)
+	}
+	block, err := ds.privateBlock(provenanceGroup, ProvenanceCreator)
+	if err != nil {
+		return err
+	}
+	ds.setElement(element{
+		Tag:   tag{provenanceGroup, block<<8 | provenanceElement},
+		VR:    "UT",
+		Value: padValue(value),
+	})
+	return nil
+}
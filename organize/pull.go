@@ -0,0 +1,533 @@
+package organize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// queryTransferSyntaxes are the transfer syntaxes proposed for queries
+// and retrieves.
+var queryTransferSyntaxes = []string{explicitVRLittleEndian, implicitVRLittleEndian}
+
+// storageTransferSyntaxes are the transfer syntaxes that instances
+// retrieved with C-GET are accepted in, in order of preference.
+var storageTransferSyntaxes = []string{
+	explicitVRLittleEndian,
+	implicitVRLittleEndian,
+	deflatedExplicitVRLittleEndian,
+	explicitVRBigEndian,
+	jpegBaseline,
+	"1.2.840.10008.1.2.4.51",
+	"1.2.840.10008.1.2.4.57",
+	"1.2.840.10008.1.2.4.70",
+	"1.2.840.10008.1.2.4.80",
+	"1.2.840.10008.1.2.4.81",
+	"1.2.840.10008.1.2.4.90",
+	"1.2.840.10008.1.2.4.91",
+	"1.2.840.10008.1.2.5",
+}
+
+// storageSOPClasses are the SOP classes that instances retrieved with
+// C-GET are accepted in. Unlike C-MOVE, where the PACS proposes what it
+// sends, they have to be proposed up front, so only the common ones are.
+var storageSOPClasses = []string{
+	"1.2.840.10008.5.1.4.1.1.1",        // Computed Radiography
+	"1.2.840.10008.5.1.4.1.1.1.1",      // Digital X-Ray (presentation)
+	"1.2.840.10008.5.1.4.1.1.1.1.1",    // Digital X-Ray (processing)
+	"1.2.840.10008.5.1.4.1.1.1.2",      // Digital Mammography (presentation)
+	"1.2.840.10008.5.1.4.1.1.1.2.1",    // Digital Mammography (processing)
+	"1.2.840.10008.5.1.4.1.1.1.3",      // Digital Intra-Oral X-Ray (presentation)
+	"1.2.840.10008.5.1.4.1.1.1.3.1",    // Digital Intra-Oral X-Ray (processing)
+	"1.2.840.10008.5.1.4.1.1.2",        // CT
+	"1.2.840.10008.5.1.4.1.1.2.1",      // Enhanced CT
+	"1.2.840.10008.5.1.4.1.1.3.1",      // Ultrasound Multi-frame
+	"1.2.840.10008.5.1.4.1.1.4",        // MR
+	"1.2.840.10008.5.1.4.1.1.4.1",      // Enhanced MR
+	"1.2.840.10008.5.1.4.1.1.6.1",      // Ultrasound
+	"1.2.840.10008.5.1.4.1.1.7",        // Secondary Capture
+	"1.2.840.10008.5.1.4.1.1.7.1",      // Multi-frame Single Bit Secondary Capture
+	"1.2.840.10008.5.1.4.1.1.7.2",      // Multi-frame Grayscale Byte Secondary Capture
+	"1.2.840.10008.5.1.4.1.1.7.3",      // Multi-frame Grayscale Word Secondary Capture
+	"1.2.840.10008.5.1.4.1.1.7.4",      // Multi-frame True Color Secondary Capture
+	"1.2.840.10008.5.1.4.1.1.11.1",     // Grayscale Softcopy Presentation State
+	"1.2.840.10008.5.1.4.1.1.12.1",     // X-Ray Angiographic
+	"1.2.840.10008.5.1.4.1.1.12.2",     // X-Ray Radiofluoroscopic
+	"1.2.840.10008.5.1.4.1.1.13.1.3",   // Breast Tomosynthesis
+	"1.2.840.10008.5.1.4.1.1.20",       // Nuclear Medicine
+	"1.2.840.10008.5.1.4.1.1.66",       // Raw Data
+	"1.2.840.10008.5.1.4.1.1.66.1",     // Spatial Registration
+	"1.2.840.10008.5.1.4.1.1.66.4",     // Segmentation
+	"1.2.840.10008.5.1.4.1.1.77.1.1",   // VL Endoscopic
+	"1.2.840.10008.5.1.4.1.1.77.1.2",   // VL Microscopic
+	"1.2.840.10008.5.1.4.1.1.77.1.4",   // VL Photographic
+	"1.2.840.10008.5.1.4.1.1.77.1.5.1", // Ophthalmic Photography 8 Bit
+	"1.2.840.10008.5.1.4.1.1.77.1.6",   // VL Whole Slide Microscopy
+	"1.2.840.10008.5.1.4.1.1.88.11",    // Basic Text SR
+	"1.2.840.10008.5.1.4.1.1.88.22",    // Enhanced SR
+	"1.2.840.10008.5.1.4.1.1.88.33",    // Comprehensive SR
+	"1.2.840.10008.5.1.4.1.1.88.59",    // Key Object Selection
+	"1.2.840.10008.5.1.4.1.1.88.67",    // X-Ray Radiation Dose SR
+	"1.2.840.10008.5.1.4.1.1.104.1",    // Encapsulated PDF
+	"1.2.840.10008.5.1.4.1.1.128",      // PET
+	"1.2.840.10008.5.1.4.1.1.130",      // Enhanced PET
+	"1.2.840.10008.5.1.4.1.1.481.1",    // RT Image
+	"1.2.840.10008.5.1.4.1.1.481.2",    // RT Dose
+	"1.2.840.10008.5.1.4.1.1.481.3",    // RT Structure Set
+	"1.2.840.10008.5.1.4.1.1.481.5",    // RT Plan
+}
+
+// validUID reports whether uid is made up of the digits and dots that UIDs
+// are, so that it can be used as a file name.
+func validUID(uid string) bool {
+	if uid == "" || len(uid) > 64 || uid[0] == '.' {
+		return false
+	}
+	for _, r := range uid {
+		if (r < '0' || r > '9') && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// fileMeta returns the preamble and file meta information of a file for
+// an instance which was received in the transfer syntax ts, which are
+// written in front of the data set as it was received.
+func fileMeta(sopClass, sopInstance, ts string) []byte {
+	ds := &dataset{TransferSyntax: ts}
+	for t, uid := range map[tag]string{sopClassUIDTag: sopClass, sopInstanceUIDTag: sopInstance} {
+		value, _ := ds.encodeValue("UI", uid)
+		ds.setElement(element{Tag: t, VR: "UI", Value: value})
+	}
+	ds.setFileMeta()
+	// Only the file meta information is written, so the data set
+	// mustn't be deflated.
+	ds.Elements, ds.TransferSyntax = nil, implicitVRLittleEndian
+	var buf bytes.Buffer
+	ds.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// A stickyWriter stops writing after its first error, which it keeps, so
+// that the rest of a data set can still be read from the network.
+type stickyWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *stickyWriter) Write(p []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// A storeSCP writes the instances that are sent to it with C-STORE into a
+// directory.
+type storeSCP struct {
+	mu  sync.Mutex
+	dir string
+	// The number of instances received since the directory was set.
+	received int
+}
+
+// SetDir sets the directory that instances are written to. While it's
+// empty, instances are refused.
+func (s *storeSCP) SetDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dir, s.received = dir, 0
+}
+
+func (s *storeSCP) Received() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+// Store writes the instance sent with the C-STORE request c, and answers
+// the request.
+func (s *storeSCP) Store(a *association, c *command) error {
+	s.mu.Lock()
+	dir := s.dir
+	s.mu.Unlock()
+
+	sop := c.stringValue(cmdAffectedSOPInstance)
+	name := randomName()
+	if validUID(sop) {
+		name = sop + ".dcm"
+	}
+	path := filepath.Join(dir, name)
+	w := &stickyWriter{err: errors.New("no retrieve is in progress")}
+	var f *os.File
+	if dir != "" {
+		if f, w.err = os.Create(path); w.err == nil {
+			w.w = f
+			w.Write(fileMeta(c.stringValue(cmdAffectedSOPClass), sop, a.contexts[c.Context].TransferSyntax()))
+		}
+	}
+	err := a.ReadData(c, w)
+	if f != nil {
+		if w.err == nil && err == nil {
+			w.err = f.Sync()
+		}
+		if cerr := f.Close(); w.err == nil {
+			w.err = cerr
+		}
+		if w.err != nil || err != nil {
+			os.Remove(path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	status := uint16(statusSuccess)
+	if w.err != nil {
+		log.Printf("Could not store instance %s from %s: %v\n", sop, a.Calling, w.err)
+		status = statusOutOfResources
+	} else {
+		s.mu.Lock()
+		s.received++
+		s.mu.Unlock()
+	}
+	return a.Send(c.response(status), nil)
+}
+
+// storageAcceptor accepts associations to ae which send instances, in
+// whichever transfer syntax the sender prefers.
+func storageAcceptor(ae string) *acceptor {
+	return &acceptor{
+		AE: ae,
+		Negotiate: func(pc presentationContext, scpRole bool) (string, byte) {
+			if strings.HasPrefix(pc.AbstractSyntax, "1.2.840.10008.5.1.4.1.2.") {
+				// Query/retrieve isn't supported.
+				return "", contextAbstractSyntaxNotSupported
+			}
+			if len(pc.TransferSyntaxes) == 0 {
+				return "", contextTransferSyntaxesNotSupported
+			}
+			return pc.TransferSyntaxes[0], contextAccepted
+		},
+	}
+}
+
+// Serve accepts associations on l, and stores the instances sent over
+// them, until l is closed.
+func (s *storeSCP) Serve(l net.Listener, ac *acceptor) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn, ac)
+	}
+}
+
+func (s *storeSCP) serve(conn net.Conn, ac *acceptor) {
+	a, err := ac.Accept(conn)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for {
+		c, err := a.ReadCommand()
+		if err == errReleased {
+			return
+		}
+		if err == nil {
+			switch c.Field() {
+			case cStoreRQ:
+				err = s.Store(a, c)
+			case cEchoRQ:
+				err = a.Send(c.response(statusSuccess), nil)
+			default:
+				err = fmt.Errorf("%s sent an unsupported command %#04x", a.Calling, c.Field())
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			a.Abort()
+			return
+		}
+	}
+}
+
+// A studyQuery selects the studies to pull. Empty fields match anything.
+type studyQuery struct {
+	AccessionNumber  string
+	PatientID        string
+	StudyInstanceUID string
+	// A date, or a range of dates such as 20240101-20240131.
+	StudyDate string
+}
+
+func (q studyQuery) Empty() bool {
+	return q == studyQuery{}
+}
+
+// identifier returns the keys of a study level C-FIND request for q.
+func (q studyQuery) identifier() *dataset {
+	ds := &dataset{}
+	for _, k := range []struct{ name, vr, value string }{
+		{"StudyDate", "DA", q.StudyDate},
+		{"AccessionNumber", "SH", q.AccessionNumber},
+		{"StudyDescription", "LO", ""},
+		{"PatientName", "PN", ""},
+		{"PatientID", "LO", q.PatientID},
+		{"StudyInstanceUID", "UI", q.StudyInstanceUID},
+	} {
+		value, _ := ds.encodeValue(k.vr, k.value)
+		ds.setElement(element{Tag: tagDictionary[k.name], VR: k.vr, Value: value})
+	}
+	ds.setElement(element{Tag: queryRetrieveLevelTag, VR: "CS", Value: padValue("STUDY")})
+	return ds
+}
+
+// A foundStudy is a study that matched the query.
+type foundStudy struct {
+	UID, PatientName, StudyDate, Description string
+}
+
+// A pacs is a remote AE that studies are pulled from.
+type pacs struct {
+	Addr string
+	// The AE title of the PACS, and the one used to call it.
+	Called, Calling string
+	// Whether to retrieve studies with C-GET, on the same association,
+	// instead of C-MOVE.
+	Get bool
+	// With C-MOVE, the address that the PACS sends instances to.
+	StoreAddr string
+
+	// Instances are received here before they're organized.
+	staging string
+}
+
+// Find returns the studies on the PACS which match q.
+func (p *pacs) Find(a *association, q studyQuery) ([]foundStudy, error) {
+	pc, ok := a.ContextFor(studyRootFindUID)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't support Study Root Query/Retrieve FIND", p.Called)
+	}
+	rq := a.NewRequest(cFindRQ, pc)
+	rq.setUS(cmdPriority, 0)
+	if err := a.Send(rq, a.Identifier(rq, q.identifier())); err != nil {
+		return nil, err
+	}
+	var studies []foundStudy
+	for {
+		rsp, err := a.ReadCommand()
+		if err != nil {
+			return nil, err
+		}
+		if rsp.Field() != cFindRSP {
+			return nil, fmt.Errorf("%s answered C-FIND with command %#04x", p.Called, rsp.Field())
+		}
+		var match *dataset
+		if rsp.HasData() {
+			if match, err = a.ReadIdentifier(rsp); err != nil {
+				return nil, err
+			}
+		}
+		switch status := rsp.Status(); status {
+		case statusPending, statusPendingWarning:
+			if match == nil {
+				continue
+			}
+			study := foundStudy{
+				UID:         match.stringValue(tagDictionary["StudyInstanceUID"]),
+				PatientName: match.stringValue(tagDictionary["PatientName"]),
+				StudyDate:   match.stringValue(tagDictionary["StudyDate"]),
+				Description: match.stringValue(tagDictionary["StudyDescription"]),
+			}
+			if !validUID(study.UID) {
+				log.Printf("Skipping study with invalid UID %q.\n", study.UID)
+				continue
+			}
+			studies = append(studies, study)
+		case statusSuccess:
+			return studies, nil
+		default:
+			return nil, fmt.Errorf("%s failed the query with status %#04x %s", p.Called, status, rsp.stringValue(cmdErrorComment))
+		}
+	}
+}
+
+// A retrieveResult is the final response to a C-MOVE or C-GET.
+type retrieveResult struct {
+	Status                      uint16
+	Completed, Failed, Warnings uint16
+	Comment                     string
+}
+
+// Retrieve retrieves a study into store.
+func (p *pacs) Retrieve(a *association, store *storeSCP, study string) (retrieveResult, error) {
+	sopClass, field := studyRootMoveUID, uint16(cMoveRQ)
+	if p.Get {
+		sopClass, field = studyRootGetUID, cGetRQ
+	}
+	pc, ok := a.ContextFor(sopClass)
+	if !ok {
+		return retrieveResult{}, fmt.Errorf("%s doesn't support retrieving studies with C-%s", p.Called, strings.ToUpper(p.retrieveName()))
+	}
+	rq := a.NewRequest(field, pc)
+	rq.setUS(cmdPriority, 0)
+	if !p.Get {
+		rq.setString(cmdMoveDestination, "AE", p.Calling)
+	}
+	id := &dataset{}
+	value, _ := id.encodeValue("UI", study)
+	id.setElement(element{Tag: tagDictionary["StudyInstanceUID"], VR: "UI", Value: value})
+	id.setElement(element{Tag: queryRetrieveLevelTag, VR: "CS", Value: padValue("STUDY")})
+	if err := a.Send(rq, a.Identifier(rq, id)); err != nil {
+		return retrieveResult{}, err
+	}
+	for {
+		c, err := a.ReadCommand()
+		if err != nil {
+			return retrieveResult{}, err
+		}
+		switch c.Field() {
+		case field | 0x8000:
+		case cStoreRQ:
+			if p.Get {
+				if err := store.Store(a, c); err != nil {
+					return retrieveResult{}, err
+				}
+				continue
+			}
+			fallthrough
+		default:
+			return retrieveResult{}, fmt.Errorf("%s answered C-%s with command %#04x", p.Called, strings.ToUpper(p.retrieveName()), c.Field())
+		}
+		if c.HasData() {
+			// The instances which failed, which are
+			// reported by the counts anyway.
+			if err := a.ReadData(c, io.Discard); err != nil {
+				return retrieveResult{}, err
+			}
+		}
+		if status := c.Status(); status == statusPending || status == statusPendingWarning {
+			continue
+		}
+		return retrieveResult{
+			Status:    c.Status(),
+			Completed: c.us(cmdCompleted),
+			Failed:    c.us(cmdFailed),
+			Warnings:  c.us(cmdWarning),
+			Comment:   c.stringValue(cmdErrorComment),
+		}, nil
+	}
+}
+
+func (p *pacs) retrieveName() string {
+	if p.Get {
+		return "get"
+	}
+	return "move"
+}
+
+// Pull finds the studies which match q, and retrieves and organizes them
+// with o one at a time. Each study is organized as soon as it has
+// arrived. If ctx is cancelled, it stops after the study it's retrieving.
+func (p *pacs) Pull(ctx context.Context, o *Organizer, q studyQuery) error {
+	contexts := []presentationContext{{ID: 1, AbstractSyntax: studyRootFindUID, TransferSyntaxes: queryTransferSyntaxes}}
+	var roles []string
+	if p.Get {
+		contexts = append(contexts, presentationContext{ID: 3, AbstractSyntax: studyRootGetUID, TransferSyntaxes: queryTransferSyntaxes})
+		for i, uid := range storageSOPClasses {
+			contexts = append(contexts, presentationContext{ID: byte(5 + 2*i), AbstractSyntax: uid, TransferSyntaxes: storageTransferSyntaxes})
+		}
+		roles = storageSOPClasses
+	} else {
+		contexts = append(contexts, presentationContext{ID: 3, AbstractSyntax: studyRootMoveUID, TransferSyntaxes: queryTransferSyntaxes})
+	}
+	a, err := dialAssociation(ctx, p.Addr, p.Calling, p.Called, contexts, roles)
+	if err != nil {
+		return err
+	}
+	defer a.Release()
+
+	studies, err := p.Find(a, q)
+	if err != nil {
+		return err
+	}
+	if len(studies) == 0 {
+		log.Println("No studies matched the query.")
+		return nil
+	}
+	if verbose {
+		log.Printf("Found %s.\n", plural(len(studies), "study", "studies"))
+		for _, s := range studies {
+			log.Printf("  %s %s %s %s\n", s.UID, s.StudyDate, s.PatientName, s.Description)
+		}
+	}
+
+	store := &storeSCP{}
+	if !p.Get {
+		l, err := net.Listen("tcp", p.StoreAddr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		go store.Serve(l, storageAcceptor(p.Calling))
+	}
+	for _, study := range studies {
+		if o.stopping(ctx) {
+			return nil
+		}
+		dir := filepath.Join(p.staging, study.UID)
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+		store.SetDir(dir)
+		result, err := p.Retrieve(a, store, study.UID)
+		received := store.Received()
+		store.SetDir("")
+		if err != nil {
+			return err
+		}
+		switch result.Status {
+		case statusSuccess:
+		case statusSubopsFailed:
+			log.Printf("%s couldn't send %s of study %s.\n", p.Called, plural(int(result.Failed), "instance", "instances"), study.UID)
+		default:
+			log.Printf("Retrieving study %s failed with status %#04x %s\n", study.UID, result.Status, result.Comment)
+		}
+		if received == 0 {
+			removeEmpty(dir)
+			continue
+		}
+
+		// The study is scanned like any other source, so that it's
+		// organized with the same walk options and site labels.
+		series := o.Scan(ctx, dir, nil)
+		failedBefore := len(o.Failed)
+		for _, uid := range o.Order.UIDs(series) {
+			o.Series(ctx, series[uid])
+		}
+		if o.stopping(ctx) {
+			return nil
+		}
+		if n := len(o.Failed) - failedBefore; n > 0 {
+			log.Printf("Could not place %s from study %s, leaving them in %s.\n", plural(n, "instance", "instances"), study.UID, dir)
+			continue
+		}
+		removeEmpty(dir)
+		if verbose {
+			log.Printf("Pulled %s of study %s.\n", plural(received, "instance", "instances"), study.UID)
+		}
+	}
+	removeEmpty(p.staging)
+	return nil
+}
@@ -0,0 +1,218 @@
+package organize
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A fakePACS answers study level C-FIND requests with one study, and
+// sends its instances for C-GET and C-MOVE requests.
+type fakePACS struct {
+	t         *testing.T
+	study     string
+	accession string
+	instances [][]string
+	// The size of the pixel data of each instance, which is large
+	// enough for it to be split across PDUs.
+	pixels int
+	// Where C-MOVE sends instances.
+	storeAddr string
+}
+
+func (p *fakePACS) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ac := &acceptor{AE: "PACS", Negotiate: func(pc presentationContext, scpRole bool) (string, byte) {
+		return pc.TransferSyntaxes[0], contextAccepted
+	}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			a, err := ac.Accept(conn)
+			if err != nil {
+				continue
+			}
+			go p.handle(a)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (p *fakePACS) handle(a *association) {
+	for {
+		c, err := a.ReadCommand()
+		if err == errReleased {
+			return
+		}
+		if err != nil {
+			p.t.Error(err)
+			return
+		}
+		keys, err := a.ReadIdentifier(c)
+		if err != nil {
+			p.t.Error(err)
+			return
+		}
+		switch c.Field() {
+		case cFindRQ:
+			if acc := keys.stringValue(tagDictionary["AccessionNumber"]); acc == p.accession {
+				match := &dataset{}
+				for name, v := range map[string]string{"StudyInstanceUID": p.study, "AccessionNumber": p.accession} {
+					value, _ := match.encodeValue("UI", v)
+					match.setElement(element{Tag: tagDictionary[name], VR: "UI", Value: value})
+				}
+				a.Send(c.response(statusPending), a.Identifier(c, match))
+			}
+			a.Send(c.response(statusSuccess), nil)
+		case cGetRQ:
+			p.send(a, c)
+			a.Send(c.response(statusSuccess), nil)
+		case cMoveRQ:
+			if dest := c.stringValue(cmdMoveDestination); dest != "DICOMFMT" {
+				p.t.Errorf("C-MOVE to %q, want DICOMFMT", dest)
+			}
+			sub, err := dialAssociation(context.Background(), p.storeAddr, "PACS", "DICOMFMT", []presentationContext{
+				{ID: 1, AbstractSyntax: synthSOPClassUID, TransferSyntaxes: []string{explicitVRLittleEndian}},
+			}, nil)
+			if err != nil {
+				p.t.Error(err)
+				a.Send(c.response(statusOutOfResources), nil)
+				continue
+			}
+			p.send(sub, c)
+			sub.Release()
+			a.Send(c.response(statusSuccess), nil)
+		}
+	}
+}
+
+// send sends the instances of the study with C-STORE over a.
+func (p *fakePACS) send(a *association, rq *command) {
+	pc, ok := a.ContextFor(synthSOPClassUID)
+	if !ok {
+		p.t.Error("secondary capture wasn't accepted")
+		return
+	}
+	for _, tags := range p.instances {
+		ds := synthDataset(p.t, append(tags, "StudyInstanceUID="+p.study)...)
+		ds.setElement(element{Tag: tag{0x7FE0, 0x0010}, VR: "OB", Value: make([]byte, p.pixels)})
+		c := a.NewRequest(cStoreRQ, pc)
+		c.setString(cmdAffectedSOPInstance, "UI", ds.stringValue(sopInstanceUIDTag))
+		c.setUS(cmdPriority, 0)
+		if err := a.Send(c, a.Identifier(c, ds)); err != nil {
+			p.t.Error(err)
+			return
+		}
+		rsp, err := a.ReadCommand()
+		if err != nil {
+			p.t.Error(err)
+			return
+		}
+		if rsp.Field() != cStoreRSP || rsp.Status() != statusSuccess {
+			p.t.Errorf("C-STORE answered with %#04x status %#04x", rsp.Field(), rsp.Status())
+		}
+	}
+}
+
+// freeAddr returns a local address that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestPull(t *testing.T) {
+	retries = retryPolicy{}
+	for _, mode := range []string{"get", "move"} {
+		t.Run(mode, func(t *testing.T) {
+			series := "SeriesInstanceUID=" + newUID(t)
+			fake := &fakePACS{
+				t:         t,
+				study:     newUID(t),
+				accession: "A123",
+				pixels:    3*maxPDULength + 10,
+				storeAddr: freeAddr(t),
+			}
+			for _, name := range []string{"AX", "COR"} {
+				fake.instances = append(fake.instances, []string{series, "PatientName=DOE", "SeriesDescription=" + name})
+			}
+			dst := t.TempDir()
+			p := &pacs{
+				Addr:      fake.serve(t),
+				Called:    "PACS",
+				Calling:   "DICOMFMT",
+				Get:       mode == "get",
+				StoreAddr: fake.storeAddr,
+				staging:   filepath.Join(dst, ".pull-incoming"),
+			}
+			o := &Organizer{Dst: dst, Layout: "{PatientName}", Move: true}
+			if err := p.Pull(context.Background(), o, studyQuery{AccessionNumber: "A123"}); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(filepath.Join(dst, "DOE"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			sort.Strings(names)
+			if len(names) != 2 {
+				t.Fatalf("organized %v, want the 2 instances", names)
+			}
+			data, err := os.ReadFile(filepath.Join(dst, "DOE", names[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ds, err := readDataset(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ds.TransferSyntax != explicitVRLittleEndian || ds.stringValue(tagDictionary["StudyInstanceUID"]) != fake.study {
+				t.Errorf("received %s in %s, want study %s", ds.stringValue(tagDictionary["StudyInstanceUID"]), ds.TransferSyntax, fake.study)
+			}
+			if el, _ := ds.element(tag{0x7FE0, 0x0010}); len(el.Value) != fake.pixels {
+				t.Errorf("received %d bytes of pixel data, want %d", len(el.Value), fake.pixels)
+			}
+			if _, err := os.Stat(p.staging); !os.IsNotExist(err) {
+				t.Errorf("staging directory left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestPullNoMatches(t *testing.T) {
+	fake := &fakePACS{t: t, study: newUID(t), accession: "A123"}
+	dst := t.TempDir()
+	p := &pacs{Addr: fake.serve(t), Called: "PACS", Calling: "DICOMFMT", Get: true, staging: filepath.Join(dst, ".pull-incoming")}
+	o := &Organizer{Dst: dst, Layout: "{PatientName}", Move: true}
+	if err := p.Pull(context.Background(), o, studyQuery{AccessionNumber: "OTHER"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssociationRejected(t *testing.T) {
+	fake := &fakePACS{t: t}
+	addr := fake.serve(t)
+	_, err := dialAssociation(context.Background(), addr, "DICOMFMT", "NOTPACS", []presentationContext{
+		{ID: 1, AbstractSyntax: verificationUID, TransferSyntaxes: []string{implicitVRLittleEndian}},
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "called AE title not recognized") {
+		t.Errorf("association to the wrong AE title: %v", err)
+	}
+}
@@ -0,0 +1,380 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// zeros is an io.Reader which reads an infinite stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// shred overwrites a file with zeros before removing it, so that its
+// contents can't be trivially recovered from the disk. Note that this
+// provides no guarantees on copy-on-write or journaling filesystems, or on
+// flash storage that remaps blocks.
+func shred(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.Copy(f, io.LimitReader(zeros{}, fi.Size())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// removeEmptyParents removes dir and each of its parents if they're empty,
+// stopping at root.
+func removeEmptyParents(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return
+		}
+		if !removeEmpty(dir) {
+			return
+		}
+	}
+}
+
+// A purgedPatient is what's known about a patient from their files, which
+// is used to find the rest of their data once the files are deleted.
+type purgedPatient struct {
+	ID string
+
+	// The patient's names and studies, as found in their files.
+	Names   map[string]bool
+	Studies map[string]bool
+
+	// The absolute paths of the files that were deleted, and of the
+	// sources that they were organized from.
+	Files   map[string]bool
+	Sources map[string]bool
+}
+
+func newPurgedPatient(id string) *purgedPatient {
+	return &purgedPatient{
+		ID:      id,
+		Names:   make(map[string]bool),
+		Studies: make(map[string]bool),
+		Files:   make(map[string]bool),
+		Sources: make(map[string]bool),
+	}
+}
+
+// hasFile reports whether path, which may be relative, is a file that was
+// deleted.
+func (p *purgedPatient) hasFile(path string) bool {
+	abs, err := filepath.Abs(path)
+	return err == nil && p.Files[abs]
+}
+
+// findPatientFiles returns every DICOM file under dir whose PatientID is
+// p.ID, and records the names and studies that they have in p. Unlike
+// SplitSeries, it doesn't require any other tags to be present, so that
+// incomplete files aren't missed.
+func findPatientFiles(dir string, p *purgedPatient) ([]string, error) {
+	parser, err := newHeaderParser()
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		if info.IsDir() || isTextFile(FileName(path)) {
+			return nil
+		}
+		bytes, err := readStored(path)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		tags, err := parsePatient(parser, FileName(path), bytes)
+		if err != nil {
+			if verbose {
+				log.Println(path, " parser error: ", err)
+			}
+			return nil
+		}
+		if tags["PatientID"] == p.ID {
+			matches = append(matches, path)
+			if name := tags["PatientName"]; name != "" {
+				p.Names[name] = true
+			}
+			if study := tags["StudyInstanceUID"]; study != "" {
+				p.Studies[study] = true
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// parsePatient returns the PatientID, PatientName and StudyInstanceUID of
+// a file.
+func parsePatient(parser HeaderParser, filename FileName, bytes []byte) (tags map[string]string, err error) {
+	defer recoverParse(filename, &err)
+	names := []string{"PatientID", "PatientName", "StudyInstanceUID"}
+	data, err := parseHeader(parser, bytes, names)
+	if err != nil {
+		return nil, err
+	}
+	tags = make(map[string]string)
+	for _, name := range names {
+		tags[name] = strings.TrimSpace(lookupValue(data, name))
+	}
+	return tags, nil
+}
+
+// scrubRecords rewrites the file of JSON lines at path without the lines
+// which keep rejects, and returns how many were removed. The old file is
+// shredded, since it still has the removed lines in it.
+func scrubRecords(path string, keep func(n int, line []byte) bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".purge-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	removed := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for n := 0; scanner.Scan(); n++ {
+		if !keep(n, scanner.Bytes()) {
+			removed++
+			continue
+		}
+		w.Write(scanner.Bytes())
+		w.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if removed == 0 {
+		tmp.Close()
+		return 0, nil
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	f.Close()
+	if err := shred(path); err != nil {
+		return 0, err
+	}
+	return removed, os.Rename(tmp.Name(), path)
+}
+
+// keepRecord reports whether a line of a manifest or journal is about
+// someone other than p. The sources of the lines which aren't are
+// recorded, so that they can be removed from the cache. Lines that can't
+// be read are removed, since they can't be checked.
+func (p *purgedPatient) keepRecord(n int, line []byte) bool {
+	var entry manifestEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return false
+	}
+	if !p.hasFile(entry.Dst) {
+		return true
+	}
+	if abs, err := filepath.Abs(entry.Src); err == nil {
+		p.Sources[abs] = true
+	}
+	return false
+}
+
+// keepCacheEntry reports whether a line of a parse cache is about someone
+// other than p. The first line is the cache's header.
+func (p *purgedPatient) keepCacheEntry(n int, line []byte) bool {
+	if n == 0 {
+		return true
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(entry.Path)
+	if err != nil {
+		return false
+	}
+	s := entry.Series
+	return !p.Files[abs] && !p.Sources[abs] && !p.Names[strings.TrimSpace(s.PatientName)] && strings.TrimSpace(s.Tags["PatientID"]) != p.ID
+}
+
+// Archives returns the encrypted archives in dir which hold p's files,
+// which are those named for one of their names or studies.
+func (p *purgedPatient) Archives(dir string) ([]string, error) {
+	var names []string
+	for name := range p.Names {
+		names = append(names, (&archiver{}).archiveName(map[string]string{"PatientName": name, "PatientID": p.ID}))
+	}
+	for study := range p.Studies {
+		names = append(names, (&archiver{PerStudy: true}).archiveName(map[string]string{"StudyInstanceUID": study}))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, e := range entries {
+		base := strings.TrimSuffix(e.Name(), encryptExtension)
+		if e.IsDir() || base == e.Name() {
+			continue
+		}
+		for _, name := range names {
+			// Later archives for the same name are numbered.
+			if base == name || strings.HasPrefix(base, name+"_") && strings.Trim(base[len(name)+1:], "0123456789") == "" {
+				archives = append(archives, filepath.Join(dir, e.Name()))
+				break
+			}
+		}
+	}
+	return archives, nil
+}
+
+// PurgeStores are the other places that a patient's data is kept, which
+// Purge removes it from.
+type PurgeStores struct {
+	Manifest, Journal, Cache, Mirror, EncryptDir string
+}
+
+// purge deletes p's files in target and removes them from stores,
+// recording what it did in audit. It prints each file deleted, and returns
+// a description of everything that couldn't be purged.
+func purge(target string, p *purgedPatient, stores PurgeStores, audit *auditLog) ([]string, error) {
+	var remaining []string
+	shredAll := func(root string, files []string) error {
+		for _, file := range files {
+			if err := shred(file); err != nil {
+				log.Println(err)
+				remaining = append(remaining, file)
+				continue
+			}
+			if abs, err := filepath.Abs(file); err == nil {
+				p.Files[abs] = true
+			}
+			if err := audit.Record("delete", file, "purge of PatientID "+p.ID); err != nil {
+				return err
+			}
+			removeEmptyParents(filepath.Dir(file), root)
+			fmt.Println(file)
+		}
+		return nil
+	}
+
+	roots := []string{target}
+	if stores.Mirror != "" {
+		roots = append(roots, stores.Mirror)
+	}
+	for _, root := range roots {
+		files, err := findPatientFiles(root, p)
+		if err != nil {
+			return nil, err
+		}
+		if err := shredAll(root, files); err != nil {
+			return nil, err
+		}
+	}
+	if stores.EncryptDir != "" {
+		archives, err := p.Archives(stores.EncryptDir)
+		if err != nil {
+			log.Println(err)
+			remaining = append(remaining, stores.EncryptDir)
+		} else if err := shredAll(stores.EncryptDir, archives); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cache is scrubbed last, since the manifest and journal say
+	// which sources the files came from.
+	for _, r := range []struct {
+		path string
+		keep func(int, []byte) bool
+	}{
+		{stores.Manifest, p.keepRecord},
+		{stores.Journal, p.keepRecord},
+		{stores.Cache, p.keepCacheEntry},
+	} {
+		if r.path == "" {
+			continue
+		}
+		n, err := scrubRecords(r.path, r.keep)
+		if err != nil {
+			log.Println(err)
+			remaining = append(remaining, r.path)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		if err := audit.Record("scrub", r.path, fmt.Sprintf("removed %d entries in purge of PatientID %s", n, p.ID)); err != nil {
+			return nil, err
+		}
+	}
+	return remaining, nil
+}
+
+// Purge securely deletes every file belonging to the patient with
+// patientID from the organized directory target, and removes them from
+// stores. It records what it did in the audit log at auditPath, or
+// purge-audit.log in target if it's empty, and also sends it to the
+// system logger if auditSyslog is set. It returns a description of
+// everything that still has data for the patient.
+func Purge(target, patientID string, stores PurgeStores, auditPath string, auditSyslog bool) ([]string, error) {
+	if auditPath == "" {
+		auditPath = filepath.Join(target, "purge-audit.log")
+	}
+	audit, err := openAuditLog(auditPath, auditSyslog)
+	if err != nil {
+		return nil, err
+	}
+	defer audit.Close()
+	return purge(target, newPurgedPatient(patientID), stores, audit)
+}
@@ -0,0 +1,220 @@
+package organize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoveEmptyParents(t *testing.T) {
+	tests := []struct {
+		name string
+		// Directories to create below the root, and files to put in
+		// them.
+		dirs, files []string
+		// The root to stop at, if it isn't the temporary directory,
+		// and whether to use it as a relative path from the temporary
+		// directory.
+		root     string
+		relative bool
+		// The directory to remove, and what's left of the tree.
+		dir  string
+		want []string
+	}{
+		{
+			name: "every parent",
+			dirs: []string{"a/b/c"},
+			dir:  "a/b/c",
+			want: nil,
+		},
+		{
+			name:  "stops at a file",
+			dirs:  []string{"a/b/c"},
+			files: []string{"a/f"},
+			dir:   "a/b/c",
+			want:  []string{"a", "a/f"},
+		},
+		{
+			name: "stops at another directory",
+			dirs: []string{"a/b/c", "a/d"},
+			dir:  "a/b/c",
+			want: []string{"a", "a/d"},
+		},
+		{
+			name:  "not empty",
+			dirs:  []string{"a/b"},
+			files: []string{"a/b/f"},
+			dir:   "a/b",
+			want:  []string{"a", "a/b", "a/b/f"},
+		},
+		{
+			name:     "relative root",
+			dirs:     []string{"a/b"},
+			root:     ".",
+			relative: true,
+			dir:      "a/b",
+			want:     nil,
+		},
+		{
+			name:  "root is a prefix of a sibling",
+			dirs:  []string{"arch", "archive2/b"},
+			files: []string{"arch/f"},
+			root:  "arch",
+			dir:   "archive2/b",
+			want:  []string{"arch", "arch/f", "archive2", "archive2/b"},
+		},
+		{
+			name: "stops at the root",
+			dirs: []string{"arch/b"},
+			root: "arch",
+			dir:  "arch/b",
+			want: []string{"arch"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, d := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, f := range tt.files {
+				if err := os.WriteFile(filepath.Join(root, f), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stop, dir := filepath.Join(root, tt.root), filepath.Join(root, tt.dir)
+			if tt.relative {
+				chdir(t, root)
+				stop, dir = tt.root, tt.dir
+			}
+			removeEmptyParents(dir, stop)
+			if _, err := os.Stat(filepath.Join(root, tt.root)); err != nil {
+				t.Fatalf("the root was removed: %v", err)
+			}
+			if got := treeContents(t, root); !equalStrings(got, tt.want) {
+				t.Errorf("left %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// chdir changes to dir until the test finishes.
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// treeContents returns the slash separated paths of everything below
+// root.
+func treeContents(t *testing.T, root string) []string {
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root {
+			rel, _ := filepath.Rel(root, path)
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPurge(t *testing.T) {
+	retries = retryPolicy{}
+	defer func(old []string) { fileTags = old }(fileTags)
+	fileTags = addTag(fileTags, "SOPInstanceUID")
+	fileTags = addTag(fileTags, "FrameOfReferenceUID")
+
+	src, dst, records := t.TempDir(), t.TempDir(), t.TempDir()
+	synthTree(t, src, 2, 1, 1, 2)
+	stores := PurgeStores{
+		Manifest:   filepath.Join(records, "manifest"),
+		Journal:    filepath.Join(records, "journal"),
+		Cache:      filepath.Join(records, "cache"),
+		Mirror:     t.TempDir(),
+		EncryptDir: t.TempDir(),
+	}
+	mnfst, err := openManifest(stores.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jrnl, err := openJournal(stores.Journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err = openParseCache(stores.Cache, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { cached = nil }()
+	o := &Organizer{
+		Dst:      dst,
+		Layout:   DefaultLayout,
+		Manifest: mnfst,
+		Journal:  jrnl,
+		Mirror:   &mirror{Dir: stores.Mirror, Root: dst},
+		Encrypt:  newArchiver(dst, stores.EncryptDir, make([]byte, 32), false),
+	}
+	o.All(context.Background(), o.Scan(context.Background(), src, nil))
+	if status := o.Finish(); status != 0 {
+		t.Fatalf("organizing exited with %d", status)
+	}
+
+	p := newPurgedPatient("SYNTH1")
+	remaining, err := purge(dst, p, stores, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) > 0 {
+		t.Errorf("%v weren't purged", remaining)
+	}
+	if len(p.Files) != 5 {
+		t.Errorf("deleted %d files, want 2 in the target, 2 in the mirror and an archive", len(p.Files))
+	}
+
+	for _, root := range []string{dst, stores.Mirror, stores.EncryptDir} {
+		for _, path := range treeContents(t, root) {
+			if strings.Contains(path, "PATIENT1") {
+				t.Errorf("%s is still in %s", path, root)
+			}
+		}
+	}
+	for path, want := range map[string]int{stores.Manifest: 2, stores.Journal: 2, stores.Cache: 3} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(b), "\n"); n != want {
+			t.Errorf("%s has %d lines, want %d", filepath.Base(path), n, want)
+		}
+		if strings.Contains(string(b), "PATIENT1") || strings.Contains(string(b), "SYNTH1") {
+			t.Errorf("%s still mentions the patient", filepath.Base(path))
+		}
+	}
+}
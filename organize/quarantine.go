@@ -0,0 +1,101 @@
+package organize
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// A parsePanic is the error for a file that made the parser panic.
+type parsePanic struct {
+	file  FileName
+	value interface{}
+	stack []byte
+}
+
+func (p parsePanic) Error() string {
+	return fmt.Sprintf("%s: parser crashed: %v", p.file, p.value)
+}
+
+// recoverParse recovers from a panic while parsing filename, replacing
+// *err with a parsePanic. It must be called with defer.
+func recoverParse(filename FileName, err *error) {
+	if v := recover(); v != nil {
+		metrics.ParseFailure()
+		*err = parsePanic{filename, v, debug.Stack()}
+	}
+}
+
+// A quarantine is a directory that files which crash the parser are put
+// in, so that they aren't retried on every run. Each file is recorded in
+// quarantine.log in the directory along with the reason.
+type quarantine struct {
+	Dir string
+
+	// If set, files are moved into the quarantine instead of copied.
+	Move bool
+
+	mu sync.Mutex
+}
+
+// quarantineEntry is a line of quarantine.log.
+type quarantineEntry struct {
+	Original    string    `json:"original"`
+	Quarantined string    `json:"quarantined"`
+	Reason      string    `json:"reason"`
+	Time        time.Time `json:"time"`
+}
+
+// The quarantine for this run, or nil if files are only logged.
+var quarantined *quarantine
+
+// Add puts file into the quarantine.
+func (q *quarantine) Add(file FileName, reason error) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := perms.MkdirAll(LocalFS{}, q.Dir); err != nil {
+		log.Println(err)
+		return
+	}
+	dst := filepath.Join(q.Dir, filepath.Base(file.String()))
+	if _, err := os.Stat(dst); err == nil {
+		// Different directories often use the same file names.
+		sum := sha1.Sum([]byte(file))
+		dst = filepath.Join(q.Dir, hex.EncodeToString(sum[:4])+"-"+filepath.Base(file.String()))
+	}
+	action := copyFile
+	if q.Move {
+		action = moveFile
+	}
+	if err := action(LocalFS{}, file, FileName(dst)); err != nil {
+		log.Printf("Could not quarantine %s: %v\n", file, err)
+		return
+	}
+	log.Printf("Quarantined %s as %s.\n", file, dst)
+
+	line, err := json.Marshal(quarantineEntry{file.String(), dst, reason.Error(), clock()})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(q.Dir, "quarantine.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,186 @@
+package organize
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A spoolQueue is a crash safe queue of uploads which have been received
+// but not organized yet, kept in a directory on the same filesystem as the
+// target.
+//
+// Each upload is written to its own directory named upload*, which is
+// renamed to queued-* once every file in it has been written and synced.
+// Since an upload's files are moved out of the queue as they're organized,
+// an upload that was interrupted by a crash can be organized again when
+// dicomfmt restarts without organizing any file twice. Uploads that were
+// still being received are discarded, since the client never got a
+// response for them.
+type spoolQueue struct {
+	Dir string
+}
+
+// The number of uploads queued by this process, used to keep them in
+// order when several are queued in the same nanosecond.
+var queueSeq uint64
+
+// Begin starts a new upload, returning the directory to write its files
+// into.
+func (q spoolQueue) Begin() (string, error) {
+	if err := os.MkdirAll(q.Dir, 0750); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(q.Dir, "upload")
+}
+
+// Commit adds an upload that has been completely written to the queue,
+// and returns its new directory.
+func (q spoolQueue) Commit(upload string) (string, error) {
+	seq := atomic.AddUint64(&queueSeq, 1)
+	name := fmt.Sprintf("queued-%020d-%06d", time.Now().UnixNano(), seq%1000000)
+	queued := filepath.Join(q.Dir, name)
+	if err := os.Rename(upload, queued); err != nil {
+		return "", err
+	}
+	return queued, syncDir(q.Dir)
+}
+
+// syncDir flushes a directory's entries to disk, so that a rename in it
+// survives a crash. Not every platform supports it, so failures are
+// ignored.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	f.Sync()
+	return f.Close()
+}
+
+// A queueItem is an upload waiting in the queue.
+type queueItem struct {
+	Dir      string
+	Files    []FileName
+	Bytes    int64
+	Received time.Time
+}
+
+// queuedTime returns when an upload was queued, from its directory name.
+func queuedTime(name string) time.Time {
+	parts := strings.Split(name, "-")
+	if len(parts) < 2 {
+		return time.Time{}
+	}
+	ns, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Pending returns the uploads in the queue, oldest first, along with the
+// directories of uploads which were never completely received. Uploads
+// which couldn't be organized when they were replayed are renamed to
+// failed-* and left for someone to look at.
+func (q spoolQueue) Pending() ([]queueItem, []string, error) {
+	infos, err := ioutil.ReadDir(q.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var items []queueItem
+	var partial []string
+	for _, info := range infos {
+		dir := filepath.Join(q.Dir, info.Name())
+		switch {
+		case !info.IsDir():
+			continue
+		case strings.HasPrefix(info.Name(), "upload"):
+			partial = append(partial, dir)
+			continue
+		case !strings.HasPrefix(info.Name(), "queued-"):
+			continue
+		}
+		item := queueItem{Dir: dir, Received: queuedTime(info.Name())}
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				item.Files = append(item.Files, FileName(path))
+				item.Bytes += fi.Size()
+			}
+			return nil
+		})
+		if len(item.Files) == 0 {
+			// Everything in it was organized, but it wasn't
+			// removed.
+			os.RemoveAll(dir)
+			continue
+		}
+		items = append(items, item)
+	}
+	// Names sort in the order that uploads were queued.
+	sort.Slice(items, func(i, j int) bool { return items[i].Dir < items[j].Dir })
+	return items, partial, nil
+}
+
+// Done removes an upload from the queue once its files have been
+// organized or discarded.
+func (q spoolQueue) Done(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Println(err)
+	}
+}
+
+// QueueStatus writes a report on the uploads waiting to be organized by
+// receive mode into target to w. The uploads are queued in spoolDir and
+// studies are held by -study-settle in stagingDir, which are .incoming
+// and .staging in target if they're empty.
+func QueueStatus(w io.Writer, target, spoolDir, stagingDir string) error {
+	if spoolDir == "" {
+		spoolDir = filepath.Join(target, ".incoming")
+	}
+	if stagingDir == "" {
+		stagingDir = filepath.Join(target, ".staging")
+	}
+
+	items, partial, err := spoolQueue{spoolDir}.Pending()
+	if err != nil {
+		return err
+	}
+	var files int
+	var size int64
+	for _, item := range items {
+		files += len(item.Files)
+		size += item.Bytes
+	}
+	fmt.Fprintf(w, "Queued uploads:     %d (%d files, %s)\n", len(items), files, humanBytes(uint64(size)))
+	if len(items) > 0 {
+		oldest := items[0].Received
+		fmt.Fprintf(w, "Oldest upload:      %s (%v ago)\n", oldest.Format(time.RFC3339), time.Since(oldest).Round(time.Second))
+	}
+	fmt.Fprintf(w, "Incomplete uploads: %d\n", len(partial))
+	failed, _ := filepath.Glob(filepath.Join(spoolDir, "failed-*"))
+	fmt.Fprintf(w, "Failed uploads:     %d\n", len(failed))
+
+	entries, err := ioutil.ReadDir(stagingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var held int
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(stagingDir, e.Name(), heldStudyFile)); err == nil {
+			held++
+		}
+	}
+	fmt.Fprintf(w, "Held studies:       %d\n", held)
+	return nil
+}
@@ -0,0 +1,119 @@
+package organize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// The implementation class UID written in the file meta information that
+// dicomfmt creates.
+const implementationUID = "2.25.229403322630987422186918477098401540997"
+
+// rawTransferSyntax returns the transfer syntax of data if it's a raw
+// dataset, without the preamble and file meta information of a Part 10
+// file, as some legacy archives store them, or "" if it isn't one. Raw
+// datasets don't say how they're encoded, so it's guessed from the first
+// element, which is expected to be in group 0008: if it's followed by a
+// VR it's explicit VR little endian, and otherwise implicit.
+func rawTransferSyntax(data []byte) string {
+	if len(data) < 8 || (len(data) >= 132 && string(data[128:132]) == "DICM") {
+		return ""
+	}
+	if binary.LittleEndian.Uint16(data) != 0x0008 {
+		return ""
+	}
+	if isVR(data[4:6]) {
+		return explicitVRLittleEndian
+	}
+	if length := binary.LittleEndian.Uint32(data[4:]); length != undefinedLength && int64(length) > int64(len(data)-8) {
+		return ""
+	}
+	return implicitVRLittleEndian
+}
+
+// isVR reports whether b is two upper case letters, as a VR is.
+func isVR(b []byte) bool {
+	return len(b) == 2 && b[0] >= 'A' && b[0] <= 'Z' && b[1] >= 'A' && b[1] <= 'Z'
+}
+
+// withFileMeta returns data with a preamble and minimal file meta
+// information in front of it if it's a raw dataset, or only a preamble if
+// it has file meta information without one, so that it can be parsed like
+// any other file. Other data is returned unchanged.
+func withFileMeta(data []byte) []byte {
+	preamble := append(make([]byte, 128), "DICM"...)
+	if len(data) >= 2 && binary.LittleEndian.Uint16(data) == 0x0002 && !(len(data) >= 132 && string(data[128:132]) == "DICM") {
+		return append(preamble, data...)
+	}
+	ts := rawTransferSyntax(data)
+	if ts == "" {
+		return data
+	}
+	uid, _ := (&dataset{}).encodeValue("UI", ts)
+	hdr := &dataset{
+		Preamble: preamble,
+		Meta: []element{
+			{Tag: tag{0x0002, 0x0000}, VR: "UL"},
+			{Tag: tag{0x0002, 0x0001}, VR: "OB", Value: []byte{0, 1}},
+			{Tag: transferSyntaxTag, VR: "UI", Value: uid},
+		},
+	}
+	var buf bytes.Buffer
+	hdr.WriteTo(&buf)
+	return append(buf.Bytes(), data...)
+}
+
+// setFileMeta gives ds a preamble and file meta information for its SOP
+// class, SOP instance and transfer syntax, replacing any that it had.
+func (ds *dataset) setFileMeta() {
+	if ds.TransferSyntax == "" {
+		ds.TransferSyntax = implicitVRLittleEndian
+	}
+	ui := func(t tag, v string) element {
+		value, _ := ds.encodeValue("UI", v)
+		return element{Tag: t, VR: "UI", Value: value}
+	}
+	ds.Preamble = append(make([]byte, 128), "DICM"...)
+	ds.Meta = []element{
+		{Tag: tag{0x0002, 0x0000}, VR: "UL"},
+		{Tag: tag{0x0002, 0x0001}, VR: "OB", Value: []byte{0, 1}},
+		ui(tag{0x0002, 0x0002}, ds.stringValue(sopClassUIDTag)),
+		ui(mediaStorageSOPTag, ds.stringValue(sopInstanceUIDTag)),
+		ui(transferSyntaxTag, ds.TransferSyntax),
+		ui(tag{0x0002, 0x0012}, implementationUID),
+	}
+}
+
+// addFileMeta is the rewrite for -add-file-meta. It gives raw datasets
+// file meta information, so that they're written as Part 10 files, and
+// leaves other files alone.
+func addFileMeta(src FileName, ds *dataset) error {
+	if len(ds.Meta) > 0 {
+		if ds.Preamble == nil {
+			ds.Preamble = append(make([]byte, 128), "DICM"...)
+		}
+		return nil
+	}
+	ds.setFileMeta()
+	return nil
+}
+
+// needsFileMeta reports whether file has to be rewritten by addFileMeta.
+// Compressed files are assumed to, since they'd have to be decompressed
+// to tell.
+func needsFileMeta(file FileName) bool {
+	if isCompressed(file.String()) {
+		return true
+	}
+	f, err := os.Open(file.String())
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	data := make([]byte, 132)
+	n, _ := io.ReadFull(f, data)
+	data = data[:n]
+	return rawTransferSyntax(data) != "" || (len(data) >= 2 && binary.LittleEndian.Uint16(data) == 0x0002)
+}
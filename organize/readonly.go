@@ -0,0 +1,51 @@
+package organize
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// readOnlySources are directories and files which dicomfmt must never
+// write to, move anything out of or delete anything from, set by
+// -no-write-source. It's checked by every function that changes the
+// filesystem, so that a mistake in option handling can't cause a write to
+// a read-only mount.
+type readOnlySources []string
+
+var readOnly readOnlySources
+
+// Add protects path, which is a source directory or file.
+func (r *readOnlySources) Add(path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = filepath.Clean(path)
+	}
+	*r = append(*r, abs)
+	if real, err := filepath.EvalSymlinks(abs); err == nil && real != abs {
+		// Also protect it when it's reached without the symlink.
+		*r = append(*r, real)
+	}
+}
+
+// Check returns an error if path is protected, or is inside a
+// directory that is.
+func (r readOnlySources) Check(path string) error {
+	if len(r) == 0 {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, src := range r {
+		prefix := src
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if abs == src || strings.HasPrefix(abs, prefix) {
+			return fmt.Errorf("not changing %s: %s is read only with -no-write-source", path, src)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package organize
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A receiver accepts DICOM files POSTed over HTTP and organizes them into
+// the target directory.
+//
+// The body of the request can either be a single file, or a multipart
+// request (such as multipart/form-data or multipart/related) with one file
+// per part. The response lists the path that each file was organized into.
+type receiver struct {
+	o *Organizer
+
+	// Uploads are queued here before they're parsed and moved into
+	// place. It should be on the same filesystem as the target.
+	queue spoolQueue
+
+	// If positive, requests with a larger body are rejected.
+	maxBody int64
+
+	// Serializes access to the organizer.
+	mu sync.Mutex
+}
+
+// receiveResponse is the body of a response to an upload which was
+// accepted. Failed lists the files which couldn't be placed, if any.
+type receiveResponse struct {
+	Paths  []string `json:"paths"`
+	Failed []string `json:"failed,omitempty"`
+}
+
+func randomName() string {
+	var b [8]byte
+	if _, err := io.ReadFull(idSource, b[:]); err != nil {
+		log.Fatalln(err)
+	}
+	return hex.EncodeToString(b[:]) + ".dcm"
+}
+
+// stage writes an uploaded file into an upload's directory. Each file is
+// written to its own subdirectory, so that names provided by different
+// clients can't conflict.
+func (rc *receiver) stage(upload string, n int, name string, r io.Reader) (FileName, error) {
+	dir := filepath.Join(upload, strconv.Itoa(n))
+	if err := os.Mkdir(dir, 0750); err != nil {
+		return "", err
+	}
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "" || name == "." || name == "/" || name == string(filepath.Separator) {
+		name = randomName()
+	}
+	file := filepath.Join(dir, name)
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return "", err
+	}
+	// The upload is only queued once its files are on the disk.
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	return FileName(file), f.Close()
+}
+
+// queued returns the paths of the files in a queued upload, given their
+// paths before it was queued.
+func queued(upload, dir string, staged []FileName) []FileName {
+	files := make([]FileName, len(staged))
+	for i, f := range staged {
+		files[i] = FileName(filepath.Join(dir, strings.TrimPrefix(f.String(), upload)))
+	}
+	return files
+}
+
+// organize parses each staged file and moves it into place, returning
+// where they were placed and which of them couldn't be. If any file isn't
+// a valid DICOM file, none of them are organized.
+func (rc *receiver) organize(staged []FileName) (paths, failed []string, err error) {
+	var series []SeriesFiles
+	for _, file := range staged {
+		buf := getBuffer()
+		_, data, err := parseFile(file, buf)
+		if err != nil {
+			putBuffer(buf)
+			return nil, nil, err
+		}
+		files, err := newSeriesFiles(file, data)
+		putBuffer(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		series = append(series, files)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	failedBefore := len(rc.o.Failed)
+	for _, files := range series {
+		// Once an upload has been accepted it's always organized
+		// completely, so that it isn't left half in the queue.
+		for _, p := range rc.o.Series(context.Background(), files) {
+			paths = append(paths, p.String())
+		}
+	}
+	if err := rc.o.FHIR.Flush(); err != nil {
+		log.Println(err)
+	}
+	for _, f := range rc.o.Failed[failedBefore:] {
+		failed = append(failed, f.String())
+	}
+	return paths, failed, nil
+}
+
+// releaseStudies periodically releases studies which have settled, until
+// ctx is cancelled.
+func (rc *receiver) releaseStudies(ctx context.Context) {
+	for {
+		wait := rc.o.Gate.Next()
+		if wait == 0 || wait > time.Minute {
+			wait = time.Minute
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		rc.mu.Lock()
+		rc.o.Release()
+		if err := rc.o.FHIR.Flush(); err != nil {
+			log.Println(err)
+		}
+		rc.mu.Unlock()
+	}
+}
+
+// Replay organizes any uploads that were queued but not organized before
+// dicomfmt last stopped, and discards uploads that were never completely
+// received. If ctx is cancelled, it stops before the next upload.
+func (rc *receiver) Replay(ctx context.Context) {
+	items, partial, err := rc.queue.Pending()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, dir := range partial {
+		if verbose {
+			log.Printf("Discarding incomplete upload %s.\n", dir)
+		}
+		rc.queue.Done(dir)
+	}
+	for _, item := range items {
+		if canceled(ctx) {
+			return
+		}
+		log.Printf("Organizing %d queued files from %s.\n", len(item.Files), item.Dir)
+		if _, _, err := rc.organize(item.Files); err != nil {
+			log.Printf("Could not organize %s: %v\n", item.Dir, err)
+			failed := filepath.Join(filepath.Dir(item.Dir), "failed"+strings.TrimPrefix(filepath.Base(item.Dir), "queued"))
+			if err := os.Rename(item.Dir, failed); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		rc.queue.Done(item.Dir)
+	}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rc.maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, rc.maxBody)
+	}
+
+	upload, err := rc.queue.Begin()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var staged []FileName
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rc.queue.Done(upload)
+				http.Error(w, err.Error(), uploadErrorStatus(err, http.StatusBadRequest))
+				return
+			}
+			file, err := rc.stage(upload, len(staged), part.FileName(), part)
+			part.Close()
+			if err != nil {
+				rc.queue.Done(upload)
+				log.Println(err)
+				http.Error(w, err.Error(), uploadErrorStatus(err, http.StatusInternalServerError))
+				return
+			}
+			staged = append(staged, file)
+		}
+	} else {
+		file, err := rc.stage(upload, 0, "", r.Body)
+		if err != nil {
+			rc.queue.Done(upload)
+			log.Println(err)
+			http.Error(w, err.Error(), uploadErrorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		staged = append(staged, file)
+	}
+	if len(staged) == 0 {
+		rc.queue.Done(upload)
+		http.Error(w, "no files in request", http.StatusBadRequest)
+		return
+	}
+	dir, err := rc.queue.Commit(upload)
+	if err != nil {
+		rc.queue.Done(upload)
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	staged = queued(upload, dir, staged)
+	for _, file := range staged {
+		activity.Publish(activityEvent{Event: activityReceived, File: file.String(), From: r.RemoteAddr})
+	}
+
+	paths, failed, err := rc.organize(staged)
+	rc.queue.Done(dir)
+	if err != nil {
+		activity.Publish(activityEvent{Event: activityError, File: dir, Reason: deadParseError, Error: err.Error()})
+		http.Error(w, fmt.Sprintf("invalid DICOM file: %v", err), http.StatusBadRequest)
+		return
+	}
+	status := http.StatusCreated
+	if len(failed) > 0 {
+		// The sender mustn't treat the upload as stored, since some
+		// of it wasn't.
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, receiveResponse{paths, failed})
+}
+
+// uploadErrorStatus returns the status to respond with when reading an
+// upload failed with err: 413 if it was larger than -max-upload-size, or
+// status otherwise.
+func uploadErrorStatus(err error, status int) int {
+	// http.MaxBytesReader's error only has its own type since Go 1.19.
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return status
+}
@@ -0,0 +1,121 @@
+package organize
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestReceiver returns a receiver which organizes into a new target
+// directory inside of a new parent directory, so that escaping the target
+// can be detected.
+func newTestReceiver(t *testing.T) (rc *receiver, parent, target string) {
+	parent = t.TempDir()
+	target = filepath.Join(parent, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := retries
+	retries = retryPolicy{}
+	t.Cleanup(func() { retries = old })
+	o := &Organizer{Dst: target, Move: true, Layout: "{PatientName}/{SeriesDescription}"}
+	return &receiver{o: o, queue: spoolQueue{filepath.Join(target, ".incoming")}}, parent, target
+}
+
+// postFiles posts files to rc as a multipart upload, and returns the
+// response.
+func postFiles(t *testing.T, rc *receiver, files map[string][]byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, data := range files {
+		w, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	rc.ServeHTTP(w, r)
+	return w
+}
+
+func TestReceiveStaysInTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+	}{
+		{"parent patient", []string{"PatientName=../../x", "SeriesDescription=AX"}},
+		{"parent series", []string{"PatientName=DOE", "SeriesDescription=../../../x"}},
+		{"dot dot", []string{"PatientName=..", "SeriesDescription=.."}},
+		{"absolute", []string{"PatientName=/tmp/x", "SeriesDescription=/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, parent, target := newTestReceiver(t)
+			w := postFiles(t, rc, map[string][]byte{"../../a.dcm": synthBytes(t, tt.tags...)})
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var resp receiveResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Paths) != 1 {
+				t.Fatalf("placed %v, want one file", resp.Paths)
+			}
+			rel, err := filepath.Rel(target, resp.Paths[0])
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				t.Errorf("placed %s outside of %s", resp.Paths[0], target)
+			}
+			if _, err := os.Stat(resp.Paths[0]); err != nil {
+				t.Error(err)
+			}
+			for _, entry := range treeContents(t, parent) {
+				if entry != "target" && !strings.HasPrefix(entry, "target/") {
+					t.Errorf("%s was created outside of the target", entry)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiveTooLarge(t *testing.T) {
+	rc, _, _ := newTestReceiver(t)
+	rc.maxBody = 64
+	w := postFiles(t, rc, map[string][]byte{"a.dcm": synthBytes(t)})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestReceivePartialFailure(t *testing.T) {
+	rc, _, target := newTestReceiver(t)
+	// Something is already in the way of one of the files.
+	if err := os.MkdirAll(filepath.Join(target, "DOE", "AX", "b.dcm", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	series := "SeriesInstanceUID=" + newUID(t)
+	w := postFiles(t, rc, map[string][]byte{
+		"a.dcm": synthBytes(t, series, "PatientName=DOE", "SeriesDescription=AX"),
+		"b.dcm": synthBytes(t, series, "PatientName=DOE", "SeriesDescription=AX"),
+	})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	var resp receiveResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Paths) != 1 || len(resp.Failed) != 1 || filepath.Base(resp.Failed[0]) != "b.dcm" {
+		t.Errorf("placed %v and failed %v, want a.dcm placed and b.dcm failed", resp.Paths, resp.Failed)
+	}
+}
@@ -0,0 +1,728 @@
+package organize
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A remote target is a target directory on another host, which is written
+// through a copy of dicomfmt started there over ssh with the remote-target
+// subcommand, like rsync. When a file that already exists there is
+// replaced, only the parts of it that changed are sent: the remote end
+// sends a checksum of each block of the existing file, and the new
+// contents are sent as references to the blocks that match, found with a
+// rolling checksum wherever they are in the file, and literal data for the
+// rest. Re-running rewrites which only change the header of large files,
+// such as -tag-rules, then sends little more than the headers.
+
+// The limits on the block size of a delta, which is the square root of
+// the size of the existing file between them.
+const (
+	minDeltaBlock = 2 << 10
+	maxDeltaBlock = 128 << 10
+)
+
+// How much literal data, or how many blocks, are sent in each write
+// request.
+const (
+	remoteWriteSize   = 256 << 10
+	remoteWriteBlocks = 4096
+)
+
+// A remoteRequest is a filesystem operation sent to the remote target.
+type remoteRequest struct {
+	Op       string
+	Name, To string
+	Mode     os.FileMode
+	Off      int64
+	UID, GID int
+	// Whether to send the block checksums of the file being created,
+	// if it exists, so that it's replaced with a delta.
+	Delta  bool
+	Handle int
+	Ops    []deltaOp
+	// The SHA-256 hash of the contents written, checked before a created
+	// file replaces the one it's named after.
+	Sum []byte
+}
+
+type remoteResponse struct {
+	Err           string
+	NotExist      bool
+	Exist         bool
+	Info          remoteFileInfo
+	Handle        int
+	BlockSize     int
+	BaseSize      int64
+	Blocks        []blockSum
+	DeltaMismatch bool
+}
+
+// A deltaOp writes either a block of the existing file, or literal data
+// if Data isn't nil.
+type deltaOp struct {
+	Block int
+	Data  []byte
+}
+
+// A blockSum is the checksums of a block of an existing file.
+type blockSum struct {
+	Weak   uint32
+	Strong [sha256.Size]byte
+}
+
+// remoteFileInfo is the os.FileInfo of a file on the remote target.
+type remoteFileInfo struct {
+	FileName    string
+	FileSize    int64
+	FileMode    os.FileMode
+	FileModTime time.Time
+}
+
+func (fi remoteFileInfo) Name() string       { return fi.FileName }
+func (fi remoteFileInfo) Size() int64        { return fi.FileSize }
+func (fi remoteFileInfo) Mode() os.FileMode  { return fi.FileMode }
+func (fi remoteFileInfo) ModTime() time.Time { return fi.FileModTime }
+func (fi remoteFileInfo) IsDir() bool        { return fi.FileMode.IsDir() }
+func (fi remoteFileInfo) Sys() interface{}   { return nil }
+
+// rollingSum is the weak checksum of a block, which can be moved along
+// the data a byte at a time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	s := rollingSum{n: uint32(len(block))}
+	for i, c := range block {
+		s.a += uint32(c)
+		s.b += uint32(len(block)-i) * uint32(c)
+	}
+	return s
+}
+
+// Roll moves the block forward by one byte, removing out from the start
+// and adding in to the end.
+func (s *rollingSum) Roll(out, in byte) {
+	s.a = s.a - uint32(out) + uint32(in)
+	s.b = s.b - s.n*uint32(out) + s.a
+}
+
+func (s rollingSum) Sum() uint32 {
+	return s.a&0xFFFF | s.b<<16
+}
+
+// deltaBlockSize returns the block size to send a delta of a file of the
+// given size with.
+func deltaBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	switch {
+	case bs < minDeltaBlock:
+		return minDeltaBlock
+	case bs > maxDeltaBlock:
+		return maxDeltaBlock
+	}
+	return bs
+}
+
+// blockSums returns the checksums of each block of r.
+func blockSums(r io.Reader, blockSize int) ([]blockSum, error) {
+	var sums []blockSum
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sums = append(sums, blockSum{newRollingSum(buf[:n]).Sum(), sha256.Sum256(buf[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// A remoteFS is the filesystem of a remote target. Requests are sent one
+// at a time, and each is answered before the next is sent.
+type remoteFS struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *gob.Encoder
+	dec *gob.Decoder
+	err error
+
+	// Files whose last delta didn't reproduce their new contents, which
+	// are sent whole the next time.
+	noDelta map[string]bool
+	// The bytes of files written, and how many of them had to be sent.
+	written, sent int64
+}
+
+func newRemoteFS(r io.Reader, w io.Writer) *remoteFS {
+	bw := bufio.NewWriter(w)
+	return &remoteFS{w: bw, enc: gob.NewEncoder(bw), dec: gob.NewDecoder(bufio.NewReader(r)), noDelta: make(map[string]bool)}
+}
+
+// dialRemote starts the remote-target subcommand of command on host over
+// ssh.
+func dialRemote(host, command string) (*remoteFS, error) {
+	cmd := exec.Command("ssh", "-o", "BatchMode=yes", host, command+" remote-target")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	fs := newRemoteFS(stdout, stdin)
+	if _, err := fs.call(remoteRequest{Op: "stat", Name: "/"}); err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("could not start %s remote-target on %s: %v", command, host, err)
+	}
+	return fs, nil
+}
+
+// call sends a request and returns the response to it. Errors that the
+// remote end returns are converted back into errors that os.IsNotExist and
+// os.IsExist recognize.
+func (fs *remoteFS) call(rq remoteRequest) (remoteResponse, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.err != nil {
+		return remoteResponse{}, fs.err
+	}
+	var rsp remoteResponse
+	if err := fs.enc.Encode(&rq); err != nil {
+		fs.err = fmt.Errorf("remote target: %v", err)
+		return rsp, fs.err
+	}
+	if err := fs.w.Flush(); err != nil {
+		fs.err = fmt.Errorf("remote target: %v", err)
+		return rsp, fs.err
+	}
+	if err := fs.dec.Decode(&rsp); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		fs.err = fmt.Errorf("remote target: %v", err)
+		return rsp, fs.err
+	}
+	switch {
+	case rsp.NotExist:
+		return rsp, &os.PathError{Op: rq.Op, Path: rq.Name, Err: os.ErrNotExist}
+	case rsp.Exist:
+		return rsp, &os.PathError{Op: rq.Op, Path: rq.Name, Err: os.ErrExist}
+	case rsp.Err != "":
+		return rsp, errors.New(rsp.Err)
+	}
+	return rsp, nil
+}
+
+func (fs *remoteFS) Stat(name string) (os.FileInfo, error) {
+	rsp, err := fs.call(remoteRequest{Op: "stat", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Info, nil
+}
+
+func (fs *remoteFS) Mkdir(name string, perm os.FileMode) error {
+	_, err := fs.call(remoteRequest{Op: "mkdir", Name: name, Mode: perm})
+	return err
+}
+
+// Create creates a file, replacing it with a delta from its current
+// contents if it already exists.
+func (fs *remoteFS) Create(name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	delta := !fs.noDelta[name]
+	fs.mu.Unlock()
+	rsp, err := fs.call(remoteRequest{Op: "create", Name: name, Delta: delta})
+	if err != nil {
+		return nil, err
+	}
+	w := &deltaWriter{fs: fs, name: name, handle: rsp.Handle, sum: sha256.New()}
+	if len(rsp.Blocks) > 0 {
+		w.blockSize, w.baseSize = rsp.BlockSize, rsp.BaseSize
+		w.strong = rsp.Blocks
+		w.weak = make(map[uint32][]int)
+		for i, b := range rsp.Blocks {
+			w.weak[b.Weak] = append(w.weak[b.Weak], i)
+		}
+	}
+	return w, nil
+}
+
+func (fs *remoteFS) CreateAt(name string, off int64) (io.WriteCloser, error) {
+	rsp, err := fs.call(remoteRequest{Op: "createat", Name: name, Off: off})
+	if err != nil {
+		return nil, err
+	}
+	return &deltaWriter{fs: fs, name: name, handle: rsp.Handle, sum: sha256.New()}, nil
+}
+
+func (fs *remoteFS) Rename(oldname, name string) error {
+	_, err := fs.call(remoteRequest{Op: "rename", Name: oldname, To: name})
+	return err
+}
+
+func (fs *remoteFS) Remove(name string) error {
+	_, err := fs.call(remoteRequest{Op: "remove", Name: name})
+	return err
+}
+
+func (fs *remoteFS) Chmod(name string, mode os.FileMode) error {
+	_, err := fs.call(remoteRequest{Op: "chmod", Name: name, Mode: mode})
+	return err
+}
+
+func (fs *remoteFS) Chown(name string, uid, gid int) error {
+	_, err := fs.call(remoteRequest{Op: "chown", Name: name, UID: uid, GID: gid})
+	return err
+}
+
+func (fs *remoteFS) SyncDir(name string) error {
+	_, err := fs.call(remoteRequest{Op: "syncdir", Name: name})
+	return err
+}
+
+// Sent returns how many bytes of files have been written, and how many of
+// them had to be sent.
+func (fs *remoteFS) Sent() (written, sent int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.written, fs.sent
+}
+
+// A deltaWriter writes a file on a remote target. If the file existed,
+// the data written is matched against its blocks, and only the data that
+// doesn't match any of them is sent.
+type deltaWriter struct {
+	fs     *remoteFS
+	name   string
+	handle int
+	sum    hash.Hash
+
+	blockSize int
+	baseSize  int64
+	weak      map[uint32][]int
+	strong    []blockSum
+
+	// The data that hasn't been sent yet. The block being matched starts
+	// at pos, and everything before it is literal data.
+	pending []byte
+	pos     int
+	rolling rollingSum
+	summed  bool
+
+	ops     []deltaOp
+	opBytes int
+	written int64
+	sent    int64
+	closed  bool
+	err     error
+}
+
+func (w *deltaWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	w.sum.Write(p)
+	w.written += int64(len(p))
+	w.pending = append(w.pending, p...)
+	if w.blockSize == 0 {
+		w.literal(len(w.pending))
+	} else {
+		w.match()
+	}
+	if w.opBytes >= remoteWriteSize || len(w.ops) >= remoteWriteBlocks {
+		w.flush()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// match looks for blocks of the existing file in the pending data,
+// rolling the block being matched forward a byte at a time.
+func (w *deltaWriter) match() {
+	for {
+		end := w.pos + w.blockSize
+		if !w.summed {
+			if end > len(w.pending) {
+				return
+			}
+			w.rolling = newRollingSum(w.pending[w.pos:end])
+			w.summed = true
+		}
+		if i, ok := w.find(w.pending[w.pos:end], w.rolling.Sum()); ok {
+			w.literal(w.pos)
+			w.block(i)
+			w.pending = w.pending[w.blockSize:]
+			w.summed = false
+			continue
+		}
+		if end >= len(w.pending) {
+			return
+		}
+		w.rolling.Roll(w.pending[w.pos], w.pending[end])
+		w.pos++
+		if w.pos >= remoteWriteSize {
+			w.literal(w.pos)
+		}
+	}
+}
+
+// find returns the block of the existing file which has the same contents
+// as data, whose weak checksum is weak.
+func (w *deltaWriter) find(data []byte, weak uint32) (int, bool) {
+	candidates := w.weak[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := sha256.Sum256(data)
+	for _, i := range candidates {
+		if w.strong[i].Strong == strong && w.blockLen(i) == len(data) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// blockLen returns the length of block i, which is shorter than the
+// block size if it's the last block of the file.
+func (w *deltaWriter) blockLen(i int) int {
+	if i == len(w.strong)-1 {
+		return int(w.baseSize - int64(i)*int64(w.blockSize))
+	}
+	return w.blockSize
+}
+
+// literal queues the first n bytes of the pending data to be sent as they
+// are.
+func (w *deltaWriter) literal(n int) {
+	if n == 0 {
+		return
+	}
+	data := append([]byte(nil), w.pending[:n]...)
+	w.ops = append(w.ops, deltaOp{Data: data})
+	w.opBytes += n
+	w.sent += int64(n)
+	w.pending = w.pending[n:]
+	if w.pos -= n; w.pos < 0 {
+		w.pos = 0
+	}
+}
+
+func (w *deltaWriter) block(i int) {
+	w.ops = append(w.ops, deltaOp{Block: i})
+}
+
+// flush sends the queued operations.
+func (w *deltaWriter) flush() {
+	if w.err != nil || len(w.ops) == 0 {
+		return
+	}
+	_, w.err = w.fs.call(remoteRequest{Op: "write", Name: w.name, Handle: w.handle, Ops: w.ops})
+	w.ops, w.opBytes = nil, 0
+}
+
+// Close sends the rest of the file. A delta that doesn't reproduce the new
+// contents exactly, because of a collision of the checksums, is discarded
+// and the file is sent whole the next time it's written.
+func (w *deltaWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.blockSize > 0 {
+		// The new contents can still end with the last block, if
+		// it's shorter than the others.
+		last := len(w.strong) - 1
+		if n := w.blockLen(last); n < w.blockSize && n <= len(w.pending) {
+			tail := w.pending[len(w.pending)-n:]
+			if newRollingSum(tail).Sum() == w.strong[last].Weak && sha256.Sum256(tail) == w.strong[last].Strong {
+				w.literal(len(w.pending) - n)
+				w.block(last)
+				w.pending = nil
+			}
+		}
+	}
+	w.literal(len(w.pending))
+	w.flush()
+	rsp, err := w.fs.call(remoteRequest{Op: "close", Name: w.name, Handle: w.handle, Sum: w.sum.Sum(nil)})
+	if w.err == nil {
+		w.err = err
+	}
+	w.fs.mu.Lock()
+	w.fs.written += w.written
+	w.fs.sent += w.sent
+	if rsp.DeltaMismatch {
+		w.fs.noDelta[w.name] = true
+	} else {
+		delete(w.fs.noDelta, w.name)
+	}
+	w.fs.mu.Unlock()
+	if verbose && w.err == nil && w.blockSize > 0 {
+		log.Printf("Replaced %s on the remote target, sending %s of %s.\n", w.name, humanBytes(uint64(w.sent)), humanBytes(uint64(w.written)))
+	}
+	return w.err
+}
+
+// A remoteFile is a file being written by the remote-target subcommand.
+type remoteFile struct {
+	f    *os.File
+	name string
+	sum  hash.Hash
+	// Whether f is a temporary file which replaces name once it's
+	// complete, so that a dropped connection doesn't leave a partly
+	// written file behind.
+	tmp bool
+	// When replacing a file with a delta, base is the existing file.
+	base      *os.File
+	baseSize  int64
+	blockSize int
+}
+
+// remoteTarget answers the requests of a remoteFS.
+type remoteTarget struct {
+	files map[int]*remoteFile
+	next  int
+}
+
+func (t *remoteTarget) handle(rq remoteRequest) (rsp remoteResponse, err error) {
+	switch rq.Op {
+	case "stat":
+		fi, err := os.Stat(rq.Name)
+		if err != nil {
+			return rsp, err
+		}
+		rsp.Info = remoteFileInfo{fi.Name(), fi.Size(), fi.Mode(), fi.ModTime()}
+	case "mkdir":
+		err = os.Mkdir(rq.Name, rq.Mode)
+	case "rename":
+		err = os.Rename(rq.Name, rq.To)
+	case "remove":
+		err = os.Remove(rq.Name)
+	case "chmod":
+		err = os.Chmod(rq.Name, rq.Mode)
+	case "chown":
+		err = os.Chown(rq.Name, rq.UID, rq.GID)
+	case "syncdir":
+		err = syncDir(rq.Name)
+	case "create":
+		return t.create(rq)
+	case "createat":
+		w, err := LocalFS{}.CreateAt(rq.Name, rq.Off)
+		if err != nil {
+			return rsp, err
+		}
+		rsp.Handle = t.add(&remoteFile{f: w.(*os.File), name: rq.Name, sum: sha256.New()})
+	case "write":
+		file, ok := t.files[rq.Handle]
+		if !ok {
+			return rsp, fmt.Errorf("%s isn't open", rq.Name)
+		}
+		for _, op := range rq.Ops {
+			if err := file.apply(op); err != nil {
+				return rsp, err
+			}
+		}
+	case "close":
+		file, ok := t.files[rq.Handle]
+		if !ok {
+			return rsp, fmt.Errorf("%s isn't open", rq.Name)
+		}
+		delete(t.files, rq.Handle)
+		return file.close(rq.Sum)
+	default:
+		err = fmt.Errorf("unknown remote target operation %q", rq.Op)
+	}
+	return rsp, err
+}
+
+func (t *remoteTarget) add(f *remoteFile) int {
+	t.next++
+	t.files[t.next] = f
+	return t.next
+}
+
+// create creates a file, which is written next to where it belongs and
+// renamed into place once it's complete. If it already exists and
+// rq.Delta is set, its block checksums are returned.
+func (t *remoteTarget) create(rq remoteRequest) (rsp remoteResponse, err error) {
+	if rq.Delta {
+		if base, err := os.Open(rq.Name); err == nil {
+			fi, err := base.Stat()
+			if err == nil && fi.Mode().IsRegular() && fi.Size() > 0 {
+				bs := deltaBlockSize(fi.Size())
+				blocks, err := blockSums(bufio.NewReader(base), bs)
+				if err != nil {
+					base.Close()
+					return rsp, err
+				}
+				f, err := createTemp(rq.Name)
+				if err != nil {
+					base.Close()
+					return rsp, err
+				}
+				f.Chmod(fi.Mode().Perm())
+				rsp.Handle = t.add(&remoteFile{f: f, name: rq.Name, sum: sha256.New(), tmp: true, base: base, baseSize: fi.Size(), blockSize: bs})
+				rsp.BlockSize, rsp.BaseSize, rsp.Blocks = bs, fi.Size(), blocks
+				return rsp, nil
+			}
+			base.Close()
+		}
+	}
+	f, err := createTemp(rq.Name)
+	if err != nil {
+		return rsp, err
+	}
+	rsp.Handle = t.add(&remoteFile{f: f, name: rq.Name, sum: sha256.New(), tmp: true})
+	return rsp, nil
+}
+
+// createTemp creates a new file in the directory of name to write its
+// contents to. Unlike os.CreateTemp, the file has the mode that os.Create
+// would give it.
+func createTemp(name string) (*os.File, error) {
+	dir, base := filepath.Split(name)
+	for i := 0; ; i++ {
+		tmp := filepath.Join(dir, fmt.Sprintf(".%s.part-%d-%d", base, os.Getpid(), i))
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 1000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+func (f *remoteFile) apply(op deltaOp) error {
+	data := op.Data
+	if data == nil {
+		off := int64(op.Block) * int64(f.blockSize)
+		if f.base == nil || op.Block < 0 || off >= f.baseSize {
+			return fmt.Errorf("%s: block %d is past the end of the existing file", f.name, op.Block)
+		}
+		n := int64(f.blockSize)
+		if off+n > f.baseSize {
+			n = f.baseSize - off
+		}
+		data = make([]byte, n)
+		if _, err := f.base.ReadAt(data, off); err != nil {
+			return err
+		}
+	}
+	f.sum.Write(data)
+	_, err := f.f.Write(data)
+	return err
+}
+
+// close finishes writing a file. A created file only replaces the one
+// it's named after if it has the hash that was sent.
+func (f *remoteFile) close(sum []byte) (rsp remoteResponse, err error) {
+	err = f.f.Sync()
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	if !f.tmp {
+		return rsp, err
+	}
+	if f.base != nil {
+		f.base.Close()
+	}
+	if err == nil && !bytes.Equal(f.sum.Sum(nil), sum) {
+		if f.base != nil {
+			rsp.DeltaMismatch = true
+			err = fmt.Errorf("%s: the delta didn't reproduce the new contents, so it will be sent whole", f.name)
+		} else {
+			err = fmt.Errorf("%s: the contents were corrupted on the way to the remote target", f.name)
+		}
+	}
+	if err == nil {
+		err = os.Rename(f.f.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(f.f.Name())
+	}
+	return rsp, err
+}
+
+// serve answers requests from r until it's closed, writing the responses
+// to w.
+func (t *remoteTarget) serve(r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	dec, enc := gob.NewDecoder(bufio.NewReader(r)), gob.NewEncoder(bw)
+	for {
+		var rq remoteRequest
+		if err := dec.Decode(&rq); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		rsp, err := t.handle(rq)
+		if err != nil {
+			rsp.Err = err.Error()
+			rsp.NotExist = os.IsNotExist(err)
+			rsp.Exist = os.IsExist(err)
+		}
+		if err := enc.Encode(&rsp); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// abandon closes the files which weren't closed by a request, such as
+// when the connection was dropped, leaving the files that they would have
+// replaced as they were.
+func (t *remoteTarget) abandon() {
+	for handle, f := range t.files {
+		f.f.Close()
+		if f.base != nil {
+			f.base.Close()
+		}
+		if f.tmp {
+			os.Remove(f.f.Name())
+		}
+		delete(t.files, handle)
+	}
+}
+
+// ServeRemoteTarget writes a target on this host for -remote, reading
+// requests from r and writing the responses to w. The remote-target
+// subcommand, which -remote starts over ssh, serves standard input and
+// output.
+func ServeRemoteTarget(r io.Reader, w io.Writer) error {
+	t := &remoteTarget{files: make(map[int]*remoteFile)}
+	err := t.serve(r, w)
+	t.abandon()
+	return err
+}
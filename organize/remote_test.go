@@ -0,0 +1,174 @@
+package organize
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pipeRemote returns a remoteFS connected to a remote target served in
+// the same process.
+func pipeRemote(t *testing.T) *remoteFS {
+	rqr, rqw := io.Pipe()
+	rspr, rspw := io.Pipe()
+	target := &remoteTarget{files: make(map[int]*remoteFile)}
+	go func() {
+		rspw.CloseWithError(target.serve(rqr, rspw))
+	}()
+	t.Cleanup(func() { rqw.Close() })
+	return newRemoteFS(rspr, rqw)
+}
+
+func TestRollingSum(t *testing.T) {
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(data)
+	const n = 700
+	s := newRollingSum(data[:n])
+	for i := 1; i+n <= len(data); i++ {
+		s.Roll(data[i-1], data[i+n-1])
+		if got, want := s.Sum(), newRollingSum(data[i:i+n]).Sum(); got != want {
+			t.Fatalf("rolled sum at %d = %#x, want %#x", i, got, want)
+		}
+	}
+}
+
+func TestRemoteDelta(t *testing.T) {
+	fs := pipeRemote(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "IM0001.dcm")
+
+	old := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(2)).Read(old)
+	if err := os.WriteFile(path, old, 0640); err != nil {
+		t.Fatal(err)
+	}
+	// A longer header shifts the rest of the file, and a few bytes in
+	// the middle change.
+	changed := append([]byte("a longer header than before"), old...)
+	copy(changed[1<<20:], "changed")
+
+	tests := []struct {
+		name     string
+		contents []byte
+	}{
+		{"shifted", changed},
+		{"unchanged", changed},
+		{"truncated", changed[:len(changed)/2]},
+		{"different", bytes.Repeat([]byte("x"), 10000)},
+	}
+	for _, tt := range tests {
+		written, sent := fs.Sent()
+		w, err := fs.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Written in odd sizes, so that blocks span writes.
+		for rest := tt.contents; len(rest) > 0; {
+			n := 4093
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := w.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.contents) {
+			t.Fatalf("%s: the remote file has %d bytes which don't match the %d written", tt.name, len(got), len(tt.contents))
+		}
+		w2, s2 := fs.Sent()
+		if w2-written != int64(len(tt.contents)) {
+			t.Errorf("%s: counted %d bytes written, want %d", tt.name, w2-written, len(tt.contents))
+		}
+		if tt.name != "different" && s2-sent > 64<<10 {
+			t.Errorf("%s: sent %d bytes of %d", tt.name, s2-sent, len(tt.contents))
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+			t.Errorf("%s: mode after replacing is %v, %v", tt.name, info.Mode(), err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("left %d files in the directory", len(entries))
+	}
+}
+
+func TestRemoteFS(t *testing.T) {
+	fs := pipeRemote(t)
+	dir := t.TempDir()
+	if _, err := fs.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing file: %v", err)
+	}
+	if err := fs.Mkdir(dir, 0750); !os.IsExist(err) {
+		t.Errorf("Mkdir of an existing directory: %v", err)
+	}
+	// Placing files only goes through the filesystem, so a whole copy
+	// works.
+	src := filepath.Join(t.TempDir(), "a.dcm")
+	synthFile(t, src, "PatientName=DOE")
+	if err := perms.MkdirAll(fs, filepath.Join(dir, "DOE")); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "DOE", "a.dcm")
+	if err := copyFile(fs, FileName(src), FileName(dst)); err != nil {
+		t.Fatal(err)
+	}
+	if same, err := sameContent(src, dst); err != nil || !same {
+		t.Errorf("copy over the remote target differs: %v", err)
+	}
+}
+
+func TestRemoteDroppedConnection(t *testing.T) {
+	rqr, rqw := io.Pipe()
+	rspr, rspw := io.Pipe()
+	target := &remoteTarget{files: make(map[int]*remoteFile)}
+	done := make(chan struct{})
+	go func() {
+		rspw.CloseWithError(target.serve(rqr, rspw))
+		target.abandon()
+		close(done)
+	}()
+	fs := newRemoteFS(rspr, rqw)
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.dcm")
+	if err := os.WriteFile(existing, bytes.Repeat([]byte("old"), 10000), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"new.dcm", "existing.dcm"} {
+		w, err := fs.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(bytes.Repeat([]byte("new"), remoteWriteSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The connection drops before either file is closed.
+	rqw.Close()
+	<-done
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "existing.dcm" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("left %v in the target, want only existing.dcm", names)
+	}
+	if got, _ := os.ReadFile(existing); !bytes.Equal(got, bytes.Repeat([]byte("old"), 10000)) {
+		t.Error("existing.dcm was changed by a write that wasn't finished")
+	}
+}
@@ -0,0 +1,124 @@
+package organize
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// restoreOrigins returns the original source path of every file recorded
+// in a manifest or journal, keyed by where it is now. Files which were
+// organized more than once, such as by reorganizing a target in place,
+// are traced back to where they were first organized from.
+func restoreOrigins(entries []manifestEntry) (map[string]string, error) {
+	origins := make(map[string]string)
+	for _, entry := range entries {
+		src, err := filepath.Abs(entry.Src)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := filepath.Abs(entry.Dst)
+		if err != nil {
+			return nil, err
+		}
+		if orig, ok := origins[src]; ok {
+			delete(origins, src)
+			src = orig
+		}
+		origins[dst] = src
+	}
+	return origins, nil
+}
+
+// commonDir returns the deepest directory containing every path.
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	common := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for common != filepath.Dir(common) && !strings.HasPrefix(path, common+string(filepath.Separator)) {
+			common = filepath.Dir(common)
+		}
+	}
+	return common
+}
+
+// Restore copies the files recorded in manifest, which can also be a
+// journal, from the organized tree back into the directory structure that
+// they were originally organized from in out, writing the path of each to
+// w. Files are restored relative to the deepest directory containing all
+// of their original paths. If move is set, they're moved out of the tree
+// instead. It returns the exit status, which is 1 if any couldn't be
+// restored.
+func Restore(w io.Writer, manifest, out string, move bool) (int, error) {
+	entries, err := readManifest(manifest)
+	if err != nil {
+		return 1, err
+	}
+	origins, err := restoreOrigins(entries)
+	if err != nil {
+		return 1, err
+	}
+	var current, sources []string
+	for dst, src := range origins {
+		current = append(current, dst)
+		sources = append(sources, src)
+	}
+	sort.Strings(current)
+	root := commonDir(sources)
+
+	action := copyFile
+	if move {
+		action = moveFile
+	}
+	var failed bool
+	for _, dst := range current {
+		rel, err := filepath.Rel(root, origins[dst])
+		if err != nil {
+			log.Println(err)
+			failed = true
+			continue
+		}
+		restored := filepath.Join(out, rel)
+		if _, err := os.Stat(dst); err != nil {
+			log.Printf("Could not restore %s: %v\n", origins[dst], err)
+			failed = true
+			continue
+		}
+		if _, err := os.Stat(restored); err == nil {
+			if same, err := sameContent(dst, restored); err != nil || !same {
+				log.Printf("Could not restore %s: %s already exists\n", dst, restored)
+				failed = true
+			} else if verbose {
+				log.Printf("%s was already restored.\n", restored)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(restored), 0750); err != nil {
+			log.Println(err)
+			failed = true
+			continue
+		}
+		restore := action
+		if isCompressed(dst) && !isCompressed(origins[dst]) {
+			// The file was compressed when it was organized.
+			restore = rewriteAction(nil, move, false)
+		}
+		if err := retries.Do("Restoring "+dst, func() error { return restore(LocalFS{}, FileName(dst), FileName(restored)) }); err != nil {
+			log.Printf("Could not restore %s: %v\n", dst, err)
+			os.Remove(restored)
+			failed = true
+			continue
+		}
+		fmt.Fprintln(w, restored)
+	}
+	if failed {
+		return 1, nil
+	}
+	return 0, nil
+}
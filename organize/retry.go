@@ -0,0 +1,41 @@
+package organize
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// A retryPolicy determines how failed file operations are retried.
+type retryPolicy struct {
+	// The number of times to retry after the first failure.
+	Retries int
+
+	// The delay before the first retry, which doubles after each
+	// subsequent failure.
+	Delay time.Duration
+}
+
+var retries = retryPolicy{Retries: 3, Delay: time.Second}
+
+// permanent reports whether err is one which won't go away by retrying.
+// Anything else, such as the EIO and ESTALE errors that network
+// filesystems return intermittently, is assumed to be transient.
+func permanent(err error) bool {
+	return os.IsNotExist(err) || os.IsPermission(err) || os.IsExist(err)
+}
+
+// Do runs op, retrying with exponential backoff if it fails with a
+// transient error. It returns the last error if op never succeeded.
+func (p retryPolicy) Do(what string, op func() error) error {
+	delay := p.Delay
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || permanent(err) || attempt >= p.Retries {
+			return err
+		}
+		log.Printf("%s failed, retrying in %v: %v\n", what, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
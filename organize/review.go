@@ -0,0 +1,135 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A reviewReason is a heuristic or fallback that was used to decide where
+// a file was organized, along with how confident it is that the result is
+// right.
+type reviewReason struct {
+	Reason     string  `json:"reason"`
+	Confidence float64 `json:"confidence"`
+}
+
+// How confident each kind of heuristic is.
+const (
+	confidenceMissingTag  = 0.5
+	confidencePhantom     = 0.6
+	confidenceBurnedIn    = 0.7
+	confidenceHashName    = 0.8
+	confidenceShortened   = 0.9
+	confidenceDescription = 0.9
+)
+
+// confidence returns the overall confidence of a file's placement, which
+// is the product of the confidence of each reason.
+func confidence(reasons []reviewReason) float64 {
+	c := 1.0
+	for _, r := range reasons {
+		c *= r.Confidence
+	}
+	return c
+}
+
+// reviewReasons returns the heuristics that placing file, which is part of
+// series s, into a directory from layout relied on, in addition to those
+// for the whole series. name and dstName are the file's name before and
+// after it was shortened to fit.
+func (o *Organizer) reviewReasons(series []reviewReason, s SeriesFiles, file FileName, layout, name, dstName string) []reviewReason {
+	reasons := append([]reviewReason(nil), series...)
+	for _, t := range layoutTags(layout) {
+		if !pseudoTags[t] && s.tagValue(t) == "" {
+			reasons = append(reasons, reviewReason{fmt.Sprintf("%s used by the layout is empty", t), confidenceMissingTag})
+		}
+	}
+	if o.Flatten && strings.TrimSpace(s.FileTags[file]["SOPInstanceUID"]) == "" {
+		reasons = append(reasons, reviewReason{"named by a hash of its path, since it has no SOPInstanceUID", confidenceHashName})
+	}
+	if name != dstName {
+		reasons = append(reasons, reviewReason{fmt.Sprintf("name shortened from %s", name), confidenceShortened})
+	}
+	return reasons
+}
+
+// reviewEntry is a line of the review list.
+type reviewEntry struct {
+	File       string         `json:"file"`
+	Src        string         `json:"src"`
+	Confidence float64        `json:"confidence"`
+	Reasons    []reviewReason `json:"reasons"`
+}
+
+// A reviewList records every file whose placement relied on heuristics or
+// fallbacks, so that someone can spot check those instead of the whole
+// archive. If its path ends in .json or .jsonl, each file is written as a
+// line of JSON, and otherwise as a line of text starting with the
+// confidence, so that it can be sorted with sort -n.
+type reviewList struct {
+	Path string
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	json bool
+}
+
+func openReviewList(path string) (*reviewList, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(path)
+	return &reviewList{Path: path, f: f, w: bufio.NewWriter(f), json: ext == ".json" || ext == ".jsonl"}, nil
+}
+
+// Add records that src was placed at dst for the reasons given. It's safe
+// to call on a nil list, and does nothing if there aren't any reasons.
+func (l *reviewList) Add(src, dst FileName, reasons []reviewReason) error {
+	if l == nil || len(reasons) == 0 {
+		return nil
+	}
+	entry := reviewEntry{File: dst.String(), Src: src.String(), Confidence: confidence(reasons), Reasons: reasons}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.json {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = l.w.Write(append(line, '\n'))
+		return err
+	}
+	descriptions := make([]string, len(reasons))
+	for i, r := range reasons {
+		descriptions[i] = r.Reason
+	}
+	_, err := fmt.Fprintf(l.w, "%.2f\t%s\t%s\n", entry.Confidence, entry.File, strings.Join(descriptions, "; "))
+	return err
+}
+
+func (l *reviewList) Flush() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Flush()
+}
+
+func (l *reviewList) Close() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
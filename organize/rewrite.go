@@ -0,0 +1,171 @@
+package organize
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A rewrite modifies the dataset of a file while it's organized into the
+// target.
+type rewrite func(src FileName, ds *dataset) error
+
+// Files larger than rewriteInMemory, such as whole slide images, aren't
+// read into memory to be rewritten. Only the elements before their pixel
+// data are, which have to fit in maxRewriteHeader bytes, and the rest is
+// copied as it is.
+var (
+	rewriteInMemory  int64 = 256 << 20
+	maxRewriteHeader       = 64 << 20
+)
+
+// pixelDataGroup is the group of the pixel data, where large files are
+// split to be rewritten.
+const pixelDataGroup = 0x7FE0
+
+// A splitDataset is a dataset that was only read up to its pixel data,
+// followed by the rest of the file.
+type splitDataset struct {
+	*dataset
+	rest io.Reader
+}
+
+func (s splitDataset) WriteTo(w io.Writer) (int64, error) {
+	n, err := s.dataset.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	m, err := io.Copy(w, s.rest)
+	return n + m, err
+}
+
+// readerTo writes the rest of a reader, for files that aren't rewritten.
+type readerTo struct {
+	io.Reader
+}
+
+func (r readerTo) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, r.Reader)
+}
+
+// readLarge reads the dataset of a large file up to its pixel data from r,
+// and returns it along with the rest of the file.
+func readLarge(r io.Reader) (splitDataset, error) {
+	head := make([]byte, maxRewriteHeader)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return splitDataset{}, err
+	}
+	ds, off, err := readDatasetUntil(head[:n], pixelDataGroup)
+	if n == len(head) && (err != nil || off == n) {
+		// The dataset might go on past what was read.
+		return splitDataset{}, fmt.Errorf("the elements before the pixel data are larger than %d bytes, or can't be read", maxRewriteHeader)
+	}
+	if err != nil {
+		return splitDataset{}, err
+	}
+	return splitDataset{ds, io.MultiReader(bytes.NewReader(head[off:n]), r)}, nil
+}
+
+// rewriteFile writes src to dst on fs after applying each rewrite to its
+// dataset, compressing it if compress is set. Without any rewrites, the
+// contents are written unchanged.
+func rewriteFile(fs FileSystem, src, dst FileName, rewrites []rewrite, compress bool) error {
+	r, err := openStored(src.String())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var contents io.WriterTo = readerTo{r}
+	if len(rewrites) > 0 {
+		info, err := os.Stat(src.String())
+		if err != nil {
+			return err
+		}
+		var ds *dataset
+		if info.Size() > rewriteInMemory {
+			split, err := readLarge(r)
+			if err != nil {
+				return err
+			}
+			ds, contents = split.dataset, split
+		} else {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if ds, err = readDataset(data); err != nil {
+				return err
+			}
+			contents = ds
+		}
+		transferSyntax := ds.TransferSyntax
+		for _, rw := range rewrites {
+			if err := rw(src, ds); err != nil {
+				return err
+			}
+		}
+		if split, ok := contents.(splitDataset); ok {
+			if err := split.check(transferSyntax); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := fs.Create(dst.String())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if compress {
+		err = writeCompressed(bandwidth.Writer(f), contents)
+	} else {
+		_, err = contents.WriteTo(bandwidth.Writer(f))
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncFile(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// check returns an error if the rewrites changed the dataset in a way that
+// would also have to change the rest of the file, which is copied as it
+// is.
+func (s splitDataset) check(transferSyntax string) error {
+	if s.TransferSyntax != transferSyntax {
+		return fmt.Errorf("can't convert files larger than %s to %s", humanBytes(uint64(rewriteInMemory)), s.TransferSyntax)
+	}
+	for _, el := range s.Elements {
+		if el.Tag.Group >= pixelDataGroup {
+			return fmt.Errorf("can't set %v in files larger than %s", el.Tag, humanBytes(uint64(rewriteInMemory)))
+		}
+	}
+	return nil
+}
+
+// rewriteAction returns a fileAction which rewrites files, removing the
+// source afterwards if move is set.
+func rewriteAction(rewrites []rewrite, move, compress bool) fileAction {
+	return func(fs FileSystem, src, dst FileName) error {
+		if err := readOnly.Check(dst.String()); err != nil {
+			return err
+		}
+		if move {
+			if err := readOnly.Check(src.String()); err != nil {
+				return err
+			}
+		}
+		if err := rewriteFile(fs, src, dst, rewrites, compress); err != nil {
+			return err
+		}
+		if move {
+			return os.Remove(src.String())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+package organize
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// synthImage writes a file with pixel data, and an element after it, to
+// path.
+func synthImage(t *testing.T, path string, tags ...string) {
+	ds := synthDataset(t, tags...)
+	pixels := make([]byte, 4096)
+	for i := range pixels {
+		pixels[i] = byte(i)
+	}
+	ds.setElement(element{Tag: tag{0x7FE0, 0x0010}, VR: "OW", Value: pixels})
+	ds.setElement(element{Tag: tag{0xFFFC, 0xFFFC}, VR: "OB", Value: make([]byte, 16)})
+	var buf bytes.Buffer
+	if _, err := ds.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRewriteLargeFiles(t *testing.T) {
+	dir := t.TempDir()
+	src := FileName(filepath.Join(dir, "src.dcm"))
+	synthImage(t, src.String(), "PatientName=DOE^JANE", "(6000,0010) US=512")
+	rewrites := []rewrite{removeOverlays, addProvenance}
+
+	inMemory := FileName(filepath.Join(dir, "memory.dcm"))
+	if err := rewriteFile(LocalFS{}, src, inMemory, rewrites, false); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old int64, oldHeader int) { rewriteInMemory, maxRewriteHeader = old, oldHeader }(rewriteInMemory, maxRewriteHeader)
+	rewriteInMemory = 0
+	split := FileName(filepath.Join(dir, "split.dcm"))
+	if err := rewriteFile(LocalFS{}, src, split, rewrites, false); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(inMemory.String())
+	got, _ := os.ReadFile(split.String())
+	if !bytes.Equal(got, want) {
+		t.Errorf("rewriting a large file wrote %d bytes that differ from rewriting it in memory (%d bytes)", len(got), len(want))
+	}
+	ds, err := readDataset(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.element(tag{0x6000, 0x0010}); ok {
+		t.Error("the overlay wasn't removed")
+	}
+
+	setPixels := func(src FileName, ds *dataset) error {
+		ds.setElement(element{Tag: tag{0x7FE0, 0x0010}, VR: "OW", Value: []byte{0, 0}})
+		return nil
+	}
+	err = rewriteFile(LocalFS{}, src, FileName(filepath.Join(dir, "pixels.dcm")), []rewrite{setPixels}, false)
+	if err == nil || !strings.Contains(err.Error(), "can't set") {
+		t.Errorf("setting the pixel data of a large file returned %v", err)
+	}
+
+	maxRewriteHeader = 64
+	err = rewriteFile(LocalFS{}, src, FileName(filepath.Join(dir, "header.dcm")), rewrites, false)
+	if err == nil || !strings.Contains(err.Error(), "larger than 64 bytes") {
+		t.Errorf("rewriting a file with a large header returned %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package organize
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A predicate matches series whose value for Tag matches Pattern, which
+// uses the same syntax as path.Match and is compared case insensitively,
+// or doesn't match it when Negate is set.
+type predicate struct {
+	Tag     string
+	Pattern string
+	Negate  bool
+}
+
+// parsePredicate parses a predicate such as Modality=CT, Modality!=SR or
+// ClinicalTrialProtocolID=?* (any non-empty value).
+func parsePredicate(s string) (predicate, error) {
+	eq := strings.IndexByte(s, '=')
+	if eq <= 0 {
+		return predicate{}, fmt.Errorf("invalid predicate %q: expected Tag=value", s)
+	}
+	p := predicate{Tag: strings.TrimSpace(s[:eq]), Pattern: strings.ToUpper(strings.TrimSpace(s[eq+1:]))}
+	if strings.HasSuffix(p.Tag, "!") {
+		p.Tag = strings.TrimSpace(strings.TrimSuffix(p.Tag, "!"))
+		p.Negate = true
+	}
+	if _, err := path.Match(p.Pattern, ""); err != nil {
+		return predicate{}, fmt.Errorf("invalid predicate %q: %v", s, err)
+	}
+	return p, nil
+}
+
+func (p predicate) Match(s SeriesFiles) bool {
+	matched, _ := path.Match(p.Pattern, strings.ToUpper(s.tagValue(p.Tag)))
+	return matched != p.Negate
+}
+
+// A route sends series matching every one of its predicates to a target
+// directory other than the default one.
+type route struct {
+	Target     string
+	Predicates []predicate
+}
+
+// routes are configured in the [route] table of the config file, keyed by
+// the target directory. The value is a predicate, or an array of
+// predicates which must all match:
+//
+//	[route]
+//	"/archive/ct" = "Modality=CT"
+//	"/research" = ["ClinicalTrialProtocolID=?*", "Modality!=SR"]
+//
+// Routes are tried in the order they're listed, and series which don't
+// match any of them are organized into the target directory given on the
+// command line.
+type routes []route
+
+func newRoutes(cfg *Config, profile string) (routes, error) {
+	table := cfg.Table("route", profile)
+	var r routes
+	for _, target := range cfg.Keys("route", profile) {
+		rt := route{Target: target}
+		for _, v := range table[target] {
+			p, err := parsePredicate(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: route %s: %v", cfg.path, target, err)
+			}
+			rt.Predicates = append(rt.Predicates, p)
+			seriesTags = addTag(seriesTags, p.Tag)
+		}
+		r = append(r, rt)
+	}
+	return r, nil
+}
+
+// For returns the target directory that series s is routed to, or "" if
+// it doesn't match any route.
+func (r routes) For(s SeriesFiles) string {
+rules:
+	for _, rt := range r {
+		for _, p := range rt.Predicates {
+			if !p.Match(s) {
+				continue rules
+			}
+		}
+		return rt.Target
+	}
+	return ""
+}
@@ -0,0 +1,939 @@
+package organize
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoArgs is returned by New and Run if Options.Args doesn't have a
+// target directory.
+var ErrNoArgs = errors.New("no source or target directory given")
+
+// A session is what Run does once the Organizer is set up, worked out
+// from the Options while setting it up.
+type session struct {
+	opts    Options
+	args    []string
+	srcDirs []string
+	maxBody int64
+
+	applyPlan Plan
+	retryList *deadLetter
+	pullPACS  pacs
+	pullQuery studyQuery
+
+	resume func(FileName, os.FileInfo) bool
+}
+
+// New returns an Organizer for opts, after checking that they're valid.
+// It opens the logs and records that the Organizer writes to, and creates
+// the target directory if it doesn't exist. Options.Command is ignored.
+func New(opts Options) (*Organizer, error) {
+	o, _, err := setup(opts)
+	return o, err
+}
+
+// Run does what opts.Command says with opts.Args, as dicomfmt does on
+// the command line, until it's done or ctx is cancelled. It returns the
+// exit status, which is 130 if the run was interrupted.
+func Run(ctx context.Context, opts Options) (int, error) {
+	o, s, err := setup(opts)
+	if err != nil {
+		return 1, err
+	}
+	return o.run(ctx, s)
+}
+
+// setup implements New, also returning what's needed to run the command.
+func setup(opts Options) (*Organizer, *session, error) {
+	s := &session{opts: opts, args: opts.Args}
+	verbose = opts.Verbose
+	syncSeries = opts.SyncSeries
+	fullParse = opts.FullParse
+	parserBackend = opts.Parser
+	retries = retryPolicy{Retries: opts.Retries, Delay: opts.RetryDelay}
+	fileTimeout = opts.FileTimeout
+	maxPathLen = opts.MaxPath
+	siteTag = opts.SiteTag
+	usage.PatientStudies = opts.WarnPatientStudies
+	usage.PatientFiles = opts.WarnPatientFiles
+	usage.StudyFiles = opts.WarnStudyFiles
+	usage.DirFiles = opts.WarnDirFiles
+	usage.AlertURL = opts.WarnURL
+
+	planOnly := opts.Command == CommandPlan
+	applying := opts.Command == CommandApply
+	retrying := opts.Command == CommandRetry
+	infoOnly := opts.Command == CommandInfo
+	orphansOnly := opts.Command == CommandOrphans
+	pulling := opts.Command == CommandPull
+	switch opts.Command {
+	case CommandOrganize, CommandPlan, CommandApply, CommandRetry, CommandInfo, CommandOrphans, CommandPull:
+	default:
+		return nil, nil, fmt.Errorf("unknown command %q", opts.Command)
+	}
+
+	// Check options that only make sense together before anything is
+	// started, so that every mode rejects them the same way.
+	daemon := opts.Watch > 0 || opts.Receive != ""
+	if opts.ControlAddr != "" && opts.Watch <= 0 {
+		return nil, nil, errors.New("-control-addr requires -watch")
+	}
+	if opts.DeleteVerified && (opts.StripOverlays || opts.ProvenanceTag || opts.TagRules != "" || opts.AddFileMeta || opts.LittleEndian || opts.ConvertRetired) {
+		return nil, nil, errors.New("-delete-source-after-verify can't be used with -strip-overlays, -provenance-tag, -tag-rules, -add-file-meta, -little-endian or -convert-retired, since the copies are modified")
+	}
+	if opts.Reconcile != "" && opts.Watch <= 0 {
+		return nil, nil, errors.New("-reconcile requires -watch")
+	}
+	if opts.MinAge != 0 && opts.Watch <= 0 {
+		return nil, nil, errors.New("-min-age requires -watch")
+	}
+	if opts.StudySettle != 0 && !daemon {
+		return nil, nil, errors.New("-study-settle requires -watch or -receive")
+	}
+	if opts.HTTPAddr != "" && !daemon {
+		return nil, nil, errors.New("-http requires -watch or -receive (use the dashboard subcommand otherwise)")
+	}
+	if opts.ActivitySocket != "" && !daemon {
+		return nil, nil, errors.New("-activity-socket requires -watch or -receive")
+	}
+	maxBody, err := parseBytes(opts.MaxUploadSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid -max-upload-size %q", opts.MaxUploadSize)
+	}
+	s.maxBody = int64(maxBody)
+
+	cfg, profile := opts.Config, opts.Profile
+	layout := expandPreset(opts.Layout)
+	naming := fileNaming{Extension: opts.Extension, StripExtension: opts.StripExtension, Lowercase: opts.Lowercase}
+	if naming.Extension != "" && !strings.HasPrefix(naming.Extension, ".") {
+		naming.Extension = "." + naming.Extension
+	}
+	if opts.Flatten != "" {
+		flat, ok := flatLayouts[opts.Flatten]
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid -flatten %q: must be study or patient", opts.Flatten)
+		}
+		if opts.SeriesNumber {
+			return nil, nil, errors.New("-series-number can't be used with -flatten")
+		}
+		layout = flat
+		fileTags = addTag(fileTags, "SOPInstanceUID")
+	}
+	if opts.SeriesNumber {
+		layout = prefixSeriesNumber(layout)
+	}
+	if derivedDir := opts.DerivedSubdir; derivedDir != "" {
+		if strings.ContainsAny(derivedDir, `/\`) || derivedDir == "." || derivedDir == ".." {
+			return nil, nil, fmt.Errorf("Invalid -derived-subdir %q: must be the name of a single directory", derivedDir)
+		}
+		fileTags = addTag(fileTags, "ImageType")
+	}
+	sites := opts.SiteLabels
+	withSites := len(sites) > 0 || siteTag != ""
+	if withSites {
+		layout = siteLayout(layout)
+		if siteTag != "" {
+			seriesTags = addTag(seriesTags, siteTag)
+		}
+	}
+	addSeriesTags(layout)
+	layoutRules := newLayoutRules(cfg, profile)
+	if opts.Transliterate != "" {
+		t, err := newTransliterator(opts.Transliterate, cfg.Table("transliterate", profile))
+		if err != nil {
+			return nil, nil, err
+		}
+		translit = t
+	}
+	validation := newTagProfiles(cfg, profile)
+	if opts.Flatten != "" {
+		// Rules could split the study back up.
+		layoutRules = nil
+	}
+	if opts.SeriesNumber {
+		layoutRules.Map(prefixSeriesNumber)
+	}
+	if withSites {
+		layoutRules.Map(siteLayout)
+	}
+	routing, err := newRoutes(cfg, profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range routing {
+		routing[i].Target = nativePath(routing[i].Target)
+	}
+	if p, err := newHeaderParser(); err != nil {
+		return nil, nil, err
+	} else {
+		putParser(p)
+	}
+
+	clock, idSource = time.Now, rand.Reader
+	if opts.Deterministic {
+		setDeterministic()
+	}
+	if opts.Clock != nil {
+		clock = opts.Clock
+	}
+	if opts.IDs != nil {
+		idSource = opts.IDs
+	}
+
+	args := s.args
+	trashDir := opts.Trash
+	if applying {
+		if len(args) != 1 {
+			return nil, nil, errors.New("apply only accepts a plan file")
+		}
+		p, err := readPlan(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		s.applyPlan = p
+		args = append(append([]string(nil), p.Sources...), p.Target)
+		if trashDir == "" {
+			trashDir = p.Trash
+		}
+	}
+	if retrying {
+		if len(args) != 1 {
+			return nil, nil, errors.New("retry only accepts a dead letter file")
+		}
+		if opts.FilesFrom != "" || opts.Watch > 0 || opts.Receive != "" || opts.OrthancURL != "" {
+			return nil, nil, errors.New("retry can't be used with -files-from, -watch, -receive or -orthanc-url")
+		}
+		d, err := readDeadLetter(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		s.retryList = d
+		args = []string{d.Target}
+	}
+	dryRun := opts.DryRun
+	if planOnly || infoOnly {
+		dryRun = true
+	}
+	if orphansOnly {
+		if len(args) != 1 {
+			return nil, nil, errors.New("orphans only accepts a target directory")
+		}
+		switch opts.FixOrphans {
+		case "":
+			dryRun = true
+		case "relocate", "remove":
+		default:
+			return nil, nil, fmt.Errorf("Unknown -fix-orphans %q", opts.FixOrphans)
+		}
+	} else if opts.FixOrphans != "" || opts.OrphanDir != "" {
+		return nil, nil, errors.New("-fix-orphans and -orphan-dir can only be used with the orphans subcommand")
+	}
+	pull := opts.Pull
+	s.pullPACS = pacs{Called: pull.AEC, Calling: pull.AET, StoreAddr: pull.StoreAddr}
+	s.pullQuery = studyQuery{
+		AccessionNumber:  pull.Accession,
+		PatientID:        pull.PatientID,
+		StudyInstanceUID: pull.StudyUID,
+		StudyDate:        pull.StudyDate,
+	}
+	if pulling {
+		if len(args) != 1 {
+			return nil, nil, errors.New("pull only accepts a target directory")
+		}
+		if pull.Host == "" || pull.AEC == "" {
+			return nil, nil, errors.New("pull requires -host and -aec")
+		}
+		if s.pullQuery.Empty() {
+			return nil, nil, errors.New("pull requires -accession, -patient-id, -study-uid or -study-date")
+		}
+		if len(pull.AEC) > 16 || len(pull.AET) > 16 || pull.AET == "" {
+			return nil, nil, errors.New("-aec and -aet must be AE titles of 1 to 16 characters")
+		}
+		if opts.FilesFrom != "" || opts.Watch > 0 || opts.Receive != "" || opts.OrthancURL != "" {
+			return nil, nil, errors.New("pull can't be used with -files-from, -watch, -receive or -orthanc-url")
+		}
+		switch pull.Retrieve {
+		case "move":
+		case "get":
+			s.pullPACS.Get = true
+		default:
+			return nil, nil, fmt.Errorf("Unknown -retrieve %q: must be move or get", pull.Retrieve)
+		}
+		s.pullPACS.Addr = net.JoinHostPort(pull.Host, strconv.Itoa(pull.Port))
+	} else if pull.Host != "" || pull.AEC != "" || !s.pullQuery.Empty() {
+		return nil, nil, errors.New("-host, -aec, -accession, -patient-id, -study-uid and -study-date can only be used with the pull subcommand")
+	}
+
+	var srcDirs []string
+	var dst string
+	var mv bool
+	switch len(args) {
+	case 0:
+		return nil, nil, ErrNoArgs
+	case 1:
+		srcDirs = append([]string(nil), args...)
+		dst = args[0]
+		// When reading the files from a list, the target isn't
+		// also the source.
+		mv = opts.FilesFrom == "" && !retrying
+	default:
+		srcDirs = append([]string(nil), args[:len(args)-1]...)
+		dst = args[len(args)-1]
+	}
+	if applying {
+		mv = s.applyPlan.Move
+	}
+	if opts.CheckOnly {
+		if len(args) != 1 || !mv || planOnly || applying || infoOnly || orphansOnly || opts.Watch > 0 || opts.Receive != "" || opts.OrthancURL != "" {
+			return nil, nil, errors.New("-check-only can only be used when organizing a single directory in place")
+		}
+		dryRun = true
+	}
+	if retrying {
+		mv = s.retryList.Move
+	}
+	dst = nativePath(dst)
+	for i, src := range srcDirs {
+		srcDirs[i] = nativePath(src)
+	}
+	s.args, s.srcDirs = args, srcDirs
+	if opts.NoWriteSource {
+		switch {
+		case opts.DeleteVerified:
+			return nil, nil, errors.New("-no-write-source can't be used with -delete-source-after-verify")
+		case opts.Receive != "" || opts.OrthancURL != "" || pulling:
+			// There are no source directories.
+		case opts.FilesFrom != "" || (retrying && !mv):
+			// The files are protected once the list is read.
+		case len(args) == 1 || mv:
+			return nil, nil, errors.New("-no-write-source can't be used to organize a directory in place or to apply a plan which moves files")
+		default:
+			for _, src := range srcDirs {
+				readOnly.Add(src)
+			}
+		}
+		for _, path := range append([]string{dst, opts.Mirror, opts.Quarantine, trashDir, opts.StagingDir, opts.EncryptDir, opts.Journal, opts.Manifest, opts.ReviewList, opts.AuditLog, opts.Cache, opts.DeadLetter}, opts.PatientRoots...) {
+			if path == "" {
+				continue
+			}
+			if err := readOnly.Check(path); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if opts.Interactive {
+		if opts.Watch > 0 || opts.Receive != "" || opts.OrthancURL != "" {
+			return nil, nil, errors.New("-interactive can't be used with -watch, -receive or -orthanc-url")
+		}
+		for _, t := range conflictTags {
+			fileTags = addTag(fileTags, t)
+		}
+	}
+	if opts.Remote != "" {
+		switch {
+		case filepath.Separator != '/':
+			return nil, nil, errors.New("-remote isn't supported on this platform")
+		case mv || orphansOnly:
+			return nil, nil, errors.New("-remote can't be used to organize a directory in place, to move files or with the orphans subcommand, since the source files are on this machine")
+		case opts.Receive != "" || opts.OrthancURL != "" || pulling || opts.StudySettle > 0:
+			return nil, nil, errors.New("-remote can't be used with -receive, -orthanc-url, pull or -study-settle, which stage files in the target directory")
+		case opts.Mirror != "" || trashDir != "" || opts.EncryptDir != "" || opts.Interactive || opts.DeleteVerified || opts.HTTPAddr != "" || usage.DirFiles > 0:
+			return nil, nil, errors.New("-remote can't be used with -mirror, -trash, -encrypt-dir, -interactive, -delete-source-after-verify, -http or -warn-dir-files, which need the target directory on this machine")
+		}
+	}
+	if opts.TrustManifest && opts.Manifest == "" {
+		return nil, nil, errors.New("-trust-manifest requires -manifest")
+	}
+	// The manifest is still trusted by dry runs, which don't append to
+	// it.
+	trustedPath := ""
+	if opts.TrustManifest {
+		trustedPath = opts.Manifest
+	}
+	auditPath, auditSyslog, journalPath, manifestPath, reviewPath := opts.AuditLog, opts.AuditSyslog, opts.Journal, opts.Manifest, opts.ReviewList
+	notifyURL, notifyMail, deadLetterPath := opts.NotifyURL, smtpConfig{Addr: opts.SMTPAddr, From: opts.SMTPFrom, To: opts.NotifyEmail}, opts.DeadLetter
+	if dryRun {
+		if opts.Watch > 0 || opts.Receive != "" || opts.OrthancURL != "" || applying || pulling {
+			return nil, nil, errors.New("-dry-run and plan can't be used with -watch, -receive, -orthanc-url, apply or pull")
+		}
+		// Nothing is organized, so there's nothing to record.
+		auditPath, auditSyslog, journalPath, manifestPath, reviewPath = "", false, "", "", ""
+		notifyURL, notifyMail.To, deadLetterPath = "", "", ""
+	}
+	s.opts.DryRun = dryRun
+	if deadLetterPath != "" {
+		deadLetters = &deadLetter{Target: dst, Move: mv, path: deadLetterPath}
+	}
+
+	mode, err := parseMode(opts.DirMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-dir-mode: %v", err)
+	}
+	perms.DirMode = mode
+	if opts.FileMode != "" {
+		mode, err := parseMode(opts.FileMode)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-file-mode: %v", err)
+		}
+		perms.FileMode = mode
+	}
+	if opts.Group != "" {
+		gid, err := lookupGroup(opts.Group)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-group: %v", err)
+		}
+		perms.Group = gid
+	}
+
+	// The filesystem that the target is on.
+	var dstFS FileSystem = LocalFS{}
+	if opts.Remote != "" {
+		if dstFS, err = dialRemote(opts.Remote, opts.RemoteCommand); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Ensure that the dst directory exists, and create it if not.
+	if _, err := dstFS.Stat(dst); os.IsNotExist(err) && !dryRun {
+		if err := perms.MkdirAll(dstFS, dst); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	walk := WalkOptions{MaxDepth: opts.MaxDepth, FollowSymlinks: opts.FollowSymlinks, SkipHidden: opts.SkipHidden}
+	var trashcan *trash
+	if trashDir != "" {
+		if dryRun {
+			trashcan = &trash{Dir: trashDir}
+		} else if trashcan, err = openTrash(trashDir); err != nil {
+			return nil, nil, err
+		}
+		if info, err := os.Stat(trashDir); err == nil {
+			walk.Exclude = append(walk.Exclude, info)
+		}
+	}
+
+	if quarantineDir := opts.Quarantine; quarantineDir != "" && !dryRun {
+		quarantined = &quarantine{Dir: quarantineDir, Move: mv}
+		if err := perms.MkdirAll(LocalFS{}, quarantineDir); err != nil {
+			return nil, nil, err
+		}
+		if info, err := os.Stat(quarantineDir); err == nil {
+			walk.Exclude = append(walk.Exclude, info)
+		}
+	}
+
+	var mirrored *mirror
+	if opts.Mirror != "" {
+		if opts.StudySettle > 0 {
+			return nil, nil, errors.New("-mirror can't be used with -study-settle, since studies are staged before they're placed")
+		}
+		mirrored = &mirror{Dir: nativePath(opts.Mirror), Root: dst}
+		if _, inside := mirrored.Path(FileName(mirrored.Dir)); inside {
+			return nil, nil, errors.New("-mirror can't be inside the target directory")
+		}
+	}
+
+	var gate *studyGate
+	if opts.StudySettle > 0 {
+		stagingDir := opts.StagingDir
+		if stagingDir == "" {
+			stagingDir = filepath.Join(dst, ".staging")
+		}
+		if gate, err = openStudyGate(stagingDir, opts.StudySettle); err != nil {
+			return nil, nil, err
+		}
+		if info, err := os.Stat(stagingDir); err == nil {
+			walk.Exclude = append(walk.Exclude, info)
+		}
+		seriesTags = addTag(seriesTags, "StudyInstanceUID")
+		seriesTags = addTag(seriesTags, "NumberOfStudyRelatedInstances")
+	}
+	if opts.WarnPatientSize != "" {
+		size, err := parseBytes(opts.WarnPatientSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid -warn-patient-size %q", opts.WarnPatientSize)
+		}
+		usage.PatientBytes = int64(size)
+	}
+	if opts.WarnStudySize != "" {
+		size, err := parseBytes(opts.WarnStudySize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid -warn-study-size %q", opts.WarnStudySize)
+		}
+		usage.StudyBytes = int64(size)
+	}
+	var descriptions descriptionMap
+	if opts.DescriptionMap != "" {
+		if descriptions, err = loadDescriptionMap(opts.DescriptionMap); err != nil {
+			return nil, nil, err
+		}
+	}
+	var rules *tagRules
+	if opts.TagRules != "" {
+		if rules, err = loadTagRules(opts.TagRules); err != nil {
+			return nil, nil, err
+		}
+	}
+	var expected *expectedStudies
+	if opts.Expect != "" {
+		if expected, err = loadExpected(opts.Expect); err != nil {
+			return nil, nil, err
+		}
+		seriesTags = addTag(seriesTags, expected.Tag)
+	}
+	if opts.LittleEndian {
+		fileTags = addTag(fileTags, "TransferSyntaxUID")
+	}
+	var stats *objectStats
+	if opts.Stats {
+		stats = newObjectStats()
+		for _, t := range statsTags {
+			fileTags = addTag(fileTags, t)
+		}
+	}
+	retired := newRetiredSOPs()
+	if opts.ShardSize > 0 {
+		fileTags = addTag(fileTags, "ConcatenationUID")
+	}
+	if len(opts.PatientRoots) > 0 {
+		seriesTags = addTag(seriesTags, "PatientID")
+	}
+	if opts.Patients != "" {
+		if onlyPatients, err = loadPatientList(opts.Patients); err != nil {
+			return nil, nil, err
+		}
+		seriesTags = addTag(seriesTags, "PatientID")
+	}
+	order, err := parseOrder(opts.Order)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range order.Tags() {
+		seriesTags = addTag(seriesTags, t)
+	}
+	var phantomRules *phantomFilter
+	if opts.PhantomDir != "" || opts.SkipPhantoms {
+		if opts.PhantomDir != "" && opts.SkipPhantoms {
+			return nil, nil, errors.New("-phantom-dir and -skip-phantoms can't be used together")
+		}
+		phantomRules = &phantomFilter{Patterns: opts.PhantomPatterns, NoHeuristics: opts.NoPhantomHeuristics}
+		if opts.PhantomDir != "" {
+			phantomRules.Dir = nativePath(opts.PhantomDir)
+		}
+		seriesTags = addTag(seriesTags, "PatientID")
+	}
+	var encrypter *archiver
+	if opts.EncryptDir != "" && !dryRun {
+		if opts.EncryptPer != "patient" && opts.EncryptPer != "study" {
+			return nil, nil, fmt.Errorf("Unknown -encrypt-per %q", opts.EncryptPer)
+		}
+		key, err := LoadKey(opts.EncryptKey, opts.EncryptKeyCommand)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-encrypt-dir: %v", err)
+		}
+		encrypter = newArchiver(dst, nativePath(opts.EncryptDir), key, opts.EncryptPer == "study")
+	} else if opts.EncryptKey != "" || opts.EncryptKeyCommand != "" {
+		if opts.EncryptDir == "" {
+			return nil, nil, errors.New("-encrypt-key and -encrypt-key-command require -encrypt-dir")
+		}
+	}
+	var batched *batches
+	if opts.BatchSize != "" || opts.BatchFiles > 0 {
+		var maxBytes float64
+		if opts.BatchSize != "" {
+			if maxBytes, err = parseBytes(opts.BatchSize); err != nil || maxBytes < 1 {
+				return nil, nil, fmt.Errorf("Invalid -batch-size %q", opts.BatchSize)
+			}
+		}
+		if opts.BatchFiles < 0 {
+			return nil, nil, errors.New("-batch-files can't be negative")
+		}
+		if batched, err = openBatches(dst, int64(maxBytes), opts.BatchFiles); err != nil {
+			return nil, nil, err
+		}
+		seriesTags = addTag(seriesTags, "SeriesInstanceUID")
+		seriesTags = addTag(seriesTags, "StudyInstanceUID")
+		seriesTags = addTag(seriesTags, "PatientID")
+	}
+	if usage.enabled() {
+		seriesTags = addTag(seriesTags, "PatientID")
+		seriesTags = addTag(seriesTags, "StudyInstanceUID")
+	}
+
+	// When copying, the target might be inside of one of the
+	// sources. Don't organize the files that were just placed there
+	// again.
+	if !mv {
+		for _, dir := range []string{dst, opts.BurnedInDir, opts.PhantomDir} {
+			if dir == "" {
+				continue
+			}
+			if info, err := os.Stat(dir); err == nil {
+				walk.Exclude = append(walk.Exclude, info)
+			}
+		}
+	}
+
+	audit, err := openAuditLog(auditPath, auditSyslog)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Resume != "" {
+		placed, err := readJournal(opts.Resume)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.resume = resumeSkip(dstFS, placed)
+		if journalPath == "" {
+			journalPath = opts.Resume
+		}
+	}
+	var trusted *manifestIndex
+	if trustedPath != "" {
+		if trusted, err = loadManifestIndex(dstFS, trustedPath); err != nil {
+			return nil, nil, err
+		}
+		if journaled := s.resume; journaled != nil {
+			s.resume = func(file FileName, info os.FileInfo) bool {
+				return journaled(file, info) || trusted.Skip(file, info)
+			}
+		} else {
+			s.resume = trusted.Skip
+		}
+	}
+	var jrnl *journal
+	if journalPath != "" {
+		if jrnl, err = openJournal(journalPath); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.HTTPAddr != "" && s.opts.RunHistory == "" {
+		s.opts.RunHistory = filepath.Join(dst, DefaultRunHistory)
+	}
+	var history *runHistory
+	if s.opts.RunHistory != "" {
+		history = &runHistory{Path: s.opts.RunHistory}
+	}
+	notify, err := newNotifier(notifyURL, notifyMail, opts.NotifyFailuresOnly, history)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mnfst *manifest
+	if manifestPath != "" {
+		if mnfst, err = openManifest(manifestPath); err != nil {
+			return nil, nil, err
+		}
+		fileTags = addTag(fileTags, "SOPInstanceUID")
+		fileTags = addTag(fileTags, "FrameOfReferenceUID")
+		seriesTags = addTag(seriesTags, "StudyInstanceUID")
+		seriesTags = addTag(seriesTags, "SeriesInstanceUID")
+	}
+	var review *reviewList
+	if reviewPath != "" {
+		if review, err = openReviewList(reviewPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if opts.BandwidthLimit != "" {
+		rate, err := parseBytes(opts.BandwidthLimit)
+		if err != nil || rate == 0 {
+			return nil, nil, fmt.Errorf("Invalid -bwlimit %q", opts.BandwidthLimit)
+		}
+		bandwidth = &rateLimiter{bytesPerSec: rate}
+	}
+	if size, err := parseBytes(opts.ResumableSize); err != nil {
+		return nil, nil, fmt.Errorf("Invalid -resumable-size %q", opts.ResumableSize)
+	} else if opts.Remote == "" {
+		// Every copy to a remote target goes through Create, so
+		// that files which are already there are sent as deltas.
+		chunkedCopySize = int64(size)
+	}
+	if opts.Nice {
+		if err := lowerPriority(); err != nil {
+			log.Println("Could not lower priority:", err)
+		}
+	}
+
+	var conflictResolver *resolver
+	if opts.Interactive {
+		in := os.Stdin
+		if opts.FilesFrom == "-" {
+			// Standard input is the list of files.
+			tty, err := os.Open("/dev/tty")
+			if err != nil {
+				return nil, nil, fmt.Errorf("-interactive: %v", err)
+			}
+			in = tty
+		}
+		conflictResolver = newResolver(in, os.Stderr)
+	}
+
+	output := outputLines
+	switch {
+	case opts.Print0 && opts.JSONLines:
+		return nil, nil, errors.New("-print0 and -json-lines can't be used together")
+	case opts.Print0:
+		output = outputNUL
+	case opts.JSONLines:
+		output = outputJSONLines
+	}
+
+	o := &Organizer{
+		Dst:            dst,
+		Move:           mv,
+		FS:             dstFS,
+		ReviewDir:      opts.BurnedInDir,
+		Phantoms:       phantomRules,
+		StripOverlays:  opts.StripOverlays,
+		Compress:       opts.Compress,
+		AddFileMeta:    opts.AddFileMeta,
+		LittleEndian:   opts.LittleEndian,
+		ConvertRetired: opts.ConvertRetired,
+		ProvenanceTag:  opts.ProvenanceTag,
+		TagRules:       rules,
+		DeleteVerified: opts.DeleteVerified,
+		ShardSize:      opts.ShardSize,
+		Audit:          audit,
+		Journal:        jrnl,
+		Manifest:       mnfst,
+		Review:         review,
+		Skip:           s.resume,
+		Trusted:        trusted,
+		Trash:          trashcan,
+		Names:          newDirNames(),
+		Flatten:        opts.Flatten != "",
+		Naming:         naming,
+		Descriptions:   descriptions,
+		Sites:          sites,
+		Conflicts:      conflictResolver,
+		KeepEmpty:      opts.KeepEmpty,
+		Hooks:          seriesHooks{Command: opts.OnSeriesComplete, URL: opts.OnSeriesCompleteURL},
+		Notify:         notify,
+		Expected:       expected,
+		Validate:       validation,
+		Mirror:         mirrored,
+		Stats:          stats,
+		Retired:        retired,
+		Layout:         layout,
+		LayoutRules:    layoutRules,
+		DerivedDir:     opts.DerivedSubdir,
+		Routes:         routing,
+		PatientRoots:   opts.PatientRoots,
+		Batches:        batched,
+		Gate:           gate,
+		Output:         output,
+		Walk:           walk,
+		Order:          order,
+		FHIR:           newFHIRExporter(opts.FHIRNDJSON, opts.FHIRURL),
+		Encrypt:        encrypter,
+	}
+
+	if verbose {
+		log.Println("Reading tags:", strings.Join(RequiredTags(), ", "))
+	}
+	if opts.Cache != "" {
+		if cached, err = openParseCache(opts.Cache, opts.CacheSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	return o, s, nil
+}
+
+// run does what the command of s says with o.
+func (o *Organizer) run(ctx context.Context, s *session) (int, error) {
+	opts, args, srcDirs := s.opts, s.args, s.srcDirs
+	auth := opts.Auth
+	if err := auth.Load(); err != nil {
+		return 1, err
+	}
+	if opts.MetricsAddr != "" {
+		go serveMetrics(opts.MetricsAddr, &auth)
+	}
+	if opts.HTTPAddr != "" {
+		go serveDashboard(opts.HTTPAddr, o.Dst, opts.RunHistory, &auth)
+	}
+	if opts.ActivitySocket != "" {
+		l, err := listenActivity(opts.ActivitySocket)
+		if err != nil {
+			return 1, err
+		}
+		// The socket is left behind on exit, and replaced by the next
+		// daemon to use it.
+		activity = &activityFeed{}
+		go activity.Serve(l)
+	}
+
+	switch opts.Command {
+	case CommandApply:
+		o.Apply(ctx, s.applyPlan)
+		return o.Finish(), nil
+
+	case CommandInfo:
+		if len(args) == 1 {
+			return printInfo(o, args, false), nil
+		}
+		return printInfo(o, srcDirs, true), nil
+
+	case CommandOrphans:
+		r := findOrphans(ctx, o, o.Dst)
+		if opts.DryRun {
+			r.Print()
+			if r.Len() > 0 {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		orphanDir := opts.OrphanDir
+		if orphanDir == "" {
+			orphanDir = filepath.Join(o.Dst, ".orphans")
+		}
+		r.Print()
+		fixOrphans(ctx, o, r, opts.FixOrphans == "remove", nativePath(orphanDir))
+		return o.Finish(), nil
+
+	case CommandPull:
+		s.pullPACS.staging = filepath.Join(o.Dst, ".pull-incoming")
+		if err := s.pullPACS.Pull(ctx, o, s.pullQuery); err != nil {
+			return 1, err
+		}
+		return o.Finish(), nil
+	}
+
+	if opts.Receive != "" {
+		if len(args) != 1 {
+			return 1, errors.New("-receive only accepts a target directory")
+		}
+		rc := &receiver{
+			o:       o,
+			queue:   spoolQueue{filepath.Join(o.Dst, ".incoming")},
+			maxBody: s.maxBody,
+		}
+		rc.Replay(ctx)
+		server := &http.Server{Addr: opts.Receive, Handler: auth.Require(scopeIngest, rc)}
+		if o.Gate != nil {
+			go rc.releaseStudies(ctx)
+		}
+		go func() {
+			<-ctx.Done()
+			server.Shutdown(context.Background())
+		}()
+		if err := auth.ListenAndServe(server); err != http.ErrServerClosed {
+			return 1, err
+		}
+		o.stopping(ctx)
+		return o.Finish(), nil
+	}
+
+	if opts.OrthancURL != "" {
+		if len(args) != 1 {
+			return 1, errors.New("-orthanc-url only accepts a target directory")
+		}
+		src, err := newOrthancSource(opts.OrthancURL, o.Dst)
+		if err != nil {
+			return 1, err
+		}
+		if err := src.Import(ctx, o); err != nil {
+			return 1, err
+		}
+		return o.Finish(), nil
+	}
+
+	if opts.FilesFrom != "" || opts.Command == CommandRetry {
+		var files []FileName
+		if opts.Command == CommandRetry {
+			files = s.retryList.FileNames()
+		} else {
+			if len(args) != 1 {
+				return 1, errors.New("-files-from only accepts a target directory")
+			}
+			var err error
+			if files, err = openFileList(opts.FilesFrom); err != nil {
+				return 1, err
+			}
+		}
+		if opts.NoWriteSource {
+			for _, f := range files {
+				readOnly.Add(f.String())
+			}
+		}
+		if s.resume != nil {
+			var remaining []FileName
+			for _, f := range files {
+				if !s.resume(FileName(filepath.Clean(f.String())), nil) {
+					remaining = append(remaining, f)
+				}
+			}
+			files = remaining
+		}
+		series := splitFiles(files)
+		if opts.DryRun {
+			printPlan(o.PlanAll(ctx, series), opts.Command == CommandPlan)
+			return 0, nil
+		}
+		if err := o.preflight(series, opts.Force); err != nil {
+			return 1, err
+		}
+		o.All(ctx, series)
+		return o.Finish(), nil
+	}
+
+	if opts.Watch > 0 {
+		w := newWatcher(ctx, o, srcDirs, opts.Watch)
+		w.minAge = opts.MinAge
+		if opts.Reconcile != "" {
+			var err error
+			if w.reconcile, err = parseCron(opts.Reconcile); err != nil {
+				return 1, err
+			}
+		}
+		if opts.ControlAddr != "" {
+			recentFailures = &recentErrors{max: 100}
+			o.Pause = newPauser()
+			go serveControl(opts.ControlAddr, w, recentFailures, &auth)
+		}
+		w.Run()
+		o.stopping(ctx)
+		return o.Finish(), nil
+	}
+	series := o.ScanAll(ctx, srcDirs, opts.ScanJobs)
+	if opts.DryRun {
+		p := o.PlanAll(ctx, series)
+		if opts.CheckOnly {
+			return printMisplaced(p), nil
+		}
+		printPlan(p, opts.Command == CommandPlan)
+		return 0, nil
+	}
+	if !o.Move && opts.Remote == "" {
+		if err := o.preflight(series, opts.Force); err != nil {
+			return 1, err
+		}
+	}
+	o.All(ctx, series)
+	return o.Finish(), nil
+}
+
+// preflight checks that there's enough space to copy series before
+// starting, returning an error if there isn't unless force is set.
+func (o *Organizer) preflight(series map[SeriesInstanceUID]SeriesFiles, force bool) error {
+	if err := o.checkSpace(series); err != nil {
+		if !force {
+			return fmt.Errorf("%v (use -force to copy anyways)", err)
+		}
+		log.Println(err)
+	}
+	return nil
+}
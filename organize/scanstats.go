@@ -0,0 +1,47 @@
+package organize
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// scanStats are the statistics for scanning a single source directory.
+type scanStats struct {
+	Source string
+
+	mu      sync.Mutex
+	Found   int
+	Skipped int
+	Errors  int
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Add counts a file of size bytes, which addFile returned err for. It's
+// safe to call on nil scanStats.
+func (s *scanStats) Add(size int64, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch err {
+	case nil:
+		s.Found++
+		s.Bytes += size
+	case errNotDICOM, errPatientNotListed:
+		s.Skipped++
+	default:
+		s.Errors++
+	}
+}
+
+// reportScans logs the statistics of each source directory, so that it's
+// clear which sources contributed what.
+func reportScans(stats []*scanStats) {
+	for _, s := range stats {
+		log.Printf("%s: %d DICOM files (%s), %d errors, %d other files skipped, in %v\n",
+			s.Source, s.Found, humanBytes(uint64(s.Bytes)), s.Errors, s.Skipped, s.Elapsed.Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,531 @@
+package organize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var verbose bool
+
+type SeriesInstanceUID string
+type FileName string
+
+type SeriesFiles struct {
+	PatientName, SeriesDescription string
+	InstanceCreationTime           time.Time
+	Modality                       string
+	Files                          []FileName
+
+	// The values of any other tags used by the layout, from the first
+	// file of the series.
+	Tags map[string]string
+
+	// The values of tags which are needed for each individual file,
+	// rather than once per series.
+	FileTags map[FileName]map[string]string
+
+	// If any file in the series was flagged as likely containing
+	// burned in annotations, why it was flagged.
+	BurnedIn burnedIn
+
+	// The site label of the source directory that the series was
+	// found in.
+	Site string
+}
+
+func (f FileName) String() string {
+	return string(f)
+}
+
+func isTextFile(file FileName) bool {
+	f, err := os.Open(file.String())
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	defer f.Close()
+
+	// Check the first 128 runes of the file to see if they're printable
+	// characters while interpreted as UTF-8.
+	// (Assuming they're all 4 byte long runes, that's still 128*4=512 bytes,
+	// which should mean we only need to read 1 disk sector.)
+	buffer := make([]byte, 128*4)
+	n, err := io.ReadFull(f, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		if verbose {
+			log.Println(err)
+		}
+		return true
+	}
+	return isText(buffer[:n])
+}
+
+// isText returns whether the first 128 runes of data are all printable,
+// or data ends before them.
+func isText(data []byte) bool {
+	for i := 0; i < 128 && len(data) > 0; i++ {
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+
+		// \n, \t, and \r are control characters, but for our purposes they're printable.
+		if !unicode.IsPrint(r) && r != '\n' && r != '\t' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes a directory if the directory is empty.
+func removeEmpty(dir string) bool {
+	if readOnly.Check(dir) != nil {
+		return false
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	if len(files) == 0 {
+		err := os.Remove(dir)
+		return err == nil
+	}
+	return false
+}
+
+// Split series takes a path name as a parameter, and map of the files contained
+// in each SeriesInstanceUID in the directory. It will recursively parse
+// files subdirectories of the directory that it's parsing.
+func SplitSeries(dir FileName) (map[SeriesInstanceUID]SeriesFiles, error) {
+	return splitSeries(context.Background(), dir, WalkOptions{})
+}
+
+// addSeries adds the files in data to the series uid, creating the series
+// if it doesn't exist yet.
+func addSeries(series map[SeriesInstanceUID]SeriesFiles, uid SeriesInstanceUID, data SeriesFiles) {
+	oldseries, ok := series[uid]
+	if !ok {
+		// It's a new series, so set the key
+		series[uid] = data
+		return
+	}
+	// The series already existed, so just add the new files to it.
+	oldseries.Files = append(oldseries.Files, data.Files...)
+	if !oldseries.BurnedIn.Flagged() {
+		oldseries.BurnedIn = data.BurnedIn
+	}
+	if len(data.FileTags) > 0 {
+		if oldseries.FileTags == nil {
+			oldseries.FileTags = make(map[FileName]map[string]string)
+		}
+		for f, tags := range data.FileTags {
+			oldseries.FileTags[f] = tags
+		}
+	}
+	series[uid] = oldseries
+}
+
+// fileTagValues returns the FileTags for a single file.
+func fileTagValues(filename FileName, data Header) map[FileName]map[string]string {
+	if len(fileTags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(fileTags))
+	for _, name := range fileTags {
+		tags[name] = lookupValue(data, name)
+	}
+	return map[FileName]map[string]string{filename: tags}
+}
+
+// parseFile parses a single DICOM file, and returns the SeriesInstanceUID
+// that it belongs to along with the parsed data. The file is read into buf,
+// which must not be reused while data is.
+func parseFile(filename FileName, buf *bytes.Buffer) (uid SeriesInstanceUID, data Header, err error) {
+	if err := readFile(filename, buf); err != nil {
+		return "", nil, err
+	}
+	return parseData(filename, buf.Bytes())
+}
+
+// readFile reads the contents of filename which are needed to parse it into
+// buf, retrying transient errors.
+func readFile(filename FileName, buf *bytes.Buffer) error {
+	return retries.Do("Reading "+filename.String(), func() error {
+		return readHeaderInto(buf, filename.String())
+	})
+}
+
+// parseData parses the contents of the DICOM file filename, and returns the
+// SeriesInstanceUID that it belongs to along with the parsed data. It's the
+// step of scanning that sees the untrusted contents of a file, so it
+// returns an error for anything it can't make sense of. A panic in the
+// parser is returned as a parsePanic. It doesn't touch the disk, so it's
+// fuzzed directly by FuzzParseData.
+func parseData(filename FileName, bytes []byte) (uid SeriesInstanceUID, data Header, err error) {
+	defer recoverParse(filename, &err)
+	if reason := checkSize(bytes); reason != "" {
+		metrics.ParseFailure()
+		return "", nil, damagedError{filename, reason}
+	}
+
+	parser, err := getParser()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer putParser(parser)
+	data, err = parseHeader(parser, bytes, RequiredTags())
+	if err != nil {
+		metrics.ParseFailure()
+		if reason := checkElements(bytes); reason != "" {
+			return "", nil, damagedError{filename, reason}
+		}
+		return "", nil, fmt.Errorf("%s parser error: %v", filename, err)
+	}
+
+	value, err := data.Lookup("SeriesInstanceUID")
+	if err != nil {
+		return "", nil, fmt.Errorf("%s lookup error: %v", filename, err)
+	}
+	newSeries := SeriesInstanceUID(value)
+	if newSeries == "" {
+		return "", nil, fmt.Errorf("%s: could not find SeriesInstanceUID", filename)
+	}
+	return newSeries, data, nil
+}
+
+// readTags parses a file and returns the values of the named elements.
+// Elements that aren't present in the file have an empty value.
+func readTags(filename FileName, names ...string) (tags map[string]string, err error) {
+	defer recoverParse(filename, &err)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := readHeaderInto(buf, filename.String()); err != nil {
+		return nil, err
+	}
+	bytes := buf.Bytes()
+	parser, err := getParser()
+	if err != nil {
+		return nil, err
+	}
+	defer putParser(parser)
+	data, err := parseHeader(parser, bytes, names)
+	if err != nil {
+		return nil, fmt.Errorf("%s parser error: %v", filename, err)
+	}
+	tags = make(map[string]string, len(names))
+	for _, name := range names {
+		tags[name] = lookupValue(data, name)
+	}
+	return tags, nil
+}
+
+// newSeriesFiles creates the SeriesFiles for a series, using the tags from
+// the first file found in it.
+func newSeriesFiles(filename FileName, data Header) (SeriesFiles, error) {
+	patient, err := data.Lookup("PatientName")
+	if err != nil {
+		return SeriesFiles{}, fmt.Errorf("%s lookup error for PatientName: %v", filename, err)
+	}
+	sd, err := data.Lookup("SeriesDescription")
+	if err != nil {
+		return SeriesFiles{}, fmt.Errorf("%s lookup error for SeriesDescription: %v", filename, err)
+	}
+	instanceDate, err := data.Lookup("InstanceCreationDate")
+	if err != nil {
+		return SeriesFiles{}, fmt.Errorf("%s lookup error for InstanceCreationDate: %v", filename, err)
+	}
+	instanceTime, err := data.Lookup("InstanceCreationTime")
+	if err != nil {
+		return SeriesFiles{}, fmt.Errorf("%s lookup error for InstanceCreationTime: %v", filename, err)
+	}
+
+	timeVal := instanceTime
+	if len(timeVal) < 4 {
+		return SeriesFiles{}, fmt.Errorf("%s invalid InstanceCreationTime: %v", filename, timeVal)
+	}
+
+	tags := make(map[string]string, len(seriesTags))
+	for _, name := range seriesTags {
+		tags[name] = lookupValue(data, name)
+	}
+
+	instanceDateTime := instanceDate + timeVal[0:4]
+	instanceTimeParsed, err := time.Parse("200601021504", instanceDateTime)
+	if err != nil {
+		return SeriesFiles{}, err
+	}
+	return SeriesFiles{
+		PatientName:          patient,
+		SeriesDescription:    sd,
+		InstanceCreationTime: instanceTimeParsed,
+		Modality:             lookupValue(data, "Modality"),
+		Files:                []FileName{filename},
+		BurnedIn:             burnedInReason(data),
+		Tags:                 tags,
+		FileTags:             fileTagValues(filename, data),
+	}, nil
+}
+
+// errNotDICOM is returned by addFile for files which were skipped because
+// they obviously aren't DICOM files.
+var errNotDICOM = errors.New("not a DICOM file")
+
+// addFile parses filename and adds it to the series that it belongs to.
+// Files which can't be parsed are logged and ignored, and files which
+// crash the parser are quarantined. The returned error is only used for
+// statistics, since it's already been reported.
+func addFile(series map[SeriesInstanceUID]SeriesFiles, filename FileName) error {
+	var text bool
+	err := within(filename, func() error {
+		text = isTextFile(filename)
+		return nil
+	})
+	if err == nil && text {
+		if verbose {
+			log.Printf("Skipping %s: not a DICOM file.\n", filename)
+		}
+		return errNotDICOM
+	}
+
+	if err == nil {
+		err = parseInto(series, filename)
+	}
+	if err == errPatientNotListed {
+		if verbose {
+			log.Printf("Skipping %s: %v.\n", filename, err)
+		}
+		return err
+	}
+	if err != nil {
+		if _, ok := err.(timeoutError); ok {
+			log.Println(err)
+			metrics.ParseFailure()
+			timedOut.Add(filename)
+			fileFailed(filename, deadTimeout, err)
+			return err
+		}
+		if d, ok := err.(damagedError); ok {
+			// Damaged files are reported at the end of the run.
+			if verbose {
+				log.Println(err)
+			}
+			damaged.Add(d)
+			fileFailed(filename, deadDamaged, err)
+			return err
+		}
+		log.Println(err)
+		if p, ok := err.(parsePanic); ok {
+			if verbose {
+				log.Printf("%s", p.stack)
+			}
+			quarantined.Add(filename, p)
+			fileFailed(filename, deadParserCrash, err)
+		} else {
+			fileFailed(filename, deadParseError, err)
+		}
+	}
+	return err
+}
+
+// parseInto does the work of addFile, returning any error that prevented
+// filename from being added.
+func parseInto(series map[SeriesInstanceUID]SeriesFiles, filename FileName) (err error) {
+	defer recoverParse(filename, &err)
+	if uid, seriesData, ok := cached.Get(filename); ok {
+		if !onlyPatients.Includes(seriesData.PatientName, seriesData.tagValue("PatientID")) {
+			return errPatientNotListed
+		}
+		addParsed(series, uid, seriesData)
+		return nil
+	}
+	buf := getBuffer()
+	var newSeries SeriesInstanceUID
+	var data Header
+	err = within(filename, func() (err error) {
+		if err := readFile(filename, buf); err != nil {
+			return err
+		}
+		// Other patients' files are skipped before they're parsed.
+		if onlyPatients.Skips(buf.Bytes()) {
+			return errPatientNotListed
+		}
+		newSeries, data, err = parseData(filename, buf.Bytes())
+		return err
+	})
+	if _, ok := err.(timeoutError); ok {
+		// The read is still using buf.
+		return err
+	}
+	defer putBuffer(buf)
+	if err != nil {
+		return err
+	}
+	if !onlyPatients.Includes(lookupValue(data, "PatientName"), lookupValue(data, "PatientID")) {
+		return errPatientNotListed
+	}
+	_, exists := series[newSeries]
+	if !exists || cached != nil {
+		seriesData, err := newSeriesFiles(filename, data)
+		switch {
+		case err == nil:
+			cached.Put(filename, newSeries, seriesData)
+			addParsed(series, newSeries, seriesData)
+			return nil
+		case !exists:
+			return err
+		}
+		// Only the first file of a series needs the tags that the
+		// series is named by.
+	}
+	addSeries(series, newSeries, SeriesFiles{
+		Files:    []FileName{filename},
+		BurnedIn: burnedInReason(data),
+		FileTags: fileTagValues(filename, data),
+	})
+	return nil
+}
+
+// addParsed adds the SeriesFiles for a single file to series, using it as
+// the first file of the series if it's a new one.
+func addParsed(series map[SeriesInstanceUID]SeriesFiles, uid SeriesInstanceUID, data SeriesFiles) {
+	if _, ok := series[uid]; !ok {
+		series[uid] = data
+		return
+	}
+	addSeries(series, uid, SeriesFiles{
+		Files:    data.Files,
+		BurnedIn: data.BurnedIn,
+		FileTags: data.FileTags,
+	})
+}
+
+// splitFiles is like SplitSeries, but splits a list of files rather than
+// the contents of a directory.
+func splitFiles(files []FileName) map[SeriesInstanceUID]SeriesFiles {
+	series := make(map[SeriesInstanceUID]SeriesFiles)
+	for _, file := range files {
+		addFile(series, FileName(filepath.Clean(file.String())))
+	}
+	return series
+}
+
+// WalkOptions control how source directories are traversed.
+type WalkOptions struct {
+	// The maximum depth of subdirectories to descend into, or 0 for no
+	// limit.
+	MaxDepth int
+
+	// If set, symlinks to directories are followed. Symlinks to files are
+	// always followed.
+	FollowSymlinks bool
+
+	// If set, files and directories whose names start with a dot are
+	// ignored.
+	SkipHidden bool
+
+	// Directories which are never descended into.
+	Exclude []os.FileInfo
+
+	// If non-nil, any file that Skip returns true for is ignored.
+	Skip func(FileName, os.FileInfo) bool
+
+	// If non-nil, counts the files that were found.
+	Stats *scanStats
+}
+
+// splitSeries implements SplitSeries, traversing dir according to opts.
+func splitSeries(ctx context.Context, dir FileName, opts WalkOptions) (map[SeriesInstanceUID]SeriesFiles, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Must provide a directory to split.")
+	}
+	info, err := os.Stat(dir.String())
+	if err != nil {
+		return nil, err
+	}
+	series := make(map[SeriesInstanceUID]SeriesFiles)
+	if err := opts.split(ctx, series, dir, 1, []os.FileInfo{info}); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// split adds the files in dir, which is depth levels below the source
+// directory, to series. ancestors are the directories that were traversed
+// to get to dir, and are used to detect symlink cycles. If ctx is
+// cancelled, it stops before the next file.
+func (opts WalkOptions) split(ctx context.Context, series map[SeriesInstanceUID]SeriesFiles, dir FileName, depth int, ancestors []os.FileInfo) error {
+	files, err := ioutil.ReadDir(dir.String())
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if canceled(ctx) {
+			return nil
+		}
+		if opts.SkipHidden && strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		filename := FileName(filepath.Join(dir.String(), file.Name()))
+
+		if file.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(filename.String())
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if target.IsDir() && !opts.FollowSymlinks {
+				if verbose {
+					log.Printf("Skipping %s: symlink to a directory.\n", filename)
+				}
+				continue
+			}
+			file = target
+		}
+
+		if file.IsDir() {
+			if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+				continue
+			}
+			if sameAsAny(file, ancestors) {
+				log.Printf("Skipping %s: symlink cycle.\n", filename)
+				continue
+			}
+			if sameAsAny(file, opts.Exclude) {
+				if verbose {
+					log.Printf("Skipping %s: excluded directory.\n", filename)
+				}
+				continue
+			}
+			// Recursively add any subdirectories as documented.
+			if err := opts.split(ctx, series, filename, depth+1, append(ancestors, file)); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if opts.Skip != nil && opts.Skip(filename, file) {
+				continue
+			}
+			opts.Stats.Add(file.Size(), addFile(series, filename))
+		}
+	}
+	return nil
+}
+
+// sameAsAny reports whether dir is the same directory as any in dirs.
+func sameAsAny(dir os.FileInfo, dirs []os.FileInfo) bool {
+	for _, a := range dirs {
+		if os.SameFile(dir, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,857 @@
+package organize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The query/retrieve levels, from the top of the hierarchy down.
+var qrLevels = []string{"PATIENT", "STUDY", "SERIES", "IMAGE"}
+
+// A qrAttribute is an attribute that can be used as a matching or return
+// key in queries.
+type qrAttribute struct {
+	Name  string
+	Tag   tag
+	VR    string
+	Level string
+	// Computed attributes aren't read from the files, but counted from
+	// the instances that match.
+	Computed bool
+}
+
+var qrAttributes = []qrAttribute{
+	{"PatientName", tag{0x0010, 0x0010}, "PN", "PATIENT", false},
+	{"PatientID", tag{0x0010, 0x0020}, "LO", "PATIENT", false},
+	{"PatientBirthDate", tag{0x0010, 0x0030}, "DA", "PATIENT", false},
+	{"PatientSex", tag{0x0010, 0x0040}, "CS", "PATIENT", false},
+	{"NumberOfPatientRelatedStudies", tag{0x0020, 0x1200}, "IS", "PATIENT", true},
+	{"NumberOfPatientRelatedInstances", tag{0x0020, 0x1204}, "IS", "PATIENT", true},
+
+	{"StudyInstanceUID", tag{0x0020, 0x000D}, "UI", "STUDY", false},
+	{"StudyDate", tag{0x0008, 0x0020}, "DA", "STUDY", false},
+	{"StudyTime", tag{0x0008, 0x0030}, "TM", "STUDY", false},
+	{"AccessionNumber", tag{0x0008, 0x0050}, "SH", "STUDY", false},
+	{"StudyID", tag{0x0020, 0x0010}, "SH", "STUDY", false},
+	{"StudyDescription", tag{0x0008, 0x1030}, "LO", "STUDY", false},
+	{"ReferringPhysicianName", tag{0x0008, 0x0090}, "PN", "STUDY", false},
+	{"ModalitiesInStudy", tag{0x0008, 0x0061}, "CS", "STUDY", true},
+	{"NumberOfStudyRelatedSeries", tag{0x0020, 0x1206}, "IS", "STUDY", true},
+	{"NumberOfStudyRelatedInstances", tag{0x0020, 0x1208}, "IS", "STUDY", true},
+
+	{"SeriesInstanceUID", tag{0x0020, 0x000E}, "UI", "SERIES", false},
+	{"Modality", tag{0x0008, 0x0060}, "CS", "SERIES", false},
+	{"SeriesNumber", tag{0x0020, 0x0011}, "IS", "SERIES", false},
+	{"SeriesDescription", tag{0x0008, 0x103E}, "LO", "SERIES", false},
+	{"SeriesDate", tag{0x0008, 0x0021}, "DA", "SERIES", false},
+	{"SeriesTime", tag{0x0008, 0x0031}, "TM", "SERIES", false},
+	{"BodyPartExamined", tag{0x0018, 0x0015}, "CS", "SERIES", false},
+	{"NumberOfSeriesRelatedInstances", tag{0x0020, 0x1209}, "IS", "SERIES", true},
+
+	{"SOPInstanceUID", tag{0x0008, 0x0018}, "UI", "IMAGE", false},
+	{"SOPClassUID", tag{0x0008, 0x0016}, "UI", "IMAGE", false},
+	{"InstanceNumber", tag{0x0020, 0x0013}, "IS", "IMAGE", false},
+}
+
+// The unique key of each level, which retrieves have to give.
+var qrUniqueKeys = map[string]string{
+	"PATIENT": "PatientID",
+	"STUDY":   "StudyInstanceUID",
+	"SERIES":  "SeriesInstanceUID",
+	"IMAGE":   "SOPInstanceUID",
+}
+
+var retrieveAETitleTag = tag{0x0008, 0x0054}
+
+// The number of files whose tags are cached between queries.
+const maxCachedTags = 100000
+
+func qrLevel(level string) int {
+	for i, l := range qrLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// qrAttributeFor returns the attribute with tag t.
+func qrAttributeFor(t tag) (qrAttribute, bool) {
+	for _, attr := range qrAttributes {
+		if attr.Tag == t {
+			return attr, true
+		}
+	}
+	return qrAttribute{}, false
+}
+
+// A qrEntity is a patient, study, series or instance in the tree, along
+// with the instances that belong to it, sorted by path.
+type qrEntity []indexedInstance
+
+// A dicomServer answers queries and retrieves for the instances in an
+// organized tree, so that viewers which speak DIMSE can browse it like
+// a PACS. It never changes the tree: instances sent to it are refused.
+type dicomServer struct {
+	ae      string
+	allowed map[string]bool
+	// The addresses of the AEs that instances can be moved to.
+	dests MoveDestinations
+	index *instanceIndex
+
+	mu    sync.Mutex
+	cache map[string]map[string]string
+}
+
+// tags returns the values that queries can match in the file at path,
+// along with its SOP class and transfer syntax.
+func (s *dicomServer) tags(path string) map[string]string {
+	s.mu.Lock()
+	tags, ok := s.cache[path]
+	s.mu.Unlock()
+	if ok {
+		return tags
+	}
+	names := []string{"TransferSyntaxUID"}
+	for _, attr := range qrAttributes {
+		if !attr.Computed {
+			names = append(names, attr.Name)
+		}
+	}
+	tags, err := readTags(FileName(path), names...)
+	if err != nil {
+		log.Println(err)
+		tags = make(map[string]string)
+	}
+	for name, v := range tags {
+		tags[name] = strings.TrimSpace(v)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil || len(s.cache) >= maxCachedTags {
+		s.cache = make(map[string]map[string]string)
+	}
+	s.cache[path] = tags
+	return tags
+}
+
+// entities returns the entities at a level which the UIDs in keys select.
+// The other keys still have to be matched.
+func (s *dicomServer) entities(level string, keys *dataset) []qrEntity {
+	s.index.Refresh()
+	study := keys.stringValue(tagDictionary["StudyInstanceUID"])
+	series := keys.stringValue(tagDictionary["SeriesInstanceUID"])
+	sop := keys.stringValue(tagDictionary["SOPInstanceUID"])
+	groups := make(map[string]qrEntity)
+	for uid, inst := range s.index.Instances() {
+		if !matchKey("UI", study, inst.StudyInstanceUID) || !matchKey("UI", series, inst.SeriesInstanceUID) || !matchKey("UI", sop, uid) {
+			continue
+		}
+		var key string
+		switch level {
+		case "PATIENT", "STUDY":
+			key = inst.StudyInstanceUID
+		case "SERIES":
+			key = inst.SeriesInstanceUID
+		default:
+			key = uid
+		}
+		groups[key] = append(groups[key], inst)
+	}
+	if level == "PATIENT" {
+		// Studies are regrouped by the patient in their first
+		// instance.
+		patients := make(map[string]qrEntity)
+		for _, g := range groups {
+			sortEntity(g)
+			id := s.tags(g[0].Path)["PatientID"]
+			patients[id] = append(patients[id], g...)
+		}
+		groups = patients
+	}
+	entities := make([]qrEntity, 0, len(groups))
+	for _, g := range groups {
+		sortEntity(g)
+		entities = append(entities, g)
+	}
+	sort.Slice(entities, func(i, j int) bool { return entities[i][0].Path < entities[j][0].Path })
+	return entities
+}
+
+func sortEntity(g qrEntity) {
+	sort.Slice(g, func(i, j int) bool { return g[i].Path < g[j].Path })
+}
+
+// value returns the value of attr for an entity. Attributes that aren't
+// computed are read from its first instance.
+func (s *dicomServer) value(attr qrAttribute, g qrEntity) string {
+	if !attr.Computed {
+		return s.tags(g[0].Path)[attr.Name]
+	}
+	studies := make(map[string]bool)
+	series := make(map[string]string)
+	for _, inst := range g {
+		studies[inst.StudyInstanceUID] = true
+		if _, ok := series[inst.SeriesInstanceUID]; !ok {
+			series[inst.SeriesInstanceUID] = inst.Path
+		}
+	}
+	switch attr.Name {
+	case "NumberOfPatientRelatedStudies":
+		return strconv.Itoa(len(studies))
+	case "NumberOfStudyRelatedSeries":
+		return strconv.Itoa(len(series))
+	case "ModalitiesInStudy":
+		seen := make(map[string]bool)
+		var modalities []string
+		for _, path := range series {
+			if m := s.tags(path)["Modality"]; m != "" && !seen[m] {
+				seen[m] = true
+				modalities = append(modalities, m)
+			}
+		}
+		sort.Strings(modalities)
+		return strings.Join(modalities, `\`)
+	default:
+		return strconv.Itoa(len(g))
+	}
+}
+
+// matchKey reports whether value matches the key of a query, as described
+// in PS3.4 C.2.2.2. Both can have several values, in which case any
+// match is enough.
+func matchKey(vr, key, value string) bool {
+	key = strings.TrimSpace(key)
+	if key == "" || key == "*" {
+		return true
+	}
+	for _, k := range strings.Split(key, `\`) {
+		for _, v := range strings.Split(value, `\`) {
+			if matchValue(vr, strings.TrimSpace(k), strings.TrimSpace(v)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchValue(vr, key, value string) bool {
+	switch {
+	case (vr == "DA" || vr == "TM" || vr == "DT") && strings.Contains(key, "-"):
+		i := strings.Index(key, "-")
+		lo, hi := key[:i], key[i+1:]
+		return value != "" && (lo == "" || compareTime(vr, value, lo) >= 0) && (hi == "" || compareTime(vr, value, hi) <= 0)
+	case vr != "UI" && strings.ContainsAny(key, "*?"):
+		var re strings.Builder
+		re.WriteString("^")
+		if vr == "PN" {
+			re.WriteString("(?i)")
+		}
+		for _, r := range key {
+			switch r {
+			case '*':
+				re.WriteString(".*")
+			case '?':
+				re.WriteString(".")
+			default:
+				re.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		re.WriteString("$")
+		return regexp.MustCompile(re.String()).MatchString(value)
+	case vr == "TM" || vr == "DT":
+		return compareTime(vr, value, key) == 0
+	case vr == "PN":
+		return strings.EqualFold(key, value)
+	default:
+		return key == value
+	}
+}
+
+// compareTime compares a time with a bound of a range, which can be less
+// precise, by only comparing as much of the time as the bound gives.
+func compareTime(vr, value, bound string) int {
+	if vr != "DA" && len(value) > len(bound) {
+		value = value[:len(bound)]
+	}
+	return strings.Compare(value, bound)
+}
+
+// matches reports whether an entity matches every key in keys.
+func (s *dicomServer) matches(level string, keys *dataset, g qrEntity) bool {
+	for _, el := range keys.Elements {
+		attr, ok := qrAttributeFor(el.Tag)
+		if !ok || qrLevel(attr.Level) > qrLevel(level) || (attr.VR == "UI" && attr.Name != "SOPClassUID") {
+			// The UIDs in the index were already matched by
+			// entities.
+			continue
+		}
+		if !matchKey(attr.VR, keys.stringValue(el.Tag), s.value(attr, g)) {
+			return false
+		}
+	}
+	return true
+}
+
+// identifier returns the response to a C-FIND for an entity, with the
+// values of the keys that were asked for. Keys that are unknown, or
+// below the level, are returned empty.
+func (s *dicomServer) identifier(level string, keys *dataset, g qrEntity) *dataset {
+	ds := &dataset{}
+	for _, el := range keys.Elements {
+		if el.Tag.Element == 0 || el.Tag == specificCharacterSetTag || el.Tag == queryRetrieveLevelTag {
+			continue
+		}
+		attr, ok := qrAttributeFor(el.Tag)
+		if !ok || qrLevel(attr.Level) > qrLevel(level) {
+			vr := el.VR
+			if vr == "" {
+				vr = "UN"
+				if attr.VR != "" {
+					vr = attr.VR
+				}
+			}
+			ds.setElement(element{Tag: el.Tag, VR: vr})
+			continue
+		}
+		value, err := ds.encodeValue(attr.VR, s.value(attr, g))
+		if err != nil {
+			value = nil
+		}
+		ds.setElement(element{Tag: el.Tag, VR: attr.VR, Value: value})
+	}
+	ds.setElement(element{Tag: queryRetrieveLevelTag, VR: "CS", Value: padValue(level)})
+	value, _ := ds.encodeValue("AE", s.ae)
+	ds.setElement(element{Tag: retrieveAETitleTag, VR: "AE", Value: value})
+	return ds
+}
+
+// readQuery reads the identifier of a query or retrieve, and returns its
+// level. If it isn't valid, the request has already been answered and
+// level is "".
+func (s *dicomServer) readQuery(a *association, c *command) (level string, keys *dataset, err error) {
+	keys, err = a.ReadIdentifier(c)
+	if err != nil {
+		return "", nil, err
+	}
+	level = keys.stringValue(queryRetrieveLevelTag)
+	studyRoot := strings.HasPrefix(a.contexts[c.Context].AbstractSyntax, "1.2.840.10008.5.1.4.1.2.2.")
+	var problem string
+	switch {
+	case qrLevel(level) < 0:
+		problem = fmt.Sprintf("unknown QueryRetrieveLevel %q", level)
+	case studyRoot && level == "PATIENT":
+		problem = "the study root has no PATIENT level"
+	case c.Field() != cFindRQ && keys.stringValue(tagDictionary[qrUniqueKeys[level]]) == "":
+		problem = "no " + qrUniqueKeys[level] + " to retrieve"
+	}
+	if problem != "" {
+		rsp := c.response(statusIdentifierError)
+		rsp.setString(cmdErrorComment, "LO", problem)
+		return "", nil, a.Send(rsp, nil)
+	}
+	return level, keys, nil
+}
+
+// find answers a C-FIND request.
+func (s *dicomServer) find(a *association, c *command) error {
+	level, keys, err := s.readQuery(a, c)
+	if err != nil || level == "" {
+		return err
+	}
+	n := 0
+	for _, g := range s.entities(level, keys) {
+		if !s.matches(level, keys, g) {
+			continue
+		}
+		if err := a.Send(c.response(statusPending), a.Identifier(c, s.identifier(level, keys, g))); err != nil {
+			return err
+		}
+		n++
+	}
+	if verbose {
+		log.Printf("%s found %s at the %s level.\n", a.Calling, plural(n, "match", "matches"), level)
+	}
+	return a.Send(c.response(statusSuccess), nil)
+}
+
+// retrievePaths returns the files of the instances that a C-GET or C-MOVE
+// asks for. If the request isn't valid, it has already been answered and
+// ok is false.
+func (s *dicomServer) retrievePaths(a *association, c *command) (paths []string, ok bool, err error) {
+	level, keys, err := s.readQuery(a, c)
+	if err != nil || level == "" {
+		return nil, false, err
+	}
+	for _, g := range s.entities(level, keys) {
+		if !s.matches(level, keys, g) {
+			continue
+		}
+		for _, inst := range g {
+			paths = append(paths, inst.Path)
+		}
+	}
+	return paths, true, nil
+}
+
+// subops counts the C-STORE sub-operations of a C-GET or C-MOVE.
+type subops struct {
+	Remaining, Completed, Failed, Warning int
+	Canceled                              bool
+}
+
+func (so *subops) add(status uint16) {
+	so.Remaining--
+	switch {
+	case status == statusSuccess:
+		so.Completed++
+	case status&0xF000 == 0xB000:
+		so.Warning++
+	default:
+		so.Failed++
+	}
+}
+
+// response returns the response to the retrieve rq with the counts.
+func (so *subops) response(rq *command, status uint16) *command {
+	rsp := rq.response(status)
+	count := func(n int) uint16 {
+		if n > 0xFFFF {
+			return 0xFFFF
+		}
+		return uint16(n)
+	}
+	if status == statusPending {
+		rsp.setUS(cmdRemaining, count(so.Remaining))
+	}
+	rsp.setUS(cmdCompleted, count(so.Completed))
+	rsp.setUS(cmdFailed, count(so.Failed))
+	rsp.setUS(cmdWarning, count(so.Warning))
+	return rsp
+}
+
+// Final returns the final response to the retrieve rq.
+func (so *subops) Final(rq *command) *command {
+	status := uint16(statusSuccess)
+	switch {
+	case so.Canceled:
+		status = statusCancel
+	case so.Failed > 0 || so.Warning > 0:
+		status = statusSubopsFailed
+	}
+	return so.response(rq, status)
+}
+
+// readInstance reads the file at path to be sent. Large files are only
+// read up to their pixel data, which is copied from the file as it's
+// sent.
+func readInstance(path string) (*dataset, io.WriterTo, io.Closer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, err := openStored(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if info.Size() > rewriteInMemory {
+		split, err := readLarge(r)
+		if err != nil {
+			r.Close()
+			return nil, nil, nil, err
+		}
+		split.Preamble, split.Meta = nil, nil
+		return split.dataset, split, r, nil
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ds, err := readDataset(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ds.Preamble, ds.Meta = nil, nil
+	return ds, ds, ioutil.NopCloser(nil), nil
+}
+
+// contextForInstance returns the accepted presentation context to send an
+// instance of the SOP class in the transfer syntax ts with, preferring
+// one that it doesn't have to be converted for.
+func contextForInstance(a *association, class, ts string) (presentationContext, bool) {
+	var ids []int
+	for id, pc := range a.contexts {
+		if pc.AbstractSyntax == class && (pc.TransferSyntax() == ts || canConvert(ts, pc.TransferSyntax())) {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if a.contexts[byte(id)].TransferSyntax() == ts {
+			return a.contexts[byte(id)], true
+		}
+	}
+	if len(ids) == 0 {
+		return presentationContext{}, false
+	}
+	return a.contexts[byte(ids[0])], true
+}
+
+// store sends the instance at path with C-STORE over a, and returns the
+// status that it was stored with. If move isn't nil, the instance is
+// sent on behalf of that C-MOVE request from the AE originator. If the peer cancels the C-GET
+// that the instance is sent for while it's being sent, so.Canceled is
+// set.
+func (s *dicomServer) store(a *association, path string, move *command, originator string, so *subops) (uint16, error) {
+	ds, data, closer, err := readInstance(path)
+	if err != nil {
+		log.Println(err)
+		return statusUnableToProcess, nil
+	}
+	defer closer.Close()
+	class, sop := ds.stringValue(sopClassUIDTag), ds.stringValue(sopInstanceUIDTag)
+	pc, ok := contextForInstance(a, class, ds.TransferSyntax)
+	if !ok {
+		log.Printf("%s: %s didn't accept SOP class %s in %s, or one that it can be converted to.\n", path, a.Called, class, ds.TransferSyntax)
+		return statusUnableToProcess, nil
+	}
+	if ts := pc.TransferSyntax(); ts != ds.TransferSyntax {
+		if _, large := data.(splitDataset); large {
+			log.Printf("%s: can't convert files larger than %s to %s.\n", path, humanBytes(uint64(rewriteInMemory)), ts)
+			return statusUnableToProcess, nil
+		}
+		if err := ds.convertTo(ts); err != nil {
+			log.Printf("%s: %v\n", path, err)
+			return statusUnableToProcess, nil
+		}
+	}
+	c := a.NewRequest(cStoreRQ, pc)
+	c.setString(cmdAffectedSOPInstance, "UI", sop)
+	c.setUS(cmdPriority, 0)
+	if move != nil {
+		c.setString(cmdMoveOriginatorAE, "AE", originator)
+		c.setUS(cmdMoveOriginatorID, move.MessageID())
+	}
+	if err := a.Send(c, data); err != nil {
+		return 0, err
+	}
+	for {
+		rsp, err := a.ReadCommand()
+		if err != nil {
+			return 0, err
+		}
+		switch rsp.Field() {
+		case cStoreRSP:
+			if rsp.HasData() {
+				if err := a.ReadData(rsp, io.Discard); err != nil {
+					return 0, err
+				}
+			}
+			return rsp.Status(), nil
+		case cCancelRQ:
+			so.Canceled = true
+		default:
+			return 0, fmt.Errorf("%s answered C-STORE with command %#04x", a.Called, rsp.Field())
+		}
+	}
+}
+
+// get answers a C-GET request, sending the instances over the same
+// association.
+func (s *dicomServer) get(a *association, c *command) error {
+	paths, ok, err := s.retrievePaths(a, c)
+	if err != nil || !ok {
+		return err
+	}
+	so := &subops{Remaining: len(paths)}
+	for _, path := range paths {
+		if so.Canceled {
+			break
+		}
+		status, err := s.store(a, path, nil, "", so)
+		if err != nil {
+			return err
+		}
+		so.add(status)
+		if err := a.Send(so.response(c, statusPending), nil); err != nil {
+			return err
+		}
+	}
+	if verbose {
+		log.Printf("Sent %s to %s.\n", plural(so.Completed+so.Warning, "instance", "instances"), a.Calling)
+	}
+	return a.Send(so.Final(c), nil)
+}
+
+// moveContexts returns the presentation contexts to propose for sending
+// the files at paths: each of their SOP classes in explicit and implicit
+// VR little endian, and in the transfer syntax of each file.
+func (s *dicomServer) moveContexts(paths []string) []presentationContext {
+	var contexts []presentationContext
+	proposed := make(map[[2]string]bool)
+	propose := func(class string, ts ...string) {
+		key := [2]string{class, strings.Join(ts, `\`)}
+		if class == "" || proposed[key] || len(contexts) >= 128 {
+			return
+		}
+		proposed[key] = true
+		contexts = append(contexts, presentationContext{ID: byte(2*len(contexts) + 1), AbstractSyntax: class, TransferSyntaxes: ts})
+	}
+	for _, path := range paths {
+		propose(s.tags(path)["SOPClassUID"], queryTransferSyntaxes...)
+	}
+	for _, path := range paths {
+		tags := s.tags(path)
+		if ts := tags["TransferSyntaxUID"]; ts != explicitVRLittleEndian && ts != implicitVRLittleEndian {
+			propose(tags["SOPClassUID"], ts)
+		}
+	}
+	return contexts
+}
+
+// move answers a C-MOVE request, sending the instances over a new
+// association to the destination.
+func (s *dicomServer) move(a *association, c *command) error {
+	dest := c.stringValue(cmdMoveDestination)
+	addr, known := s.dests[dest]
+	paths, ok, err := s.retrievePaths(a, c)
+	if err != nil || !ok {
+		return err
+	}
+	if !known {
+		rsp := c.response(statusUnknownMoveDest)
+		rsp.setString(cmdErrorComment, "LO", "unknown move destination "+dest)
+		return a.Send(rsp, nil)
+	}
+	so := &subops{Remaining: len(paths)}
+	if len(paths) > 0 {
+		sub, err := dialAssociation(context.Background(), addr, s.ae, dest, s.moveContexts(paths), nil)
+		if err != nil {
+			log.Printf("Could not move instances to %s: %v\n", dest, err)
+			so.Failed, so.Remaining = len(paths), 0
+			rsp := so.response(c, statusCantStartSubops)
+			rsp.setString(cmdErrorComment, "LO", "could not connect to "+dest)
+			return a.Send(rsp, nil)
+		}
+		for _, path := range paths {
+			status, err := s.store(sub, path, c, a.Calling, so)
+			if err != nil {
+				sub.Abort()
+				log.Printf("Could not move instances to %s: %v\n", dest, err)
+				so.Failed += so.Remaining
+				so.Remaining = 0
+				break
+			}
+			so.add(status)
+			if err := a.Send(so.response(c, statusPending), nil); err != nil {
+				sub.Abort()
+				return err
+			}
+		}
+		sub.Release()
+	}
+	if verbose {
+		log.Printf("Moved %s to %s for %s.\n", plural(so.Completed+so.Warning, "instance", "instances"), dest, a.Calling)
+	}
+	return a.Send(so.Final(c), nil)
+}
+
+// Query/retrieve SOP classes that are served.
+var qrSOPClasses = map[string]bool{
+	verificationUID:    true,
+	studyRootFindUID:   true,
+	studyRootMoveUID:   true,
+	studyRootGetUID:    true,
+	patientRootFindUID: true,
+	patientRootMoveUID: true,
+	patientRootGetUID:  true,
+}
+
+// acceptor returns the acceptor for an association. Storage SOP classes
+// are only accepted with the SCP role, for C-GET. Since instances are
+// only converted from uncompressed transfer syntaxes, each further
+// context that's proposed for a class is accepted in a transfer syntax
+// that hasn't been yet, so that compressed instances can be sent as
+// they are.
+func (s *dicomServer) acceptor() *acceptor {
+	taken := make(map[string]map[string]bool)
+	return &acceptor{
+		AE:      s.ae,
+		Allowed: s.allowed,
+		Negotiate: func(pc presentationContext, scpRole bool) (string, byte) {
+			if qrSOPClasses[pc.AbstractSyntax] {
+				for _, ts := range pc.TransferSyntaxes {
+					if ts == explicitVRLittleEndian || ts == implicitVRLittleEndian {
+						return ts, contextAccepted
+					}
+				}
+				return "", contextTransferSyntaxesNotSupported
+			}
+			if !scpRole || len(pc.TransferSyntaxes) == 0 {
+				return "", contextAbstractSyntaxNotSupported
+			}
+			if taken[pc.AbstractSyntax] == nil {
+				taken[pc.AbstractSyntax] = make(map[string]bool)
+			}
+			choice := pc.TransferSyntaxes[0]
+			if len(taken[pc.AbstractSyntax]) == 0 {
+				for _, ts := range pc.TransferSyntaxes {
+					if ts == explicitVRLittleEndian {
+						choice = ts
+						break
+					}
+				}
+			} else {
+				for _, ts := range pc.TransferSyntaxes {
+					if !taken[pc.AbstractSyntax][ts] {
+						choice = ts
+						break
+					}
+				}
+			}
+			taken[pc.AbstractSyntax][choice] = true
+			return choice, contextAccepted
+		},
+	}
+}
+
+// Serve accepts associations on l until it's closed.
+func (s *dicomServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *dicomServer) serve(conn net.Conn) {
+	a, err := s.acceptor().Accept(conn)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for {
+		c, err := a.ReadCommand()
+		if err == errReleased {
+			return
+		}
+		if err == nil {
+			switch c.Field() {
+			case cEchoRQ:
+				err = a.Send(c.response(statusSuccess), nil)
+			case cFindRQ:
+				err = s.find(a, c)
+			case cGetRQ:
+				err = s.get(a, c)
+			case cMoveRQ:
+				err = s.move(a, c)
+			case cCancelRQ:
+				// Queries are answered before a cancel can
+				// be read, so there's nothing left to cancel.
+			case cStoreRQ:
+				if err = a.ReadData(c, io.Discard); err == nil {
+					err = a.Send(c.response(statusNotAuthorized), nil)
+				}
+			default:
+				err = fmt.Errorf("%s sent an unsupported command %#04x", a.Calling, c.Field())
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			a.Abort()
+			return
+		}
+	}
+}
+
+// MoveDestinations maps the AE titles that instances can be moved to to
+// their addresses. It's set with AE=host:port flags.
+type MoveDestinations map[string]string
+
+func (m MoveDestinations) String() string {
+	var dests []string
+	for ae, addr := range m {
+		dests = append(dests, ae+"="+addr)
+	}
+	sort.Strings(dests)
+	return strings.Join(dests, ",")
+}
+
+func (m MoveDestinations) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return errors.New("must be AE=host:port")
+	}
+	if _, _, err := net.SplitHostPort(v[i+1:]); err != nil {
+		return err
+	}
+	m[v[:i]] = v[i+1:]
+	return nil
+}
+
+// DICOMServerOptions configure ServeDICOM.
+type DICOMServerOptions struct {
+	// The organized tree to serve, and optionally a manifest to find
+	// its instances with instead of reading every file in it.
+	Dir      string
+	Manifest string
+
+	// The AE title that viewers have to call.
+	AE string
+
+	// The calling AE titles that associations are accepted from. If
+	// AllowAnyAE is set instead, anything which can connect can retrieve
+	// every instance.
+	AllowAE    []string
+	AllowAnyAE bool
+
+	// The AEs that instances can be moved to.
+	MoveDestinations MoveDestinations
+
+	// The TLS configuration. Its API tokens aren't used.
+	Auth ServerAuth
+}
+
+// ServeDICOM serves the instances in an organized tree on addr to viewers
+// with C-FIND, C-GET and C-MOVE. It only returns if the server fails.
+func ServeDICOM(addr string, opts DICOMServerOptions) error {
+	switch {
+	case len(opts.AllowAE) == 0 && !opts.AllowAnyAE:
+		return errors.New("serve-dicom requires -allow-ae, or -allow-any-ae to let any AE that can connect retrieve every instance")
+	case len(opts.AllowAE) > 0 && opts.AllowAnyAE:
+		return errors.New("-allow-ae and -allow-any-ae can't be used together")
+	}
+	if err := opts.Auth.Load(); err != nil {
+		return err
+	}
+
+	s := &dicomServer{ae: opts.AE, dests: opts.MoveDestinations, index: &instanceIndex{dir: opts.Dir, manifest: opts.Manifest}}
+	if len(opts.AllowAE) > 0 {
+		s.allowed = make(map[string]bool)
+		for _, calling := range opts.AllowAE {
+			s.allowed[strings.TrimSpace(calling)] = true
+		}
+	}
+	if err := s.index.Load(); err != nil {
+		return err
+	}
+	l, err := opts.Auth.Listen(addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
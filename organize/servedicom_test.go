@@ -0,0 +1,339 @@
+package organize
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		vr, key, value string
+		want           bool
+	}{
+		{"LO", "", "anything", true},
+		{"LO", "*", "", true},
+		{"LO", "ABC", "ABC", true},
+		{"LO", "ABC", "abc", false},
+		{"PN", "doe^jane", "DOE^JANE", true},
+		{"PN", "DOE*", "doe^jane", true},
+		{"LO", "A?C", "ABC", true},
+		{"LO", "A?C", "ABBC", false},
+		{"LO", "A.C", "ABC", false},
+		{"UI", `1.2\1.3`, "1.3", true},
+		{"UI", "1.*", "1.3", false},
+		{"CS", "MR", `CT\MR`, true},
+		{"CS", `PT\MR`, `CT\MR`, true},
+		{"DA", "20240101-20240131", "20240115", true},
+		{"DA", "20240101-20240131", "20240201", false},
+		{"DA", "-20240131", "20231231", true},
+		{"DA", "20240101-", "20231231", false},
+		{"DA", "20240101-", "", false},
+		{"TM", "1000-1200", "115959.123", true},
+		{"TM", "1000-1200", "120001", true},
+		{"TM", "1000-1159", "120001", false},
+	}
+	for _, tt := range tests {
+		if got := matchKey(tt.vr, tt.key, tt.value); got != tt.want {
+			t.Errorf("matchKey(%s, %q, %q) = %v, want %v", tt.vr, tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+// serveTree serves the files in dir with serve-dicom, moving instances to
+// the AE PULL at moveAddr, and returns its address.
+func serveTree(t *testing.T, dir, moveAddr string) string {
+	s := &dicomServer{ae: "DICOMFMT", dests: MoveDestinations{"PULL": moveAddr}, index: &instanceIndex{dir: dir}}
+	if err := s.index.Load(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func countFiles(t *testing.T, dir string) int {
+	n := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestServeDICOMPull(t *testing.T) {
+	retries = retryPolicy{}
+	tree := t.TempDir()
+	synthTree(t, tree, 2, 1, 2, 2)
+	storeAddr := freeAddr(t)
+	addr := serveTree(t, tree, storeAddr)
+	for _, mode := range []string{"get", "move"} {
+		t.Run(mode, func(t *testing.T) {
+			dst := t.TempDir()
+			p := &pacs{
+				Addr:      addr,
+				Called:    "DICOMFMT",
+				Calling:   "PULL",
+				Get:       mode == "get",
+				StoreAddr: storeAddr,
+				staging:   filepath.Join(dst, ".pull-incoming"),
+			}
+			o := &Organizer{Dst: dst, Layout: "{PatientName}/{SeriesDescription}", Move: true}
+			if err := p.Pull(context.Background(), o, studyQuery{PatientID: "SYNTH2"}); err != nil {
+				t.Fatal(err)
+			}
+			if n := countFiles(t, filepath.Join(dst, "SYNTH^PATIENT2")); n != 4 {
+				t.Errorf("pulled %d instances of SYNTH2, want 4", n)
+			}
+			if n := countFiles(t, dst); n != 4 {
+				t.Errorf("pulled %d instances, want only the 4 of SYNTH2", n)
+			}
+		})
+	}
+}
+
+func TestServeDICOMFind(t *testing.T) {
+	tree := t.TempDir()
+	paths := synthTree(t, tree, 1, 1, 2, 3)
+	tags, err := readTags(FileName(paths[0]), "StudyInstanceUID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTree(t, tree, "")
+	a, err := dialAssociation(context.Background(), addr, "VIEWER", "DICOMFMT", []presentationContext{
+		{ID: 1, AbstractSyntax: studyRootFindUID, TransferSyntaxes: []string{implicitVRLittleEndian}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Release()
+
+	find := func(keys map[string]string, level string) (matches []*dataset, status uint16) {
+		pc, _ := a.ContextFor(studyRootFindUID)
+		rq := a.NewRequest(cFindRQ, pc)
+		rq.setUS(cmdPriority, 0)
+		id := &dataset{}
+		for name, v := range keys {
+			attr, ok := qrAttributeFor(tagDictionary[name])
+			if !ok {
+				attr.Tag, attr.VR = tagDictionary[name], "LO"
+			}
+			value, _ := id.encodeValue(attr.VR, v)
+			id.setElement(element{Tag: attr.Tag, VR: attr.VR, Value: value})
+		}
+		id.setElement(element{Tag: queryRetrieveLevelTag, VR: "CS", Value: padValue(level)})
+		if err := a.Send(rq, a.Identifier(rq, id)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			rsp, err := a.ReadCommand()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp.Status() != statusPending {
+				return matches, rsp.Status()
+			}
+			match, err := a.ReadIdentifier(rsp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			matches = append(matches, match)
+		}
+	}
+
+	matches, status := find(map[string]string{
+		"StudyInstanceUID":  tags["StudyInstanceUID"],
+		"SeriesDescription": "*2",
+		"SeriesInstanceUID": "",
+	}, "SERIES")
+	if status != statusSuccess || len(matches) != 1 {
+		t.Fatalf("series query found %d matches with status %#04x, want 1", len(matches), status)
+	}
+	if got := matches[0].stringValue(tagDictionary["SeriesDescription"]); got != "Series 2" {
+		t.Errorf("matched series %q, want Series 2", got)
+	}
+
+	matches, _ = find(map[string]string{"StudyInstanceUID": "", "NumberOfStudyRelatedInstances": "", "Manufacturer": ""}, "STUDY")
+	if len(matches) != 1 {
+		t.Fatalf("study query found %d matches, want 1", len(matches))
+	}
+	if got := matches[0].stringValue(tagDictionary["NumberOfStudyRelatedInstances"]); got != "6" {
+		t.Errorf("NumberOfStudyRelatedInstances = %q, want 6", got)
+	}
+	if _, ok := matches[0].element(tagDictionary["Manufacturer"]); !ok {
+		t.Error("unknown key Manufacturer wasn't returned")
+	}
+
+	if _, status := find(nil, "PATIENT"); status != statusIdentifierError {
+		t.Errorf("PATIENT level query in the study root answered with %#04x, want %#04x", status, statusIdentifierError)
+	}
+}
+
+func TestServeDICOMConverts(t *testing.T) {
+	tree := t.TempDir()
+	paths := synthTree(t, tree, 1, 1, 1, 1)
+	tags, err := readTags(FileName(paths[0]), "SOPInstanceUID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTree(t, tree, "")
+	// The only storage context is implicit VR little endian, so the
+	// explicit VR file has to be converted.
+	a, err := dialAssociation(context.Background(), addr, "VIEWER", "DICOMFMT", []presentationContext{
+		{ID: 1, AbstractSyntax: studyRootGetUID, TransferSyntaxes: []string{explicitVRLittleEndian}},
+		{ID: 3, AbstractSyntax: synthSOPClassUID, TransferSyntaxes: []string{implicitVRLittleEndian}},
+	}, []string{synthSOPClassUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Release()
+
+	dir := t.TempDir()
+	store := &storeSCP{}
+	store.SetDir(dir)
+	id := &dataset{}
+	value, _ := id.encodeValue("UI", tags["SOPInstanceUID"])
+	id.setElement(element{Tag: tagDictionary["SOPInstanceUID"], VR: "UI", Value: value})
+	pc, _ := a.ContextFor(studyRootGetUID)
+	rq := a.NewRequest(cGetRQ, pc)
+	rq.setUS(cmdPriority, 0)
+	id.setElement(element{Tag: queryRetrieveLevelTag, VR: "CS", Value: padValue("IMAGE")})
+	if err := a.Send(rq, a.Identifier(rq, id)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		c, err := a.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Field() == cStoreRQ {
+			if err := store.Store(a, c); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if c.Status() == statusPending {
+			continue
+		}
+		if c.Status() != statusSuccess || c.us(cmdCompleted) != 1 {
+			t.Fatalf("C-GET finished with status %#04x after %d instances", c.Status(), c.us(cmdCompleted))
+		}
+		break
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, tags["SOPInstanceUID"]+".dcm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := readDataset(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.TransferSyntax != implicitVRLittleEndian {
+		t.Errorf("received in %s, want implicit VR little endian", ds.TransferSyntax)
+	}
+	if got := ds.stringValue(tagDictionary["PatientName"]); got != "SYNTH^PATIENT1" {
+		t.Errorf("PatientName = %q after converting", got)
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir.
+func writeCert(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dicomfmt test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestServeDICOMTLS(t *testing.T) {
+	tree := t.TempDir()
+	synthTree(t, tree, 1, 1, 1, 1)
+	s := &dicomServer{ae: "DICOMFMT", allowed: map[string]bool{"VIEWER": true}, index: &instanceIndex{dir: tree}}
+	if err := s.index.Load(); err != nil {
+		t.Fatal(err)
+	}
+	auth := &ServerAuth{}
+	auth.TLSCert, auth.TLSKey = writeCert(t, t.TempDir())
+	if err := auth.Load(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := auth.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+
+	contexts := []presentationContext{{ID: 1, AbstractSyntax: verificationUID, TransferSyntaxes: []string{implicitVRLittleEndian}}}
+	if a, err := dialAssociation(context.Background(), l.Addr().String(), "VIEWER", "DICOMFMT", contexts, nil); err == nil {
+		a.Abort()
+		t.Fatal("an association without TLS was accepted")
+	}
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := requestAssociation(conn, l.Addr().String(), "VIEWER", "DICOMFMT", contexts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Release()
+	pc, _ := a.ContextFor(verificationUID)
+	if err := a.Send(a.NewRequest(cEchoRQ, pc), nil); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := a.ReadCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Status() != statusSuccess {
+		t.Errorf("C-ECHO over TLS answered with %#04x", rsp.Status())
+	}
+}
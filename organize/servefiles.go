@@ -0,0 +1,252 @@
+package organize
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tags that the serve-files subcommand indexes each file by.
+var instanceIndexTags = []string{"StudyInstanceUID", "SeriesInstanceUID", "SOPInstanceUID"}
+
+// How long the index is trusted for before an instance that isn't in it
+// causes it to be loaded again.
+const instanceIndexTTL = time.Minute
+
+// An indexedInstance is where an instance was found in an organized tree.
+type indexedInstance struct {
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	Path              string
+}
+
+// An instanceIndex finds the file of each instance in an organized tree by
+// its SOPInstanceUID, either from a manifest or by reading every file.
+type instanceIndex struct {
+	dir      string
+	manifest string
+
+	mu        sync.Mutex
+	instances map[string]indexedInstance
+	loaded    time.Time
+}
+
+// Load replaces the index with the instances currently in the tree.
+func (idx *instanceIndex) Load() error {
+	instances := make(map[string]indexedInstance)
+	var err error
+	if idx.manifest != "" {
+		err = scanManifest(idx.manifest, func(entry manifestEntry) {
+			if entry.SOPInstanceUID == "" {
+				return
+			}
+			// Later entries are more recent, so they replace
+			// earlier ones.
+			instances[entry.SOPInstanceUID] = indexedInstance{entry.StudyInstanceUID, entry.SeriesInstanceUID, entry.Dst}
+		})
+	} else {
+		err = filepath.Walk(idx.dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			if info.IsDir() {
+				if path != idx.dir && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() || (!isCompressed(path) && isTextFile(FileName(path))) {
+				return nil
+			}
+			tags, err := readTags(FileName(path), instanceIndexTags...)
+			if err != nil {
+				if verbose {
+					log.Println(err)
+				}
+				return nil
+			}
+			sop := strings.TrimSpace(tags["SOPInstanceUID"])
+			if sop == "" {
+				return nil
+			}
+			instances[sop] = indexedInstance{strings.TrimSpace(tags["StudyInstanceUID"]), strings.TrimSpace(tags["SeriesInstanceUID"]), path}
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.instances = instances
+	idx.loaded = time.Now()
+	if verbose {
+		log.Printf("Indexed %s.\n", plural(len(instances), "instance", "instances"))
+	}
+	return nil
+}
+
+// Lookup returns the path of an instance. The study and series are only
+// checked if they're given. If the instance isn't in the index and the
+// index is older than instanceIndexTTL, it's loaded again first, so that
+// instances organized since it was loaded can be found.
+func (idx *instanceIndex) Lookup(study, series, sop string) (string, bool) {
+	idx.mu.Lock()
+	inst, ok := idx.instances[sop]
+	stale := time.Since(idx.loaded) > instanceIndexTTL
+	idx.mu.Unlock()
+	if !ok && stale {
+		if err := idx.Load(); err != nil {
+			log.Println(err)
+		}
+		idx.mu.Lock()
+		inst, ok = idx.instances[sop]
+		idx.mu.Unlock()
+	}
+	if !ok || (study != "" && study != inst.StudyInstanceUID) || (series != "" && series != inst.SeriesInstanceUID) {
+		return "", false
+	}
+	return inst.Path, true
+}
+
+// Refresh loads the index again if it's older than instanceIndexTTL.
+func (idx *instanceIndex) Refresh() {
+	idx.mu.Lock()
+	stale := time.Since(idx.loaded) > instanceIndexTTL
+	idx.mu.Unlock()
+	if stale {
+		if err := idx.Load(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Instances returns every instance in the index by its SOPInstanceUID.
+// The map is replaced rather than changed when the index is loaded
+// again, so it can be read without holding the lock.
+func (idx *instanceIndex) Instances() map[string]indexedInstance {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.instances
+}
+
+// A fileServer serves the instances in an organized tree by their UIDs,
+// so that web viewers can display them in place.
+//
+// It answers WADO-URI requests, such as
+// /wado?requestType=WADO&studyUID=...&seriesUID=...&objectUID=..., and
+// the same request as a path, /studies/{study}/series/{series}/instances/{sop}.
+// Only application/dicom is supported, so rendered images and other
+// content types aren't available.
+type fileServer struct {
+	index *instanceIndex
+}
+
+// allowCORS lets web viewers served from origin fetch from h. Preflight
+// requests are answered without passing them on, since they're sent
+// without a token.
+func allowCORS(origin string, h http.Handler) http.Handler {
+	if origin == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var study, series, sop string
+	switch parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); {
+	case r.URL.Path == "/wado":
+		q := r.URL.Query()
+		if q.Get("requestType") != "WADO" {
+			http.Error(w, "requestType must be WADO", http.StatusBadRequest)
+			return
+		}
+		if ct := q.Get("contentType"); ct != "" && ct != "application/dicom" {
+			http.Error(w, "only application/dicom is supported", http.StatusNotAcceptable)
+			return
+		}
+		study, series, sop = q.Get("studyUID"), q.Get("seriesUID"), q.Get("objectUID")
+		if study == "" || series == "" || sop == "" {
+			http.Error(w, "studyUID, seriesUID and objectUID are required", http.StatusBadRequest)
+			return
+		}
+	case len(parts) == 6 && parts[0] == "studies" && parts[2] == "series" && parts[4] == "instances":
+		study, series, sop = parts[1], parts[3], parts[5]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	path, ok := s.index.Lookup(study, series, sop)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dicom")
+	if !isCompressed(path) {
+		// Uncompressed files can be served with range requests.
+		f, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+	rc, err := openStored(path)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer rc.Close()
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("%s: %v\n", path, err)
+	}
+}
+
+// ServeFiles serves the instances in the organized tree dir over HTTP on
+// addr, finding them with manifest instead of reading every file in dir
+// if it's set. If allowOrigin is set, web viewers served from that origin
+// (or any, if it's *) can fetch instances. It only returns if the server
+// fails.
+func ServeFiles(addr, dir, manifest, allowOrigin string, auth *ServerAuth) error {
+	if err := auth.Load(); err != nil {
+		return err
+	}
+	idx := &instanceIndex{dir: dir, manifest: manifest}
+	if err := idx.Load(); err != nil {
+		return err
+	}
+	return auth.ListenAndServe(&http.Server{Addr: addr, Handler: allowCORS(allowOrigin, auth.Require(scopeRead, &fileServer{index: idx}))})
+}
@@ -0,0 +1,326 @@
+package organize
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A heldSeries is a series which has been organized into the staging area,
+// waiting for the rest of its study.
+type heldSeries struct {
+	Dir    string      `json:"dir"`
+	Series SeriesFiles `json:"series"`
+	Shard  string      `json:"shard,omitempty"`
+}
+
+// A heldStudy is a study which is being held in the staging area until
+// it's complete.
+type heldStudy struct {
+	// Where the study's files would have been organized, keyed by the
+	// directory in the staging area that they're placed in instead.
+	Roots map[string]string `json:"roots"`
+
+	Series   []heldSeries `json:"series"`
+	Files    int          `json:"files"`
+	Expected int          `json:"expected,omitempty"`
+	Last     time.Time    `json:"last"`
+}
+
+// A studyGate holds studies in a staging area until no new instances have
+// arrived for them for a while, or until they have as many instances as
+// their NumberOfStudyRelatedInstances, and then releases each study into
+// the target all at once. This is used in watch and receive mode, so that
+// anything watching the target never sees a partial study.
+type studyGate struct {
+	Dir    string
+	Settle time.Duration
+
+	mu      sync.Mutex
+	studies map[string]*heldStudy
+}
+
+// The state of each held study is saved in this file of its staging
+// directory, so that it can be released after a restart.
+const heldStudyFile = "study.json"
+
+// openStudyGate returns a gate which stages studies in dir, loading any
+// studies which were held by a previous run.
+func openStudyGate(dir string, settle time.Duration) (*studyGate, error) {
+	g := &studyGate{Dir: dir, Settle: settle, studies: make(map[string]*heldStudy)}
+	if err := perms.MkdirAll(LocalFS{}, dir); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name(), heldStudyFile))
+		if err != nil {
+			continue
+		}
+		var study heldStudy
+		if err := json.Unmarshal(data, &study); err != nil {
+			log.Printf("Could not load held study %s: %v\n", e.Name(), err)
+			continue
+		}
+		// Give anything that was still being sent time to arrive.
+		study.Last = time.Now()
+		g.studies[e.Name()] = &study
+	}
+	if len(g.studies) > 0 {
+		log.Printf("Holding %d studies from a previous run.\n", len(g.studies))
+	}
+	return g, nil
+}
+
+// studyKey returns the name of the staging directory for a study.
+func studyKey(s SeriesFiles) string {
+	uid := s.tagValue("StudyInstanceUID")
+	if uid == "" {
+		// Keep each series separate, rather than holding together
+		// everything without a study.
+		uid = "series " + s.tagValue("SeriesInstanceUID")
+	}
+	sum := sha1.Sum([]byte(uid))
+	return hex.EncodeToString(sum[:10])
+}
+
+func (g *studyGate) study(key string) *heldStudy {
+	study, ok := g.studies[key]
+	if !ok {
+		study = &heldStudy{Roots: make(map[string]string)}
+		g.studies[key] = study
+	}
+	return study
+}
+
+// Stage returns the directory in the staging area that a series, which
+// would otherwise be organized into root, is placed in.
+func (g *studyGate) Stage(s SeriesFiles, root string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := studyKey(s)
+	study := g.study(key)
+	for staged, r := range study.Roots {
+		if r == root {
+			return staged
+		}
+	}
+	staged := filepath.Join(g.Dir, key, strconv.Itoa(len(study.Roots)))
+	study.Roots[staged] = root
+	return staged
+}
+
+// Arrived records that the files of a series have been placed in dirs in
+// the staging area, and which shard of the series directory each of them
+// is if it's split.
+func (g *studyGate) Arrived(s SeriesFiles, dirs []string, shards map[string]string, files int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := studyKey(s)
+	study := g.study(key)
+	for _, dir := range dirs {
+		study.Series = append(study.Series, heldSeries{dir, s, shards[dir]})
+	}
+	study.Files += files
+	study.Last = time.Now()
+	if n, err := strconv.Atoi(s.tagValue("NumberOfStudyRelatedInstances")); err == nil && n > study.Expected {
+		study.Expected = n
+	}
+	data, err := json.Marshal(study)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(g.Dir, key, heldStudyFile), data, 0640)
+	}
+	if err != nil {
+		log.Printf("Could not save held study %s: %v\n", key, err)
+	}
+}
+
+// complete reports whether a study is ready to be released.
+func (g *studyGate) complete(study *heldStudy, now time.Time) bool {
+	if study.Expected > 0 && study.Files >= study.Expected {
+		return true
+	}
+	return now.Sub(study.Last) >= g.Settle
+}
+
+// Next returns how long until the next held study settles, or 0 if none
+// are held.
+func (g *studyGate) Next() time.Duration {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var next time.Duration
+	now := time.Now()
+	for _, study := range g.studies {
+		d := study.Last.Add(g.Settle).Sub(now)
+		if d <= 0 {
+			d = time.Millisecond
+		}
+		if next == 0 || d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+// Release moves every complete study from the staging area into the
+// target. It's safe to call on a nil gate.
+func (o *Organizer) Release() {
+	g := o.Gate
+	if g == nil {
+		return
+	}
+	if o.Pause != nil && o.Pause.Paused() {
+		return
+	}
+	g.mu.Lock()
+	var ready []string
+	now := time.Now()
+	for key, study := range g.studies {
+		if g.complete(study, now) {
+			ready = append(ready, key)
+		}
+	}
+	g.mu.Unlock()
+	sort.Strings(ready)
+
+	for _, key := range ready {
+		g.mu.Lock()
+		study := g.studies[key]
+		delete(g.studies, key)
+		g.mu.Unlock()
+		o.releaseStudy(key, study)
+	}
+}
+
+// finalDir returns where a directory in a study's staging area is released
+// to.
+func (study *heldStudy) finalDir(dir string) (string, bool) {
+	for staged, root := range study.Roots {
+		if strings.HasPrefix(dir, staged+string(filepath.Separator)) {
+			return filepath.Join(root, dir[len(staged)+1:]), true
+		}
+	}
+	return "", false
+}
+
+// releaseStudy moves the series of a study into their final directories.
+// Series whose directory doesn't exist yet are renamed into place in one
+// step, while those that are added to an existing directory are moved a
+// file at a time.
+func (o *Organizer) releaseStudy(key string, study *heldStudy) {
+	if verbose {
+		log.Printf("Releasing study with %d files from %s.\n", study.Files, filepath.Join(o.Gate.Dir, key))
+	}
+	released := make(map[string]bool)
+	for _, held := range study.Series {
+		if released[held.Dir] {
+			// More of the series arrived later.
+			continue
+		}
+		released[held.Dir] = true
+		final, ok := study.finalDir(held.Dir)
+		if !ok {
+			log.Printf("Could not release %s: not in the staging area\n", held.Dir)
+			continue
+		}
+		placed, err := o.releaseDir(held.Dir, final, held.Shard)
+		if err != nil {
+			log.Printf("Could not release %s: %v\n", held.Dir, err)
+			continue
+		}
+		if err := syncDirs(LocalFS{}, o.Dst, []string{final}); err != nil {
+			log.Printf("Could not flush %s to disk, not reporting it: %v\n", final, err)
+			continue
+		}
+		o.Output.Print(final, held.Series, len(placed))
+		o.Hooks.Complete(final, held.Series, len(placed))
+		o.FHIR.Add(placed)
+		o.Encrypt.Add(placed)
+		if err := o.Batches.Record(held.Series, placed); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := o.Journal.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := o.Manifest.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+	os.Remove(filepath.Join(o.Gate.Dir, key, heldStudyFile))
+	for staged := range study.Roots {
+		removeEmptyParents(staged, o.Gate.Dir)
+	}
+}
+
+// releaseDir moves the files in a staged series directory (or shard of
+// one) into dst, and returns their new paths.
+func (o *Organizer) releaseDir(dir, dst, shard string) ([]FileName, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var placed []FileName
+	for _, info := range infos {
+		if !info.IsDir() {
+			placed = append(placed, FileName(filepath.Join(dst, info.Name())))
+		}
+	}
+	if err := perms.MkdirAll(LocalFS{}, filepath.Dir(dst)); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(dir, dst); err == nil {
+		perms.set(LocalFS{}, dst, perms.DirMode)
+		o.recordRelease(dir, shard, placed)
+		return placed, nil
+	}
+	// The directory already exists, so merge the files into it.
+	if err := perms.MkdirAll(LocalFS{}, dst); err != nil {
+		return nil, err
+	}
+	placed = placed[:0]
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		src := filepath.Join(dir, info.Name())
+		file := FileName(filepath.Join(dst, info.Name()))
+		if err := os.Rename(src, file.String()); err != nil {
+			log.Println(err)
+			continue
+		}
+		placed = append(placed, file)
+	}
+	o.recordRelease(dir, shard, placed)
+	return placed, nil
+}
+
+// recordRelease records that the files which were staged in dir were
+// released, so that the journal and manifest point to their final
+// location.
+func (o *Organizer) recordRelease(dir, shard string, placed []FileName) {
+	for _, file := range placed {
+		staged := FileName(filepath.Join(dir, filepath.Base(file.String())))
+		if err := o.Journal.Placed(staged, file); err != nil {
+			log.Fatalln(err)
+		}
+		if err := o.Manifest.Record(LocalFS{}, staged, file, SeriesFiles{}, manifestEntry{Shard: shard}); err != nil {
+			log.Fatalln(err)
+		}
+		o.Audit.Record("release", file.String(), "from "+staged.String())
+	}
+}
@@ -0,0 +1,112 @@
+package organize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// shardName returns the name of the nth (counting from 0) numbered
+// subfolder that a series directory is split into.
+func shardName(n int) string {
+	return fmt.Sprintf("%04d", n+1)
+}
+
+// shardNumber returns which shard a directory named name is, or -1 if it
+// isn't one.
+func shardNumber(name string) int {
+	if len(name) != 4 {
+		return -1
+	}
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 1 {
+		return -1
+	}
+	return n - 1
+}
+
+// shardCounts returns the number of files in each shard that already
+// exists in dir.
+func shardCounts(dir string) []int {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var counts []int
+	for _, info := range infos {
+		n := shardNumber(info.Name())
+		if !info.IsDir() || n < 0 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, info.Name()))
+		if err != nil {
+			continue
+		}
+		for len(counts) <= n {
+			counts = append(counts, 0)
+		}
+		for _, f := range files {
+			if !f.IsDir() {
+				counts[n]++
+			}
+		}
+	}
+	return counts
+}
+
+// shard returns the numbered subfolder of dir that file should be placed
+// in, or "" if dir isn't split into shards. A directory is split once more
+// than ShardSize files are planned for it, and then stays split, with new
+// files added to its last shard until it's full. The instances of a
+// concatenation, which are the parts of one multi-frame object that was
+// too large for a single instance, are given by its ConcatenationUID, and
+// are always placed in the same shard, even if that fills it past
+// ShardSize.
+func (o *Organizer) shard(dir string, file FileName, concat string, planned int) (name string) {
+	if o.ShardSize <= 0 {
+		return ""
+	}
+	if o.shards == nil {
+		o.shards = make(map[string][]int)
+		o.concatShards = make(map[string]string)
+	}
+	counts, ok := o.shards[dir]
+	if !ok {
+		counts = shardCounts(dir)
+	}
+	if len(counts) == 0 && planned <= o.ShardSize {
+		o.shards[dir] = counts
+		return ""
+	}
+	if concat != "" {
+		key := dir + "\x00" + concat
+		defer func() {
+			if _, ok := o.concatShards[key]; !ok {
+				o.concatShards[key] = name
+			}
+		}()
+	}
+	// Files which are already in one of the directory's shards stay
+	// where they are.
+	if parent := filepath.Dir(file.String()); filepath.Dir(parent) == dir && shardNumber(filepath.Base(parent)) >= 0 {
+		o.shards[dir] = counts
+		return filepath.Base(parent)
+	}
+	if name, ok := o.concatShards[dir+"\x00"+concat]; ok && concat != "" {
+		if n := shardNumber(name); n >= 0 {
+			for len(counts) <= n {
+				counts = append(counts, 0)
+			}
+			counts[n]++
+		}
+		o.shards[dir] = counts
+		return name
+	}
+	if len(counts) == 0 || counts[len(counts)-1] >= o.ShardSize {
+		counts = append(counts, 0)
+	}
+	counts[len(counts)-1]++
+	o.shards[dir] = counts
+	return shardName(len(counts) - 1)
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package organize
+
+import "os/exec"
+
+// shellCommand returns a command which runs command with the shell used
+// for hook commands.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// shellVar returns a reference to the environment variable name that the
+// shell expands to a single word.
+func shellVar(name string) string {
+	return `"$` + name + `"`
+}
@@ -0,0 +1,24 @@
+package organize
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns a command which runs command with the shell used
+// for hook commands. The command line is given to cmd as it is, since cmd
+// doesn't follow the quoting rules that arguments are otherwise escaped
+// with. /S makes it strip the outer quotes and leave the rest alone.
+func shellCommand(command string) *exec.Cmd {
+	cmd := exec.Command("cmd")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd /S /C "` + command + `"`}
+	return cmd
+}
+
+// shellVar returns a reference to the environment variable name that the
+// shell expands to a single word. Variables are only expanded once, and
+// characters such as & are literal inside the quotes, so it's safe for
+// any value without a double quote, which paths can't have.
+func shellVar(name string) string {
+	return `"%` + name + `%"`
+}
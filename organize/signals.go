@@ -0,0 +1,9 @@
+package organize
+
+import "context"
+
+// canceled reports whether work for ctx should stop. Anything in progress
+// checks it between files, so that a file is never left half copied.
+func canceled(ctx context.Context) bool {
+	return ctx.Err() != nil
+}
@@ -0,0 +1,56 @@
+package organize
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SiteLabels are the sites that source directories came from, for
+// multi-center data. They're given with -site-label, either as LABEL for
+// every source directory or as LABEL=DIR for a single one, and are
+// available in layouts as {Site}.
+type SiteLabels map[string]string
+
+func (l SiteLabels) String() string {
+	var labels []string
+	for dir, label := range l {
+		if dir == "" {
+			labels = append(labels, label)
+		} else {
+			labels = append(labels, label+"="+dir)
+		}
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+func (l SiteLabels) Set(v string) error {
+	label, dir := v, ""
+	if i := strings.IndexByte(v, '='); i >= 0 {
+		label, dir = v[:i], filepath.Clean(nativePath(v[i+1:]))
+	}
+	if label == "" {
+		return fmt.Errorf("empty site label in %q", v)
+	}
+	l[dir] = label
+	return nil
+}
+
+// For returns the label for the source directory src.
+func (l SiteLabels) For(src string) string {
+	if label, ok := l[filepath.Clean(src)]; ok {
+		return label
+	}
+	return l[""]
+}
+
+// If set, the tag that {Site} comes from for series without a site label,
+// such as InstitutionName.
+var siteTag string
+
+// siteLayout returns layout with a level for the site added above it.
+func siteLayout(layout string) string {
+	return "{Site}/" + layout
+}
@@ -0,0 +1,143 @@
+package organize
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A retiredSOPClass is a SOP class which has been retired from the
+// standard, so that future viewers may stop being able to read it.
+type retiredSOPClass struct {
+	Name string
+	// Whether it's an image, which -convert-retired can store as a
+	// Secondary Capture Image instead.
+	Image bool
+}
+
+// retiredSOPClasses are the retired storage SOP classes, keyed by UID.
+var retiredSOPClasses = map[string]retiredSOPClass{
+	"1.2.840.10008.5.1.1.30":       {"Hardcopy Grayscale Image Storage", true},
+	"1.2.840.10008.5.1.1.31":       {"Hardcopy Color Image Storage", true},
+	"1.2.840.10008.5.1.4.1.1.3":    {"Ultrasound Multi-frame Image Storage (Retired)", true},
+	"1.2.840.10008.5.1.4.1.1.5":    {"Nuclear Medicine Image Storage (Retired)", true},
+	"1.2.840.10008.5.1.4.1.1.6":    {"Ultrasound Image Storage (Retired)", true},
+	"1.2.840.10008.5.1.4.1.1.8":    {"Standalone Overlay Storage", false},
+	"1.2.840.10008.5.1.4.1.1.9":    {"Standalone Curve Storage", false},
+	"1.2.840.10008.5.1.4.1.1.10":   {"Standalone Modality LUT Storage", false},
+	"1.2.840.10008.5.1.4.1.1.11":   {"Standalone VOI LUT Storage", false},
+	"1.2.840.10008.5.1.4.1.1.12.3": {"X-Ray Angiographic Bi-Plane Image Storage", true},
+	"1.2.840.10008.5.1.4.1.1.77.1": {"VL Image Storage - Trial", true},
+	"1.2.840.10008.5.1.4.1.1.77.2": {"VL Multi-frame Image Storage - Trial", true},
+	"1.2.840.10008.5.1.4.1.1.88.1": {"Text SR Storage - Trial", false},
+	"1.2.840.10008.5.1.4.1.1.88.2": {"Audio SR Storage - Trial", false},
+	"1.2.840.10008.5.1.4.1.1.88.3": {"Detail SR Storage - Trial", false},
+	"1.2.840.10008.5.1.4.1.1.88.4": {"Comprehensive SR Storage - Trial", false},
+	"1.2.840.10008.5.1.4.1.1.129":  {"Standalone PET Curve Storage", false},
+}
+
+// The SOP class that retired images are converted to, Secondary Capture
+// Image Storage.
+const secondaryCaptureUID = "1.2.840.10008.5.1.4.1.1.7"
+
+var conversionTypeTag = tag{0x0008, 0x0064}
+
+// sopClassOf returns the SOP class of file, which is part of series s.
+// It's the series' SOP class unless the file's own was read.
+func sopClassOf(s SeriesFiles, file FileName) string {
+	if uid := strings.TrimSpace(s.FileTags[file]["SOPClassUID"]); uid != "" {
+		return uid
+	}
+	return strings.TrimSpace(s.tagValue("SOPClassUID"))
+}
+
+// retiredSOPs counts the files of retired SOP classes that were organized,
+// so that the parts of the archive which may become unreadable are known.
+type retiredSOPs struct {
+	mu sync.Mutex
+	// The number of files and the directories they're in, for each
+	// SOP class.
+	files map[string]int
+	dirs  map[string]map[string]bool
+}
+
+func newRetiredSOPs() *retiredSOPs {
+	seriesTags = addTag(seriesTags, "SOPClassUID")
+	return &retiredSOPs{files: make(map[string]int), dirs: make(map[string]map[string]bool)}
+}
+
+// Add records file, which is part of series s, if it's of a retired SOP
+// class. dst is where it was placed. It's safe to call on nil retiredSOPs.
+func (r *retiredSOPs) Add(s SeriesFiles, file, dst FileName) {
+	if r == nil {
+		return
+	}
+	uid := sopClassOf(s, file)
+	if _, ok := retiredSOPClasses[uid]; !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[uid]++
+	if r.dirs[uid] == nil {
+		r.dirs[uid] = make(map[string]bool)
+	}
+	r.dirs[uid][filepath.Dir(dst.String())] = true
+}
+
+// Report logs how many files of each retired SOP class were organized, and
+// where they were put.
+func (r *retiredSOPs) Report() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.files) == 0 {
+		return
+	}
+	uids := make([]string, 0, len(r.files))
+	for uid := range r.files {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	log.Println("Files of retired SOP classes, which future viewers may not be able to read, were organized:")
+	for _, uid := range uids {
+		log.Printf("\t%s (%s): %s\n", uid, retiredSOPClasses[uid].Name, plural(r.files[uid], "file", "files"))
+		dirs := make([]string, 0, len(r.dirs[uid]))
+		for dir := range r.dirs[uid] {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			log.Println("\t\t" + dir)
+		}
+	}
+}
+
+// convertRetired is the rewrite for -convert-retired. It stores images of
+// retired SOP classes as Secondary Capture Images, which every viewer can
+// display, and leaves other files alone.
+func convertRetired(src FileName, ds *dataset) error {
+	c, ok := retiredSOPClasses[ds.stringValue(sopClassUIDTag)]
+	if !ok || !c.Image {
+		return nil
+	}
+	uid, err := ds.encodeValue("UI", secondaryCaptureUID)
+	if err != nil {
+		return err
+	}
+	ds.setElement(element{Tag: sopClassUIDTag, VR: "UI", Value: uid})
+	for i, el := range ds.Meta {
+		if el.Tag == (tag{0x0002, 0x0002}) {
+			ds.Meta[i].Value = uid
+		}
+	}
+	if _, ok := ds.element(conversionTypeTag); !ok {
+		// Workstation, since it was converted after the fact.
+		ds.setElement(element{Tag: conversionTypeTag, VR: "CS", Value: padValue("WSD")})
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package organize
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// An objectCount is the number of files of some kind, and their size.
+type objectCount struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// objectStats break the files that were organized down by modality, SOP
+// class and transfer syntax, for capacity planning and for noticing when
+// new kinds of objects start arriving, such as from a new scanner.
+type objectStats struct {
+	Modality       map[string]*objectCount `json:"modality"`
+	SOPClass       map[string]*objectCount `json:"sop_class"`
+	TransferSyntax map[string]*objectCount `json:"transfer_syntax"`
+
+	mu sync.Mutex
+}
+
+// The tags that objectStats need from every file.
+var statsTags = []string{"Modality", "SOPClassUID", "TransferSyntaxUID"}
+
+func newObjectStats() *objectStats {
+	return &objectStats{
+		Modality:       make(map[string]*objectCount),
+		SOPClass:       make(map[string]*objectCount),
+		TransferSyntax: make(map[string]*objectCount),
+	}
+}
+
+func countObject(counts map[string]*objectCount, key string, size int64) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		key = "(none)"
+	}
+	c, ok := counts[key]
+	if !ok {
+		c = &objectCount{}
+		counts[key] = c
+	}
+	c.Files++
+	c.Bytes += size
+}
+
+// Add counts a file of size bytes with the given tags. It's safe to call
+// on nil objectStats.
+func (s *objectStats) Add(tags map[string]string, size int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	countObject(s.Modality, tags["Modality"], size)
+	countObject(s.SOPClass, tags["SOPClassUID"], size)
+	countObject(s.TransferSyntax, tags["TransferSyntaxUID"], size)
+}
+
+// AddFile counts file, which is part of series s and was placed in the
+// target. It's safe to call on nil objectStats.
+func (s *objectStats) AddFile(series SeriesFiles, file FileName, size int64) {
+	if s == nil {
+		return
+	}
+	tags := series.FileTags[file]
+	modality := tags["Modality"]
+	if strings.TrimSpace(modality) == "" {
+		modality = series.Modality
+	}
+	s.Add(map[string]string{
+		"Modality":          modality,
+		"SOPClassUID":       tags["SOPClassUID"],
+		"TransferSyntaxUID": tags["TransferSyntaxUID"],
+	}, size)
+}
+
+// Print writes a table of the counts for each modality, SOP class and
+// transfer syntax to w, with the most common first.
+func (s *objectStats) Print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, section := range []struct {
+		Name   string
+		Counts map[string]*objectCount
+		Names  func(string) string
+	}{
+		{"MODALITY", s.Modality, nil},
+		{"SOP CLASS", s.SOPClass, sopClassName},
+		{"TRANSFER SYNTAX", s.TransferSyntax, transferSyntaxName},
+	} {
+		keys := make([]string, 0, len(section.Counts))
+		for k := range section.Counts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := section.Counts[keys[i]], section.Counts[keys[j]]
+			if a.Bytes != b.Bytes {
+				return a.Bytes > b.Bytes
+			}
+			return keys[i] < keys[j]
+		})
+		if i > 0 {
+			fmt.Fprintln(tw, "\t\t")
+		}
+		fmt.Fprintf(tw, "%s\tFILES\tBYTES\n", section.Name)
+		for _, k := range keys {
+			name := k
+			if section.Names != nil {
+				if n := section.Names(k); n != "" {
+					name += " (" + n + ")"
+				}
+			}
+			c := section.Counts[k]
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", name, c.Files, humanBytes(uint64(c.Bytes)))
+		}
+	}
+	tw.Flush()
+}
+
+// Report logs the counts at the end of a run, if anything was organized.
+func (s *objectStats) Report() {
+	if s == nil || len(s.Modality) == 0 {
+		return
+	}
+	var b strings.Builder
+	s.Print(&b)
+	log.Println("Organized files by modality, SOP class and transfer syntax:")
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		log.Println("\t" + strings.TrimRight(line, " "))
+	}
+}
+
+// sopClassName returns the name of a SOP class, if it's one that dicomfmt
+// knows the IOD of.
+func sopClassName(uid string) string {
+	return iods[uid].Name
+}
+
+// transferSyntaxName returns the name of a common transfer syntax.
+func transferSyntaxName(uid string) string {
+	switch uid {
+	case implicitVRLittleEndian:
+		return "Implicit VR Little Endian"
+	case explicitVRLittleEndian:
+		return "Explicit VR Little Endian"
+	case deflatedExplicitVRLittleEndian:
+		return "Deflated Explicit VR Little Endian"
+	case explicitVRBigEndian:
+		return "Explicit VR Big Endian"
+	case jpegBaseline:
+		return "JPEG Baseline"
+	case "1.2.840.10008.1.2.4.57", "1.2.840.10008.1.2.4.70":
+		return "JPEG Lossless"
+	case "1.2.840.10008.1.2.4.80", "1.2.840.10008.1.2.4.81":
+		return "JPEG-LS"
+	case "1.2.840.10008.1.2.4.90":
+		return "JPEG 2000 Lossless"
+	case "1.2.840.10008.1.2.4.91":
+		return "JPEG 2000"
+	case "1.2.840.10008.1.2.5":
+		return "RLE Lossless"
+	}
+	return ""
+}
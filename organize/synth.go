@@ -0,0 +1,159 @@
+package organize
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"path/filepath"
+	"strings"
+)
+
+// The SOP class of synthesized files, Secondary Capture Image Storage.
+const synthSOPClassUID = "1.2.840.10008.5.1.4.1.1.7"
+
+// NewUID returns a new UID under the 2.25 root, which is for UIDs derived
+// from random numbers. The numbers come from Options.IDs, if it's set.
+func NewUID() (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(idSource, b[:]); err != nil {
+		return "", err
+	}
+	return "2.25." + new(big.Int).SetBytes(b[:]).String(), nil
+}
+
+// A synthTag is an element to set in a synthesized file, given as
+// Keyword=value or (gggg,eeee) VR=value.
+type synthTag struct {
+	Name  string
+	Tag   tag
+	VR    string
+	Value string
+}
+
+func parseSynthTag(v string) (synthTag, error) {
+	i := strings.IndexByte(v, '=')
+	if i < 0 {
+		return synthTag{}, fmt.Errorf("%q isn't of the form Keyword=value", v)
+	}
+	name, tg, vr, err := parseTagKey(v[:i])
+	if err != nil {
+		return synthTag{}, err
+	}
+	if vr == "" {
+		return synthTag{}, fmt.Errorf("the VR of %s has to be given", name)
+	}
+	return synthTag{name, tg, vr, v[i+1:]}, nil
+}
+
+// newSynthDataset returns the dataset that Synthesize encodes.
+func newSynthDataset(tags ...string) (*dataset, error) {
+	ds := &dataset{TransferSyntax: explicitVRLittleEndian}
+	var elements []synthTag
+	for _, name := range []string{"SOPInstanceUID", "StudyInstanceUID", "SeriesInstanceUID"} {
+		uid, err := NewUID()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, synthTag{name, tagDictionary[name], "UI", uid})
+	}
+	elements = append(elements,
+		synthTag{"SOPClassUID", tagDictionary["SOPClassUID"], "UI", synthSOPClassUID},
+		synthTag{"InstanceCreationDate", tagDictionary["InstanceCreationDate"], "DA", "20200102"},
+		synthTag{"InstanceCreationTime", tagDictionary["InstanceCreationTime"], "TM", "030405"},
+	)
+	for _, v := range tags {
+		e, err := parseSynthTag(v)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+	}
+	for _, e := range elements {
+		if e.Tag.Group == 0x0002 {
+			return nil, fmt.Errorf("%s is in the file meta information, which can't be set", e.Name)
+		}
+		value, err := ds.encodeValue(e.VR, e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("setting %s: %v", e.Name, err)
+		}
+		ds.setElement(element{Tag: e.Tag, VR: e.VR, Value: value})
+	}
+	ds.setFileMeta()
+	return ds, nil
+}
+
+// Synthesize returns a minimal valid DICOM file, encoded as explicit VR
+// little endian, with the elements in tags set, for testing code which
+// reads DICOM files without checking binary files in. Each tag is given
+// as Keyword=value, or as (gggg,eeee) VR=value for elements which aren't
+// in the dictionary. Any of SOPClassUID, SOPInstanceUID,
+// StudyInstanceUID, SeriesInstanceUID and the instance creation date and
+// time that aren't given are generated, so that the file can be
+// organized.
+func Synthesize(tags ...string) ([]byte, error) {
+	ds, err := newSynthDataset(tags...)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := ds.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SynthesizeTree returns the files of a tree with the given number of
+// patients, studies for each patient, series for each study and
+// instances for each series, keyed by their path relative to the root of
+// the tree. Each file is synthesized with the tags that identify its
+// patient, study, series and instance, followed by tags. %[1]d, %[2]d,
+// %[3]d and %[4]d in the values of tags are replaced with the number of
+// the file's patient, study, series and instance.
+func SynthesizeTree(patients, studies, series, instances int, tags ...string) (map[string][]byte, error) {
+	if patients < 0 || studies < 0 || series < 0 || instances < 0 {
+		return nil, errors.New("the number of patients, studies, series and instances can't be negative")
+	}
+	files := make(map[string][]byte)
+	for p := 1; p <= patients; p++ {
+		for st := 1; st <= studies; st++ {
+			studyUID, err := NewUID()
+			if err != nil {
+				return nil, err
+			}
+			for se := 1; se <= series; se++ {
+				seriesUID, err := NewUID()
+				if err != nil {
+					return nil, err
+				}
+				for i := 1; i <= instances; i++ {
+					file := []string{
+						"StudyInstanceUID=" + studyUID,
+						"SeriesInstanceUID=" + seriesUID,
+						fmt.Sprintf("PatientName=SYNTH^PATIENT%d", p),
+						fmt.Sprintf("PatientID=SYNTH%d", p),
+						fmt.Sprintf("StudyDescription=Study %d", st),
+						fmt.Sprintf("SeriesDescription=Series %d", se),
+						"Modality=OT",
+						fmt.Sprintf("SeriesNumber=%d", se),
+						fmt.Sprintf("InstanceNumber=%d", i),
+					}
+					for _, v := range tags {
+						if strings.Contains(v, "%") {
+							v = fmt.Sprintf(v, p, st, se, i)
+						}
+						file = append(file, v)
+					}
+					data, err := Synthesize(file...)
+					if err != nil {
+						return nil, err
+					}
+					path := filepath.Join(fmt.Sprintf("P%03d", p), fmt.Sprintf("ST%03d", st), fmt.Sprintf("SE%03d", se), fmt.Sprintf("IM%04d.dcm", i))
+					files[path] = data
+				}
+			}
+		}
+	}
+	return files, nil
+}
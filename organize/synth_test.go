@@ -0,0 +1,109 @@
+package organize
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newUID returns NewUID(), failing t if it can't.
+func newUID(t testing.TB) string {
+	uid, err := NewUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uid
+}
+
+// synthDataset returns a minimal valid DICOM dataset with the elements in
+// tags set, as Synthesize encodes it.
+func synthDataset(t testing.TB, tags ...string) *dataset {
+	ds, err := newSynthDataset(tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+// synthBytes returns Synthesize(tags...).
+func synthBytes(t testing.TB, tags ...string) []byte {
+	data, err := Synthesize(tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// synthFile writes Synthesize(tags...) to path, creating its directory.
+func synthFile(t testing.TB, path string, tags ...string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, synthBytes(t, tags...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// synthTree writes the tree returned by SynthesizeTree to dir, and
+// returns the paths written, sorted.
+func synthTree(t testing.TB, dir string, patients, studies, series, instances int, tags ...string) []string {
+	files, err := SynthesizeTree(patients, studies, series, instances, tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestSynthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.dcm")
+	synthFile(t, path, "PatientName=DOE^JANE", "Modality=CT", "SeriesNumber=7")
+	tags, err := readTags(FileName(path), "PatientName", "Modality", "SeriesNumber", "SOPClassUID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"PatientName":  "DOE^JANE",
+		"Modality":     "CT",
+		"SeriesNumber": "7",
+		"SOPClassUID":  synthSOPClassUID,
+	} {
+		if got := strings.TrimSpace(tags[name]); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSynthTree(t *testing.T) {
+	dir := t.TempDir()
+	paths := synthTree(t, dir, 2, 1, 3, 2, "SeriesDescription=AX %[3]d")
+	if len(paths) != 12 {
+		t.Fatalf("wrote %d files, want 12", len(paths))
+	}
+	tags, err := readTags(FileName(paths[len(paths)-1]), "PatientID", "SeriesDescription", "InstanceNumber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(tags["PatientID"]); got != "SYNTH2" {
+		t.Errorf("PatientID = %q, want SYNTH2", got)
+	}
+	if got := strings.TrimSpace(tags["SeriesDescription"]); got != "AX 3" {
+		t.Errorf("SeriesDescription = %q, want AX 3", got)
+	}
+	if got := strings.TrimSpace(tags["InstanceNumber"]); got != "2" {
+		t.Errorf("InstanceNumber = %q, want 2", got)
+	}
+}
@@ -0,0 +1,184 @@
+package organize
+
+import (
+	"bytes"
+	"sort"
+)
+
+// tagDictionary maps the keywords of elements commonly used in layouts,
+// routes and filters to their tags. It's only used to know how far into a
+// file the parser needs to read, so it doesn't need to be complete: if a
+// keyword isn't in it, the whole file is parsed.
+var tagDictionary = map[string]tag{
+	"TransferSyntaxUID":             {0x0002, 0x0010},
+	"ImageType":                     {0x0008, 0x0008},
+	"InstanceCreationDate":          {0x0008, 0x0012},
+	"InstanceCreationTime":          {0x0008, 0x0013},
+	"SOPClassUID":                   {0x0008, 0x0016},
+	"SOPInstanceUID":                {0x0008, 0x0018},
+	"StudyDate":                     {0x0008, 0x0020},
+	"SeriesDate":                    {0x0008, 0x0021},
+	"AcquisitionDate":               {0x0008, 0x0022},
+	"ContentDate":                   {0x0008, 0x0023},
+	"StudyTime":                     {0x0008, 0x0030},
+	"SeriesTime":                    {0x0008, 0x0031},
+	"AccessionNumber":               {0x0008, 0x0050},
+	"Modality":                      {0x0008, 0x0060},
+	"Manufacturer":                  {0x0008, 0x0070},
+	"InstitutionName":               {0x0008, 0x0080},
+	"ReferringPhysicianName":        {0x0008, 0x0090},
+	"StationName":                   {0x0008, 0x1010},
+	"StudyDescription":              {0x0008, 0x1030},
+	"SeriesDescription":             {0x0008, 0x103E},
+	"InstitutionalDepartmentName":   {0x0008, 0x1040},
+	"ManufacturerModelName":         {0x0008, 0x1090},
+	"PatientName":                   {0x0010, 0x0010},
+	"PatientID":                     {0x0010, 0x0020},
+	"PatientBirthDate":              {0x0010, 0x0030},
+	"PatientSex":                    {0x0010, 0x0040},
+	"ClinicalTrialSponsorName":      {0x0012, 0x0010},
+	"ClinicalTrialProtocolID":       {0x0012, 0x0020},
+	"ClinicalTrialSiteID":           {0x0012, 0x0030},
+	"ClinicalTrialSubjectID":        {0x0012, 0x0040},
+	"BodyPartExamined":              {0x0018, 0x0015},
+	"SliceThickness":                {0x0018, 0x0050},
+	"KVP":                           {0x0018, 0x0060},
+	"RepetitionTime":                {0x0018, 0x0080},
+	"EchoTime":                      {0x0018, 0x0081},
+	"ProtocolName":                  {0x0018, 0x1030},
+	"ViewPosition":                  {0x0018, 0x5101},
+	"StudyInstanceUID":              {0x0020, 0x000D},
+	"SeriesInstanceUID":             {0x0020, 0x000E},
+	"StudyID":                       {0x0020, 0x0010},
+	"SeriesNumber":                  {0x0020, 0x0011},
+	"AcquisitionNumber":             {0x0020, 0x0012},
+	"InstanceNumber":                {0x0020, 0x0013},
+	"FrameOfReferenceUID":           {0x0020, 0x0052},
+	"ImageLaterality":               {0x0020, 0x0062},
+	"NumberOfStudyRelatedInstances": {0x0020, 0x1208},
+	"ConcatenationUID":              {0x0020, 0x9161},
+	"Rows":                          {0x0028, 0x0010},
+	"Columns":                       {0x0028, 0x0011},
+	"BurnedInAnnotation":            {0x0028, 0x0301},
+	"RecognizableVisualFeatures":    {0x0028, 0x0302},
+}
+
+// pseudoTags are names that can be used like tags in layouts, but which
+// don't come from the file.
+var pseudoTags = map[string]bool{
+	"Site": true,
+}
+
+// organizeTags are the tags that are always needed to organize a file.
+var organizeTags = []string{
+	"SeriesInstanceUID", "PatientName", "SeriesDescription",
+	"InstanceCreationDate", "InstanceCreationTime", "Modality",
+	"BurnedInAnnotation", "SOPClassUID",
+}
+
+// If set, files are always parsed completely, even if every tag that's
+// needed has been read.
+var fullParse bool
+
+// RequiredTags returns the keyword of every element which is read from
+// files while organizing them with the current options, along with any
+// extra ones.
+func RequiredTags(extra ...string) []string {
+	var names []string
+	for _, list := range [][]string{organizeTags, seriesTags, fileTags, extra} {
+		for _, name := range list {
+			if !pseudoTags[name] {
+				names = addTag(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lastTag returns the highest tag of the named elements, or false if any
+// of them aren't in the dictionary.
+func lastTag(names []string) (tag, bool) {
+	var last tag
+	for _, name := range names {
+		if pseudoTags[name] {
+			continue
+		}
+		t, ok := tagDictionary[name]
+		if !ok {
+			return tag{}, false
+		}
+		if t.Group > last.Group || (t.Group == last.Group && t.Element > last.Element) {
+			last = t
+		}
+	}
+	return last, true
+}
+
+// headerEnd returns the length of the start of data which contains every
+// top level element up to and including last. Since elements are stored in
+// order, anything after that, such as the pixel data, doesn't need to be
+// parsed. If the elements can't be split without decoding them, the
+// length of data is returned.
+func headerEnd(data []byte, last tag) int {
+	off := 0
+	if len(data) >= 132 && string(data[128:132]) == "DICM" {
+		off = 132
+	}
+	r := &elementReader{data: data, off: off, enc: metaEncoding}
+	transferSyntax := ""
+	for r.more() {
+		t, err := r.peekTag()
+		if err != nil {
+			return len(data)
+		}
+		if t.Group != 0x0002 {
+			break
+		}
+		el, err := r.next()
+		if err != nil {
+			return len(data)
+		}
+		if el.Tag == transferSyntaxTag {
+			transferSyntax = string(bytes.TrimRight(el.Value, " \x00"))
+		}
+	}
+	if transferSyntax == deflatedExplicitVRLittleEndian {
+		return len(data)
+	}
+	r.enc = encodingFor(transferSyntax)
+	start := r.off
+	for r.more() {
+		t, err := r.peekTag()
+		if err != nil {
+			return len(data)
+		}
+		if t.Group > last.Group || (t.Group == last.Group && t.Element > last.Element) {
+			if r.off == start {
+				// Nothing was read, so this probably isn't a
+				// dataset that the reader understands.
+				return len(data)
+			}
+			return r.off
+		}
+		if _, err := r.next(); err != nil {
+			return len(data)
+		}
+	}
+	return len(data)
+}
+
+// parseHeader parses the elements of data which are needed to look up the
+// named elements, stopping once they've all been read.
+func parseHeader(parser HeaderParser, data []byte, names []string) (Header, error) {
+	data = withFileMeta(data)
+	if !fullParse {
+		if last, ok := lastTag(names); ok {
+			data = data[:headerEnd(data, last)]
+		}
+	}
+	if ts := fileTransferSyntax(data); retiredTransferSyntaxes[ts] {
+		return parseRetired(parser, data, ts)
+	}
+	return parser.Parse(data)
+}
@@ -0,0 +1,337 @@
+package organize
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The value representations of the keywords in tagDictionary, for setting
+// elements which aren't in a file yet.
+var tagVRs = map[string]string{
+	"ImageType":                     "CS",
+	"InstanceCreationDate":          "DA",
+	"InstanceCreationTime":          "TM",
+	"SOPClassUID":                   "UI",
+	"SOPInstanceUID":                "UI",
+	"StudyDate":                     "DA",
+	"SeriesDate":                    "DA",
+	"AcquisitionDate":               "DA",
+	"ContentDate":                   "DA",
+	"StudyTime":                     "TM",
+	"SeriesTime":                    "TM",
+	"AccessionNumber":               "SH",
+	"Modality":                      "CS",
+	"Manufacturer":                  "LO",
+	"InstitutionName":               "LO",
+	"ReferringPhysicianName":        "PN",
+	"StationName":                   "SH",
+	"StudyDescription":              "LO",
+	"SeriesDescription":             "LO",
+	"InstitutionalDepartmentName":   "LO",
+	"ManufacturerModelName":         "LO",
+	"PatientName":                   "PN",
+	"PatientID":                     "LO",
+	"PatientBirthDate":              "DA",
+	"PatientSex":                    "CS",
+	"ClinicalTrialSponsorName":      "LO",
+	"ClinicalTrialProtocolID":       "LO",
+	"ClinicalTrialSiteID":           "LO",
+	"ClinicalTrialSubjectID":        "LO",
+	"BodyPartExamined":              "CS",
+	"SliceThickness":                "DS",
+	"KVP":                           "DS",
+	"RepetitionTime":                "DS",
+	"EchoTime":                      "DS",
+	"ProtocolName":                  "LO",
+	"ViewPosition":                  "CS",
+	"StudyInstanceUID":              "UI",
+	"SeriesInstanceUID":             "UI",
+	"StudyID":                       "SH",
+	"SeriesNumber":                  "IS",
+	"AcquisitionNumber":             "IS",
+	"InstanceNumber":                "IS",
+	"FrameOfReferenceUID":           "UI",
+	"ImageLaterality":               "CS",
+	"NumberOfStudyRelatedInstances": "IS",
+	"BurnedInAnnotation":            "CS",
+	"RecognizableVisualFeatures":    "CS",
+}
+
+// The maximum length of a single value of each string VR that rules can
+// set.
+var maxValueLen = map[string]int{
+	"AE": 16, "AS": 4, "CS": 16, "DA": 8, "DS": 16, "DT": 26, "IS": 12,
+	"LO": 64, "LT": 10240, "PN": 64, "SH": 16, "ST": 1024, "TM": 14,
+	"UC": 0, "UI": 64, "UR": 0, "UT": 0,
+}
+
+var (
+	specificCharacterSetTag = tag{0x0008, 0x0005}
+	sopClassUIDTag          = tag{0x0008, 0x0016}
+	sopInstanceUIDTag       = tag{0x0008, 0x0018}
+	mediaStorageSOPTag      = tag{0x0002, 0x0003}
+)
+
+// A tagChange records the value of an element that was changed by a tag
+// rule.
+type tagChange struct {
+	Tag string `json:"tag"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+}
+
+// A tagCondition is a predicate on the value of an element in the file
+// being rewritten.
+type tagCondition struct {
+	predicate
+	tag tag
+}
+
+// A tagRule sets an element to Value in every file matching all of its
+// conditions.
+type tagRule struct {
+	Name  string
+	Tag   tag
+	VR    string
+	Value string
+	When  []tagCondition
+}
+
+// tagRules are read from a rules file with one rule per line:
+//
+//	# Set for every file.
+//	ClinicalTrialSubjectID = "SUBJ-0042"
+//	InstitutionName = "General Hospital"
+//	# Only set when every condition matches.
+//	StationName = "CT01" if StationName=CT_O1 Modality=CT
+//	(0011,0010) LO = "ACME"
+//
+// Rules are applied in order while files are copied or moved, and the
+// elements that each file had changed are recorded in the manifest.
+type tagRules struct {
+	Rules []tagRule
+
+	mu      sync.Mutex
+	changes map[FileName][]tagChange
+}
+
+// parseTagKey parses the name of the element that a rule sets, either a
+// keyword or a tag such as (0011,0010) optionally followed by its VR.
+func parseTagKey(key string) (string, tag, string, error) {
+	key = strings.TrimSpace(key)
+	if !strings.HasPrefix(key, "(") {
+		t, ok := tagDictionary[key]
+		if !ok {
+			return "", tag{}, "", fmt.Errorf("unknown keyword %s", key)
+		}
+		return key, t, tagVRs[key], nil
+	}
+	end := strings.IndexByte(key, ')')
+	if end < 0 {
+		return "", tag{}, "", fmt.Errorf("invalid tag %s", key)
+	}
+	parts := strings.Split(key[1:end], ",")
+	if len(parts) != 2 {
+		return "", tag{}, "", fmt.Errorf("invalid tag %s", key)
+	}
+	group, err1 := strconv.ParseUint(strings.TrimSpace(parts[0]), 16, 16)
+	elem, err2 := strconv.ParseUint(strings.TrimSpace(parts[1]), 16, 16)
+	if err1 != nil || err2 != nil {
+		return "", tag{}, "", fmt.Errorf("invalid tag %s", key)
+	}
+	t := tag{uint16(group), uint16(elem)}
+	return t.String(), t, strings.ToUpper(strings.TrimSpace(key[end+1:])), nil
+}
+
+// loadTagRules reads a tag rules file.
+func loadTagRules(path string) (*tagRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := &tagRules{changes: make(map[FileName][]tagChange)}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected element = value", path, lineno)
+		}
+		var rule tagRule
+		if rule.Name, rule.Tag, rule.VR, err = parseTagKey(line[:eq]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		if rule.Tag.Group == 0x0002 {
+			return nil, fmt.Errorf("%s:%d: can't set file meta elements", path, lineno)
+		}
+		if _, ok := maxValueLen[rule.VR]; rule.VR != "" && !ok {
+			return nil, fmt.Errorf("%s:%d: can't set elements with VR %s", path, lineno, rule.VR)
+		}
+		value := strings.TrimSpace(line[eq+1:])
+		if value == "" {
+			return nil, fmt.Errorf("%s:%d: missing value", path, lineno)
+		}
+		rest := ""
+		if rule.Value, rest, err = splitValue(value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		rest = strings.TrimSpace(rest)
+		if rest != "" {
+			if !strings.HasPrefix(rest, "if ") {
+				return nil, fmt.Errorf("%s:%d: unexpected %q after value", path, lineno, rest)
+			}
+			for _, field := range strings.Fields(rest[3:]) {
+				p, err := parsePredicate(field)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+				}
+				t, ok := tagDictionary[p.Tag]
+				if !ok {
+					return nil, fmt.Errorf("%s:%d: unknown keyword %s", path, lineno, p.Tag)
+				}
+				rule.When = append(rule.When, tagCondition{p, t})
+			}
+		}
+		rules.Rules = append(rules.Rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// element returns the top level element with tag t, if there is one.
+func (ds *dataset) element(t tag) (element, bool) {
+	for _, el := range ds.Elements {
+		if el.Tag == t {
+			return el, true
+		}
+	}
+	return element{}, false
+}
+
+// stringValue returns the value of a top level string element, without
+// its padding.
+func (ds *dataset) stringValue(t tag) string {
+	el, _ := ds.element(t)
+	return string(bytes.TrimRight(el.Value, " \x00"))
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeValue encodes a string value for an element with the given VR,
+// making sure that it can be represented in the dataset.
+func (ds *dataset) encodeValue(vr, v string) ([]byte, error) {
+	if limit := maxValueLen[vr]; limit > 0 {
+		for _, part := range strings.Split(v, `\`) {
+			if vr == "PN" {
+				// The limit is for each component group.
+				for _, group := range strings.Split(part, "=") {
+					if len(group) > limit {
+						return nil, fmt.Errorf("%q is longer than the %d bytes allowed for PN", v, limit)
+					}
+				}
+			} else if len(part) > limit {
+				return nil, fmt.Errorf("%q is longer than the %d bytes allowed for %s", v, limit, vr)
+			}
+		}
+	}
+	if !isASCII(v) {
+		switch charset := ds.stringValue(specificCharacterSetTag); charset {
+		case "ISO_IR 192":
+		case "":
+			// Since the file only used the default repertoire,
+			// it can be declared UTF-8 without changing the
+			// meaning of anything else in it.
+			ds.setElement(element{Tag: specificCharacterSetTag, VR: "CS", Value: padValue("ISO_IR 192")})
+		default:
+			return nil, fmt.Errorf("%q can't be encoded in the file's character set %s", v, charset)
+		}
+	}
+	if vr == "UI" {
+		if len(v)%2 != 0 {
+			v += "\x00"
+		}
+		return []byte(v), nil
+	}
+	return padValue(v), nil
+}
+
+func (c tagCondition) Match(ds *dataset) bool {
+	matched, _ := path.Match(c.Pattern, strings.ToUpper(ds.stringValue(c.tag)))
+	return matched != c.Negate
+}
+
+// rewrite is a rewrite which applies every matching rule to a file.
+func (r *tagRules) rewrite(src FileName, ds *dataset) error {
+	var changes []tagChange
+rules:
+	for _, rule := range r.Rules {
+		for _, c := range rule.When {
+			if !c.Match(ds) {
+				continue rules
+			}
+		}
+		old, exists := ds.element(rule.Tag)
+		vr := rule.VR
+		if exists && old.VR != "" {
+			vr = old.VR
+		}
+		if vr == "" {
+			return fmt.Errorf("%s: VR of new element %s is unknown", src, rule.Name)
+		}
+		value, err := ds.encodeValue(vr, rule.Value)
+		if err != nil {
+			return fmt.Errorf("setting %s: %v", rule.Name, err)
+		}
+		oldValue := ds.stringValue(rule.Tag)
+		if exists && oldValue == rule.Value {
+			continue
+		}
+		ds.setElement(element{Tag: rule.Tag, VR: vr, Value: value})
+		if rule.Tag == sopInstanceUIDTag {
+			// The file meta information has to agree.
+			for i, el := range ds.Meta {
+				if el.Tag == mediaStorageSOPTag {
+					ds.Meta[i].Value = value
+				}
+			}
+		}
+		changes = append(changes, tagChange{Tag: rule.Name, Old: oldValue, New: rule.Value})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(changes) > 0 {
+		r.changes[src] = changes
+	} else {
+		delete(r.changes, src)
+	}
+	return nil
+}
+
+// Changes returns the elements that were changed when src was last
+// rewritten, and forgets them. It's safe to call on nil rules.
+func (r *tagRules) Changes(src FileName) []tagChange {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := r.changes[src]
+	delete(r.changes, src)
+	return changes
+}
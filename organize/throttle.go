@@ -0,0 +1,88 @@
+package organize
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A rateLimiter limits the rate at which data is written across all of the
+// writers that it wraps.
+type rateLimiter struct {
+	bytesPerSec float64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// bandwidth limits the rate that file data is written to the target. If
+// nil, it's not limited.
+var bandwidth *rateLimiter
+
+// wait blocks until n more bytes can be written.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSec * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *rateLimiter
+}
+
+func (lw limitedWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		lw.l.wait(len(chunk))
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// Writer wraps w so that writes to it are limited. It returns w unchanged
+// on a nil limiter.
+func (l *rateLimiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return limitedWriter{w, l}
+}
+
+// parseBytes parses a size such as 500K, 20M or 1.5G, using powers of 1024.
+func parseBytes(s string) (float64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := 1.0
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			for ; i >= 0; i-- {
+				multiplier *= 1024
+			}
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,149 @@
+package organize
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// The largest width or height of a series thumbnail on the dashboard.
+const thumbnailSize = 128
+
+var (
+	samplesPerPixelTag     = tag{0x0028, 0x0002}
+	photometricTag         = tag{0x0028, 0x0004}
+	planarConfigurationTag = tag{0x0028, 0x0006}
+	rowsTag                = tag{0x0028, 0x0010}
+	columnsTag             = tag{0x0028, 0x0011}
+	bitsAllocatedTag       = tag{0x0028, 0x0100}
+	pixelRepresentationTag = tag{0x0028, 0x0103}
+)
+
+// thumbnail returns a small image of the first frame of a file. Only
+// uncompressed 8 or 16 bit greyscale and 8 bit RGB pixel data can be
+// shown, since dicomfmt doesn't include any image codecs. Greyscale
+// images are scaled from their lowest to their highest value rather than
+// by their window.
+func thumbnail(file string) (image.Image, error) {
+	data, err := readStored(file)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := readDataset(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	switch ds.TransferSyntax {
+	case implicitVRLittleEndian, explicitVRLittleEndian, deflatedExplicitVRLittleEndian, explicitVRBigEndian:
+	default:
+		return nil, fmt.Errorf("%s: can't make thumbnails of transfer syntax %s", file, ds.TransferSyntax)
+	}
+	enc := encodingFor(ds.TransferSyntax)
+	elements := make(map[tag]element, len(ds.Elements))
+	for _, el := range ds.Elements {
+		elements[el.Tag] = el
+	}
+	us := func(t tag) int {
+		if el, ok := elements[t]; ok && len(el.Value) >= 2 {
+			return int(enc.order.Uint16(el.Value))
+		}
+		return 0
+	}
+	rows, cols, bits := us(rowsTag), us(columnsTag), us(bitsAllocatedTag)
+	samples, signed, planar := us(samplesPerPixelTag), us(pixelRepresentationTag) == 1, us(planarConfigurationTag) == 1
+	if samples == 0 {
+		samples = 1
+	}
+	photometric := strings.TrimSpace(string(bytes.TrimRight(elements[photometricTag].Value, " \x00")))
+	pixels, ok := elements[pixelDataTag]
+	if !ok || pixels.Undefined {
+		return nil, fmt.Errorf("%s: no uncompressed pixel data", file)
+	}
+	if rows == 0 || cols == 0 || (bits != 8 && bits != 16) || len(pixels.Value) < rows*cols*samples*bits/8 {
+		return nil, fmt.Errorf("%s: unsupported pixel data", file)
+	}
+
+	// The value of sample s of the pixel at x, y.
+	value := func(x, y, s int) int {
+		i := (y*cols+x)*samples + s
+		if planar {
+			i = s*rows*cols + y*cols + x
+		}
+		if bits == 8 {
+			if signed {
+				return int(int8(pixels.Value[i]))
+			}
+			return int(pixels.Value[i])
+		}
+		v := enc.order.Uint16(pixels.Value[2*i:])
+		if signed {
+			return int(int16(v))
+		}
+		return int(v)
+	}
+
+	w, h := cols, rows
+	if w > thumbnailSize || h > thumbnailSize {
+		if w >= h {
+			w, h = thumbnailSize, rows*thumbnailSize/cols
+		} else {
+			w, h = cols*thumbnailSize/rows, thumbnailSize
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	// Each pixel of the thumbnail is the nearest pixel of the image.
+	at := func(x, y int) (int, int) {
+		return x * cols / w, y * rows / h
+	}
+
+	switch {
+	case samples == 3 && bits == 8 && photometric == "RGB":
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sx, sy := at(x, y)
+				img.Set(x, y, color.RGBA{uint8(value(sx, sy, 0)), uint8(value(sx, sy, 1)), uint8(value(sx, sy, 2)), 0xFF})
+			}
+		}
+		return img, nil
+	case samples == 1 && (photometric == "MONOCHROME1" || photometric == "MONOCHROME2"):
+		grey := func(x, y int) int {
+			sx, sy := at(x, y)
+			return value(sx, sy, 0)
+		}
+		lo, hi := grey(0, 0), grey(0, 0)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := grey(x, y)
+				if v < lo {
+					lo = v
+				}
+				if v > hi {
+					hi = v
+				}
+			}
+		}
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var g uint8
+				if hi > lo {
+					g = uint8((grey(x, y) - lo) * 255 / (hi - lo))
+				}
+				if photometric == "MONOCHROME1" {
+					g = 255 - g
+				}
+				img.SetGray(x, y, color.Gray{g})
+			}
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("%s: can't make thumbnails of %d sample %s images", file, samples, photometric)
+}
@@ -0,0 +1,76 @@
+package organize
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How long reading and parsing a single file can take before it's given
+// up on, or 0 for no limit.
+var fileTimeout time.Duration
+
+// A timeoutError is the error for a file which took longer than
+// fileTimeout to read and parse.
+type timeoutError struct {
+	file  FileName
+	after time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%s: timed out after %v", e.file, e.after)
+}
+
+// timedOutFiles collects the files that timed out during a run, so that
+// they're reported together at the end.
+type timedOutFiles struct {
+	mu    sync.Mutex
+	files []FileName
+}
+
+var timedOut timedOutFiles
+
+func (t *timedOutFiles) Add(file FileName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files = append(t.files, file)
+}
+
+// Report logs every file that timed out.
+func (t *timedOutFiles) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.files) == 0 {
+		return
+	}
+	log.Printf("%d files failed because they took longer than %v to read:\n", len(t.files), fileTimeout)
+	for _, file := range t.files {
+		log.Printf("\t%s\n", file)
+	}
+}
+
+// within runs op, which reads file, giving up on it if it takes longer
+// than fileTimeout. Since a read from a hung network filesystem can't be
+// interrupted, op keeps running in the background after a timeout, and
+// anything that it uses mustn't be reused.
+func within(file FileName, op func() error) error {
+	if fileTimeout <= 0 {
+		return op()
+	}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer recoverParse(file, &err)
+		err = op()
+	}()
+	timer := time.NewTimer(fileTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return timeoutError{file, fileTimeout}
+	}
+}
@@ -0,0 +1,331 @@
+package organize
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// A transliterator replaces the characters of tag values that aren't
+// ASCII with ASCII ones, with -transliterate, so that the directories that
+// series are organized into can be used by tools which only handle ASCII
+// file names. Values are only changed in names; the files themselves and
+// the manifest keep the original values.
+type transliterator struct {
+	// Replacements for strings of one or more characters. The longest
+	// match at each position is used.
+	table   map[string]string
+	longest int
+}
+
+// The transliterator for this run, or nil if names aren't transliterated.
+var translit *transliterator
+
+// Letters which aren't a base letter with diacritics, and so aren't
+// handled by removing them.
+var latinLetters = map[string]string{
+	"ß": "ss", "ẞ": "SS", "Æ": "Ae", "æ": "ae", "Œ": "Oe", "œ": "oe",
+	"Ø": "O", "ø": "o", "Ł": "L", "ł": "l", "Đ": "D", "đ": "d",
+	"Ð": "D", "ð": "d", "Þ": "Th", "þ": "th", "Ħ": "H", "ħ": "h",
+	"ı": "i", "Ŋ": "N", "ŋ": "n", "Ŧ": "T", "ŧ": "t",
+}
+
+// Cyrillic, as transliterated in passports (ICAO 9303).
+var cyrillicLetters = map[string]string{
+	"А": "A", "Б": "B", "В": "V", "Г": "G", "Д": "D", "Е": "E", "Ё": "E",
+	"Ж": "Zh", "З": "Z", "И": "I", "Й": "I", "К": "K", "Л": "L", "М": "M",
+	"Н": "N", "О": "O", "П": "P", "Р": "R", "С": "S", "Т": "T", "У": "U",
+	"Ф": "F", "Х": "Kh", "Ц": "Ts", "Ч": "Ch", "Ш": "Sh", "Щ": "Shch",
+	"Ъ": "Ie", "Ы": "Y", "Ь": "", "Э": "E", "Ю": "Iu", "Я": "Ia",
+	"Є": "Ie", "І": "I", "Ї": "I", "Ґ": "G", "Ў": "U", "Ј": "J", "Љ": "Lj",
+	"Њ": "Nj", "Ћ": "C", "Ђ": "Dj", "Џ": "Dz", "Ѓ": "G", "Ќ": "K", "Ѕ": "Dz",
+}
+
+// Greek (ELOT 743).
+var greekLetters = map[string]string{
+	"Α": "A", "Β": "V", "Γ": "G", "Δ": "D", "Ε": "E", "Ζ": "Z", "Η": "I",
+	"Θ": "Th", "Ι": "I", "Κ": "K", "Λ": "L", "Μ": "M", "Ν": "N", "Ξ": "X",
+	"Ο": "O", "Π": "P", "Ρ": "R", "Σ": "S", "Τ": "T", "Υ": "Y", "Φ": "F",
+	"Χ": "Ch", "Ψ": "Ps", "Ω": "O", "ς": "s",
+}
+
+// Hiragana, in Hepburn romanization. Katakana are romanized the same way.
+var kana = map[string]string{
+	"あ": "a", "い": "i", "う": "u", "え": "e", "お": "o",
+	"か": "ka", "き": "ki", "く": "ku", "け": "ke", "こ": "ko",
+	"が": "ga", "ぎ": "gi", "ぐ": "gu", "げ": "ge", "ご": "go",
+	"さ": "sa", "し": "shi", "す": "su", "せ": "se", "そ": "so",
+	"ざ": "za", "じ": "ji", "ず": "zu", "ぜ": "ze", "ぞ": "zo",
+	"た": "ta", "ち": "chi", "つ": "tsu", "て": "te", "と": "to",
+	"だ": "da", "ぢ": "ji", "づ": "zu", "で": "de", "ど": "do",
+	"な": "na", "に": "ni", "ぬ": "nu", "ね": "ne", "の": "no",
+	"は": "ha", "ひ": "hi", "ふ": "fu", "へ": "he", "ほ": "ho",
+	"ば": "ba", "び": "bi", "ぶ": "bu", "べ": "be", "ぼ": "bo",
+	"ぱ": "pa", "ぴ": "pi", "ぷ": "pu", "ぺ": "pe", "ぽ": "po",
+	"ま": "ma", "み": "mi", "む": "mu", "め": "me", "も": "mo",
+	"や": "ya", "ゆ": "yu", "よ": "yo",
+	"ら": "ra", "り": "ri", "る": "ru", "れ": "re", "ろ": "ro",
+	"わ": "wa", "ゐ": "i", "ゑ": "e", "を": "o", "ん": "n",
+	"ぁ": "a", "ぃ": "i", "ぅ": "u", "ぇ": "e", "ぉ": "o", "ゎ": "wa",
+	"ゔ": "vu", "ー": "",
+}
+
+// The sokuon, which doubles the consonant that follows it.
+const sokuon, sokuonKatakana = 'っ', 'ッ'
+
+// Hangul, in the Revised Romanization of Korean, by the initial, medial
+// and final jamo of each syllable. Sound changes between syllables aren't
+// applied.
+var (
+	hangulInitials = []string{"g", "kk", "n", "d", "tt", "r", "m", "b", "pp", "s", "ss", "", "j", "jj", "ch", "k", "t", "p", "h"}
+	hangulMedials  = []string{"a", "ae", "ya", "yae", "eo", "e", "yeo", "ye", "o", "wa", "wae", "oe", "yo", "u", "wo", "we", "wi", "yu", "eu", "ui", "i"}
+	hangulFinals   = []string{"", "k", "k", "k", "n", "n", "n", "t", "l", "k", "m", "l", "l", "l", "p", "l", "m", "p", "p", "t", "t", "ng", "t", "t", "k", "t", "p", "t"}
+)
+
+// transliterationLocales are the conventions that -transliterate accepts,
+// as changes to the default tables. The default removes diacritics, so
+// that Müller becomes Muller, while the German convention gives Mueller.
+var transliterationLocales = map[string]map[string]string{
+	"ascii": nil,
+	"de":    {"Ä": "Ae", "Ö": "Oe", "Ü": "Ue"},
+	"da":    {"Æ": "Ae", "Ø": "Oe", "Å": "Aa"},
+	"nb":    {"Æ": "Ae", "Ø": "Oe", "Å": "Aa"},
+	"sv":    {"Ä": "Ae", "Ö": "Oe", "Å": "Aa"},
+	"uk": {
+		"Г": "H", "И": "Y", "Й": "I", "Х": "Kh", "Щ": "Shch", "Є": "Ie",
+		"Ї": "I", "Ю": "Iu", "Я": "Ia", "Ь": "",
+	},
+	"bg": {
+		"Х": "H", "Щ": "Sht", "Ъ": "A", "Ь": "Y", "Ю": "Yu", "Я": "Ya",
+		"Й": "Y",
+	},
+}
+
+// TransliterationLocaleNames returns the locales that tag values can be
+// transliterated by, separated by commas.
+func TransliterationLocaleNames() string {
+	var names []string
+	for name := range transliterationLocales {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newTransliterator returns a transliterator for a locale, with extra
+// replacements taken from the [transliterate] table of the configuration
+// file, which take precedence over the built in ones:
+//
+//	[transliterate]
+//	"김" = "Kim"
+//	"山田" = "Yamada"
+func newTransliterator(locale string, extra map[string][]string) (*transliterator, error) {
+	changes, ok := transliterationLocales[locale]
+	if !ok {
+		return nil, fmt.Errorf("unknown -transliterate %q (must be one of %s)", locale, TransliterationLocaleNames())
+	}
+	t := &transliterator{table: make(map[string]string)}
+	for _, letters := range []map[string]string{latinLetters, cyrillicLetters, greekLetters, changes} {
+		for from, to := range letters {
+			t.add(from, to)
+			if lower := strings.ToLower(from); lower != from {
+				t.add(lower, strings.ToLower(to))
+			}
+		}
+	}
+	for from, to := range kana {
+		t.add(from, to)
+		// Katakana are 0x60 after the same hiragana.
+		if r := []rune(from)[0]; r >= 'ぁ' && r <= 'ゖ' {
+			t.add(string(r+0x60), to)
+		}
+	}
+	// Syllables with a small ya, yu or yo, such as きゃ (kya) and しゅ
+	// (shu).
+	for _, from := range []string{"き", "ぎ", "し", "じ", "ち", "ぢ", "に", "ひ", "び", "ぴ", "み", "り"} {
+		stem := strings.TrimSuffix(kana[from], "i")
+		for small, vowel := range map[string]string{"ゃ": "a", "ゅ": "u", "ょ": "o"} {
+			to := stem + "y" + vowel
+			if strings.HasSuffix(stem, "sh") || strings.HasSuffix(stem, "ch") || stem == "j" {
+				to = stem + vowel
+			}
+			t.add(from+small, to)
+			katakana := []rune(from + small)
+			t.add(string([]rune{katakana[0] + 0x60, katakana[1] + 0x60}), to)
+		}
+	}
+	for from, to := range extra {
+		t.add(norm.NFC.String(from), to[len(to)-1])
+	}
+	return t, nil
+}
+
+func (t *transliterator) add(from, to string) {
+	t.table[from] = to
+	if n := len([]rune(from)); n > t.longest {
+		t.longest = n
+	}
+}
+
+// pnTags are the tags used in layouts whose values are person names, with
+// up to three component groups: alphabetic, ideographic and phonetic.
+var pnTags = map[string]bool{
+	"PatientName":            true,
+	"ReferringPhysicianName": true,
+}
+
+// Apply returns the ASCII form of the value v of the tag name. Characters
+// which can't be transliterated are replaced with _, and a hash of the
+// original value is appended so that different values stay distinct. It's
+// safe to call on a nil transliterator, which returns v unchanged.
+func (t *transliterator) Apply(name, v string) string {
+	if t == nil || isASCII(v) {
+		return v
+	}
+	if pnTags[name] {
+		v = personNameGroup(v)
+	}
+	runes := []rune(norm.NFC.String(v))
+	var out strings.Builder
+	unknown := false
+	double := false
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		var repl string
+		n := 1
+		switch {
+		case r < 0x80:
+			repl = string(r)
+		case r == sokuon || r == sokuonKatakana:
+			double = true
+			i++
+			continue
+		default:
+			var ok bool
+			repl, n, ok = t.match(runes[i:])
+			switch {
+			case ok:
+				if n == 1 && unicode.IsUpper(r) && len(repl) > 1 && upperContext(runes, i) {
+					repl = strings.ToUpper(repl)
+				}
+			case r >= 0xAC00 && r <= 0xD7A3:
+				n = 1
+				idx := int(r - 0xAC00)
+				repl = hangulInitials[idx/588] + hangulMedials[idx%588/28] + hangulFinals[idx%28]
+			default:
+				n = 1
+				if repl, ok = t.decompose(r); !ok {
+					repl = "_"
+					unknown = true
+				}
+			}
+		}
+		if double && repl != "" {
+			if c := repl[0]; !strings.ContainsRune("aeiou_", rune(c)) {
+				if strings.HasPrefix(repl, "ch") {
+					c = 't'
+				}
+				out.WriteByte(c)
+			}
+		}
+		double = false
+		out.WriteString(repl)
+		i += n
+	}
+	if !unknown {
+		return out.String()
+	}
+	sum := sha1.Sum([]byte(v))
+	return out.String() + "~" + hex.EncodeToString(sum[:4])
+}
+
+// match returns the replacement for the longest string in the table at the
+// start of runes, and how many runes it replaces.
+func (t *transliterator) match(runes []rune) (string, int, bool) {
+	n := t.longest
+	if n > len(runes) {
+		n = len(runes)
+	}
+	for ; n > 0; n-- {
+		if repl, ok := t.table[string(runes[:n])]; ok {
+			return repl, n, true
+		}
+	}
+	return "", 0, false
+}
+
+// decompose returns r without its diacritics, such as é as e or ǅ as Dz,
+// if that leaves only ASCII letters or letters in the table.
+func (t *transliterator) decompose(r rune) (string, bool) {
+	var out strings.Builder
+	for _, c := range norm.NFKD.String(string(r)) {
+		switch {
+		case c < 0x80:
+			out.WriteRune(c)
+		case unicode.Is(unicode.Mn, c):
+		default:
+			repl, ok := t.table[string(c)]
+			if !ok {
+				return "", false
+			}
+			out.WriteString(repl)
+		}
+	}
+	return out.String(), true
+}
+
+// upperContext reports whether an upper case letter at runes[i] is part of
+// a word written in upper case, as names in DICOM usually are, so that Ж in
+// ЖУК gives ZH rather than Zh.
+func upperContext(runes []rune, i int) bool {
+	if i+1 < len(runes) && unicode.IsLetter(runes[i+1]) {
+		return unicode.IsUpper(runes[i+1])
+	}
+	return i > 0 && unicode.IsUpper(runes[i-1])
+}
+
+// personNameGroup returns the component group of a person name which is
+// best transliterated: the alphabetic group if there is one, which is
+// already how the name is written in Latin letters, then the phonetic
+// group, such as the kana of a Japanese name, and then the ideographic
+// group.
+func personNameGroup(v string) string {
+	groups := strings.Split(v, "=")
+	if len(groups) == 1 {
+		return v
+	}
+	for _, i := range []int{0, 2, 1} {
+		if i < len(groups) && strings.Trim(groups[i], "^ ") != "" {
+			return groups[i]
+		}
+	}
+	return v
+}
+
+// Originals returns the original values of the tags of s which Apply
+// changes in names, to be recorded in the manifest, or nil if there are
+// none. It's safe to call on a nil transliterator.
+func (t *transliterator) Originals(s SeriesFiles) map[string]string {
+	if t == nil {
+		return nil
+	}
+	var originals map[string]string
+	for _, list := range [][]string{organizeTags, seriesTags} {
+		for _, name := range list {
+			v := s.tagValue(name)
+			if t.Apply(name, v) == v {
+				continue
+			}
+			if originals == nil {
+				originals = make(map[string]string)
+			}
+			originals[name] = v
+		}
+	}
+	return originals
+}
@@ -0,0 +1,129 @@
+package organize
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A trash holds files and directories that would otherwise be deleted, so
+// that there's a window to recover them before they're removed for good.
+//
+// Each run uses its own subdirectory of the trash directory, which
+// mirrors the original absolute paths of everything put in it. Every item
+// is also recorded in trash.log in the trash directory.
+type trash struct {
+	Dir string
+	run string
+
+	mu    sync.Mutex
+	index *os.File
+}
+
+// trashEntry is a line of trash.log.
+type trashEntry struct {
+	Original string    `json:"original"`
+	Trashed  string    `json:"trashed"`
+	Time     time.Time `json:"time"`
+}
+
+// openTrash opens the trash in dir, with a new directory for this run. It's
+// named by the real time even with -deterministic, which would give every
+// run the same name, and numbered if a run in the same second already has
+// it.
+func openTrash(dir string) (*trash, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	name := time.Now().Format("2006-01-02T15-04-05")
+	run := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		err := os.Mkdir(run, 0750)
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+		run = filepath.Join(dir, fmt.Sprintf("%s_%d", name, i))
+	}
+	index, err := os.OpenFile(filepath.Join(dir, "trash.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &trash{Dir: dir, run: run, index: index}, nil
+}
+
+// location returns where original is kept in the trash.
+func (t *trash) location(original string) (string, error) {
+	abs, err := filepath.Abs(original)
+	if err != nil {
+		return "", err
+	}
+	abs = strings.TrimPrefix(abs, filepath.VolumeName(abs))
+	return filepath.Join(t.run, abs), nil
+}
+
+func (t *trash) record(original, trashed string) error {
+	line, err := json.Marshal(trashEntry{Original: original, Trashed: trashed, Time: clock()})
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.index.Write(append(line, '\n'))
+	return err
+}
+
+// File moves a file into the trash.
+func (t *trash) File(path string) error {
+	if err := readOnly.Check(path); err != nil {
+		return err
+	}
+	loc, err := t.location(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(loc), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(path, loc); err != nil {
+		// The trash is probably on a different filesystem.
+		if err := copyFile(LocalFS{}, FileName(path), FileName(loc)); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return t.record(path, loc)
+}
+
+// EmptyDir removes an empty directory, recreating it in the trash. It
+// returns false if the directory isn't empty.
+func (t *trash) EmptyDir(dir string) bool {
+	if readOnly.Check(dir) != nil {
+		return false
+	}
+	loc, err := t.location(dir)
+	if err != nil {
+		return false
+	}
+	if err := os.Remove(dir); err != nil {
+		return false
+	}
+	if err := os.MkdirAll(loc, 0750); err == nil {
+		t.record(dir, loc)
+	}
+	return true
+}
+
+func (t *trash) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.index.Close()
+}
@@ -0,0 +1,35 @@
+package organize
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOpenTrashRuns(t *testing.T) {
+	defer func(old func() time.Time) { clock = old }(clock)
+	frozen := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return frozen }
+
+	dir := t.TempDir()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		tr, err := openTrash(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[tr.run] {
+			t.Errorf("run %d reused the trash directory %s", i, tr.run)
+		}
+		seen[tr.run] = true
+		tr.Close()
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each run's directory and the index.
+	if len(entries) != 4 {
+		t.Errorf("the trash has %d entries, want 4", len(entries))
+	}
+}
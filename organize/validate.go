@@ -0,0 +1,102 @@
+package organize
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tagProfiles are the elements that series of each modality must have,
+// for catching data that was exported without them. They're read from the
+// [validate.modality] table of the config file, where "*" applies to every
+// modality:
+//
+//	[validate.modality]
+//	CT = ["SliceThickness", "KVP"]
+//	MR = ["EchoTime", "RepetitionTime"]
+//	"*" = "StudyDate"
+//
+// Series missing any of them are still organized, and are listed at the
+// end of the run. The elements are checked in the first file of each
+// series, and an empty value counts as missing.
+type tagProfiles struct {
+	Modality map[string][]string
+
+	mu      sync.Mutex
+	invalid []string
+}
+
+func newTagProfiles(cfg *Config, profile string) *tagProfiles {
+	p := &tagProfiles{Modality: make(map[string][]string)}
+	for k, v := range cfg.Table("validate.modality", profile) {
+		var names []string
+		for _, name := range v {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names = append(names, name)
+				seriesTags = addTag(seriesTags, name)
+			}
+		}
+		p.Modality[strings.ToUpper(strings.TrimSpace(k))] = names
+	}
+	if len(p.Modality) == 0 {
+		return nil
+	}
+	return p
+}
+
+// Missing returns the required elements that series s doesn't have. It's
+// safe to call on nil profiles.
+func (p *tagProfiles) Missing(s SeriesFiles) []string {
+	if p == nil {
+		return nil
+	}
+	var missing []string
+	for _, key := range []string{"*", strings.ToUpper(strings.TrimSpace(s.Modality))} {
+		for _, name := range p.Modality[key] {
+			if strings.TrimSpace(s.tagValue(name)) == "" {
+				missing = addTag(missing, name)
+			}
+		}
+	}
+	return missing
+}
+
+// Add checks a series that was organized, recording it if it's missing
+// any required elements. It's safe to call on nil profiles.
+func (p *tagProfiles) Add(s SeriesFiles, dirs []string) {
+	missing := p.Missing(s)
+	if len(missing) == 0 {
+		return
+	}
+	desc := fmt.Sprintf("%s series %s of %s", s.Modality, s.SeriesDescription, s.PatientName)
+	if len(dirs) > 0 {
+		desc += " (" + strings.Join(dirs, ", ") + ")"
+	}
+	desc += ": no " + strings.Join(missing, ", ")
+	if verbose {
+		log.Println(desc)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.invalid = append(p.invalid, desc)
+}
+
+// Report logs every series which was missing required elements.
+func (p *tagProfiles) Report() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.invalid) == 0 {
+		return
+	}
+	sort.Strings(p.invalid)
+	log.Printf("%d series were missing elements required for their modality:\n", len(p.invalid))
+	for _, desc := range p.invalid {
+		log.Println("\t" + desc)
+	}
+}
@@ -0,0 +1,56 @@
+package organize
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// hashFile returns the SHA-256 hash of a file's contents, after
+// decompressing it if it's compressed.
+func hashFile(path string) ([]byte, error) {
+	f, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyCopy checks that dst has the same contents as src, by reading both
+// back from the disk.
+func verifyCopy(src, dst FileName) error {
+	srcSum, err := hashFile(src.String())
+	if err != nil {
+		return err
+	}
+	dstSum, err := hashFile(dst.String())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return fmt.Errorf("%s does not match %s (sha256 %x, expected %x)", dst, src, dstSum, srcSum)
+	}
+	return nil
+}
+
+// deleteVerified removes src once its copy at dst has been verified,
+// moving it to the trash if there is one.
+func (o *Organizer) deleteVerified(src, dst FileName) error {
+	if err := readOnly.Check(src.String()); err != nil {
+		return err
+	}
+	if err := verifyCopy(src, dst); err != nil {
+		return err
+	}
+	if o.Trash != nil {
+		return o.Trash.File(src.String())
+	}
+	return os.Remove(src.String())
+}
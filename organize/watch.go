@@ -0,0 +1,259 @@
+package organize
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileState is used to detect when a file has changed since it was last
+// seen.
+type fileState struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// A pendingFile is a file which is waiting to be stable for the minimum
+// age before it's organized.
+type pendingFile struct {
+	state fileState
+	since time.Time
+}
+
+// A watcher periodically rescans the source directories, organizing any
+// files which are new or have changed since the previous scan.
+type watcher struct {
+	o        *Organizer
+	sources  []string
+	interval time.Duration
+	seen     map[FileName]fileState
+	// The files that the current scan has come across, so that files
+	// which are gone can be forgotten afterwards.
+	visited map[FileName]bool
+	rescan  chan struct{}
+	ctx     context.Context
+
+	// If non-zero, files aren't organized until their size and
+	// modification time have been unchanged for at least this long, in
+	// case they're still being written.
+	minAge  time.Duration
+	pending map[FileName]pendingFile
+
+	// If set, full scans which recheck every file are run on this
+	// schedule, in case a file was missed.
+	reconcile *cronSchedule
+
+	mu     sync.Mutex
+	status status
+}
+
+func newWatcher(ctx context.Context, o *Organizer, sources []string, interval time.Duration) *watcher {
+	return &watcher{
+		o:        o,
+		sources:  sources,
+		interval: interval,
+		ctx:      ctx,
+		seen:     make(map[FileName]fileState),
+		pending:  make(map[FileName]pendingFile),
+		rescan:   make(chan struct{}, 1),
+		status:   status{State: "idle"},
+	}
+}
+
+// skip reports whether a file was already handled by an earlier scan,
+// and records it as handled for the next one.
+func (w *watcher) skip(file FileName, info os.FileInfo) bool {
+	w.visited[file] = true
+	state := fileState{info.Size(), info.ModTime()}
+	if old, ok := w.seen[file]; ok && old == state {
+		return true
+	}
+	if w.minAge > 0 && !w.stable(file, state) {
+		return true
+	}
+	w.seen[file] = state
+	return false
+}
+
+// stable reports whether a file has had the same size and modification
+// time for at least the minimum age. The modification time alone can't be
+// relied on, since tools like rsync set it before the file is complete.
+func (w *watcher) stable(file FileName, state fileState) bool {
+	now := time.Now()
+	p, ok := w.pending[file]
+	if !ok || p.state != state {
+		w.pending[file] = pendingFile{state, now}
+		if verbose {
+			log.Printf("Waiting for %s to be unchanged for %v.\n", file, w.minAge)
+		}
+		return false
+	}
+	if now.Sub(p.since) < w.minAge {
+		return false
+	}
+	delete(w.pending, file)
+	return true
+}
+
+// Scan does a single pass over the source directories.
+func (w *watcher) Scan() {
+	w.mu.Lock()
+	w.status.State = "scanning"
+	w.status.LastScanStarted = time.Now()
+	w.mu.Unlock()
+
+	w.visited = make(map[FileName]bool)
+	for _, src := range w.sources {
+		if canceled(w.ctx) {
+			break
+		}
+		w.o.Dir(w.ctx, src, w.skip)
+	}
+	if !canceled(w.ctx) {
+		w.forget()
+	}
+	for file := range w.pending {
+		// Files such as partial downloads are often renamed once
+		// they're complete.
+		if _, err := os.Stat(file.String()); err != nil {
+			delete(w.pending, file)
+		}
+	}
+	w.o.Release()
+	w.o.Sweep()
+	if err := cached.Save(); err != nil {
+		log.Println(err)
+	}
+	if err := w.o.FHIR.Flush(); err != nil {
+		log.Println(err)
+	}
+	w.o.Encrypt.Flush()
+	w.notify()
+
+	w.mu.Lock()
+	w.status.State = "idle"
+	w.status.Scans++
+	w.status.LastScanEnded = time.Now()
+	w.mu.Unlock()
+}
+
+// forget removes the files which are no longer in the sources from the
+// files seen, so that it doesn't grow forever. That's every file that was
+// moved into the target, and anything else that was removed since.
+func (w *watcher) forget() {
+	for file := range w.seen {
+		if !w.visited[file] {
+			delete(w.seen, file)
+		} else if w.o.Move {
+			if _, err := os.Lstat(file.String()); os.IsNotExist(err) {
+				delete(w.seen, file)
+			}
+		}
+	}
+	w.visited = nil
+}
+
+// notify sends a summary of the scan that just finished, if it found
+// anything to organize. Scans which found nothing new aren't notified
+// about, since there would be one every interval.
+func (w *watcher) notify() {
+	n := w.o.Notify
+	if n == nil {
+		return
+	}
+	s := n.Summary("scan", "completed", w.o.Dst, len(w.o.Failed))
+	switch {
+	case s.Failed > 0 || s.Damaged > 0 || s.ParseFailures > 0:
+		s.Status = "failed"
+	case s.Files == 0:
+		return
+	}
+	n.Record(s, w.o.Failed)
+	n.Send(s)
+	n.Reset(len(w.o.Failed))
+}
+
+// Reconcile does a full pass over the source directories, rechecking every
+// file rather than only those that changed since the previous scan. Files
+// which were already copied with the same content are left as they are.
+func (w *watcher) Reconcile() {
+	log.Println("Starting scheduled reconciliation scan.")
+	w.mu.Lock()
+	w.status.LastReconcile = time.Now()
+	w.mu.Unlock()
+
+	w.seen = make(map[FileName]fileState)
+	w.pending = make(map[FileName]pendingFile)
+	w.o.SkipIdentical = true
+	w.Scan()
+	w.o.SkipIdentical = false
+}
+
+// Rescan starts the next scan immediately instead of waiting for the
+// interval to elapse.
+func (w *watcher) Rescan() {
+	select {
+	case w.rescan <- struct{}{}:
+	default:
+		// A rescan is already pending.
+	}
+}
+
+// Status returns the current state of the watcher.
+func (w *watcher) Status() status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.status
+	if w.o.Pause != nil && w.o.Pause.Paused() {
+		s.State = "paused"
+	}
+	return s
+}
+
+// Run scans the sources every interval, and does a full reconciliation
+// scan whenever one is scheduled, until it's asked to stop.
+func (w *watcher) Run() {
+	full := false
+	for {
+		if w.o.Pause.Wait(w.ctx) != nil {
+			return
+		}
+		if full {
+			w.Reconcile()
+		} else {
+			w.Scan()
+		}
+		full = false
+
+		wait := w.interval
+		if len(w.pending) > 0 && w.minAge < wait {
+			// Pick up files that are waiting to be stable without
+			// waiting for the whole interval.
+			wait = w.minAge
+		}
+		if next := w.o.Gate.Next(); next > 0 && next < wait {
+			// Release studies as soon as they've settled.
+			wait = next
+		}
+		var scheduled <-chan time.Time
+		if w.reconcile != nil {
+			next := w.reconcile.Next(time.Now())
+			if !next.IsZero() {
+				scheduled = time.After(next.Sub(time.Now()))
+			}
+			w.mu.Lock()
+			w.status.NextReconcile = next
+			w.mu.Unlock()
+		}
+		select {
+		case <-time.After(wait):
+		case <-scheduled:
+			full = true
+		case <-w.rescan:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
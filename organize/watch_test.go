@@ -0,0 +1,41 @@
+package organize
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestWatcherForgetsRemovedFiles(t *testing.T) {
+	retries = retryPolicy{}
+	for _, move := range []bool{false, true} {
+		src, dst := t.TempDir(), t.TempDir()
+		paths := synthTree(t, src, 1, 1, 1, 3)
+		o := &Organizer{Dst: dst, Move: move, Layout: "{SeriesDescription}"}
+		w := newWatcher(context.Background(), o, []string{src}, 0)
+
+		w.Scan()
+		want := len(paths)
+		if move {
+			// Everything was placed, so nothing is left to remember.
+			want = 0
+		}
+		if len(w.seen) != want {
+			t.Errorf("move %v: %d files remembered after the first scan, want %d", move, len(w.seen), want)
+		}
+		if move {
+			continue
+		}
+
+		if err := os.Remove(paths[0]); err != nil {
+			t.Fatal(err)
+		}
+		w.Scan()
+		if len(w.seen) != len(paths)-1 {
+			t.Errorf("%d files remembered after one was removed, want %d", len(w.seen), len(paths)-1)
+		}
+		if _, ok := w.seen[FileName(paths[0])]; ok {
+			t.Errorf("%s is still remembered after it was removed", paths[0])
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package organize
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Files at least this large, such as whole slide images and breast
+// tomosynthesis, are read sparsely for parsing: every element is read
+// except for large binary values like the pixel data, which are skipped
+// over on disk instead of being read into memory. Elements after the pixel
+// data are still read, since some of these objects store metadata there.
+var sparseReadSize int64 = maxPooledBuffer
+
+// Values larger than this are left out of a sparse read. Elements which
+// are needed to organize files are far smaller.
+const maxSparseValue = 1 << 20
+
+var pixelDataTag = tag{0x7FE0, 0x0010}
+
+// errNotSparse is returned by readSparse for files which it can't make
+// sense of, which are read in full instead.
+var errNotSparse = errors.New("can't be read sparsely")
+
+// readHeaderInto replaces the contents of buf with the contents of a file
+// which are needed to parse it, leaving out its large values if the file
+// is large enough to read sparsely.
+func readHeaderInto(buf *bytes.Buffer, filename string) error {
+	if sparseReadSize > 0 && !isCompressed(filename) {
+		if info, err := os.Stat(filename); err == nil && info.Mode().IsRegular() && info.Size() >= sparseReadSize {
+			if err := readSparse(buf, filename, info.Size()); err == nil {
+				return nil
+			}
+		}
+	}
+	return readInto(buf, filename)
+}
+
+// A sparseReader copies the elements of a file into out, seeking past the
+// values that it leaves out.
+type sparseReader struct {
+	f    *os.File
+	r    *bufio.Reader
+	pos  int64
+	size int64
+	out  *bytes.Buffer
+}
+
+// readSparse replaces the contents of buf with the elements of a file,
+// with any top level value larger than maxSparseValue replaced by an
+// empty one. Encapsulated pixel data is replaced by an empty basic offset
+// table, so that the dataset is still encoded the way its transfer syntax
+// says.
+func readSparse(buf *bytes.Buffer, filename string, size int64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf.Reset()
+	s := &sparseReader{f: f, r: bufio.NewReaderSize(f, 64<<10), size: size, out: buf}
+
+	if head, _ := s.r.Peek(132); len(head) == 132 && string(head[128:132]) == "DICM" {
+		if err := s.copyN(132); err != nil {
+			return err
+		}
+	}
+	transferSyntax := ""
+	hasMeta := false
+	for {
+		b, _ := s.r.Peek(2)
+		if len(b) < 2 || binary.LittleEndian.Uint16(b) != 0x0002 {
+			break
+		}
+		hasMeta = true
+		t, _, length, hdr, err := s.header(metaEncoding)
+		if err != nil {
+			return err
+		}
+		if length == undefinedLength || length > maxSparseValue {
+			return errNotSparse
+		}
+		s.out.Write(hdr)
+		start := s.out.Len()
+		if err := s.copyN(int64(length)); err != nil {
+			return err
+		}
+		if t == transferSyntaxTag {
+			transferSyntax = string(bytes.TrimRight(s.out.Bytes()[start:], " \x00"))
+		}
+	}
+	if !hasMeta {
+		head, _ := s.r.Peek(4096)
+		if transferSyntax = rawTransferSyntax(head); transferSyntax == "" {
+			return errNotSparse
+		}
+	}
+	if transferSyntax == deflatedExplicitVRLittleEndian {
+		return errNotSparse
+	}
+
+	enc := encodingFor(transferSyntax)
+	for s.pos < s.size {
+		if s.size-s.pos < 8 {
+			// Trailing bytes which can't be an element are left
+			// for the parser to deal with.
+			return s.copyN(s.size - s.pos)
+		}
+		t, vr, length, hdr, err := s.header(enc)
+		if err != nil {
+			return err
+		}
+		switch {
+		case length == undefinedLength && t == pixelDataTag:
+			if err := s.skipFragments(enc); err != nil {
+				return err
+			}
+			var offsets []byte
+			offsets = appendElement(offsets, element{Tag: itemTag}, enc)
+			offsets = appendElement(offsets, element{Tag: seqDelimTag}, enc)
+			s.out.Write(appendElement(nil, element{Tag: t, VR: vr, Undefined: true, Value: offsets}, enc))
+		case length == undefinedLength:
+			s.out.Write(hdr)
+			if err := s.copyUndefined(vr, enc, 1); err != nil {
+				return err
+			}
+		case length > maxSparseValue:
+			if err := s.skip(int64(length)); err != nil {
+				return err
+			}
+			s.out.Write(appendElement(nil, element{Tag: t, VR: vr}, enc))
+		default:
+			s.out.Write(hdr)
+			if err := s.copyN(int64(length)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// header reads the tag, VR and length of the next element, along with its
+// encoded header.
+func (s *sparseReader) header(enc encoding) (t tag, vr string, length uint32, hdr []byte, err error) {
+	b, err := s.r.Peek(8)
+	if err != nil {
+		return t, "", 0, nil, errNotSparse
+	}
+	t = tag{enc.order.Uint16(b), enc.order.Uint16(b[2:])}
+	n := 8
+	switch {
+	case !enc.explicit || t.Group == 0xFFFE:
+		length = enc.order.Uint32(b[4:])
+	case longVR(string(b[4:6])):
+		vr = string(b[4:6])
+		if b, err = s.r.Peek(12); err != nil {
+			return t, vr, 0, nil, errNotSparse
+		}
+		length = enc.order.Uint32(b[8:])
+		n = 12
+	default:
+		vr = string(b[4:6])
+		length = uint32(enc.order.Uint16(b[6:]))
+	}
+	hdr = append([]byte(nil), b[:n]...)
+	s.r.Discard(n)
+	s.pos += int64(n)
+	return t, vr, length, hdr, nil
+}
+
+// copyN copies the next n bytes of the file to out.
+func (s *sparseReader) copyN(n int64) error {
+	if s.pos+n > s.size {
+		return errNotSparse
+	}
+	if _, err := io.CopyN(s.out, s.r, n); err != nil {
+		return err
+	}
+	s.pos += n
+	return nil
+}
+
+// skip advances past the next n bytes of the file without reading them.
+// Lengths which run past the end of the file are left for the parser to
+// report.
+func (s *sparseReader) skip(n int64) error {
+	if s.pos+n > s.size {
+		return errNotSparse
+	}
+	if n <= int64(s.r.Buffered()) {
+		s.r.Discard(int(n))
+	} else {
+		if _, err := s.f.Seek(s.pos+n, io.SeekStart); err != nil {
+			return err
+		}
+		s.r.Reset(s.f)
+	}
+	s.pos += n
+	return nil
+}
+
+// skipFragments advances past the items of encapsulated pixel data, up to
+// and including its sequence delimitation item.
+func (s *sparseReader) skipFragments(enc encoding) error {
+	for {
+		t, _, length, _, err := s.header(enc)
+		if err != nil {
+			return err
+		}
+		switch {
+		case t == seqDelimTag:
+			return nil
+		case t == itemTag && length != undefinedLength:
+			if err := s.skip(int64(length)); err != nil {
+				return err
+			}
+		default:
+			return errNotSparse
+		}
+	}
+}
+
+// copyUndefined copies the items of an undefined length element, up to and
+// including its sequence delimitation item, like elementReader's
+// skipUndefined.
+func (s *sparseReader) copyUndefined(vr string, enc encoding, depth int) error {
+	if depth > maxSequenceDepth {
+		return errNotSparse
+	}
+	if vr == "UN" {
+		enc = encoding{false, binary.LittleEndian}
+	}
+	for {
+		t, _, length, hdr, err := s.header(enc)
+		if err != nil {
+			return err
+		}
+		s.out.Write(hdr)
+		switch {
+		case t == seqDelimTag:
+			return nil
+		case t != itemTag:
+			return errNotSparse
+		case length != undefinedLength:
+			if err := s.copyN(int64(length)); err != nil {
+				return err
+			}
+			continue
+		}
+		for {
+			t, vr, length, hdr, err := s.header(enc)
+			if err != nil {
+				return err
+			}
+			s.out.Write(hdr)
+			if t == itemDelimTag {
+				break
+			}
+			if length == undefinedLength {
+				err = s.copyUndefined(vr, enc, depth+1)
+			} else {
+				err = s.copyN(int64(length))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals traps SIGINT and SIGTERM, so that an interrupted run can
+// finish the file that it's working on and flush its journal before it
+// exits. The returned context is cancelled when the first signal arrives.
+// A second signal exits immediately.
+func handleSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+		log.Println("Stopping after the current file. Interrupt again to exit immediately.")
+		<-c
+		log.Println("Exiting immediately.")
+		os.Exit(130)
+	}()
+	return ctx
+}
@@ -0,0 +1,193 @@
+package testutil
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an organize.FileSystem kept in memory, for organizing into a
+// target without touching the disk, and checking what was written to it.
+// Its zero value isn't usable; create one with NewMemFS.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *memFile) Name() string       { return filepath.Base(f.name) }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) Mode() os.FileMode  { return f.mode }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return f.mode.IsDir() }
+func (f *memFile) Sys() interface{}   { return nil }
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memFile)}
+}
+
+// Files returns the names of the regular files in m, sorted.
+func (m *MemFS) Files() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name, f := range m.files {
+		if !f.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReadFile returns the contents of the file name in m.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok || f.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	cp := *f
+	return &cp, nil
+}
+
+func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if parent := filepath.Dir(name); filepath.Dir(parent) != parent {
+		if p, ok := m.files[parent]; !ok || !p.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+		}
+	}
+	m.files[name] = &memFile{name: name, mode: os.ModeDir | perm, modTime: time.Now()}
+	return nil
+}
+
+// A memWriter writes a file into a MemFS when it's closed.
+type memWriter struct {
+	fs   *MemFS
+	name string
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	w.once.Do(func() {
+		w.fs.mu.Lock()
+		defer w.fs.mu.Unlock()
+		w.fs.files[w.name] = &memFile{name: w.name, data: w.buf.Bytes(), mode: 0644, modTime: time.Now()}
+	})
+	return nil
+}
+
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+	return m.CreateAt(name, 0)
+}
+
+func (m *MemFS) CreateAt(name string, off int64) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if p, ok := m.files[filepath.Dir(name)]; !ok || !p.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	w := &memWriter{fs: m, name: name}
+	if f, ok := m.files[name]; ok {
+		if f.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if off > int64(len(f.data)) {
+			off = int64(len(f.data))
+		}
+		w.buf.Write(f.data[:off])
+	}
+	m.files[name] = &memFile{name: name, data: w.buf.Bytes(), mode: 0644, modTime: time.Now()}
+	return w, nil
+}
+
+// Rename moves a file within m, or moves a source file from the local
+// disk into it.
+func (m *MemFS) Rename(oldname, name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	f, ok := m.files[filepath.Clean(oldname)]
+	m.mu.Unlock()
+	if !ok {
+		data, err := os.ReadFile(oldname)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(oldname); err != nil {
+			return err
+		}
+		f = &memFile{data: data, mode: 0644, modTime: time.Now()}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, filepath.Clean(oldname))
+	f.name = name
+	m.files[name] = f
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	f.mode = f.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+func (m *MemFS) Chown(name string, uid, gid int) error {
+	_, err := m.Stat(name)
+	return err
+}
+
+func (m *MemFS) SyncDir(name string) error {
+	_, err := m.Stat(name)
+	return err
+}
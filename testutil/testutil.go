@@ -0,0 +1,102 @@
+// Package testutil helps to write unit tests for code which extends
+// dicomfmt, such as custom layouts, filters and parser backends, without
+// checking DICOM files in. It synthesizes minimal valid DICOM files with
+// the elements that a test needs, and trees of them, and provides a
+// target filesystem kept in memory.
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/driusan/dicomfmt/organize"
+)
+
+// UID returns a new UID, for elements such as StudyInstanceUID which
+// several files have to share.
+func UID(t testing.TB) string {
+	t.Helper()
+	uid, err := organize.NewUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uid
+}
+
+// Bytes returns a minimal valid DICOM file with the elements in tags set,
+// as organize.Synthesize does, failing t if tags are invalid.
+func Bytes(t testing.TB, tags ...string) []byte {
+	t.Helper()
+	data, err := organize.Synthesize(tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// File writes Bytes(t, tags...) to path, creating its directory.
+func File(t testing.TB, path string, tags ...string) {
+	t.Helper()
+	writeFile(t, path, Bytes(t, tags...))
+}
+
+// A Tree is a tree of files kept in memory, keyed by their path relative
+// to its root.
+type Tree map[string][]byte
+
+// NewTree returns a tree with the given number of patients, studies for
+// each patient, series for each study and instances for each series, as
+// organize.SynthesizeTree does, failing t if tags are invalid.
+func NewTree(t testing.TB, patients, studies, series, instances int, tags ...string) Tree {
+	t.Helper()
+	files, err := organize.SynthesizeTree(patients, studies, series, instances, tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Tree(files)
+}
+
+// Paths returns the paths of the files in tr, sorted.
+func (tr Tree) Paths() []string {
+	paths := make([]string, 0, len(tr))
+	for path := range tr {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Write writes tr to dir, which can then be organized, and returns the
+// paths written, sorted.
+func (tr Tree) Write(t testing.TB, dir string) []string {
+	t.Helper()
+	var paths []string
+	for _, name := range tr.Paths() {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, tr[name])
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// SourceDir writes a tree with the given number of patients, studies,
+// series and instances to a new temporary directory, which is removed
+// when the test finishes, and returns the directory.
+func SourceDir(t testing.TB, patients, studies, series, instances int, tags ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	NewTree(t, patients, studies, series, instances, tags...).Write(t, dir)
+	return dir
+}
+
+func writeFile(t testing.TB, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package testutil_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/driusan/dicomfmt/organize"
+	"github.com/driusan/dicomfmt/testutil"
+)
+
+func TestOrganizeTree(t *testing.T) {
+	src := testutil.SourceDir(t, 2, 1, 1, 2, "Modality=%[1]d")
+	m := testutil.NewMemFS()
+	dst := string(filepath.Separator) + "target"
+	if err := m.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	o := &organize.Organizer{Dst: dst, FS: m, Layout: "{PatientName}/{Modality}"}
+	o.All(context.Background(), o.Scan(context.Background(), src, nil))
+	if len(o.Failed) != 0 {
+		t.Fatalf("failed to organize %v", o.Failed)
+	}
+	var want []string
+	for _, p := range []string{"SYNTH^PATIENT1/1", "SYNTH^PATIENT2/2"} {
+		for _, im := range []string{"IM0001.dcm", "IM0002.dcm"} {
+			want = append(want, filepath.Join(dst, filepath.FromSlash(p), im))
+		}
+	}
+	if got := m.Files(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("target has\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	data, err := m.ReadFile(want[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 132 || string(data[128:132]) != "DICM" {
+		t.Errorf("%s isn't a DICOM file", want[0])
+	}
+}
+
+func TestTreePaths(t *testing.T) {
+	tree := testutil.NewTree(t, 1, 2, 1, 1)
+	want := []string{
+		filepath.Join("P001", "ST001", "SE001", "IM0001.dcm"),
+		filepath.Join("P001", "ST002", "SE001", "IM0001.dcm"),
+	}
+	if got := tree.Paths(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Paths() = %v, want %v", got, want)
+	}
+}